@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+var adminBodyLimit = flag.Int("admin-body-limit", 64<<10, "maximum number of body bytes returned by /admin/entry?body=true")
+
+// redactedHeaders lists stored response headers whose values are never returned by the admin API.
+var redactedHeaders = []string{"Set-Cookie", "Authorization", "Proxy-Authorization", "Cookie"}
+
+// The adminEntryHandler function returns everything stored for a single cache entry: status, headers,
+// timestamps, hit count and, when requested with body=true, the body truncated to -admin-body-limit
+// bytes. Sensitive headers are redacted.
+func adminEntryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := authorize(w, r, roleViewer, false)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	key := query.Get("key")
+	if key == "" {
+		http.Error(w, "Missing 'key' parameter. Usage: ?key=<cache key>[&namespace=<namespace>][&body=true]", http.StatusBadRequest)
+		return
+	}
+	namespace := query.Get("namespace")
+	entry, ok := proxyCache.Namespace(namespace).Peek(key)
+	if !ok || !p.allowsURL(entry.Response.Request.URL) {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
+
+	header := entry.Response.Header.Clone()
+	for _, name := range redactedHeaders {
+		if header.Get(name) != "" {
+			header.Set(name, "[REDACTED]")
+		}
+	}
+
+	info := map[string]interface{}{
+		"Key":       key,
+		"Namespace": namespace,
+		"URL":       entry.Response.Request.URL,
+		"Method":    entry.Response.Request.Method,
+		"Status":    entry.Response.StatusCode,
+		"Headers":   header,
+		"ETag":      entry.ETag,
+		"StoredAt":  entry.StoredAt,
+		"ExpiresAt": entry.ExpiresAt,
+		"Hits":      entry.Hits(),
+		"Identity":  entry.Identity,
+		"Vary":      entry.Vary,
+		"Tags":      entry.Tags,
+		"Size":      bodyLength(entry),
+		"Revisions": revisionInfo(entry),
+	}
+	if query.Get("body") == "true" {
+		body, err := entryBody(entry)
+		if err != nil {
+			http.Error(w, "Error decompressing the body: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		truncated := len(body) > *adminBodyLimit
+		if truncated {
+			body = body[:*adminBodyLimit]
+		}
+		if utf8.Valid(body) {
+			info["Body"] = string(body)
+		} else {
+			info["Body"] = base64.StdEncoding.EncodeToString(body)
+			info["BodyEncoding"] = "base64"
+		}
+		info["BodyTruncated"] = truncated
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// The adminRollbackHandler function replaces an entry with one of the revisions it keeps on POST
+// ?key=<cache key>&revision=<n>, with an optional &namespace= and &ttl=<duration> for how long the
+// restored version stays fresh (by default, as long as the replaced one would have). Revisions are
+// numbered as listed by /admin/entry. Tenant-scoped callers can only roll back entries of their hosts.
+func adminRollbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := authorize(w, r, rolePurger, false)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	key := query.Get("key")
+	revision, err := strconv.Atoi(query.Get("revision"))
+	if key == "" || err != nil || revision < 1 {
+		http.Error(w, "Missing 'key' or 'revision' parameter. Usage: ?key=<cache key>&revision=<n>[&namespace=<namespace>][&ttl=<duration>]", http.StatusBadRequest)
+		return
+	}
+	var ttl time.Duration
+	if value := query.Get("ttl"); value != "" {
+		if ttl, err = time.ParseDuration(value); err != nil || ttl < 0 {
+			http.Error(w, "Invalid 'ttl' parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	namespace := proxyCache.Namespace(query.Get("namespace"))
+	entry, ok := namespace.Peek(key)
+	if !ok {
+		entry, ok = namespace.GetStale(key)
+	}
+	if !ok || !p.allowsURL(entry.Response.Request.URL) {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
+	restored, err := namespace.Rollback(key, revision-1, ttl, func(entry *cache.Entry) {
+		entry.JSON = decodeJSON(entry.Response.Header, entry.Body)
+	})
+	switch {
+	case errors.Is(err, cache.ErrNoEntry):
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	case errors.Is(err, cache.ErrNoRevision):
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, "Error rolling back: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Rolled entry back", "target", restored.Response.Request.URL, "revision", revision, "etag", restored.ETag, "who", p.name)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"Key":       key,
+		"ETag":      restored.ETag,
+		"ExpiresAt": restored.ExpiresAt,
+		"Revisions": revisionInfo(restored),
+	})
+}
+
+// revisionSummary describes a previous revision of an entry in /admin/entry.
+type revisionSummary struct {
+	Revision    int
+	Status      int
+	ETag        string
+	StoredAt    time.Time
+	Size        int
+	StoredBytes int
+}
+
+// The revisionInfo function summarizes the revisions an entry keeps, numbered from 1 for the newest
+// previous one. Size is the decoded body size and StoredBytes what the revision's delta takes in memory.
+func revisionInfo(entry cache.Entry) []revisionSummary {
+	summaries := make([]revisionSummary, 0, len(entry.Revisions))
+	for i, revision := range entry.Revisions {
+		body, err := entry.RevisionBody(i)
+		if err != nil {
+			slog.Error("Error decoding revision", "target", entry.Response.Request.URL, "revision", i, "error", err)
+			break
+		}
+		summaries = append(summaries, revisionSummary{
+			Revision:    i + 1,
+			Status:      revision.Response.StatusCode,
+			ETag:        revision.ETag,
+			StoredAt:    revision.StoredAt,
+			Size:        len(body),
+			StoredBytes: len(revision.Delta),
+		})
+	}
+	return summaries
+}
+
+// The adminStatsHandler function reports cache size per namespace, lock contention and the current
+// load on target servers, so capacity problems show up as data rather than unexplained latency.
+func adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := authorize(w, r, roleViewer, true); !ok {
+		return
+	}
+
+	stats := proxyCache.Stats()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"Entries":          stats.Entries,
+		"Namespaces":       stats.Namespaces,
+		"Identities":       stats.Identities,
+		"Bytes":            stats.Bytes,
+		"MaxBytes":         stats.MaxBytes,
+		"Expired":          stats.Expired,
+		"Evictions":        stats.Evictions,
+		"Rejections":       stats.Rejections,
+		"LockAcquisitions": stats.LockAcquisitions,
+		"LockWaitTotal":    stats.LockWaitTotal.String(),
+		"LockWaitMax":      stats.LockWaitMax.String(),
+		"LockWaitAverage":  stats.LockWaitAverage.String(),
+		"StoreLoads":       stats.StoreLoads,
+		"StoreErrors":      stats.StoreErrors,
+		"StoreDropped":     stats.StoreDropped,
+		"ChecksumFailures": stats.ChecksumFailures,
+		"UpstreamInflight": upstreamInflight.Load(),
+		"UpstreamLatency":  time.Duration(upstreamLatency.Load()).String(),
+		"UpstreamConns":    upstreamConnStats(),
+		"UpstreamLeaks":    upstreamLeaks.Load(),
+		"Goroutines":       runtime.NumGoroutine(),
+		"HotKeys":          hotHits.top(*hotKeys),
+		"HotMisses":        hotMisses.top(*hotKeys),
+	})
+}
+
+// expiryBucket counts the entries expiring in a time range from now, with their size and hits, which
+// indicate the misses and target server load to expect when they expire.
+type expiryBucket struct {
+	From    string `json:",omitempty"`
+	To      string `json:",omitempty"`
+	Entries int
+	Bytes   int64
+	Hits    int64
+}
+
+// The `add` method in the `expiryBucket` struct counts an entry in the bucket.
+func (b *expiryBucket) add(entry cache.Entry) {
+	b.Entries++
+	b.Bytes += entry.Size()
+	b.Hits += entry.Hits()
+}
+
+// The adminExpiryHandler function forecasts expiries: it counts the unexpired entries visible to the
+// caller by when they expire, in buckets bounded by ?buckets= (comma-separated durations, default
+// 1m,5m,1h) and a last bucket for everything later, and separately the entries that never expire.
+// Operators can see miss storms coming and warm or revalidate the entries beforehand.
+func adminExpiryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := authorize(w, r, roleViewer, false)
+	if !ok {
+		return
+	}
+
+	bounds := []time.Duration{time.Minute, 5 * time.Minute, time.Hour}
+	if value := r.URL.Query().Get("buckets"); value != "" {
+		bounds = nil
+		for _, item := range strings.Split(value, ",") {
+			d, err := time.ParseDuration(strings.TrimSpace(item))
+			if err != nil || d <= 0 {
+				http.Error(w, "Invalid 'buckets' parameter, expected positive durations such as 1m,5m,1h", http.StatusBadRequest)
+				return
+			}
+			bounds = append(bounds, d)
+		}
+		slices.Sort(bounds)
+	}
+
+	buckets := make([]expiryBucket, len(bounds)+1)
+	from := time.Duration(0)
+	for i, bound := range bounds {
+		buckets[i].From, buckets[i].To = from.String(), bound.String()
+		from = bound
+	}
+	buckets[len(bounds)].From = from.String()
+	var never expiryBucket
+
+	now := time.Now()
+	proxyCache.Range(func(namespace, key string, entry cache.Entry) bool {
+		if !p.allowsURL(entry.Response.Request.URL) {
+			return true
+		}
+		if entry.ExpiresAt.IsZero() {
+			never.add(entry)
+			return true
+		}
+		remaining := entry.ExpiresAt.Sub(now)
+		i, _ := slices.BinarySearch(bounds, remaining)
+		buckets[i].add(entry)
+		return true
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"Buckets":  buckets,
+		"NoExpiry": never,
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var alertWebhook = flag.String("alert-webhook", "", "URL that receives a POST when an alert fires or resolves; the payload's text field makes it usable as a Slack incoming webhook")
+
+var alertInterval = flag.Duration("alert-interval", time.Minute, "window over which the hit ratio and error rate are evaluated")
+
+var alertMinRequests = flag.Int64("alert-min-requests", 100, "minimum number of requests in a window for the hit ratio and error rate to be evaluated")
+
+var alertMinHitRatio = flag.Float64("alert-min-hit-ratio", 0, "alert when the share of cacheable requests served from cache drops below this (0 to 1), 0 to disable")
+
+var alertMaxErrorRate = flag.Float64("alert-max-error-rate", 0, "alert when the share of requests answered with a 5xx status exceeds this (0 to 1), 0 to disable")
+
+var alertMaxLatency = flag.Duration("alert-max-latency", 0, "alert when the moving average of target server latency exceeds this, 0 to disable")
+
+// alertWindow counts the requests of the current evaluation window.
+type alertWindow struct {
+	requests atomic.Int64
+	lookups  atomic.Int64
+	hits     atomic.Int64
+	errors   atomic.Int64
+}
+
+var alertCounts alertWindow
+
+// alertRule is a threshold on one of the watched metrics. An alert fires once when its rule starts being
+// violated and resolves once it stops.
+type alertRule struct {
+	name     string
+	enabled  func() bool
+	violated func(window alertSnapshot) (bool, string)
+	firing   bool
+}
+
+// alertSnapshot holds the metrics of a finished window.
+type alertSnapshot struct {
+	requests, lookups, hits, errors int64
+	latency                         time.Duration
+}
+
+var alertRules = []*alertRule{
+	{
+		name:    "hit-ratio",
+		enabled: func() bool { return *alertMinHitRatio > 0 },
+		violated: func(s alertSnapshot) (bool, string) {
+			if s.lookups < *alertMinRequests {
+				return false, ""
+			}
+			ratio := float64(s.hits) / float64(s.lookups)
+			return ratio < *alertMinHitRatio, fmt.Sprintf("hit ratio is %.1f%% (threshold %.1f%%)", ratio*100, *alertMinHitRatio*100)
+		},
+	},
+	{
+		name:    "error-rate",
+		enabled: func() bool { return *alertMaxErrorRate > 0 },
+		violated: func(s alertSnapshot) (bool, string) {
+			if s.requests < *alertMinRequests {
+				return false, ""
+			}
+			rate := float64(s.errors) / float64(s.requests)
+			return rate > *alertMaxErrorRate, fmt.Sprintf("5xx rate is %.1f%% (threshold %.1f%%)", rate*100, *alertMaxErrorRate*100)
+		},
+	},
+	{
+		name:    "upstream-latency",
+		enabled: func() bool { return *alertMaxLatency > 0 },
+		violated: func(s alertSnapshot) (bool, string) {
+			return s.latency > *alertMaxLatency, fmt.Sprintf("target server latency is %s (threshold %s)", s.latency, *alertMaxLatency)
+		},
+	},
+}
+
+// The observeAlertMetrics function counts a finished request towards the current alert window.
+func observeAlertMetrics(event *cacheEvent) {
+	alertCounts.requests.Add(1)
+	if event.Outcome == "hit" || event.Outcome == "miss" || event.Outcome == "revalidated" {
+		alertCounts.lookups.Add(1)
+	}
+	if event.Outcome == "hit" {
+		alertCounts.hits.Add(1)
+	}
+	if event.Status >= 500 {
+		alertCounts.errors.Add(1)
+	}
+}
+
+// The startAlerts function evaluates the alert rules every -alert-interval when -alert-webhook is set
+// and at least one threshold is configured.
+func startAlerts() {
+	enabled := false
+	for _, rule := range alertRules {
+		enabled = enabled || rule.enabled()
+	}
+	if *alertWebhook == "" || !enabled {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(*alertInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			evaluateAlerts()
+		}
+	}()
+}
+
+// The evaluateAlerts function closes the current window and notifies -alert-webhook of every rule that
+// started or stopped being violated.
+func evaluateAlerts() {
+	snapshot := alertSnapshot{
+		requests: alertCounts.requests.Swap(0),
+		lookups:  alertCounts.lookups.Swap(0),
+		hits:     alertCounts.hits.Swap(0),
+		errors:   alertCounts.errors.Swap(0),
+		latency:  time.Duration(upstreamLatency.Load()),
+	}
+	for _, rule := range alertRules {
+		if !rule.enabled() {
+			continue
+		}
+		// Windows with too few requests to judge leave the alert as it is
+		violated, detail := rule.violated(snapshot)
+		if detail == "" || violated == rule.firing {
+			continue
+		}
+		rule.firing = violated
+		state := "resolved"
+		if violated {
+			state = "firing"
+		}
+		slog.Warn("Alert "+state, "alert", rule.name, "detail", detail)
+		go notifyAlert(rule.name, state, detail)
+	}
+}
+
+// The notifyAlert function posts an alert to -alert-webhook.
+func notifyAlert(name, state, detail string) {
+	postWebhook(*alertWebhook, "alert "+name, map[string]interface{}{
+		"Alert":  name,
+		"State":  state,
+		"Detail": detail,
+		"Time":   time.Now(),
+		"text":   fmt.Sprintf("[%s] go-proxy-cache alert %s: %s", state, name, detail),
+	})
+}
+
+// The postWebhook function posts payload as JSON to a webhook, logging failures with what describes the
+// notification.
+func postWebhook(webhook, what string, payload interface{}) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("Error encoding webhook payload", "payload", what, "error", err)
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		slog.Error("Error sending webhook", "payload", what, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("Webhook responded with an error", "payload", what, "status", resp.StatusCode)
+	}
+}
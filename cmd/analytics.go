@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var analyticsURL = flag.String("analytics-url", "", "ClickHouse HTTP endpoint that per-request cache events are exported to in batches for offline hit-rate analysis (e.g. http://clickhouse:8123); empty to disable")
+
+var analyticsTable = flag.String("analytics-table", "cache_events", "ClickHouse table the cache events are inserted into")
+
+var analyticsBatchSize = flag.Int("analytics-batch-size", 1000, "maximum number of cache events sent in one insert")
+
+var analyticsFlushInterval = flag.Duration("analytics-flush-interval", 5*time.Second, "maximum time a cache event waits before its batch is sent")
+
+var analyticsQueue = flag.Int("analytics-queue", 10000, "number of cache events buffered for export; events are dropped while the queue is full")
+
+// cacheEvent is the record exported for every proxied request. The field names are the columns of the
+// analytics table.
+type cacheEvent struct {
+	Time      string  `json:"time"`
+	Key       string  `json:"key"`
+	Method    string  `json:"method"`
+	URL       string  `json:"url"`
+	Host      string  `json:"host"`
+	Outcome   string  `json:"outcome"`
+	Status    int     `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Size      int     `json:"size"`
+	Tenant    string  `json:"tenant"`
+	Identity  string  `json:"identity"`
+	Client    string  `json:"client"`
+	// ClientCert is the common name of the client's certificate under mutual TLS, identifying the
+	// calling service.
+	ClientCert string `json:"client_cert"`
+
+	start time.Time
+}
+
+// analyticsExporter ships cache events to -analytics-url in the background so that exporting never
+// delays responses.
+type analyticsExporter struct {
+	events  chan cacheEvent
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+var analytics *analyticsExporter
+
+// The startAnalytics function starts the exporter when -analytics-url is set.
+func startAnalytics() {
+	if *analyticsURL == "" {
+		return
+	}
+	analytics = &analyticsExporter{
+		events: make(chan cacheEvent, *analyticsQueue),
+		done:   make(chan struct{}),
+	}
+	go analytics.run()
+}
+
+// The newCacheEvent function starts the event of a proxied request; the outcome, status and size are
+// filled in while the request is handled and the event is exported by `recordCacheEvent`.
+func newCacheEvent(r *http.Request, target *url.URL, key, client string) *cacheEvent {
+	return &cacheEvent{
+		Key:        key,
+		Method:     r.Method,
+		URL:        target.String(),
+		Host:       target.Hostname(),
+		Tenant:     hostTenant(target.Hostname()),
+		Identity:   requestIdentity(r.Header),
+		Client:     client,
+		ClientCert: clientCertName(r),
+		start:      time.Now(),
+	}
+}
+
+// The recordCacheEvent function completes the event of a finished request with the request latency,
+// logs it and counts it towards the alert and exposed metrics and the recorded traffic, then queues it
+// for export, dropping it when the queue is full.
+func recordCacheEvent(event *cacheEvent) {
+	event.Time = event.start.UTC().Format("2006-01-02 15:04:05.000")
+	event.LatencyMs = float64(time.Since(event.start).Microseconds()) / 1000
+	logRequest(event)
+	observeAlertMetrics(event)
+	observeRequestMetrics(event)
+	traffic.observe(event)
+	if analytics == nil {
+		return
+	}
+	select {
+	case analytics.events <- *event:
+	default:
+		if analytics.dropped.Add(1)%1000 == 1 {
+			slog.Warn("Analytics queue full, dropping events", "dropped", analytics.dropped.Load())
+		}
+	}
+}
+
+// The `run` method in the `analyticsExporter` struct collects queued events into batches and sends a
+// batch when it is full or -analytics-flush-interval has passed. It sends the last batch and returns
+// once the queue is closed.
+func (a *analyticsExporter) run() {
+	defer close(a.done)
+	ticker := time.NewTicker(*analyticsFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]cacheEvent, 0, *analyticsBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := insertEvents(batch); err != nil {
+			slog.Error("Error exporting cache events", "events", len(batch), "error", err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case event, ok := <-a.events:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= *analyticsBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// The `close` method in the `analyticsExporter` struct sends the events still queued and waits for the
+// exporter to finish. No events may be recorded afterwards.
+func (a *analyticsExporter) close() {
+	close(a.events)
+	<-a.done
+}
+
+// The insertEvents function inserts a batch of events into the analytics table through the ClickHouse
+// HTTP interface.
+func insertEvents(events []cacheEvent) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+
+	query := url.Values{"query": {"INSERT INTO " + *analyticsTable + " FORMAT JSONEachRow"}}
+	endpoint := strings.TrimSuffix(*analyticsURL, "/") + "/?" + query.Encode()
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(endpoint, "application/x-ndjson", &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("insert failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// The hostTenant function returns the tenant whose admin tokens are scoped to host (see
+// -admin-tokens-file), or an empty string when no tenant owns it.
+func hostTenant(host string) string {
+	host = strings.ToLower(host)
+	for _, t := range adminTokens {
+		if t.hosts[host] {
+			return t.tenant
+		}
+	}
+	return ""
+}
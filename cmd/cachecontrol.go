@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+var staleIfError = flag.Duration("stale-if-error", 0, "how long after expiry a stale entry is served when the target server fails or answers 5xx, for responses without a stale-if-error Cache-Control directive; 0 to only honour the directive")
+
+var ignoreCacheControl = flag.Bool("ignore-cache-control", false, "cache every response with a heuristically cacheable status (200, 404, ...) regardless of its Cache-Control and Expires headers, for the default -ttl")
+
+// The parseCacheControl function parses a Cache-Control header into its directives, with lowercase
+// names and unquoted values.
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// The responseTTL function applies the storage rules of RFC 9111 for a shared cache to a response and
+// the request it answers. It reports whether the response may be stored and for how long it stays
+// fresh; a zero TTL means the response has no explicit lifetime and the default -ttl applies, unless
+// its -route sets a ttl.
+//
+// Responses marked no-store are never stored, and neither are responses marked no-cache, which would
+// have to be revalidated on every use. Responses marked private are only stored per identity (see
+// -identity-header). s-maxage takes precedence over max-age, which takes precedence over Expires.
+// Responses without any of them are only stored when their status is heuristically cacheable, so that
+// e.g. a 503 doesn't replace the entry it interrupted.
+func responseTTL(r *http.Request, resp cache.ResponseRecord) (time.Duration, bool) {
+	if *ignoreCacheControl {
+		return defaultTTL(resp), heuristicallyCacheable(resp.StatusCode)
+	}
+	if _, ok := parseCacheControl(r.Header)["no-store"]; ok {
+		return 0, false
+	}
+
+	directives := parseCacheControl(resp.Header)
+	if _, ok := directives["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := directives["no-cache"]; ok {
+		return 0, false
+	}
+	if _, ok := directives["private"]; ok && requestIdentity(r.Header) == "" {
+		return 0, false
+	}
+	// Responses to authenticated requests are only shared when the origin explicitly allows it
+	if r.Header.Get("Authorization") != "" && requestIdentity(r.Header) == "" {
+		_, public := directives["public"]
+		_, sMaxAge := directives["s-maxage"]
+		_, mustRevalidate := directives["must-revalidate"]
+		if !public && !sMaxAge && !mustRevalidate {
+			return 0, false
+		}
+	}
+
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[name]; ok {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seconds <= 0 {
+				return 0, false
+			}
+			// The response spent part of its lifetime in caches before reaching this one
+			ttl := time.Duration(seconds)*time.Second - ageHeader(resp.Header)
+			if ttl <= 0 {
+				return 0, false
+			}
+			return ttl, true
+		}
+	}
+
+	if value := resp.Header.Get("Expires"); value != "" {
+		expires, err := http.ParseTime(value)
+		if err != nil {
+			// An invalid Expires means the response is already stale
+			return 0, false
+		}
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		if ttl := expires.Sub(date); ttl > 0 {
+			return ttl, true
+		}
+		return 0, false
+	}
+	return defaultTTL(resp), heuristicallyCacheable(resp.StatusCode)
+}
+
+// The heuristicallyCacheable function reports whether responses with a status code may be stored
+// without an explicit lifetime (RFC 9110, section 15.1).
+func heuristicallyCacheable(status int) bool {
+	switch status {
+	case 200, 203, 204, 206, 300, 301, 308, 404, 405, 410, 414, 501:
+		return true
+	}
+	return false
+}
+
+// The ageHeader function returns the age of a response according to its Age header, or zero.
+func ageHeader(header http.Header) time.Duration {
+	seconds, err := strconv.ParseInt(header.Get("Age"), 10, 64)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// The defaultTTL function returns the lifetime of a response without an explicit one: the ttl of the
+// -route matching its target, or zero for the default -ttl.
+func defaultTTL(resp cache.ResponseRecord) time.Duration {
+	target, err := url.Parse(resp.Request.URL)
+	if err != nil {
+		return 0
+	}
+	return routeFor(target).TTL
+}
+
+// The usableOnError function reports whether a stale entry may be served in place of a failed or 5xx
+// response at the given time (RFC 5861). The entry's stale-if-error directive sets the window, and
+// -stale-if-error applies to entries without one.
+func usableOnError(entry cache.Entry, now time.Time) bool {
+	if entry.ExpiresAt.IsZero() {
+		return false
+	}
+	window := *staleIfError
+	if value, ok := parseCacheControl(entry.Response.Header)["stale-if-error"]; ok {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false
+		}
+		window = time.Duration(seconds) * time.Second
+	}
+	return now.Before(entry.ExpiresAt.Add(window))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	header := http.Header{"Cache-Control": {`Public, max-age=60`, `s-maxage="120", no-transform`}}
+	got := parseCacheControl(header)
+	want := map[string]string{"public": "", "max-age": "60", "s-maxage": "120", "no-transform": ""}
+	if len(got) != len(want) {
+		t.Fatalf("parseCacheControl: got %q, want %q", got, want)
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Fatalf("parseCacheControl: got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestResponseTTL(t *testing.T) {
+	date := time.Now().UTC()
+	for _, test := range []struct {
+		name     string
+		request  http.Header
+		status   int
+		response http.Header
+		ttl      time.Duration
+		storable bool
+	}{
+		{"max-age", nil, 200, http.Header{"Cache-Control": {"max-age=60"}}, time.Minute, true},
+		{"s-maxage over max-age", nil, 200, http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 2 * time.Minute, true},
+		{"max-age over Expires", nil, 200, http.Header{"Cache-Control": {"max-age=60"}, "Expires": {date.Add(time.Hour).Format(http.TimeFormat)}}, time.Minute, true},
+		{"max-age minus Age", nil, 200, http.Header{"Cache-Control": {"max-age=60"}, "Age": {"20"}}, 40 * time.Second, true},
+		{"Age past max-age", nil, 200, http.Header{"Cache-Control": {"max-age=60"}, "Age": {"60"}}, 0, false},
+		{"max-age=0", nil, 200, http.Header{"Cache-Control": {"max-age=0"}}, 0, false},
+		{"invalid max-age", nil, 200, http.Header{"Cache-Control": {"max-age=soon"}}, 0, false},
+		{"Expires", nil, 200, http.Header{"Date": {date.Format(http.TimeFormat)}, "Expires": {date.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour, true},
+		{"Expires in the past", nil, 200, http.Header{"Date": {date.Format(http.TimeFormat)}, "Expires": {date.Add(-time.Hour).Format(http.TimeFormat)}}, 0, false},
+		{"invalid Expires", nil, 200, http.Header{"Expires": {"0"}}, 0, false},
+		{"no-store", nil, 200, http.Header{"Cache-Control": {"no-store, max-age=60"}}, 0, false},
+		{"no-cache", nil, 200, http.Header{"Cache-Control": {"no-cache"}}, 0, false},
+		{"private", nil, 200, http.Header{"Cache-Control": {"private, max-age=60"}}, 0, false},
+		{"request no-store", http.Header{"Cache-Control": {"no-store"}}, 200, http.Header{"Cache-Control": {"max-age=60"}}, 0, false},
+		{"authorized", http.Header{"Authorization": {"Bearer token"}}, 200, http.Header{"Cache-Control": {"max-age=60"}}, 0, false},
+		{"authorized public", http.Header{"Authorization": {"Bearer token"}}, 200, http.Header{"Cache-Control": {"public, max-age=60"}}, time.Minute, true},
+		{"authorized s-maxage", http.Header{"Authorization": {"Bearer token"}}, 200, http.Header{"Cache-Control": {"s-maxage=60"}}, time.Minute, true},
+		{"heuristic 200", nil, 200, http.Header{}, 0, true},
+		{"heuristic 404", nil, 404, http.Header{}, 0, true},
+		{"heuristic 503", nil, 503, http.Header{}, 0, false},
+		{"explicit 503", nil, 503, http.Header{"Cache-Control": {"max-age=5"}}, 5 * time.Second, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "https://example.com/", nil)
+			for name, values := range test.request {
+				r.Header[name] = values
+			}
+			resp := cache.ResponseRecord{StatusCode: test.status, Header: test.response, Request: cache.RequestRecord{URL: "https://example.com/"}}
+			ttl, storable := responseTTL(r, resp)
+			// Expires is only precise to the second
+			if storable != test.storable || ttl.Round(time.Second) != test.ttl {
+				t.Fatalf("responseTTL: got %s, %v, want %s, %v", ttl, storable, test.ttl, test.storable)
+			}
+		})
+	}
+}
+
+func TestResponseTTLPerIdentity(t *testing.T) {
+	setVar(t, identityHeader, "X-User-ID")
+	r := httptest.NewRequest("GET", "https://example.com/", nil)
+	r.Header.Set("X-User-ID", "alice")
+	r.Header.Set("Authorization", "Bearer token")
+	resp := cache.ResponseRecord{StatusCode: 200, Header: http.Header{"Cache-Control": {"private, max-age=60"}}, Request: cache.RequestRecord{URL: "https://example.com/"}}
+	if ttl, storable := responseTTL(r, resp); !storable || ttl != time.Minute {
+		t.Fatalf("responseTTL of a private response for an identity: got %s, %v, want 1m0s, true", ttl, storable)
+	}
+}
+
+func TestResponseTTLIgnoringCacheControl(t *testing.T) {
+	setVar(t, ignoreCacheControl, true)
+	r := httptest.NewRequest("GET", "https://example.com/", nil)
+	for status, storable := range map[int]bool{200: true, 500: false} {
+		resp := cache.ResponseRecord{StatusCode: status, Header: http.Header{"Cache-Control": {"no-store"}}, Request: cache.RequestRecord{URL: "https://example.com/"}}
+		if ttl, got := responseTTL(r, resp); got != storable || ttl != 0 {
+			t.Fatalf("responseTTL of a no-store %d with -ignore-cache-control: got %s, %v, want 0s, %v", status, ttl, got, storable)
+		}
+	}
+}
+
+func TestUsableOnError(t *testing.T) {
+	now := time.Now()
+	entry := func(cacheControl string, expiredFor time.Duration) cache.Entry {
+		return cache.Entry{
+			Response:  cache.ResponseRecord{Header: http.Header{"Cache-Control": {cacheControl}}},
+			ExpiresAt: now.Add(-expiredFor),
+		}
+	}
+	setVar(t, staleIfError, 10*time.Minute)
+	for _, test := range []struct {
+		name   string
+		entry  cache.Entry
+		usable bool
+	}{
+		{"within -stale-if-error", entry("max-age=60", 5*time.Minute), true},
+		{"past -stale-if-error", entry("max-age=60", 15*time.Minute), false},
+		{"within stale-if-error", entry("max-age=60, stale-if-error=3600", 30*time.Minute), true},
+		{"past stale-if-error", entry("max-age=60, stale-if-error=60", 5*time.Minute), false},
+		{"invalid stale-if-error", entry("stale-if-error=soon", time.Second), false},
+		{"never expires", cache.Entry{}, false},
+	} {
+		if got := usableOnError(test.entry, now); got != test.usable {
+			t.Errorf("usableOnError %s: got %v, want %v", test.name, got, test.usable)
+		}
+	}
+}
+
+func TestProxyStaleIfError(t *testing.T) {
+	useTestCache(t, cache.Options{StaleRetention: time.Hour})
+	var status int
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60, stale-if-error=600")
+		w.Write([]byte("cached"))
+	}))
+	defer target.Close()
+
+	proxyGet(target.URL)
+	expireAll()
+	status = http.StatusServiceUnavailable
+	if w := proxyGet(target.URL); w.Code != http.StatusOK || w.Body.String() != "cached" {
+		t.Fatalf("request to a failing target: got %d %q, want the stale response", w.Code, w.Body)
+	}
+	status = http.StatusNotFound
+	if w := proxyGet(target.URL); w.Code != http.StatusNotFound {
+		t.Fatalf("request for a removed page: got %d %q, want the target's 404", w.Code, w.Body)
+	}
+}
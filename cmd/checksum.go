@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+// Checksum verification modes selected by -verify-checksums.
+const (
+	verifyOff     = "off"
+	verifyStore   = "store"
+	verifySampled = "sampled"
+	verifyAlways  = "always"
+)
+
+// verifyMode is the -verify-checksums mode.
+var verifyMode = verifyStore
+
+func init() {
+	flag.Func("verify-checksums", "when the checksum of a cached body is verified before it is served: store (entries read from -disk-dir, -redis-url or -memcached-servers), sampled (those and a -verify-checksums-sample share of the others), always, or off (default store)", func(value string) error {
+		switch value {
+		case verifyOff, verifyStore, verifySampled, verifyAlways:
+			verifyMode = value
+			return nil
+		}
+		return fmt.Errorf("expected off, store, sampled or always, got %q", value)
+	})
+}
+
+var verifySample = flag.Float64("verify-checksums-sample", 0.01, "share of entries kept in memory whose checksum is verified before they are served with -verify-checksums sampled")
+
+// The verifyChecksum function reports whether the checksum of an entry about to be served is verified,
+// given whether it was just read from the store.
+func verifyChecksum(loaded bool) bool {
+	switch verifyMode {
+	case verifyAlways:
+		return true
+	case verifySampled:
+		return loaded || rand.Float64() < *verifySample
+	case verifyStore:
+		return loaded
+	}
+	return false
+}
+
+// The logCorruptEntry function reports an entry that failed checksum verification, which is removed
+// and fetched again from the target server.
+func logCorruptEntry(namespace, key string, entry cache.Entry) {
+	slog.Warn("Cached response failed checksum verification, fetching it again", "target", entry.Response.Request.URL)
+	notifyEvent("corrupt-entry", "cache", fmt.Sprintf("cached response for %s failed checksum verification", entry.Response.Request.URL))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+var chunkBytes = flag.Int("chunk-bytes", 0, "with -disk-dir, -redis-url or -memcached-servers, cacheable GET responses whose Content-Length exceeds this are written to the store in chunks of this size as they arrive rather than read into memory, range requests only read the chunks they need, and interrupted downloads are resumed; 0 disables chunking")
+
+// chunkingKey is the context key marking a request to a target server whose response is cached when it
+// can be, so that a large body may be written to the store in chunks.
+type chunkingKey struct{}
+
+// The withChunking function marks a request to a target server as filling the cache, so that a large
+// response body is written to the store in chunks with -chunk-bytes.
+func withChunking(req *http.Request) *http.Request {
+	if *chunkBytes <= 0 {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), chunkingKey{}, true))
+}
+
+// The chunking function reports whether the response to a request to a target server may be written to
+// the store in chunks.
+func chunking(req *http.Request) bool {
+	marked, _ := req.Context().Value(chunkingKey{}).(bool)
+	return marked && req.Method == "GET" && req.Header.Get("Range") == ""
+}
+
+// The chunkable function reports whether a response is large enough to be written to the store in
+// chunks, and would be cached: bodies of routes validating them against a schema or keeping revisions
+// are needed in memory.
+func chunkable(req *http.Request, resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK || resp.ContentLength <= int64(*chunkBytes) || resp.Header.Get("Vary") == "*" {
+		return false
+	}
+	if r := routeFor(req.URL); r.Schema != nil || r.Revisions > 0 {
+		return false
+	}
+	_, storable := responseTTL(req, cache.ResponseRecord{StatusCode: resp.StatusCode, Header: resp.Header})
+	return storable
+}
+
+// The fillValidator function returns the validator a fill can be resumed with using If-Range: the
+// response's strong ETag, or else its Last-Modified date.
+func fillValidator(header http.Header) string {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return header.Get("Last-Modified")
+}
+
+// The resumeFill function returns a copy of a request asking the target server for the rest of the body
+// of an interrupted fill under key, if there is one, together with the offset the rest starts at.
+// Conditional requests are not resumed, as the target server may answer them without a body.
+func resumeFill(req *http.Request, key string) (*http.Request, int64) {
+	if req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		return req, 0
+	}
+	validator, written, ok := proxyCache.InterruptedFill(key)
+	if !ok {
+		return req, 0
+	}
+	slog.Info("Resuming download", "target", req.URL.String(), "offset", written)
+	req = req.Clone(req.Context())
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", written))
+	req.Header.Set("If-Range", validator)
+	return req, written
+}
+
+// The resumes function reports whether a response holds the rest of a body from offset on: a 206
+// Partial Content response whose Content-Range starts at offset and runs to the end of the body.
+func resumes(resp *http.Response, offset int64) bool {
+	if resp.StatusCode != http.StatusPartialContent {
+		return false
+	}
+	spec, ok := strings.CutPrefix(resp.Header.Get("Content-Range"), "bytes ")
+	if !ok {
+		return false
+	}
+	span, total, _ := strings.Cut(spec, "/")
+	first, last, _ := strings.Cut(span, "-")
+	start, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	size, err3 := strconv.ParseInt(total, 10, 64)
+	return err1 == nil && err2 == nil && err3 == nil && start == offset && end == size-1
+}
+
+// The fillEntry function writes the body of a response to the cache's store in chunks as it arrives,
+// continuing the interrupted fill under key when the response resumes it at offset, and returns an
+// entry referring to the saved body. Should the body be cut short, what was saved is kept to be resumed
+// by a later request when the response has a validator.
+func fillEntry(req *http.Request, resp *http.Response, key string, offset int64) (cache.Entry, error) {
+	ttl, _ := responseTTL(req, cache.ResponseRecord{StatusCode: resp.StatusCode, Header: resp.Header})
+	fill, err := proxyCache.Fill(key, fillValidator(resp.Header), offset, ttl)
+	if err != nil {
+		return cache.Entry{}, fmt.Errorf("filling response body: %w", err)
+	}
+	// Bodies filled in one go are hashed for an ETag, like those read into memory
+	hash := sha256.New()
+	var w io.Writer = fill
+	if offset == 0 {
+		w = io.MultiWriter(fill, hash)
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		fill.Abandon()
+		return cache.Entry{}, fmt.Errorf("reading response body: %w", timeoutCause(req, err))
+	}
+
+	// A resumed body is cached as the whole response
+	if resp.StatusCode == http.StatusPartialContent {
+		resp.StatusCode = http.StatusOK
+		resp.Header.Del("Content-Range")
+	}
+	resp.Header.Set("Content-Length", strconv.FormatInt(fill.Written(), 10))
+	header, tags := responseHeader(req, resp)
+	etag := header.Get("ETag")
+	if etag == "" && offset == 0 {
+		etag = `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+	}
+	request := compactRequest(req)
+	delete(request.Header, "Range")
+	delete(request.Header, "If-Range")
+	entry := cache.Entry{
+		Response: cache.ResponseRecord{StatusCode: resp.StatusCode, Header: header, Request: request},
+		ETag:     etag,
+		Tags:     tags,
+	}
+	if err := fill.Finish(&entry); err != nil {
+		return cache.Entry{}, fmt.Errorf("filling response body: %w", err)
+	}
+	return entry, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// trustedProxies holds the networks of reverse proxies whose X-Forwarded-For and X-Real-IP headers are
+// believed when deriving a client's IP address.
+var trustedProxies []netip.Prefix
+
+func init() {
+	flag.Func("trusted-proxies", "comma-separated CIDRs (or addresses) of reverse proxies whose X-Forwarded-For/X-Real-IP headers are trusted; may be repeated", func(value string) error {
+		prefixes, err := parsePrefixes(value)
+		trustedProxies = append(trustedProxies, prefixes...)
+		return err
+	})
+}
+
+// The parsePrefixes function parses comma-separated CIDRs, where a plain address stands for itself.
+func parsePrefixes(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, err
+			}
+			item = netip.PrefixFrom(addr, addr.BitLen()).String()
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// The containsAddr function reports whether an address belongs to any of the networks.
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// The parseIP function parses an address as it appears in RemoteAddr or forwarding headers, accepting
+// an optional port and brackets, dropping IPv6 zones and unmapping IPv4-mapped IPv6 addresses so the
+// same client is always reported the same way on dual-stack listeners.
+func parseIP(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid IP address %q", s)
+	}
+	return addr.WithZone("").Unmap(), nil
+}
+
+// The trustedProxy function reports whether an address belongs to -trusted-proxies.
+func trustedProxy(addr netip.Addr) bool {
+	return containsAddr(trustedProxies, addr)
+}
+
+// The clientIP function derives the IP address of the client that made a request. Forwarding headers
+// are only honoured when the request comes from a trusted proxy: X-Forwarded-For is walked from the
+// right, skipping trusted proxies, and X-Real-IP is used when there is no X-Forwarded-For. It falls
+// back to the connection's remote address.
+func clientIP(r *http.Request) string {
+	remote, err := parseIP(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	if !trustedProxy(remote) {
+		return remote.String()
+	}
+
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := parseIP(hops[i])
+			if err != nil {
+				break
+			}
+			if !trustedProxy(hop) || i == 0 {
+				return hop.String()
+			}
+		}
+		return remote.String()
+	}
+	if realIP, err := parseIP(r.Header.Get("X-Real-IP")); err == nil {
+		return realIP.String()
+	}
+	return remote.String()
+}
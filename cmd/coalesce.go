@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+// errShed is returned by a fetch that was not sent because the target servers are overloaded.
+var errShed = errors.New("target servers overloaded")
+
+// flight is a fetch from a target server shared by every concurrent miss for the same key.
+type flight struct {
+	done  chan struct{}
+	entry cache.Entry
+	err   error
+}
+
+// fetchGroup coalesces concurrent fetches for the same cache key, so a burst of misses for an uncached
+// URL sends a single request to the target server.
+type fetchGroup struct {
+	mutex   sync.Mutex
+	flights map[string]*flight
+}
+
+// fetches coalesces the misses of the proxy handler.
+var fetches = &fetchGroup{flights: make(map[string]*flight)}
+
+// The `do` method in the `fetchGroup` struct calls fetch unless a fetch for the key is already in
+// flight, in which case it waits for that one and returns its result. shared reports whether the
+// result came from another caller's fetch, which then also takes care of caching it.
+func (g *fetchGroup) do(key string, fetch func() (cache.Entry, error)) (entry cache.Entry, shared bool, err error) {
+	g.mutex.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mutex.Unlock()
+		<-f.done
+		return f.entry, true, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mutex.Unlock()
+
+	defer func() {
+		g.mutex.Lock()
+		delete(g.flights, key)
+		g.mutex.Unlock()
+		close(f.done)
+	}()
+	f.entry, f.err = fetch()
+	return f.entry, false, f.err
+}
+
+// The shareable function reports whether a response fetched for a concurrent request may also answer
+// r, which is the case when it would have been cached and served to r. Requests for a URL whose Vary
+// headers aren't known yet share a key, so a response that varies only answers requests with the same
+// values for the varying headers. Credentials aren't kept with the response, so one that varies on them
+// is never shared.
+func shareable(r *http.Request, entry cache.Entry) bool {
+	if _, storable := responseTTL(r, entry.Response); !storable {
+		return false
+	}
+	names, ok := varyNames(entry.Response.Header)
+	if !ok || variesOnCredentials(names) {
+		return false
+	}
+	return variantKey("", names, r.Header) == variantKey("", names, entry.Response.Request.Header)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"flag"
+	"io"
+	"log/slog"
+	"strings"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+var compressTypes = newListFlag("compress-types", "content types, or prefixes such as text/, whose bodies are kept gzip-compressed in the cache to save memory; clients accepting gzip are served the compressed body as is, others a decompressed copy")
+
+var compressMinBytes = flag.Int("compress-min-bytes", 1024, "smallest body kept compressed with -compress-types")
+
+// The compressStored function replaces the body of an entry about to be cached with its gzip variant
+// when its content type is listed in -compress-types and compressing saves space. Entries of routes
+// keeping revisions keep their body, as revisions are stored as deltas against it.
+func compressStored(r route, entry *cache.Entry) {
+	if len(*compressTypes) == 0 || r.Revisions > 0 || len(entry.Body) < *compressMinBytes || entry.Response.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	contentType := strings.ToLower(entry.Response.Header.Get("Content-Type"))
+	listed := false
+	for _, prefix := range *compressTypes {
+		listed = listed || strings.HasPrefix(contentType, strings.ToLower(prefix))
+	}
+	if !listed {
+		return
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(entry.Body)
+	if err := zw.Close(); err != nil {
+		slog.Error("Error compressing body", "target", entry.Response.Request.URL, "error", err)
+		return
+	}
+	if buf.Len() < len(entry.Body) {
+		entry.Body, entry.Variants = nil, map[string][]byte{"gzip": buf.Bytes()}
+	}
+}
+
+// The storedCompressed function reports whether an entry's body is only kept as its gzip variant.
+// Empty bodies are never compressed, so an entry without a body but with a gzip variant is one.
+func storedCompressed(entry cache.Entry) bool {
+	return len(entry.Body) == 0 && len(entry.Variants["gzip"]) > 0
+}
+
+// The entryBody function returns the body of an entry, decompressing it when it is kept compressed and
+// reading it from the store when it is kept in chunks.
+func entryBody(entry cache.Entry) ([]byte, error) {
+	if entry.BodySize > 0 {
+		body := make([]byte, 0, entry.BodySize)
+		err := proxyCache.ReadBody(entry, 0, entry.BodySize, func(p []byte) error {
+			body = append(body, p...)
+			return nil
+		})
+		return body, err
+	}
+	if !storedCompressed(entry) {
+		return entry.Body, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(entry.Variants["gzip"]))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(zr)
+}
+
+// The bodyLength function returns the length of an entry's body without decompressing it or reading
+// it from the store: a gzip stream ends with the length of its input, modulo 4 GiB.
+func bodyLength(entry cache.Entry) int {
+	if entry.BodySize > 0 {
+		return int(entry.BodySize)
+	}
+	variant := entry.Variants["gzip"]
+	if !storedCompressed(entry) || len(variant) < 4 {
+		return len(entry.Body)
+	}
+	return int(binary.LittleEndian.Uint32(variant[len(variant)-4:]))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var faultInjection = flag.Bool("fault-injection", false, "apply the delay, delay_jitter and error_rate route annotations, turning the proxy into a fault injector for clients under test; never enable it in production")
+
+// The checkFaultRoutes function refuses routes injecting faults unless -fault-injection is set, so that
+// a route copied from a test configuration can't slow down or fail production traffic.
+func checkFaultRoutes() error {
+	for _, r := range routes {
+		if !r.injectsFaults() {
+			continue
+		}
+		if !*faultInjection {
+			return fmt.Errorf("route %s injects faults, which requires -fault-injection", r.Prefix)
+		}
+		slog.Warn("Injecting faults into requests", "route", r.Prefix)
+	}
+	return nil
+}
+
+// The `injectsFaults` method in the `route` struct reports whether the route delays or fails requests.
+func (r route) injectsFaults() bool {
+	return r.Delay > 0 || r.DelayJitter > 0 || r.ErrorRate > 0
+}
+
+// The `injectFault` method in the `route` struct delays a request for the route by its delay plus a
+// random part of its jitter, then answers it with the route's error status at its error rate. It
+// reports whether the request was answered, or abandoned by the client during the delay. Injected
+// faults are listed in an X-Fault-Injected header, so clients under test can tell them from real ones.
+func (r route) injectFault(w http.ResponseWriter, req *http.Request, target *url.URL, client string) bool {
+	if !*faultInjection || !r.injectsFaults() {
+		return false
+	}
+	delay := r.Delay
+	if r.DelayJitter > 0 {
+		delay += time.Duration(rand.Int64N(int64(r.DelayJitter) + 1))
+	}
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			return true
+		}
+		w.Header().Add("X-Fault-Injected", "delay="+delay.Round(time.Millisecond).String())
+	}
+	if r.ErrorRate == 0 || rand.Float64() >= r.ErrorRate {
+		return false
+	}
+
+	status := r.ErrorStatus
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	event := newCacheEvent(req, target, "", client)
+	event.Outcome, event.Status = "fault", status
+	defer recordCacheEvent(event)
+	slog.Debug("Injecting fault", "status", status, "target", target.String(), "client", client, "route", r.Prefix)
+	w.Header().Add("X-Fault-Injected", "error")
+	http.Error(w, http.StatusText(status)+" (injected fault)", status)
+	return true
+}
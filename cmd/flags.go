@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// listFlag is a flag.Value holding a list of strings. Values are comma-separated and the flag may also
+// be repeated.
+type listFlag []string
+
+// The newListFlag function defines a list flag with the specified name and usage string.
+func newListFlag(name, usage string) *listFlag {
+	l := new(listFlag)
+	flag.Var(l, name, usage)
+	return l
+}
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// intValue is an integer flag that may be changed at runtime (see /admin/tuning) while other goroutines
+// read it.
+type intValue struct {
+	atomic.Int64
+}
+
+// The newIntValue function defines a runtime-tunable integer flag with the specified name, default
+// value and usage string.
+func newIntValue(name string, value int64, usage string) *intValue {
+	v := new(intValue)
+	v.Store(value)
+	flag.Var(v, name, usage)
+	return v
+}
+
+func (v *intValue) String() string {
+	return strconv.FormatInt(v.Load(), 10)
+}
+
+func (v *intValue) Set(value string) error {
+	n, err := strconv.ParseInt(value, 0, 64)
+	if err != nil {
+		return err
+	}
+	v.Store(n)
+	return nil
+}
+
+// durationValue is a duration flag that may be changed at runtime (see /admin/tuning) while other
+// goroutines read it.
+type durationValue struct {
+	atomic.Int64
+}
+
+// The newDurationValue function defines a runtime-tunable duration flag with the specified name,
+// default value and usage string.
+func newDurationValue(name string, value time.Duration, usage string) *durationValue {
+	v := new(durationValue)
+	v.Store(int64(value))
+	flag.Var(v, name, usage)
+	return v
+}
+
+// The `Duration` method in the `durationValue` struct returns the current value.
+func (v *durationValue) Duration() time.Duration {
+	return time.Duration(v.Load())
+}
+
+func (v *durationValue) String() string {
+	return v.Duration().String()
+}
+
+func (v *durationValue) Set(value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	v.Store(int64(d))
+	return nil
+}
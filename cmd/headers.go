@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+var maxStoredHeaders = flag.Int("max-stored-headers", 0, "maximum number of response header fields stored per entry, 0 for unlimited")
+
+var maxStoredHeaderBytes = flag.Int("max-stored-header-bytes", 0, "maximum total size of response header names and values stored per entry, 0 for unlimited")
+
+// essentialHeaders are kept ahead of all other headers when an entry's headers have to be trimmed.
+var essentialHeaders = []string{"Content-Type", "Content-Length", "Content-Encoding", "Cache-Control", "ETag", "Last-Modified", "Expires", "Vary"}
+
+// The trimHeaders function enforces -max-stored-headers and -max-stored-header-bytes on a response's
+// headers. Essential headers are kept first, then the remaining headers in name order; fields that no
+// longer fit are dropped whole. It also returns how many fields were dropped.
+func trimHeaders(header http.Header) (http.Header, int) {
+	if *maxStoredHeaders <= 0 && *maxStoredHeaderBytes <= 0 {
+		return header, 0
+	}
+
+	names := make([]string, 0, len(header))
+	essential := make(map[string]bool, len(essentialHeaders))
+	for _, name := range essentialHeaders {
+		essential[name] = true
+		if _, ok := header[name]; ok {
+			names = append(names, name)
+		}
+	}
+	rest := make([]string, 0, len(header))
+	for name := range header {
+		if !essential[name] {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	names = append(names, rest...)
+
+	trimmed := make(http.Header, len(header))
+	fields, size := 0, 0
+	for _, name := range names {
+		for _, value := range header[name] {
+			if *maxStoredHeaders > 0 && fields+1 > *maxStoredHeaders {
+				continue
+			}
+			if *maxStoredHeaderBytes > 0 && size+len(name)+len(value) > *maxStoredHeaderBytes {
+				continue
+			}
+			trimmed[name] = append(trimmed[name], value)
+			fields++
+			size += len(name) + len(value)
+		}
+	}
+	return trimmed, headerFields(header) - fields
+}
+
+// The headerFields function counts the header fields (name/value pairs) in a header.
+func headerFields(header http.Header) int {
+	n := 0
+	for _, values := range header {
+		n += len(values)
+	}
+	return n
+}
+
+// maxInterned bounds the number of distinct strings kept by the interner, and maxInternedLength the
+// length of strings worth interning; unique values such as dates soon stop being added once it fills.
+const (
+	maxInterned       = 10000
+	maxInternedLength = 256
+)
+
+// interner deduplicates strings shared by many entries (header names and values, methods, hosts) so
+// large caches store one copy of each.
+type interner struct {
+	strings map[string]string
+	mutex   sync.Mutex
+}
+
+var headerStrings = &interner{strings: make(map[string]string)}
+
+// The `intern` method in the `interner` struct returns the canonical copy of s.
+func (in *interner) intern(s string) string {
+	if len(s) > maxInternedLength {
+		return s
+	}
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+	if canonical, ok := in.strings[s]; ok {
+		return canonical
+	}
+	if len(in.strings) < maxInterned {
+		in.strings[s] = s
+	}
+	return s
+}
+
+// The internHeader function returns a copy of a header whose names and values are interned and whose
+// value slices are exactly sized.
+func internHeader(header http.Header) http.Header {
+	interned := make(http.Header, len(header))
+	for name, values := range header {
+		stored := make([]string, len(values))
+		for i, value := range values {
+			stored[i] = headerStrings.intern(value)
+		}
+		interned[headerStrings.intern(name)] = stored
+	}
+	return interned
+}
+
+// The compactHeader function returns a copy of a response header suitable for long-term storage: the
+// per-entry limits are applied and the result is interned. It also returns how many fields were
+// dropped by the limits.
+func compactHeader(header http.Header) (http.Header, int) {
+	header, dropped := trimHeaders(header)
+	return internHeader(header), dropped
+}
+
+// credentialHeaders are the request headers carrying credentials. They are left out of the request
+// records kept with cached entries, so the store, snapshots and exports never hold them.
+var credentialHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// The compactRequest function returns the record of a request kept with a cached entry, with its
+// method and headers interned and its credentials left out. Entries for the same site mostly share
+// these (User-Agent, Accept, ...), so with millions of similar keys they would otherwise be stored once
+// per entry.
+func compactRequest(req *http.Request) cache.RequestRecord {
+	header := req.Header.Clone()
+	for _, name := range credentialHeaders {
+		header.Del(name)
+	}
+	return cache.RequestRecord{
+		Method: headerStrings.intern(req.Method),
+		URL:    req.URL.String(),
+		Header: internHeader(header),
+	}
+}
+
+// The variesOnCredentials function reports whether any of the canonical header names is a credential
+// header. A response varying on one can't be matched against the request record kept with it.
+func variesOnCredentials(names []string) bool {
+	return slices.ContainsFunc(names, func(name string) bool { return slices.Contains(credentialHeaders, name) })
+}
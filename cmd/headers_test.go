@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+func TestCompactRequestDropsCredentials(t *testing.T) {
+	req := httptest.NewRequest("GET", "https://example.com/page", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("Proxy-Authorization", "Basic secret")
+	req.Header.Set("Accept-Language", "en")
+
+	record := compactRequest(req)
+	for _, name := range credentialHeaders {
+		if value := record.Header.Get(name); value != "" {
+			t.Fatalf("compactRequest: kept %s: %s", name, value)
+		}
+	}
+	if record.Header.Get("Accept-Language") != "en" || record.Method != "GET" || record.URL != "https://example.com/page" {
+		t.Fatalf("compactRequest: got %+v", record)
+	}
+	if req.Header.Get("Cookie") == "" {
+		t.Fatal("compactRequest: removed the Cookie header from the request")
+	}
+
+	entry := cache.Entry{Response: cache.ResponseRecord{StatusCode: http.StatusOK, Header: http.Header{"Cache-Control": {"public, max-age=60"}}, Request: record}}
+	for _, test := range []struct {
+		vary      string
+		shareable bool
+	}{
+		{"Accept-Language", true},
+		{"Cookie", false},
+		{"accept-language, authorization", false},
+	} {
+		entry.Response.Header.Set("Vary", test.vary)
+		if got := shareable(req, entry); got != test.shareable {
+			t.Errorf("shareable of a response varying on %s: got %v, want %v", test.vary, got, test.shareable)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"container/heap"
+	"flag"
+	"sort"
+	"sync"
+)
+
+var hotKeys = flag.Int("hot-keys", 10, "number of hottest keys and most frequent misses reported by /admin/stats")
+
+var hotKeysCapacity = flag.Int("hot-keys-capacity", 1000, "number of keys tracked to find the hottest ones; more counters make the reported counts more accurate")
+
+// hotKey is a key reported by a heavy-hitter sketch. Count may overestimate the key's true count by at
+// most Error.
+type hotKey struct {
+	Key   string
+	Count int64
+	Error int64
+
+	index int
+}
+
+// heavyHitters finds the most frequent keys of a stream with the Space-Saving algorithm: it keeps a
+// fixed number of counters, and a key without a counter takes over the smallest one. Any key seen more
+// than 1/capacity of the time is guaranteed to be tracked, without storing a counter per key.
+type heavyHitters struct {
+	capacity int
+	keys     map[string]*hotKey
+	// counters is a min-heap on Count, so the counter to take over is always at the root
+	counters hotKeyHeap
+	mutex    sync.Mutex
+}
+
+// The newHeavyHitters function creates a sketch with the given number of counters.
+func newHeavyHitters(capacity int) *heavyHitters {
+	return &heavyHitters{capacity: capacity, keys: make(map[string]*hotKey, capacity)}
+}
+
+var (
+	hotHits   *heavyHitters
+	hotMisses *heavyHitters
+)
+
+// The startHotKeys function creates the sketches of cache hits and misses from the flags.
+func startHotKeys() {
+	hotHits = newHeavyHitters(max(*hotKeysCapacity, *hotKeys))
+	hotMisses = newHeavyHitters(max(*hotKeysCapacity, *hotKeys))
+}
+
+// The `offer` method in the `heavyHitters` struct counts an occurrence of key.
+func (h *heavyHitters) offer(key string) {
+	if h == nil || h.capacity <= 0 {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if counter, ok := h.keys[key]; ok {
+		counter.Count++
+		heap.Fix(&h.counters, counter.index)
+		return
+	}
+	if len(h.counters) < h.capacity {
+		counter := &hotKey{Key: key, Count: 1}
+		heap.Push(&h.counters, counter)
+		h.keys[key] = counter
+		return
+	}
+	counter := h.counters[0]
+	delete(h.keys, counter.Key)
+	counter.Key, counter.Error = key, counter.Count
+	counter.Count++
+	heap.Fix(&h.counters, 0)
+	h.keys[key] = counter
+}
+
+// The `top` method in the `heavyHitters` struct returns the k most frequent keys, most frequent first.
+func (h *heavyHitters) top(k int) []hotKey {
+	if h == nil {
+		return nil
+	}
+	h.mutex.Lock()
+	top := make([]hotKey, 0, len(h.counters))
+	for _, counter := range h.counters {
+		top = append(top, *counter)
+	}
+	h.mutex.Unlock()
+
+	sort.Slice(top, func(i, j int) bool { return top[i].Count > top[j].Count })
+	return top[:min(k, len(top))]
+}
+
+// hotKeyHeap implements heap.Interface for the counters of a heavyHitters sketch.
+type hotKeyHeap []*hotKey
+
+func (h hotKeyHeap) Len() int           { return len(h) }
+func (h hotKeyHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+
+func (h hotKeyHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *hotKeyHeap) Push(x interface{}) {
+	counter := x.(*hotKey)
+	counter.index = len(*h)
+	*h = append(*h, counter)
+}
+
+func (h *hotKeyHeap) Pop() interface{} {
+	old := *h
+	counter := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return counter
+}
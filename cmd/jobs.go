@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+var jobWebhook = flag.String("job-webhook", "", "URL that receives a POST with the final status of every admin job")
+
+var exportDir = flag.String("export-dir", "exports", "directory export jobs write their files to")
+
+// maxJobHistory bounds how many jobs are remembered; the oldest finished jobs are forgotten first.
+const maxJobHistory = 100
+
+// Job is a long-running admin operation such as a purge, warm, export or revalidation. Its progress
+// can be polled via /admin/jobs while it runs in the background.
+type Job struct {
+	ID         string
+	Kind       string
+	State      string
+	Total      int
+	Done       int
+	Outcomes   map[string]int
+	Error      string `json:",omitempty"`
+	Tenant     string `json:",omitempty"`
+	StartedAt  time.Time
+	FinishedAt time.Time
+
+	cancel context.CancelFunc
+}
+
+// jobRequest is the body accepted by POST /admin/jobs. Which fields are used depends on the kind:
+// revalidate, purge and export select entries by URLs and Pattern, warm fetches URLs, and export
+// writes to File inside -export-dir. Final statuses only go to -job-webhook: a webhook chosen by the
+// caller would let it make the proxy send requests anywhere.
+type jobRequest struct {
+	Kind    string   `json:"kind"`
+	URLs    []string `json:"urls"`
+	Pattern string   `json:"pattern"`
+	File    string   `json:"file"`
+}
+
+// jobFunc performs the work of a job. It reports every processed item to progress with its outcome
+// and should stop early once ctx is cancelled.
+type jobFunc func(ctx context.Context, progress func(outcome string)) error
+
+// jobManager keeps track of running and recently finished jobs.
+type jobManager struct {
+	jobs  map[string]*Job
+	order []string
+	mutex sync.Mutex
+}
+
+var jobs = &jobManager{jobs: make(map[string]*Job)}
+
+// The newJobID function returns a random identifier for a background job.
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// The `start` method in the `jobManager` struct runs a job of the given kind over total items for a
+// tenant (empty when unscoped) in the background and returns it immediately. When the job finishes,
+// its final status is posted to -job-webhook.
+func (m *jobManager) start(kind, tenant string, total int, run jobFunc) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:        newJobID(),
+		Kind:      kind,
+		Tenant:    tenant,
+		State:     "running",
+		Total:     total,
+		Outcomes:  make(map[string]int),
+		StartedAt: time.Now(),
+		cancel:    cancel,
+	}
+
+	m.mutex.Lock()
+	m.jobs[job.ID] = job
+	m.order = append(m.order, job.ID)
+	m.prune()
+	m.mutex.Unlock()
+	slog.Info("Job started", "job", job.ID, "kind", kind, "items", total)
+
+	go func() {
+		err := run(ctx, func(outcome string) {
+			m.mutex.Lock()
+			defer m.mutex.Unlock()
+			job.Done++
+			job.Outcomes[outcome]++
+		})
+
+		m.mutex.Lock()
+		switch {
+		case ctx.Err() != nil:
+			job.State = "cancelled"
+		case err != nil:
+			job.State = "failed"
+			job.Error = err.Error()
+		default:
+			job.State = "succeeded"
+		}
+		job.FinishedAt = time.Now()
+		status := job.snapshot()
+		m.mutex.Unlock()
+		cancel()
+
+		slog.Info("Job "+status.State, "job", status.ID, "kind", status.Kind, "done", status.Done, "items", status.Total, "outcomes", status.Outcomes)
+		if *jobWebhook != "" {
+			notifyJobWebhook(*jobWebhook, status)
+		}
+	}()
+
+	return job
+}
+
+// The `prune` method in the `jobManager` struct forgets the oldest finished jobs once more than
+// maxJobHistory jobs are tracked. The caller must hold the mutex.
+func (m *jobManager) prune() {
+	for i := 0; len(m.order) > maxJobHistory && i < len(m.order); {
+		id := m.order[i]
+		if m.jobs[id].State == "running" {
+			i++
+			continue
+		}
+		delete(m.jobs, id)
+		m.order = append(m.order[:i], m.order[i+1:]...)
+	}
+}
+
+// The `snapshot` method in the `Job` struct returns a copy of the job that is safe to use without
+// holding the job manager's mutex. The caller must hold the mutex.
+func (j *Job) snapshot() Job {
+	status := *j
+	status.Outcomes = make(map[string]int, len(j.Outcomes))
+	for outcome, count := range j.Outcomes {
+		status.Outcomes[outcome] = count
+	}
+	return status
+}
+
+// The `get` method in the `jobManager` struct returns the current status of a job.
+func (m *jobManager) get(id string) (Job, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return job.snapshot(), true
+}
+
+// The `list` method in the `jobManager` struct returns the status of every tracked job visible to the
+// principal, oldest first.
+func (m *jobManager) list(p principal) []Job {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	list := make([]Job, 0, len(m.order))
+	for _, id := range m.order {
+		if job := m.jobs[id].snapshot(); p.allowsJob(job) {
+			list = append(list, job)
+		}
+	}
+	return list
+}
+
+// The `cancel` method in the `jobManager` struct asks a running job to stop and reports whether the
+// job exists and is visible to the principal.
+func (m *jobManager) cancel(id string, p principal) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	job, ok := m.jobs[id]
+	if !ok || !p.allowsJob(*job) {
+		return false
+	}
+	job.cancel()
+	return true
+}
+
+// The notifyJobWebhook function posts a finished job's status as JSON to the webhook URL.
+func notifyJobWebhook(webhook string, status Job) {
+	payload, err := json.Marshal(status)
+	if err != nil {
+		slog.Error("Error encoding job for webhook", "job", status.ID, "error", err)
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		slog.Error("Error notifying webhook", "job", status.ID, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("Webhook responded with an error", "job", status.ID, "status", resp.StatusCode)
+	}
+}
+
+// jobRoles is the role needed to start each kind of job. Exports write files on the server, so they
+// are reserved to admins.
+var jobRoles = map[string]role{"revalidate": rolePurger, "purge": rolePurger, "warm": rolePurger, "export": roleAdmin}
+
+// The adminJobsHandler function lists jobs on GET, returns a single job on GET ?id=<job ID>, starts a
+// job described by a jobRequest on POST, and cancels a job on DELETE ?id=<job ID>. Tenant-scoped
+// callers only see their tenant's jobs.
+func adminJobsHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	switch r.Method {
+	case "GET":
+		p, ok := authorize(w, r, roleViewer, false)
+		if !ok {
+			return
+		}
+		if id == "" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(jobs.list(p))
+			return
+		}
+		writeJobStatus(w, id, p)
+
+	case "POST":
+		var body jobRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		need, ok := jobRoles[body.Kind]
+		if !ok {
+			need = rolePurger
+		}
+		p, ok := authorize(w, r, need, false)
+		if !ok {
+			return
+		}
+		job, err := startJob(body, p)
+		if err != nil {
+			http.Error(w, "Invalid job request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"ID": job.ID})
+
+	case "DELETE":
+		p, ok := authorize(w, r, rolePurger, false)
+		if !ok {
+			return
+		}
+		if !jobs.cancel(id, p) {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// The writeJobStatus function writes the status of a job visible to the principal as JSON.
+func writeJobStatus(w http.ResponseWriter, id string, p principal) {
+	job, ok := jobs.get(id)
+	if !ok || !p.allowsJob(job) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// The startJob function validates a job request and starts the corresponding job on behalf of the
+// principal, limited to the entries and URLs the principal is allowed to act on.
+func startJob(req jobRequest, p principal) (*Job, error) {
+	var pattern *regexp.Regexp
+	if req.Pattern != "" {
+		var err error
+		if pattern, err = regexp.Compile(req.Pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern: %w", err)
+		}
+	}
+	selects := len(req.URLs) > 0 || pattern != nil
+
+	switch req.Kind {
+	case "revalidate":
+		if !selects {
+			return nil, errors.New("revalidate jobs need urls or a pattern")
+		}
+		matches := matchEntries(req.URLs, pattern, p)
+		return jobs.start(req.Kind, p.tenant, len(matches), func(ctx context.Context, progress func(string)) error {
+			forEach(ctx, matches, int(revalidateConcurrency.Load()), func(m matchedEntry) {
+				err := revalidateEntry(m.namespace, m.key, m.entry)
+				switch {
+				case err == errNotRevalidatable:
+					progress("skipped")
+				case err == errNotStorable:
+					progress("uncacheable")
+				case err != nil:
+					slog.Warn("Error revalidating", "target", m.entry.Response.Request.URL, "error", err)
+					progress("failed")
+				default:
+					progress("refreshed")
+				}
+			})
+			return nil
+		}), nil
+
+	case "purge":
+		if !selects {
+			return nil, errors.New("purge jobs need urls or a pattern")
+		}
+		matches := matchEntries(req.URLs, pattern, p)
+		return jobs.start(req.Kind, p.tenant, len(matches), func(ctx context.Context, progress func(string)) error {
+			purged := 0
+			defer func() {
+				recordPurge(purgeRecord{Who: p.name, Client: p.client, Tenant: p.tenant, Kind: "purge job", URLs: req.URLs, Pattern: req.Pattern, Entries: purged})
+			}()
+			for _, m := range matches {
+				if ctx.Err() != nil {
+					return nil
+				}
+				if proxyCache.Namespace(m.namespace).Delete(m.key) {
+					purged++
+					progress("purged")
+				} else {
+					progress("missing")
+				}
+			}
+			return nil
+		}), nil
+
+	case "warm":
+		if len(req.URLs) == 0 {
+			return nil, errors.New("warm jobs need urls")
+		}
+		for _, u := range req.URLs {
+			target, err := parseTarget(u)
+			if err == nil {
+				err = secureTarget(target)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid url %q: %w", u, err)
+			}
+			if !p.allowsURL(target.String()) {
+				return nil, fmt.Errorf("url %q is outside of tenant %s", u, p.tenant)
+			}
+		}
+		return jobs.start(req.Kind, p.tenant, len(req.URLs), func(ctx context.Context, progress func(string)) error {
+			forEach(ctx, req.URLs, int(revalidateConcurrency.Load()), func(u string) {
+				err := warmURL(u)
+				switch {
+				case err == errNotStorable:
+					progress("uncacheable")
+					return
+				case err != nil:
+					slog.Warn("Error warming", "target", u, "error", err)
+					progress("failed")
+					return
+				}
+				progress("warmed")
+			})
+			return nil
+		}), nil
+
+	case "export":
+		name := filepath.Base(req.File)
+		if req.File == "" || name == "." || name == ".." || name == string(filepath.Separator) {
+			return nil, errors.New("export jobs need a file name")
+		}
+		matches := matchEntries(req.URLs, pattern, p)
+		path := filepath.Join(*exportDir, name)
+		return jobs.start(req.Kind, p.tenant, len(matches), func(ctx context.Context, progress func(string)) error {
+			return exportEntries(ctx, path, matches, progress)
+		}), nil
+
+	default:
+		return nil, fmt.Errorf("unknown job kind %q (expected revalidate, purge, warm or export)", req.Kind)
+	}
+}
+
+// matchedEntry is a cache entry selected by a job together with its location in the cache.
+type matchedEntry struct {
+	namespace, key string
+	entry          cache.Entry
+}
+
+// The matchEntries function returns the cached entries the principal may act on whose URL is listed in
+// urls or matches pattern. When neither urls nor pattern is given, every such entry matches.
+func matchEntries(urls []string, pattern *regexp.Regexp, p principal) []matchedEntry {
+	all := len(urls) == 0 && pattern == nil
+	wanted := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		wanted[u] = true
+	}
+
+	var matches []matchedEntry
+	proxyCache.Range(func(namespace, key string, entry cache.Entry) bool {
+		u := entry.Response.Request.URL
+		if !p.allowsURL(u) {
+			return true
+		}
+		if all || wanted[u] || (pattern != nil && pattern.MatchString(u)) {
+			matches = append(matches, matchedEntry{namespace, key, entry})
+		}
+		return true
+	})
+	return matches
+}
+
+// The forEach function calls fn for every item with at most concurrency calls in flight. It stops
+// starting new calls once ctx is cancelled and returns when all started calls have finished.
+func forEach[T any](ctx context.Context, items []T, concurrency int, fn func(T)) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(concurrency, 1))
+	defer wg.Wait()
+	for _, item := range items {
+		select {
+		case <-ctx.Done():
+			return
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(item)
+		}()
+	}
+}
+
+// The warmURL function fetches a URL from its origin and caches the response as if a client without
+// any request headers had asked for it.
+func warmURL(rawURL string) error {
+	target, err := parseTarget(rawURL)
+	if err == nil {
+		err = secureTarget(target)
+	}
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", target.String(), nil)
+	if err != nil {
+		return err
+	}
+	entry, err := fetchEntry(withChunking(req))
+	if err != nil {
+		return err
+	}
+	ttl, storable := responseTTL(req, entry.Response)
+	key, vary, varies := storeKey(buildCacheKey("GET", target, req.Header), req.Header, entry.Response.Header)
+	if !storable || !varies {
+		proxyCache.RemoveBody(entry)
+		return errNotStorable
+	}
+	entry.Vary = vary
+	namespace := originNamespace(target)
+	route := routeFor(target)
+	route.keepRevisions(namespace, key, &entry)
+	compressStored(route, &entry)
+	namespace.Set(key, entry, ttl)
+	return nil
+}
+
+// exportedEntry is the JSON line written for each entry by an export job.
+type exportedEntry struct {
+	Namespace string
+	Key       string
+	URL       string
+	Method    string
+	Status    int
+	Headers   http.Header
+	ETag      string
+	StoredAt  time.Time
+	Body      string
+}
+
+// The exportEntries function writes the matched entries as JSON lines, with base64-encoded bodies, to
+// the file at path.
+func exportEntries(ctx context.Context, path string, matches []matchedEntry, progress func(string)) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	for _, m := range matches {
+		if ctx.Err() != nil {
+			return nil
+		}
+		body, err := entryBody(m.entry)
+		if err != nil {
+			return err
+		}
+		err = enc.Encode(exportedEntry{
+			Namespace: m.namespace,
+			Key:       m.key,
+			URL:       m.entry.Response.Request.URL,
+			Method:    m.entry.Response.Request.Method,
+			Status:    m.entry.Response.StatusCode,
+			Headers:   m.entry.Response.Header,
+			ETag:      m.entry.ETag,
+			StoredAt:  m.entry.StoredAt,
+			Body:      base64.StdEncoding.EncodeToString(body),
+		})
+		if err != nil {
+			return err
+		}
+		progress("exported")
+	}
+	return f.Close()
+}
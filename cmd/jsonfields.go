@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+var jsonFields = flag.Bool("json-fields", false, "decode JSON responses once when caching them and let clients select top-level fields with ?fields=a,b")
+
+// The isJSON function reports whether a Content-Type denotes a JSON document.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// The decodeJSON function decodes a JSON body for field filtering, or returns nil when JSON mode is
+// disabled or the body is not a JSON object or array of objects. Numbers are kept as json.Number so
+// they are served back unchanged.
+func decodeJSON(header http.Header, body []byte) interface{} {
+	if !*jsonFields || !isJSON(header.Get("Content-Type")) {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil
+	}
+	switch doc.(type) {
+	case map[string]interface{}, []interface{}:
+		return doc
+	}
+	return nil
+}
+
+// The filterFields function returns a copy of a decoded JSON document keeping only the given top-level
+// fields of an object, or of every object in an array.
+func filterFields(doc interface{}, fields map[string]bool) interface{} {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		filtered := make(map[string]interface{}, len(fields))
+		for name, value := range v {
+			if fields[name] {
+				filtered[name] = value
+			}
+		}
+		return filtered
+	case []interface{}:
+		filtered := make([]interface{}, len(v))
+		for i, item := range v {
+			filtered[i] = filterFields(item, fields)
+		}
+		return filtered
+	}
+	return doc
+}
+
+// The writeFilteredJSON function serves the fields requested with ?fields=a,b from a cached entry's
+// decoded JSON document. It reports false when the request doesn't ask for fields or the entry has no
+// decoded document, in which case nothing has been written.
+func writeFilteredJSON(w http.ResponseWriter, r *http.Request, entry cache.Entry) bool {
+	param := r.URL.Query().Get("fields")
+	if entry.JSON == nil || param == "" {
+		return false
+	}
+	fields := make(map[string]bool)
+	for _, name := range strings.Split(param, ",") {
+		fields[strings.TrimSpace(name)] = true
+	}
+	body, err := json.Marshal(filterFields(entry.JSON, fields))
+	if err != nil {
+		return false
+	}
+
+	// Clipped slices make values added to the response copy instead of writing to the shared entry
+	for k, v := range entry.Response.Header {
+		w.Header()[k] = slices.Clip(v)
+	}
+	setAge(w, entry)
+	// The filtered document is a different representation than the one the validators describe
+	w.Header().Del("ETag")
+	w.Header().Del("Last-Modified")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(entry.Response.StatusCode)
+	if err := writeBody(w, body); err != nil {
+		slog.Warn("Error writing response", "client", clientIP(r), "error", err)
+	}
+	return true
+}
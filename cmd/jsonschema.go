@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// errInvalidPayload is returned by fetchEntry for responses failing the JSON Schema of their route.
+var errInvalidPayload = errors.New("response failed schema validation")
+
+// jsonSchema is a compiled JSON Schema. The validation keywords of draft 2020-12 are supported, except
+// for dynamic references, unevaluated*, dependent* and contentMediaType; "format" is an annotation and
+// patterns use Go's regular expression syntax. Unknown keywords are ignored, as the specification
+// requires.
+type jsonSchema struct {
+	// always is set for the boolean schemas true and false
+	always *bool
+	ref    *jsonSchema
+
+	types    []string
+	enum     []interface{}
+	hasConst bool
+	constant interface{}
+
+	minimum, maximum                   *float64
+	exclusiveMinimum, exclusiveMaximum *float64
+	multipleOf                         *float64
+
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+
+	prefixItems         []*jsonSchema
+	items               *jsonSchema
+	contains            *jsonSchema
+	minItems, maxItems  *int
+	minContains         *int
+	maxContains         *int
+	uniqueItems         bool
+	properties          map[string]*jsonSchema
+	patternProperties   map[*regexp.Regexp]*jsonSchema
+	additional          *jsonSchema
+	propertyNames       *jsonSchema
+	required            []string
+	minProps, maxProps  *int
+	allOf, anyOf, oneOf []*jsonSchema
+	not                 *jsonSchema
+	ifSchema            *jsonSchema
+	thenSchema          *jsonSchema
+	elseSchema          *jsonSchema
+}
+
+// The loadJSONSchema function reads and compiles the JSON Schema in a file.
+func loadJSONSchema(path string) (*jsonSchema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var root interface{}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	c := schemaCompiler{root: root, compiled: make(map[string]*jsonSchema)}
+	schema, err := c.compile(root, "#")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return schema, nil
+}
+
+// schemaCompiler compiles the subschemas of a schema document, each once, so that recursive $refs
+// compile to cycles.
+type schemaCompiler struct {
+	root     interface{}
+	compiled map[string]*jsonSchema
+}
+
+// The `compile` method in the `schemaCompiler` struct compiles the subschema found at pointer.
+func (c *schemaCompiler) compile(node interface{}, pointer string) (*jsonSchema, error) {
+	if s, ok := c.compiled[pointer]; ok {
+		return s, nil
+	}
+	s := &jsonSchema{}
+	c.compiled[pointer] = s
+	if b, ok := node.(bool); ok {
+		s.always = &b
+		return s, nil
+	}
+	m, ok := node.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: a schema must be an object or boolean", pointer)
+	}
+
+	var err error
+	sub := func(name string) *jsonSchema {
+		value, ok := m[name]
+		if !ok || err != nil {
+			return nil
+		}
+		var schema *jsonSchema
+		schema, err = c.compile(value, pointer+"/"+escapePointer(name))
+		return schema
+	}
+	subs := func(name string) []*jsonSchema {
+		list, _ := m[name].([]interface{})
+		var schemas []*jsonSchema
+		for i, value := range list {
+			if err != nil {
+				return nil
+			}
+			var schema *jsonSchema
+			schema, err = c.compile(value, fmt.Sprintf("%s/%s/%d", pointer, name, i))
+			schemas = append(schemas, schema)
+		}
+		return schemas
+	}
+	number := func(name string) *float64 {
+		if v, ok := m[name].(float64); ok {
+			return &v
+		}
+		return nil
+	}
+	count := func(name string) *int {
+		if v, ok := m[name].(float64); ok {
+			n := int(v)
+			return &n
+		}
+		return nil
+	}
+	regex := func(expr, name string) *regexp.Regexp {
+		re, compileErr := regexp.Compile(expr)
+		if compileErr != nil && err == nil {
+			err = fmt.Errorf("%s/%s: %w", pointer, name, compileErr)
+		}
+		return re
+	}
+
+	if ref, ok := m["$ref"].(string); ok {
+		target, resolveErr := resolvePointer(c.root, ref)
+		if resolveErr != nil {
+			return nil, fmt.Errorf("%s/$ref: %w", pointer, resolveErr)
+		}
+		if s.ref, err = c.compile(target, ref); err != nil {
+			return nil, err
+		}
+	}
+	switch t := m["type"].(type) {
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, name := range t {
+			if name, ok := name.(string); ok {
+				s.types = append(s.types, name)
+			}
+		}
+	}
+	s.enum, _ = m["enum"].([]interface{})
+	s.constant, s.hasConst = m["const"]
+	s.minimum, s.maximum = number("minimum"), number("maximum")
+	s.exclusiveMinimum, s.exclusiveMaximum = number("exclusiveMinimum"), number("exclusiveMaximum")
+	s.multipleOf = number("multipleOf")
+	s.minLength, s.maxLength = count("minLength"), count("maxLength")
+	if expr, ok := m["pattern"].(string); ok {
+		s.pattern = regex(expr, "pattern")
+	}
+
+	s.prefixItems = subs("prefixItems")
+	if _, ok := m["items"].([]interface{}); ok {
+		// Draft 7 and earlier spell prefixItems as an items array, with additionalItems for the rest
+		s.prefixItems, s.items = subs("items"), sub("additionalItems")
+	} else {
+		s.items = sub("items")
+	}
+	s.contains = sub("contains")
+	s.minItems, s.maxItems = count("minItems"), count("maxItems")
+	s.minContains, s.maxContains = count("minContains"), count("maxContains")
+	s.uniqueItems, _ = m["uniqueItems"].(bool)
+
+	if properties, ok := m["properties"].(map[string]interface{}); ok {
+		s.properties = make(map[string]*jsonSchema, len(properties))
+		for name, value := range properties {
+			if err != nil {
+				break
+			}
+			s.properties[name], err = c.compile(value, pointer+"/properties/"+escapePointer(name))
+		}
+	}
+	if patterns, ok := m["patternProperties"].(map[string]interface{}); ok {
+		s.patternProperties = make(map[*regexp.Regexp]*jsonSchema, len(patterns))
+		for expr, value := range patterns {
+			re := regex(expr, "patternProperties")
+			if err != nil {
+				break
+			}
+			s.patternProperties[re], err = c.compile(value, pointer+"/patternProperties/"+escapePointer(expr))
+		}
+	}
+	s.additional = sub("additionalProperties")
+	s.propertyNames = sub("propertyNames")
+	required, _ := m["required"].([]interface{})
+	for _, name := range required {
+		if name, ok := name.(string); ok {
+			s.required = append(s.required, name)
+		}
+	}
+	s.minProps, s.maxProps = count("minProperties"), count("maxProperties")
+
+	s.allOf, s.anyOf, s.oneOf = subs("allOf"), subs("anyOf"), subs("oneOf")
+	s.not = sub("not")
+	s.ifSchema, s.thenSchema, s.elseSchema = sub("if"), sub("then"), sub("else")
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// The resolvePointer function resolves a $ref within the schema document: "#" or a JSON Pointer
+// fragment such as "#/$defs/answer". References to other documents are not supported.
+func resolvePointer(root interface{}, ref string) (interface{}, error) {
+	fragment, ok := strings.CutPrefix(ref, "#")
+	if !ok {
+		return nil, fmt.Errorf("unsupported reference %q, only references within the schema are supported", ref)
+	}
+	node := root
+	if fragment == "" {
+		return node, nil
+	}
+	for _, token := range strings.Split(strings.TrimPrefix(fragment, "/"), "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		switch v := node.(type) {
+		case map[string]interface{}:
+			if node, ok = v[token]; !ok {
+				return nil, fmt.Errorf("reference %q not found", ref)
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, fmt.Errorf("reference %q not found", ref)
+			}
+			node = v[i]
+		default:
+			return nil, fmt.Errorf("reference %q not found", ref)
+		}
+	}
+	return node, nil
+}
+
+// The escapePointer function escapes a name for use in a JSON Pointer.
+func escapePointer(name string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1")
+}
+
+// The `validateBody` method in the `jsonSchema` struct checks that a body is a JSON document matching
+// the schema. The error names the first failing location.
+func (s *jsonSchema) validateBody(body []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	if dec.More() {
+		return errors.New("invalid JSON: data after the document")
+	}
+	return s.validate(doc, "")
+}
+
+// The `validate` method in the `jsonSchema` struct checks a decoded JSON value against the schema;
+// path is the value's location in the document, as a JSON Pointer.
+func (s *jsonSchema) validate(value interface{}, path string) error {
+	fail := func(format string, args ...interface{}) error {
+		location := path
+		if location == "" {
+			location = "/"
+		}
+		return fmt.Errorf("%s: %s", location, fmt.Sprintf(format, args...))
+	}
+	if s.always != nil {
+		if !*s.always {
+			return fail("not allowed")
+		}
+		return nil
+	}
+	if s.ref != nil {
+		if err := s.ref.validate(value, path); err != nil {
+			return err
+		}
+	}
+	if len(s.types) > 0 && !slices.ContainsFunc(s.types, func(t string) bool { return jsonTypeIs(value, t) }) {
+		return fail("expected %s, got %s", strings.Join(s.types, " or "), jsonTypeOf(value))
+	}
+	if s.enum != nil && !slices.ContainsFunc(s.enum, func(v interface{}) bool { return reflect.DeepEqual(v, value) }) {
+		return fail("value is not one of the allowed values")
+	}
+	if s.hasConst && !reflect.DeepEqual(s.constant, value) {
+		return fail("value does not equal the constant")
+	}
+
+	switch v := value.(type) {
+	case float64:
+		if s.minimum != nil && v < *s.minimum {
+			return fail("%v is less than %v", v, *s.minimum)
+		}
+		if s.maximum != nil && v > *s.maximum {
+			return fail("%v is greater than %v", v, *s.maximum)
+		}
+		if s.exclusiveMinimum != nil && v <= *s.exclusiveMinimum {
+			return fail("%v is not greater than %v", v, *s.exclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && v >= *s.exclusiveMaximum {
+			return fail("%v is not less than %v", v, *s.exclusiveMaximum)
+		}
+		if s.multipleOf != nil && *s.multipleOf > 0 {
+			if q := v / *s.multipleOf; math.Abs(q-math.Round(q)) > 1e-9 {
+				return fail("%v is not a multiple of %v", v, *s.multipleOf)
+			}
+		}
+
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.minLength != nil && length < *s.minLength {
+			return fail("string shorter than %d characters", *s.minLength)
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			return fail("string longer than %d characters", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fail("string does not match %s", s.pattern)
+		}
+
+	case []interface{}:
+		if s.minItems != nil && len(v) < *s.minItems {
+			return fail("fewer than %d items", *s.minItems)
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			return fail("more than %d items", *s.maxItems)
+		}
+		for i, item := range v {
+			itemPath := path + "/" + strconv.Itoa(i)
+			var err error
+			switch {
+			case i < len(s.prefixItems):
+				err = s.prefixItems[i].validate(item, itemPath)
+			case s.items != nil:
+				err = s.items.validate(item, itemPath)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if s.uniqueItems {
+			for i := range v {
+				for j := i + 1; j < len(v); j++ {
+					if reflect.DeepEqual(v[i], v[j]) {
+						return fail("items %d and %d are equal", i, j)
+					}
+				}
+			}
+		}
+		if s.contains != nil {
+			matches := 0
+			for i, item := range v {
+				if s.contains.validate(item, path+"/"+strconv.Itoa(i)) == nil {
+					matches++
+				}
+			}
+			minContains := 1
+			if s.minContains != nil {
+				minContains = *s.minContains
+			}
+			if matches < minContains {
+				return fail("fewer than %d items match contains", minContains)
+			}
+			if s.maxContains != nil && matches > *s.maxContains {
+				return fail("more than %d items match contains", *s.maxContains)
+			}
+		}
+
+	case map[string]interface{}:
+		if s.minProps != nil && len(v) < *s.minProps {
+			return fail("fewer than %d properties", *s.minProps)
+		}
+		if s.maxProps != nil && len(v) > *s.maxProps {
+			return fail("more than %d properties", *s.maxProps)
+		}
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				return fail("missing required property %q", name)
+			}
+		}
+		// Properties are checked in order so that the reported error doesn't change between fetches
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			propertyPath := path + "/" + escapePointer(name)
+			if s.propertyNames != nil {
+				if err := s.propertyNames.validate(name, propertyPath); err != nil {
+					return err
+				}
+			}
+			matched := false
+			if schema, ok := s.properties[name]; ok {
+				matched = true
+				if err := schema.validate(v[name], propertyPath); err != nil {
+					return err
+				}
+			}
+			for re, schema := range s.patternProperties {
+				if re.MatchString(name) {
+					matched = true
+					if err := schema.validate(v[name], propertyPath); err != nil {
+						return err
+					}
+				}
+			}
+			if !matched && s.additional != nil {
+				if err := s.additional.validate(v[name], propertyPath); err != nil {
+					if s.additional.always != nil {
+						return fail("unexpected property %q", name)
+					}
+					return err
+				}
+			}
+		}
+	}
+
+	for _, schema := range s.allOf {
+		if err := schema.validate(value, path); err != nil {
+			return err
+		}
+	}
+	if s.anyOf != nil && !slices.ContainsFunc(s.anyOf, func(schema *jsonSchema) bool { return schema.validate(value, path) == nil }) {
+		return fail("value matches none of anyOf")
+	}
+	if s.oneOf != nil {
+		matches := 0
+		for _, schema := range s.oneOf {
+			if schema.validate(value, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fail("value matches %d of oneOf instead of exactly one", matches)
+		}
+	}
+	if s.not != nil && s.not.validate(value, path) == nil {
+		return fail("value matches not")
+	}
+	if s.ifSchema != nil {
+		if s.ifSchema.validate(value, path) == nil {
+			if s.thenSchema != nil {
+				return s.thenSchema.validate(value, path)
+			}
+		} else if s.elseSchema != nil {
+			return s.elseSchema.validate(value, path)
+		}
+	}
+	return nil
+}
+
+// The jsonTypeIs function reports whether a decoded JSON value has the named JSON Schema type.
+func jsonTypeIs(value interface{}, name string) bool {
+	if name == "integer" {
+		v, ok := value.(float64)
+		return ok && v == math.Trunc(v)
+	}
+	return jsonTypeOf(value) == name
+}
+
+// The jsonTypeOf function returns the JSON Schema type name of a decoded JSON value.
+func jsonTypeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
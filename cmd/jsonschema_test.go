@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+// The compileSchema function compiles a JSON Schema document, failing the test if it is invalid.
+func compileSchema(t *testing.T, doc string) (*jsonSchema, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(path, []byte(doc), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	schema, err := loadJSONSchema(path)
+	if err != nil {
+		t.Fatalf("loadJSONSchema: %v", err)
+	}
+	return schema, path
+}
+
+func TestJSONSchema(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		schema  string
+		valid   []string
+		invalid []string
+	}{
+		{"type", `{"type": ["string", "null"]}`, []string{`"a"`, `null`}, []string{`1`, `{}`}},
+		{"integer", `{"type": "integer"}`, []string{`1`, `1.0`}, []string{`1.5`, `"1"`}},
+		{"enum and const", `{"enum": [1, "a", {"b": true}], "not": {"const": "a"}}`, []string{`1`, `{"b": true}`}, []string{`"a"`, `2`}},
+		{"numbers", `{"minimum": 1, "exclusiveMaximum": 10, "multipleOf": 0.5}`, []string{`1`, `9.5`}, []string{`0.5`, `10`, `1.2`}},
+		{"strings", `{"minLength": 2, "maxLength": 3, "pattern": "^\\p{Ll}+$"}`, []string{`"ab"`, `"été"`}, []string{`"a"`, `"abcd"`, `"AB"`}},
+		{"objects", `{
+			"type": "object",
+			"required": ["id"],
+			"properties": {"id": {"type": "integer"}},
+			"patternProperties": {"^x-": {"type": "string"}},
+			"additionalProperties": false,
+			"maxProperties": 2
+		}`, []string{`{"id": 1}`, `{"id": 1, "x-a": "b"}`}, []string{`{}`, `{"id": "1"}`, `{"id": 1, "x-a": 1}`, `{"id": 1, "other": 1}`}},
+		{"arrays", `{
+			"prefixItems": [{"type": "string"}],
+			"items": {"type": "integer"},
+			"contains": {"const": 0},
+			"maxContains": 1,
+			"uniqueItems": true
+		}`, []string{`["a", 0]`, `["a", 0, 1]`}, []string{`[1, 0]`, `["a", 1]`, `["a", 0, 0]`, `["a", 0, "b"]`}},
+		{"combinators", `{
+			"oneOf": [{"type": "integer"}, {"minimum": 2}],
+			"anyOf": [{"type": "number"}]
+		}`, []string{`1`, `2.5`}, []string{`2`, `"a"`}},
+		{"conditional", `{
+			"if": {"properties": {"kind": {"const": "a"}}},
+			"then": {"required": ["a"]},
+			"else": {"required": ["b"]}
+		}`, []string{`{"kind": "a", "a": 1}`, `{"kind": "b", "b": 1}`}, []string{`{"kind": "a", "b": 1}`, `{"kind": "b"}`}},
+		{"recursive ref", `{
+			"$defs": {"node": {"type": "object", "properties": {"children": {"type": "array", "items": {"$ref": "#/$defs/node"}}}}},
+			"$ref": "#/$defs/node"
+		}`, []string{`{"children": [{"children": []}]}`}, []string{`{"children": [{"children": [1]}]}`}},
+		{"false", `{"properties": {"secret": false}}`, []string{`{"public": 1}`}, []string{`{"secret": 1}`}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			schema, _ := compileSchema(t, test.schema)
+			for _, doc := range test.valid {
+				if err := schema.validateBody([]byte(doc)); err != nil {
+					t.Errorf("validateBody(%s): %v", doc, err)
+				}
+			}
+			for _, doc := range test.invalid {
+				if err := schema.validateBody([]byte(doc)); err == nil {
+					t.Errorf("validateBody(%s): got no error", doc)
+				}
+			}
+		})
+	}
+
+	schema, _ := compileSchema(t, `true`)
+	if err := schema.validateBody([]byte(`{"a": `)); err == nil {
+		t.Error("validateBody of a truncated document: got no error")
+	}
+}
+
+func TestJSONSchemaInvalid(t *testing.T) {
+	for _, doc := range []string{`[]`, `{"$ref": "#/$defs/missing"}`, `{"pattern": "("}`, `{`} {
+		path := filepath.Join(t.TempDir(), "schema.json")
+		os.WriteFile(path, []byte(doc), 0o600)
+		if _, err := loadJSONSchema(path); err == nil {
+			t.Errorf("loadJSONSchema(%s): got no error", doc)
+		}
+	}
+}
+
+func TestProxyValidatesSchema(t *testing.T) {
+	useTestCache(t, cache.Options{})
+	var body atomic.Value
+	body.Store(`{"id": "one"}`)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(body.Load().(string)))
+	}))
+	defer target.Close()
+	schema, path := compileSchema(t, `{"type": "object", "required": ["id"], "properties": {"id": {"type": "integer"}}}`)
+	setVar(t, &routes, []route{{Prefix: target.URL, Schema: schema, SchemaFile: path}})
+
+	if w := proxyGet(target.URL); w.Code != http.StatusBadGateway {
+		t.Fatalf("request for an invalid response: got %d %q, want 502", w.Code, w.Body)
+	}
+	if proxyCache.Stats().Entries != 0 {
+		t.Fatal("request for an invalid response: got it cached")
+	}
+	body.Store(`{"id": 1}`)
+	if w := proxyGet(target.URL); w.Code != http.StatusOK || w.Body.String() != `{"id": 1}` {
+		t.Fatalf("request for a valid response: got %d %q", w.Code, w.Body)
+	}
+	if proxyCache.Stats().Entries != 1 {
+		t.Fatal("request for a valid response: got it not cached")
+	}
+
+	err := routes[0].validate("GET", http.StatusOK, []byte(`{}`))
+	if !errors.Is(err, errInvalidPayload) {
+		t.Fatalf("validate: got error %v, want errInvalidPayload", err)
+	}
+	if err := routes[0].validate("GET", http.StatusNotFound, []byte(`not found`)); err != nil {
+		t.Fatalf("validate of a 404: %v", err)
+	}
+}
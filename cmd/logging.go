@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// logFormat is the -log-format output format: text or json.
+var logFormat = "text"
+
+// logLevel is the -log-level threshold below which records are dropped.
+var logLevel slog.LevelVar
+
+func init() {
+	flag.Func("log-format", "format of the logs written to stderr: text (key=value pairs) or json (one object per line, for log aggregation pipelines) (default text)", func(value string) error {
+		if value != "text" && value != "json" {
+			return fmt.Errorf("expected text or json, got %q", value)
+		}
+		logFormat = value
+		return nil
+	})
+	flag.TextVar(&logLevel, "log-level", &logLevel, "minimum level of the logs written: debug (which also traces how each request is served), info, warn or error")
+}
+
+// The setupLogging function makes the -log-format handler the default slog logger. Messages of the log
+// package, such as those of net/http, go through it too.
+func setupLogging() {
+	options := &slog.HandlerOptions{Level: &logLevel}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if logFormat == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// The fatal function logs an error that prevents the server from running and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// The logRequest function writes the access log record of a finished proxied request.
+func logRequest(event *cacheEvent) {
+	slog.Info("Request",
+		"method", event.Method,
+		"target", event.URL,
+		"status", event.Status,
+		"cache", event.Outcome,
+		"latency_ms", event.LatencyMs,
+		"bytes", event.Size,
+		"client", event.Client,
+	)
+}
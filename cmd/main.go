@@ -1,66 +1,487 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go-proxy-cache/pkg/cache"
 )
 
-type CacheEntry struct {
-	Response *http.Response
-	Body     []byte
+var ttl = flag.Duration("ttl", 0, "time cached responses stay fresh before they are fetched from the target server again, 0 to keep them until they are removed")
+
+var staleRetention = flag.Duration("stale-retention", time.Hour, "how long expired entries are kept so they can be revalidated with a conditional request (If-None-Match / If-Modified-Since) instead of downloaded again")
+
+var sweepInterval = flag.Duration("sweep-interval", time.Minute, "how often expired entries are removed from memory, 0 to only remove them when they are looked up")
+
+var maxBytes = flag.Int64("max-bytes", 0, "memory budget for cached response bodies in bytes; least recently used entries are evicted to stay within it, 0 for unlimited")
+
+// evictionPolicy is the cache.Policy selected by -eviction-policy.
+var evictionPolicy cache.Policy
+
+func init() {
+	flag.Func("eviction-policy", "entries evicted when -max-bytes is reached: lru, lfu (least frequently used of the oldest entries) or tinylfu (lru, admitting new entries only when requested more often than the ones they replace) (default lru)", func(value string) (err error) {
+		evictionPolicy, err = cache.ParsePolicy(value)
+		return err
+	})
+}
+
+// proxyCache holds every response cached by the proxy server. It is created once the flags are parsed.
+var proxyCache *cache.Cache
+
+var dryRun = flag.Bool("dry-run", false, "run the full caching decision pipeline but always forward to the target, logging what would have been served from cache")
+
+var versionHeader = flag.String("version-header", "", "upstream response header carrying the origin's deployment version (e.g. X-App-Version); a new version makes previously cached entries unreachable")
+
+// versionTracker remembers the latest deployment version advertised by each origin so that cache
+// entries can be namespaced per origin version.
+type versionTracker struct {
+	versions map[string]string
+	mutex    sync.Mutex
+}
+
+var versions = &versionTracker{versions: make(map[string]string)}
+
+// The `namespace` method in the `versionTracker` struct returns the cache namespace holding entries for
+// the current version of the given origin.
+func (v *versionTracker) namespace(origin string) string {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return origin + "@" + v.versions[origin]
 }
 
-type Cache struct {
-	entries map[string]CacheEntry
-	mutex   sync.RWMutex
+// The `observe` method in the `versionTracker` struct records a version seen on a response from the
+// given origin. When the version differs from the current one it returns the namespace of the
+// previous version, which no longer receives lookups.
+func (v *versionTracker) observe(origin, version string) (previous string, changed bool) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	current, ok := v.versions[origin]
+	if ok && current == version {
+		return "", false
+	}
+	v.versions[origin] = version
+	return origin + "@" + current, true
 }
 
-// The NewCache function creates and returns a new Cache instance with an empty map of entries.
-func NewCache() *Cache {
-	return &Cache{
-		entries: make(map[string]CacheEntry),
+// The observeVersion function records the deployment version an origin advertises in its
+// -version-header. A new deployment makes everything cached for the previous version unreachable, so
+// it is dropped.
+func observeVersion(target *url.URL, header http.Header) {
+	version := header.Get(*versionHeader)
+	if *versionHeader == "" || version == "" {
+		return
 	}
+	origin := target.Scheme + "://" + target.Host
+	if previous, changed := versions.observe(origin, version); changed {
+		dropped := proxyCache.DropNamespace(previous)
+		recordPurge(purgeRecord{Who: "origin", Tenant: hostTenant(target.Hostname()), Kind: "version change", URLs: []string{origin}, Entries: dropped})
+		slog.Info("Origin advertised a new version, dropped its entries", "origin", origin, "version", version, "dropped", dropped)
+	}
+}
+
+// The contentETag function returns a strong ETag derived from the SHA-256 hash of the body, used when
+// the origin did not provide a validator of its own.
+func contentETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
 }
 
-// The `Set` method in the `Cache` struct is used to set a cache entry in the cache map.
-func (c *Cache) Set(key string, entry CacheEntry) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	c.entries[key] = entry
+// The etagMatches function reports whether an If-None-Match header value matches the given ETag using
+// the weak comparison required for If-None-Match (RFC 9110, section 13.1.2).
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
 }
 
-// The `Get` method in the `Cache` struct is used to retrieve a cache entry based on a given key.
-func (c *Cache) Get(key string) (CacheEntry, bool) {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-	entry, ok := c.entries[key]
-	return entry, ok
+// The notModified function reports whether a cached entry can be answered with a 304 Not Modified
+// for the given client request.
+func notModified(r *http.Request, entry cache.Entry) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if entry.Response.StatusCode != http.StatusOK {
+		return false
+	}
+	return etagMatches(r.Header.Get("If-None-Match"), entry.ETag)
+}
+
+var exposeCacheKey = flag.Bool("x-cache-key", false, "add an X-Cache-Key header with the cache key (Authorization redacted) to proxied responses")
+
+// The setCacheStatus function tells the client how a response was served, with an X-Cache header of
+// HIT, MISS, STALE, REVALIDATED, BYPASS or STATIC, so cache behaviour can be checked without the server
+// logs.
+func setCacheStatus(w http.ResponseWriter, r *http.Request, event *cacheEvent) {
+	w.Header().Set("X-Cache", strings.ToUpper(event.Outcome))
+	if *exposeCacheKey {
+		key := event.Key
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			key = strings.ReplaceAll(key, auth, "[REDACTED]")
+		}
+		w.Header().Set("X-Cache-Key", key)
+	}
 }
 
-// The `Debug()` method in the `Cache` struct is used to retrieve debug information from the cache. It
-// iterates over all entries in the cache, extracts relevant information from each entry (such as URL,
-// HTTP method, response status, and response body size), and stores this information in a map with
-// string keys and interface{} values. This map is then returned as the debug information.
-func (c *Cache) Debug() map[string]interface{} {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-	debug := make(map[string]interface{})
-	for key, entry := range c.entries {
-		debug[key] = map[string]interface{}{
-			"URL":    entry.Response.Request.URL.String(),
-			"Method": entry.Response.Request.Method,
-			"Status": entry.Response.Status,
-			"Size":   len(entry.Body),
+// The setAge function sets the Age header of a response served from a stored entry to the entry's
+// current age as defined by RFC 9111: the age it had when it was stored, taken from its Age header or
+// the time since its Date, plus the time it has been in the cache since. Responses passed through from
+// the target server keep the Age header it sent.
+func setAge(w http.ResponseWriter, entry cache.Entry) {
+	if entry.StoredAt.IsZero() {
+		return
+	}
+	initial := ageHeader(entry.Response.Header)
+	if date, err := http.ParseTime(entry.Response.Header.Get("Date")); err == nil {
+		initial = max(initial, entry.StoredAt.Sub(date))
+	}
+	age := initial + time.Since(entry.StoredAt)
+	w.Header().Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+}
+
+// The writeEntry function writes a cached entry to the client, answering with 304 Not Modified when
+// the client already holds the current representation, and with 206 Partial Content when it asks for a
+// byte range of it. A body kept in chunks is read from the store a chunk at a time.
+func writeEntry(w http.ResponseWriter, r *http.Request, entry cache.Entry) {
+	if writeFilteredJSON(w, r, entry) {
+		return
+	}
+	coding, variant, encoded := acceptedVariant(r, entry)
+	body := entry.Body
+	if storedCompressed(entry) && !encoded && r.Method != "HEAD" {
+		decoded, err := entryBody(entry)
+		if err != nil {
+			slog.Error("Error decompressing cached body", "target", entry.Response.Request.URL, "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		body = decoded
+	}
+	// Clipped slices make values added to the response copy instead of writing to the shared entry
+	for k, v := range entry.Response.Header {
+		w.Header()[k] = slices.Clip(v)
+	}
+	setAge(w, entry)
+	length := bodyLength(entry)
+	if len(entry.Variants) > 0 {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if encoded {
+			// Each encoding is a different representation, with its own ETag
+			body, length = variant, len(variant)
+			w.Header().Set("Content-Encoding", coding)
+			w.Header().Set("Content-Length", strconv.Itoa(length))
+			if entry.ETag != "" {
+				entry.ETag = strings.TrimSuffix(entry.ETag, `"`) + "-" + coding + `"`
+			}
+		}
+	}
+	if entry.ETag != "" {
+		w.Header().Set("ETag", entry.ETag)
+	}
+	if notModified(r, entry) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if entry.Response.StatusCode == http.StatusOK {
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+	if r.Method == "HEAD" {
+		// A HEAD answered from a GET entry advertises the length of the body it would get
+		if entry.Response.Request.Method == "GET" {
+			w.Header().Set("Content-Length", strconv.Itoa(length))
+		}
+		w.WriteHeader(entry.Response.StatusCode)
+		return
+	}
+	status, offset, count := entry.Response.StatusCode, int64(0), int64(length)
+	if rangeable(r, entry) {
+		first, n, ranged, satisfiable := requestedRange(r, entry, int64(length))
+		if !satisfiable {
+			w.Header().Del("Content-Length")
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", length))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if ranged {
+			status, offset, count = http.StatusPartialContent, first, n
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, first+n-1, length))
+			w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+		}
+	}
+	if entry.BodySize > 0 && !encoded {
+		writeChunkedBody(w, r, entry, status, offset, count)
+		return
+	}
+	w.WriteHeader(status)
+	if err := writeBody(w, body[offset:offset+count]); err != nil {
+		slog.Warn("Error writing response", "client", clientIP(r), "error", err)
+	}
+}
+
+// The writeChunkedBody function writes count bytes from offset of a body kept in chunks, with the
+// given status. Should its first chunk be missing or corrupt, the client gets an error instead, and the
+// entry is fetched again by the next request.
+func writeChunkedBody(w http.ResponseWriter, r *http.Request, entry cache.Entry, status int, offset, count int64) {
+	wrote := false
+	err := proxyCache.ReadBody(entry, offset, count, func(p []byte) error {
+		if !wrote {
+			w.WriteHeader(status)
+			wrote = true
+		}
+		return writeBody(w, p)
+	})
+	switch {
+	case err != nil && !wrote:
+		slog.Error("Error reading cached body", "target", entry.Response.Request.URL, "error", err)
+		for _, name := range []string{"Accept-Ranges", "Content-Encoding", "Content-Length", "Content-Range", "ETag", "Last-Modified"} {
+			w.Header().Del(name)
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	case err != nil:
+		slog.Warn("Error writing response", "client", clientIP(r), "error", err)
+	case !wrote:
+		w.WriteHeader(status)
+	}
+}
+
+var identityHeader = flag.String("identity-header", "", "request header identifying the end user (e.g. X-User-ID injected by an auth layer); responses are cached separately per identity")
+
+var identityQuota = flag.Int("identity-quota", 0, "maximum number of entries cached per identity, 0 for unlimited")
+
+// The buildCacheKey function returns the key under which the response to a request for the target URL
+// is cached. CORS preflight responses depend on the preflight headers, so OPTIONS keys include them.
+// With -identity-header, every identity gets its own entries. Query parameters the target's route
+// ignores are left out.
+func buildCacheKey(method string, target *url.URL, header http.Header) string {
+	key := method + " " + routeFor(target).keyURL(target).String() + " " + header.Get("Content-Type") + " " + header.Get("Authorization")
+	if method == "OPTIONS" {
+		key += " " + header.Get("Origin") + " " + header.Get("Access-Control-Request-Method") + " " + header.Get("Access-Control-Request-Headers")
+	}
+	if *identityHeader != "" {
+		key += " " + header.Get(*identityHeader)
+	}
+	return key
+}
+
+// The requestIdentity function returns the identity of the client making a request, or an empty
+// string when per-identity caching is disabled or the request is anonymous.
+func requestIdentity(header http.Header) string {
+	if *identityHeader == "" {
+		return ""
+	}
+	return header.Get(*identityHeader)
+}
+
+// The withinIdentityQuota function reports whether an entry may be cached for the given identity
+// without exceeding -identity-quota. Replacing an existing entry is always allowed.
+func withinIdentityQuota(namespace *cache.Namespace, key, identity string) bool {
+	if identity == "" || *identityQuota <= 0 {
+		return true
+	}
+	if _, ok := namespace.Peek(key); ok {
+		return true
+	}
+	return proxyCache.IdentityEntries(identity) < *identityQuota
+}
+
+// The originNamespace function returns the cache namespace holding entries for the target's origin,
+// which is the default namespace unless entries are versioned with -version-header.
+func originNamespace(target *url.URL) *cache.Namespace {
+	if *versionHeader == "" {
+		return proxyCache.Namespace(cache.DefaultNamespace)
+	}
+	return proxyCache.Namespace(versions.namespace(target.Scheme + "://" + target.Host))
+}
+
+// methodRule enables caching of a method for targets starting with Prefix (every target when empty).
+type methodRule struct {
+	Method string
+	Prefix string
+}
+
+// cacheMethodRules holds the -cache-method rules. GET and POST responses are always cached.
+var cacheMethodRules []methodRule
+
+func init() {
+	flag.Func("cache-method", "enable caching for a safe method (HEAD or OPTIONS) as METHOD or METHOD=<target URL prefix>; may be repeated", func(value string) error {
+		method, prefix, _ := strings.Cut(value, "=")
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method != "HEAD" && method != "OPTIONS" {
+			return fmt.Errorf("only HEAD and OPTIONS can be enabled, got %q", method)
+		}
+		cacheMethodRules = append(cacheMethodRules, methodRule{Method: method, Prefix: strings.TrimSpace(prefix)})
+		return nil
+	})
+}
+
+// The methodCacheable function reports whether responses to the given method are cached for the
+// target. Methods other than GET and POST are only forwarded unless enabled with -cache-method.
+func methodCacheable(method string, target *url.URL) bool {
+	if method == "GET" || method == "POST" {
+		return true
+	}
+	for _, rule := range cacheMethodRules {
+		if rule.Method == method && strings.HasPrefix(target.String(), rule.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var headPrefetch = newListFlag("head-prefetch", "comma-separated target URL prefixes (or * for every target) whose HEAD requests are forwarded as GET, so the body is cached and the following GET is a hit")
+
+// The prefetchOnHead function reports whether a HEAD request for the target is upgraded to a GET.
+func prefetchOnHead(target *url.URL) bool {
+	for _, prefix := range *headPrefetch {
+		if prefix == "*" || strings.HasPrefix(target.String(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var maxUploadBytes = flag.Int64("max-upload-bytes", 0, "maximum size of a request body forwarded to the target server, 0 for unlimited")
+
+var bypassCookies = newListFlag("bypass-cookies", "comma-separated session cookie names whose presence bypasses the cache (a trailing * matches a prefix, e.g. wordpress_logged_in_*)")
+
+// The sessionCookie function returns the name of the first cookie on the request that marks a logged-in
+// session according to -bypass-cookies.
+func sessionCookie(r *http.Request) (string, bool) {
+	for _, cookie := range r.Cookies() {
+		for _, name := range *bypassCookies {
+			if prefix, ok := strings.CutSuffix(name, "*"); (ok && strings.HasPrefix(cookie.Name, prefix)) || cookie.Name == name {
+				return cookie.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+var stripResponseHeaders = newListFlag("strip-response-headers", "comma-separated target server response headers removed before responses are cached and served (e.g. Set-Cookie,Server,X-Debug-Token)")
+
+var allowResponseHeaders = newListFlag("allow-response-headers", "comma-separated allowlist of target server response headers kept when responses are cached and served; all others are removed (default: keep all)")
+
+// The filterResponseHeaders function applies -allow-response-headers and -strip-response-headers to a
+// target server's response headers. It runs once, when a response is fetched, so cached entries never
+// contain the removed headers.
+func filterResponseHeaders(header http.Header) {
+	if len(*allowResponseHeaders) > 0 {
+		allowed := make(map[string]bool, len(*allowResponseHeaders))
+		for _, name := range *allowResponseHeaders {
+			allowed[http.CanonicalHeaderKey(name)] = true
+		}
+		for name := range header {
+			if !allowed[name] {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range *stripResponseHeaders {
+		header.Del(name)
+	}
+}
+
+// The fetchEntry function sends a request to the target server and reads the full response into a
+// cache entry, deriving a content-hash ETag when the target server didn't provide one. The request is
+// bounded by the connect, time-to-first-byte and transfer timeouts of its route. With -chunk-bytes, a
+// large body is written to the store in chunks instead (see fillEntry), resuming an interrupted fill.
+func fetchEntry(req *http.Request) (cache.Entry, error) {
+	fill, offset := "", int64(0)
+	if chunking(req) {
+		fill = buildCacheKey(req.Method, req.URL, req.Header)
+		req, offset = resumeFill(req, fill)
+	}
+	req, gotHeaders, cancel := timeoutsFor(req.URL).apply(req)
+	defer cancel()
+	start := time.Now()
+	resp, err := upstreamClient.Do(req)
+	gotHeaders()
+	if err != nil {
+		observeUpstreamMetrics(req.URL, 0, start)
+		return cache.Entry{}, fmt.Errorf("forwarding request: %w", timeoutCause(req, err))
+	}
+	defer resp.Body.Close()
+	defer observeUpstreamMetrics(req.URL, resp.StatusCode, start)
+
+	// The target server sends the whole body again when it changed since the fill was interrupted
+	if offset > 0 && !resumes(resp, offset) {
+		proxyCache.DiscardFill(fill)
+		if resp.StatusCode != http.StatusOK {
+			return cache.Entry{}, fmt.Errorf("resuming response body: target server answered %s", resp.Status)
 		}
+		offset = 0
+	}
+	if fill != "" && (offset > 0 || chunkable(req, resp)) {
+		return fillEntry(req, resp, fill, offset)
+	}
+
+	// Read the response body
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return cache.Entry{}, fmt.Errorf("reading response body: %w", timeoutCause(req, err))
 	}
-	return debug
+
+	// Malformed output of the target server is rejected before it can be served or cached
+	if err := routeFor(req.URL).validate(req.Method, resp.StatusCode, body); err != nil {
+		return cache.Entry{}, err
+	}
+
+	header, tags := responseHeader(req, resp)
+	etag := header.Get("ETag")
+	if etag == "" {
+		etag = contentETag(body)
+	}
+	return cache.Entry{
+		Response: cache.ResponseRecord{StatusCode: resp.StatusCode, Header: header, Request: compactRequest(req)},
+		Body:     body,
+		ETag:     etag,
+		JSON:     decodeJSON(header, body),
+		Tags:     tags,
+	}, nil
 }
 
-var cache = NewCache()
+// The responseHeader function returns the header of a target server response as it is cached, with
+// -allow-response-headers, -strip-response-headers and the per-entry limits applied, together with the
+// response's surrogate keys. It also records the target's HSTS policy and origin version first, as the
+// filters may remove their headers.
+func responseHeader(req *http.Request, resp *http.Response) (http.Header, []string) {
+	rememberHSTS(req.URL, resp.Header)
+	observeVersion(req.URL, resp.Header)
+	tags := surrogateKeys(resp.Header)
+	filterResponseHeaders(resp.Header)
+	header, dropped := compactHeader(resp.Header)
+	if dropped > 0 {
+		slog.Info("Dropped response header fields exceeding the per-entry limits", "target", req.URL.String(), "dropped", dropped)
+	}
+	return header, tags
+}
 
 // The `proxyHandler` function serves as a proxy that forwards HTTP requests to a target server, caches
 // responses, and forwards the responses back to the client.
@@ -72,99 +493,383 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	targetURL, err := url.Parse(targetURLParam)
+	targetURL, err := parseTarget(targetURLParam)
 	if err != nil {
 		http.Error(w, "Invalid 'target' URL", http.StatusBadRequest)
 		return
 	}
+	if override := r.Header.Get("X-Upstream-Override"); override != "" {
+		if targetURL, err = overrideUpstream(r, targetURL); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errOverrideForbidden) {
+				status = http.StatusForbidden
+			}
+			http.Error(w, http.StatusText(status)+": "+err.Error(), status)
+			return
+		}
+		slog.Info("Routing request with X-Upstream-Override", "target", targetURLParam, "override", override)
+		targetURLParam = targetURL.String()
+	}
+	if err := secureTarget(targetURL); err != nil {
+		http.Error(w, "Invalid 'target' URL: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	targetURLParam = targetURL.String()
 
-	// Check if the response is cached
-	cacheKey := r.Method + " " + targetURL.String() + " " + r.Header.Get("Content-Type") + " " + r.Header.Get("Authorization")
-	if cachedEntry, ok := cache.Get(cacheKey); ok {
-		log.Printf("Serving cached response for %s\n", targetURL.String())
+	client := clientIP(r)
+	route := routeFor(targetURL)
+	if route.injectFault(w, r, targetURL, client) {
+		return
+	}
+	if route.Respond != 0 {
+		route.serveSynthetic(w, r, targetURL, client)
+		return
+	}
+	normalizeRequestHeader(r.Header)
 
-		// Copy headers from cached response
-		for k, v := range cachedEntry.Response.Header {
-			w.Header()[k] = v
+	// A HEAD upgraded to a GET shares the GET's entry, and is answered from its headers
+	method := r.Method
+	if method == "HEAD" && prefetchOnHead(targetURL) {
+		method = "GET"
+	}
+
+	// Check if the response is cached, in the variant matching the request's headers
+	baseKey := buildCacheKey(method, targetURL, r.Header)
+	cacheKey := lookupKey(baseKey, r.Header)
+	namespace := originNamespace(targetURL)
+	var cachedEntry cache.Entry
+	cached := false
+	cacheable := methodCacheable(method, targetURL)
+	if session, ok := sessionCookie(r); ok && cacheable {
+		slog.Debug("Bypassing cache for session cookie", "target", targetURL.String(), "cookie", session)
+		cacheable = false
+	}
+	if reason, ok := route.bypassReason(targetURL); ok && cacheable {
+		slog.Debug("Bypassing cache", "target", targetURL.String(), "reason", reason)
+		cacheable = false
+	}
+	event := newCacheEvent(r, targetURL, cacheKey, client)
+	defer recordCacheEvent(event)
+	event.Outcome = "bypass"
+	if cacheable {
+		event.Outcome = "miss"
+		cachedEntry, cached = namespace.Get(cacheKey)
+		if cached {
+			hotHits.offer(cacheKey)
+		} else {
+			hotMisses.offer(cacheKey)
 		}
-		w.WriteHeader(cachedEntry.Response.StatusCode)
-		w.Write(cachedEntry.Body)
+	}
+	// An expired entry that is still retained can be revalidated instead of downloaded again
+	var stale cache.Entry
+	hasStale := false
+	if cacheable && !cached && method == "GET" {
+		stale, hasStale = namespace.GetStale(cacheKey)
+	}
+	// Within the route's stale-while-revalidate window the stale entry is served right away
+	if hasStale && !*dryRun && route.serveStale(stale, time.Now()) {
+		slog.Debug("Serving stale response while revalidating", "target", targetURL.String(), "client", client)
+		event.Outcome, event.Status, event.Size = "stale", stale.Response.StatusCode, bodyLength(stale)
+		revalidateInBackground(namespace, cacheKey, stale)
+		setCacheStatus(w, r, event)
+		writeEntry(w, r, stale)
+		return
+	}
+	if cached && !*dryRun {
+		slog.Debug("Serving cached response", "target", targetURL.String(), "client", client)
+		event.Outcome, event.Status, event.Size = "hit", cachedEntry.Response.StatusCode, bodyLength(cachedEntry)
+		maybePrecompress(namespace, cacheKey, cachedEntry)
+		setCacheStatus(w, r, event)
+		writeEntry(w, r, cachedEntry)
 		return
 	}
 
-	resp := &http.Response{}
+	var req *http.Request
+	conditional := false
 	contentType := r.Header.Get("Content-Type")
 	// Forward the request to the target server
-	if r.Method == "GET" {
-		log.Printf("Forwarding request to %s\n", targetURLParam)
+	if method == "GET" {
+		slog.Debug("Forwarding request", "target", targetURLParam, "client", client)
 
 		// forward headers to target
-		req, err := http.NewRequest("GET", targetURL.String(), nil)
+		req, err = http.NewRequest("GET", targetURL.String(), nil)
 		if err != nil {
+			event.Outcome, event.Status = "error", http.StatusInternalServerError
 			http.Error(w, "Error creating request: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
-		req.Header = r.Header
-
-		resp, err = http.DefaultClient.Do(req)
-		if err != nil {
-			http.Error(w, "Error forwarding request: "+err.Error(), http.StatusInternalServerError)
-			return
+		// Conditional headers and ranges are answered locally, so the cache is always filled with a full
+		// response
+		req.Header = r.Header.Clone()
+		req.Header.Del("If-None-Match")
+		req.Header.Del("If-Modified-Since")
+		if cacheable {
+			req.Header.Del("Range")
+			req.Header.Del("If-Range")
+			req = withChunking(req)
+		}
+		if hasStale && !*dryRun {
+			conditional = addValidators(req, stale)
 		}
 	}
 
-	if r.Method == "POST" {
-		log.Printf("Forwarding request to %s\n", targetURLParam)
+	if method != "GET" {
+		slog.Debug("Forwarding request", "target", targetURLParam, "client", client)
+
+		body := r.Body
+		if r.ContentLength != 0 && *maxUploadBytes > 0 {
+			if r.ContentLength > *maxUploadBytes {
+				event.Outcome, event.Status = "error", http.StatusRequestEntityTooLarge
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			body = http.MaxBytesReader(w, r.Body, *maxUploadBytes)
+		}
 
 		// forward headers to target
-		req, err := http.NewRequest("POST", targetURL.String(), r.Body)
+		req, err = http.NewRequest(r.Method, targetURL.String(), body)
 		if err != nil {
+			event.Outcome, event.Status = "error", http.StatusInternalServerError
 			http.Error(w, "Error creating request: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		// The body is streamed to the target without buffering. Keeping the client's Content-Length
+		// preserves the framing, and Expect: 100-continue travels end to end so the client only
+		// sends the body once the target server has accepted the request.
+		req.ContentLength = r.ContentLength
 		req.Header = r.Header
 		req.Header.Set("Content-Type", contentType)
+	}
 
-		resp, err = http.DefaultClient.Do(req)
-		if err != nil {
-			http.Error(w, "Error forwarding request: "+err.Error(), http.StatusInternalServerError)
-			return
+	// Under overload only cache hits are served, keeping the hot path alive
+	fetch := func() (cache.Entry, error) {
+		done, ok := admitUpstream()
+		if !ok {
+			return cache.Entry{}, errShed
 		}
+		defer done()
+		return fetchEntry(req)
+	}
+	// Concurrent misses for the same entry share a single request to the target server
+	var entry cache.Entry
+	shared := false
+	if method == "GET" && cacheable {
+		entry, shared, err = fetches.do(cacheKey, fetch)
+		if shared && err == nil && !shareable(r, entry) {
+			entry, err = fetch()
+			shared = false
+		}
+	} else {
+		entry, err = fetch()
+	}
+	if shared && err == nil {
+		slog.Debug("Sharing response", "target", targetURL.String(), "client", client)
+	}
+	if errors.Is(err, errShed) {
+		slog.Warn("Shedding request", "target", targetURL.String(), "client", client)
+		event.Outcome, event.Status = "shed", http.StatusServiceUnavailable
+		notifyEvent("load-shedding", "upstream", fmt.Sprintf("shedding requests that can't be served from cache (%d in flight, average latency %s)", upstreamInflight.Load(), time.Duration(upstreamLatency.Load())))
+		shedRequest(w)
+		return
 	}
-
-	defer resp.Body.Close()
-
-	// Read the response body
-	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		http.Error(w, "Error reading response body: "+err.Error(), http.StatusInternalServerError)
+		event.Outcome = "error"
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			event.Status = http.StatusRequestEntityTooLarge
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		event.Status = http.StatusInternalServerError
+		if errors.Is(err, errUpstreamTimeout) {
+			event.Status = http.StatusGatewayTimeout
+		}
+		if errors.Is(err, errInvalidPayload) {
+			event.Status = http.StatusBadGateway
+		}
+		notifyEvent("target-failure", targetURL.Host, fmt.Sprintf("request to %s failed: %v", targetURL.String(), err))
+		if hasStale && !*dryRun && usableOnError(stale, time.Now()) {
+			serveStaleOnError(w, r, stale, event, err.Error())
+			return
+		}
+		http.Error(w, "Error "+err.Error(), event.Status)
+		return
+	}
+	resp := entry.Response
+	if conditional && resp.StatusCode == http.StatusNotModified {
+		slog.Debug("Revalidated stale entry", "target", targetURL.String())
+		refreshed, _ := refreshStale(namespace, cacheKey, stale, r, resp)
+		event.Outcome, event.Status, event.Size = "revalidated", refreshed.Response.StatusCode, bodyLength(refreshed)
+		setCacheStatus(w, r, event)
+		writeEntry(w, r, refreshed)
 		return
 	}
+	if resp.StatusCode >= 500 {
+		notifyEvent("target-failure", targetURL.Host, fmt.Sprintf("%s answered %s", targetURL.String(), resp.Status()))
+		if hasStale && !*dryRun && usableOnError(stale, time.Now()) {
+			serveStaleOnError(w, r, stale, event, resp.Status())
+			return
+		}
+	}
+	event.Status, event.Size = resp.StatusCode, bodyLength(entry)
+	if method == "GET" && cacheable && !shared {
+		traffic.fetched(targetURL, entry)
+	}
 
-	// Cache the response
-	cache.Set(cacheKey, CacheEntry{
-		Response: resp,
-		Body:     body,
-	})
+	if *dryRun {
+		decision := "miss"
+		if cached {
+			decision = "hit"
+			fresh := cachedEntry.Response.StatusCode == resp.StatusCode && cachedEntry.ETag == entry.ETag
+			slog.Info("Dry run: would have served cached response", "target", targetURL.String(), "matches_origin", fresh)
+		}
+		w.Header().Set("X-Dry-Run-Decision", decision)
+	}
+
+	// The response may have advertised a new origin deployment, whose entries go to a new namespace
+	namespace = originNamespace(targetURL)
+
+	// Cache the response, unless the method isn't cached for this target, the response belongs to a
+	// logged-in session and must not be shared, or the origin's Cache-Control or Vary forbids it. A
+	// response shared with a concurrent miss is cached by the request that fetched it.
+	kept := false
+	if cacheable && !shared {
+		ttl, storable := responseTTL(r, resp)
+		entry.Identity = headerStrings.intern(requestIdentity(r.Header))
+		key, vary, varies := storeKey(baseKey, r.Header, resp.Header)
+		entry.Vary = vary
+		if !storable {
+			slog.Debug("Not caching response", "target", targetURL.String(), "cache_control", resp.Header.Get("Cache-Control"))
+		} else if !varies {
+			slog.Debug("Not caching response varying on *", "target", targetURL.String())
+		} else if withinIdentityQuota(namespace, key, entry.Identity) {
+			route.keepRevisions(namespace, key, &entry)
+			stored := entry
+			compressStored(route, &stored)
+			namespace.Set(key, stored, ttl)
+			kept = true
+		} else {
+			slog.Info("Identity reached its quota, not caching response", "identity", entry.Identity, "quota", *identityQuota, "target", targetURL.String())
+		}
+	}
 
 	// Forward the response to the client
-	for k, v := range resp.Header {
-		w.Header()[k] = v
+	setCacheStatus(w, r, event)
+	writeEntry(w, r, entry)
+	if !kept && !shared {
+		proxyCache.RemoveBody(entry)
 	}
-	w.WriteHeader(resp.StatusCode)
-	w.Write(body)
+}
+
+// The serveStaleOnError function serves a stale entry in place of a target server failure.
+func serveStaleOnError(w http.ResponseWriter, r *http.Request, stale cache.Entry, event *cacheEvent, failure string) {
+	slog.Warn("Serving stale response after target server failure", "target", stale.Response.Request.URL, "failure", failure)
+	event.Outcome, event.Status, event.Size = "stale", stale.Response.StatusCode, bodyLength(stale)
+	setCacheStatus(w, r, event)
+	writeEntry(w, r, stale)
 }
 
 // The debugHandler function retrieves debug information from a cache and encodes it into JSON format
 // to be sent as a response.
 func debugHandler(w http.ResponseWriter, r *http.Request) {
-	debug := cache.Debug()
+	if _, ok := authorize(w, r, roleViewer, true); !ok {
+		return
+	}
+	debug := proxyCache.Debug()
 	json.NewEncoder(w).Encode(debug)
 }
 
-// The main function sets up HTTP handlers for a proxy, health check, and debug endpoints, and starts a
-// server listening on port 8080.
+var drainDelay = flag.Duration("drain-delay", 0, "time to keep serving after SIGTERM while /readyz reports not ready, so load balancers stop routing new requests first")
+
+var drainTimeout = flag.Duration("drain-timeout", 30*time.Second, "maximum time to wait for in-flight requests to finish during shutdown")
+
+// ready reports whether the server accepts traffic; it is set once the listener is bound and cleared
+// when a shutdown signal is received.
+var ready atomic.Bool
+
+// The livezHandler function reports that the process is alive and able to serve HTTP.
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// The readyzHandler function reports whether the server should receive traffic. It fails while the
+// server is starting up or draining.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !ready.Load() {
+		http.Error(w, "Not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+var listenAddrs = flag.String("listen", ":8080", "comma-separated addresses to listen on; an address without a host listens on both IPv4 and IPv6")
+
+// The main function sets up HTTP handlers for a proxy, health check, probe, and debug endpoints, and
+// starts a server listening on -listen (port 8080 by default). On SIGTERM or SIGINT it stops reporting
+// ready, waits for the drain delay, and then shuts down gracefully within the drain timeout.
 func main() {
+	flag.Parse()
+	setupLogging()
+	if *adminTokensFile != "" {
+		if err := loadAdminTokens(*adminTokensFile); err != nil {
+			fatal("Error loading admin tokens", "error", err)
+		}
+	}
+	if *oidcIssuer != "" && *oidcAudience == "" {
+		fatal("-oidc-issuer requires -oidc-audience")
+	}
+	if *purgeKeysFile != "" {
+		if err := loadPurgeKeys(*purgeKeysFile); err != nil {
+			fatal("Error loading purge keys", "error", err)
+		}
+	}
+	if err := checkFaultRoutes(); err != nil {
+		fatal("Invalid fault injection routes", "error", err)
+	}
+	// Stale entries are kept for at least -stale-if-error and the longest stale-while-revalidate window
+	// of the routes
+	retention := max(*staleRetention, *staleIfError)
+	for _, r := range routes {
+		retention = max(retention, r.SWR)
+	}
+	store, localTTL, err := cacheStore()
+	if err != nil {
+		fatal("Error opening cache store", "error", err)
+	}
+	if *chunkBytes > 0 && store == nil {
+		fatal("-chunk-bytes requires -disk-dir, -redis-url or -memcached-servers")
+	}
+	proxyCache = cache.New(cache.Options{
+		DefaultTTL:     *ttl,
+		StaleRetention: retention,
+		SweepInterval:  *sweepInterval,
+		MaxBytes:       *maxBytes,
+		Policy:         evictionPolicy,
+		OnEvict: func(namespace, key string, entry cache.Entry) {
+			notifyEvent("cache-full", "memory", fmt.Sprintf("cache reached its budget of %d bytes, evicting least recently used entries", *maxBytes))
+		},
+		Store:    store,
+		LocalTTL: localTTL,
+		OnLoad: func(namespace, key string, entry *cache.Entry) {
+			// Bodies kept in chunks are too large to be decoded
+			if *jsonFields && entry.BodySize == 0 {
+				body, _ := entryBody(*entry)
+				entry.JSON = decodeJSON(entry.Response.Header, body)
+			}
+		},
+		OnStoreError:   logStoreError,
+		VerifyChecksum: verifyChecksum,
+		OnCorrupt:      logCorruptEntry,
+		ChunkBytes:     *chunkBytes,
+	})
+	restoreSnapshot()
+	startAnalytics()
+	startHotKeys()
+	startTraffic()
+	startLeakDetector()
+	startAlerts()
+	setupSLOs()
+
 	http.HandleFunc("/", withCors(proxyHandler))
 	http.Handle("/health", withCors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
@@ -174,9 +879,95 @@ func main() {
 		w.WriteHeader(http.StatusOK)
 	})))
 	http.HandleFunc("/debug", withCors(debugHandler))
+	http.HandleFunc("/admin/entry", adminEntryHandler)
+	http.HandleFunc("/admin/rollback", adminRollbackHandler)
+	http.HandleFunc("/admin/revalidate", adminRevalidateHandler)
+	http.HandleFunc("/admin/jobs", adminJobsHandler)
+	http.HandleFunc("/admin/stats", adminStatsHandler)
+	http.HandleFunc("/admin/expiry", adminExpiryHandler)
+	http.HandleFunc("/admin/suggestions", adminSuggestionsHandler)
+	http.HandleFunc("/admin/purge", adminPurgeHandler)
+	http.HandleFunc("/admin/purge-tag", adminPurgeTagHandler)
+	http.HandleFunc("/admin/flush", adminFlushHandler)
+	http.HandleFunc("/admin/purges", adminPurgesHandler)
+	http.HandleFunc("/admin/tuning", adminTuningHandler)
+	http.HandleFunc("/admin/slo", adminSLOHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/livez", livezHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-	log.Println("Starting server on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	tlsConf, err := tlsConfig()
+	if err != nil {
+		fatal("Error loading TLS configuration", "error", err)
+	}
+
+	// A listen address without a host (":8080") or with "[::]" accepts both IPv4 and IPv6 clients
+	server := &http.Server{Handler: withHSTS(withClientCertACL(http.DefaultServeMux))}
+	for _, addr := range strings.Split(*listenAddrs, ",") {
+		addr = strings.TrimSpace(addr)
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			fatal("Error listening", "addr", addr, "error", err)
+		}
+		if *clientWriteBuffer > 0 {
+			listener = writeBufferListener{Listener: listener, size: *clientWriteBuffer}
+		}
+		if tlsConf != nil {
+			listener = tls.NewListener(listener, tlsConf)
+		}
+
+		slog.Info("Starting server", "addr", addr)
+		go func() {
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				fatal("Error serving", "addr", addr, "error", err)
+			}
+		}()
+	}
+
+	// Plain HTTP clients are sent to the HTTPS listener
+	redirectServer := &http.Server{Handler: redirectHandler(httpsPort())}
+	if *redirectListen != "" {
+		if tlsConf == nil {
+			fatal("-redirect-listen requires -tls-cert")
+		}
+		listener, err := net.Listen("tcp", *redirectListen)
+		if err != nil {
+			fatal("Error listening", "addr", *redirectListen, "error", err)
+		}
+		slog.Info("Redirecting HTTP to HTTPS", "addr", *redirectListen)
+		go func() {
+			if err := redirectServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+				fatal("Error serving", "addr", *redirectListen, "error", err)
+			}
+		}()
+	}
+	ready.Store(true)
+
+	<-ctx.Done()
+	stop()
+	ready.Store(false)
+	slog.Info("Shutdown requested, draining", "delay", drainDelay.String())
+	time.Sleep(*drainDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Error during shutdown", "error", err)
+	}
+	redirectServer.Shutdown(shutdownCtx)
+	saveSnapshot()
+	// Entries cached last may still be on their way to the store
+	proxyCache.Stop()
+	if closer, ok := store.(io.Closer); ok {
+		closer.Close()
+	}
+	if analytics != nil {
+		analytics.close()
+	}
+	slog.Info("Server stopped")
 }
 
 // withCors is a middleware function that adds CORS headers to the response.
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+// The useTestCache function replaces the proxy's cache with a new one for the rest of the test.
+func useTestCache(t *testing.T, opts cache.Options) *cache.Cache {
+	t.Helper()
+	previous := proxyCache
+	proxyCache = cache.New(opts)
+	t.Cleanup(func() {
+		proxyCache.Stop()
+		proxyCache = previous
+	})
+	return proxyCache
+}
+
+// The setVar function sets a flag or another package variable for the rest of the test.
+func setVar[T any](t *testing.T, v *T, value T) {
+	t.Helper()
+	previous := *v
+	*v = value
+	t.Cleanup(func() { *v = previous })
+}
+
+// The proxyGet function sends a GET request for target through the proxy and returns the response.
+func proxyGet(target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest("GET", "/?target="+url.QueryEscape(target), nil))
+	return w
+}
+
+// The adminRequest function sends a request to an admin API handler from the loopback address and
+// returns the response.
+func adminRequest(handler http.HandlerFunc, method, target string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// The expireAll function marks every entry of the proxy's cache as expired.
+func expireAll() int {
+	return proxyCache.ExpireFunc(func(string, string, cache.Entry) bool { return true })
+}
+
+func TestDryRunForwardsUnconditionally(t *testing.T) {
+	useTestCache(t, cache.Options{StaleRetention: time.Hour})
+	var conditional atomic.Bool
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") != "" {
+			conditional.Store(true)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("body"))
+	}))
+	defer target.Close()
+
+	proxyGet(target.URL)
+	if expireAll() != 1 {
+		t.Fatal("first request: got no cached entry")
+	}
+	setVar(t, dryRun, true)
+	if w := proxyGet(target.URL); w.Code != http.StatusOK || w.Body.String() != "body" {
+		t.Fatalf("request in dry run: got %d %q", w.Code, w.Body)
+	}
+	if conditional.Load() {
+		t.Fatal("request in dry run: the stale entry was revalidated, want a full request to the target")
+	}
+}
+
+func TestDryRunForwardsErrors(t *testing.T) {
+	useTestCache(t, cache.Options{StaleRetention: time.Hour})
+	setVar(t, staleIfError, time.Hour)
+	var failing atomic.Bool
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("body"))
+	}))
+	defer target.Close()
+
+	proxyGet(target.URL)
+	if expireAll() != 1 {
+		t.Fatal("first request: got no cached entry")
+	}
+	failing.Store(true)
+	setVar(t, dryRun, true)
+	if w := proxyGet(target.URL); w.Code != http.StatusBadGateway {
+		t.Fatalf("request to a failing target in dry run: got %d %q, want the target's 502", w.Code, w.Body)
+	}
+	target.Close()
+	if w := proxyGet(target.URL); w.Code != http.StatusInternalServerError {
+		t.Fatalf("request to an unreachable target in dry run: got %d %q, want 500", w.Code, w.Body)
+	}
+}
+
+func TestVersionHeaderFiltered(t *testing.T) {
+	useTestCache(t, cache.Options{})
+	setVar(t, versionHeader, "X-Version")
+	setVar(t, allowResponseHeaders, listFlag{"Content-Type", "Cache-Control"})
+	setVar(t, &versions, &versionTracker{versions: make(map[string]string)})
+	var version atomic.Value
+	version.Store("v1")
+	var fetched atomic.Int64
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched.Add(1)
+		w.Header().Set("X-Version", version.Load().(string))
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer target.Close()
+
+	for range 2 {
+		if w := proxyGet(target.URL + "/a"); w.Header().Get("X-Version") != "" {
+			t.Fatalf("response: got X-Version %q, want it removed by -allow-response-headers", w.Header().Get("X-Version"))
+		}
+	}
+	if fetched.Load() != 1 {
+		t.Fatalf("requests to the target: got %d, want 1", fetched.Load())
+	}
+	version.Store("v2")
+	proxyGet(target.URL + "/b")
+	proxyGet(target.URL + "/a")
+	if fetched.Load() != 3 {
+		t.Fatalf("requests to the target after a new version: got %d, want 3", fetched.Load())
+	}
+	if got, want := versions.namespace(target.URL), target.URL+"@v2"; got != want {
+		t.Fatalf("namespace after a new version: got %q, want %q", got, want)
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	for _, test := range []struct {
+		ifNoneMatch string
+		etag        string
+		matches     bool
+	}{
+		{`"v1"`, `"v1"`, true},
+		{`"v0", "v1"`, `"v1"`, true},
+		{`W/"v1"`, `"v1"`, true},
+		{`"v1"`, `W/"v1"`, true},
+		{`*`, `"v1"`, true},
+		{`"v2"`, `"v1"`, false},
+		{`v1`, `"v1"`, false},
+		{``, `"v1"`, false},
+		{`*`, ``, false},
+	} {
+		if got := etagMatches(test.ifNoneMatch, test.etag); got != test.matches {
+			t.Errorf("etagMatches(%q, %q): got %v, want %v", test.ifNoneMatch, test.etag, got, test.matches)
+		}
+	}
+}
+
+func TestProxyAnswersIfNoneMatch(t *testing.T) {
+	useTestCache(t, cache.Options{})
+	var fetched atomic.Int64
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("body"))
+	}))
+	defer target.Close()
+
+	etag := proxyGet(target.URL).Header().Get("ETag")
+	if etag != contentETag([]byte("body")) {
+		t.Fatalf("response without an ETag from the target: got ETag %q, want %q", etag, contentETag([]byte("body")))
+	}
+	for _, test := range []struct {
+		ifNoneMatch string
+		code        int
+	}{
+		{etag, http.StatusNotModified},
+		{"W/" + etag, http.StatusNotModified},
+		{`"other"`, http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/?target="+url.QueryEscape(target.URL), nil)
+		r.Header.Set("If-None-Match", test.ifNoneMatch)
+		w := httptest.NewRecorder()
+		proxyHandler(w, r)
+		if w.Code != test.code || w.Header().Get("ETag") != etag {
+			t.Fatalf("request with If-None-Match %s: got %d with ETag %q, want %d", test.ifNoneMatch, w.Code, w.Header().Get("ETag"), test.code)
+		}
+	}
+	if fetched.Load() != 1 {
+		t.Fatalf("requests to the target: got %d, want 1", fetched.Load())
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// labeledCounter is a Prometheus counter with one label, such as a status code.
+type labeledCounter struct {
+	mutex  sync.Mutex
+	counts map[string]int64
+}
+
+// The `add` method in the `labeledCounter` struct counts one occurrence of a label value.
+func (c *labeledCounter) add(value string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]int64)
+	}
+	c.counts[value]++
+}
+
+// The `snapshot` method in the `labeledCounter` struct returns the counts by label value, in order of
+// label value.
+func (c *labeledCounter) snapshot() ([]string, []int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	values := make([]string, 0, len(c.counts))
+	for value := range c.counts {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	counts := make([]int64, len(values))
+	for i, value := range values {
+		counts[i] = c.counts[value]
+	}
+	return values, counts
+}
+
+// latencyBuckets are the upper bounds, in seconds, of the target server latency histogram.
+var latencyBuckets = [...]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// latencyHistogram is a Prometheus histogram of durations. Each bucket counts the observations above
+// the previous bound up to its own, the last one those above all bounds; they are accumulated when
+// exposed.
+type latencyHistogram struct {
+	buckets [len(latencyBuckets) + 1]atomic.Int64
+	count   atomic.Int64
+	sum     atomic.Int64
+}
+
+// The `observe` method in the `latencyHistogram` struct counts a duration.
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := sort.SearchFloat64s(latencyBuckets[:], d.Seconds())
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+var (
+	// requestOutcomes counts proxied requests by how they were served, as reported in X-Cache.
+	requestOutcomes labeledCounter
+	// responseCodes counts the status codes of the responses sent to clients.
+	responseCodes labeledCounter
+	// upstreamCodes counts the status codes of the responses of target servers.
+	upstreamCodes labeledCounter
+	// upstreamErrors counts requests to target servers that failed without a response.
+	upstreamErrors atomic.Int64
+	// upstreamDurations holds the time target servers took to send their responses, body included.
+	upstreamDurations latencyHistogram
+)
+
+// The observeRequestMetrics function counts a finished request towards the exposed metrics.
+func observeRequestMetrics(event *cacheEvent) {
+	requestOutcomes.add(event.Outcome)
+	if event.Status != 0 {
+		responseCodes.add(strconv.Itoa(event.Status))
+	}
+}
+
+// The observeUpstreamMetrics function counts a request for target to a target server, started at start,
+// once its response has been read, including towards the SLOs of its route. A status of 0 counts a
+// request that failed without a response.
+func observeUpstreamMetrics(target *url.URL, status int, start time.Time) {
+	d := time.Since(start)
+	upstreamDurations.observe(d)
+	observeSLOs(target, status, d)
+	if status == 0 {
+		upstreamErrors.Add(1)
+		return
+	}
+	upstreamCodes.add(strconv.Itoa(status))
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	*bufio.Writer
+}
+
+// The `metric` method in the `metricsWriter` struct writes the help and type lines of a metric family
+// and, unless it is labeled, its single sample.
+func (m metricsWriter) metric(name, kind, help string, value any) {
+	fmt.Fprintf(m, "# HELP go_proxy_cache_%s %s\n# TYPE go_proxy_cache_%s %s\n", name, help, name, kind)
+	if value != nil {
+		fmt.Fprintf(m, "go_proxy_cache_%s %v\n", name, value)
+	}
+}
+
+// The `labeled` method in the `metricsWriter` struct writes a counter with one label.
+func (m metricsWriter) labeled(name, label, help string, c *labeledCounter) {
+	m.metric(name, "counter", help, nil)
+	values, counts := c.snapshot()
+	for i, value := range values {
+		fmt.Fprintf(m, "go_proxy_cache_%s{%s=%q} %d\n", name, label, value, counts[i])
+	}
+}
+
+// The `histogram` method in the `metricsWriter` struct writes a histogram of durations in seconds.
+func (m metricsWriter) histogram(name, help string, h *latencyHistogram) {
+	m.metric(name, "histogram", help, nil)
+	cumulative := int64(0)
+	for i, bound := range latencyBuckets {
+		cumulative += h.buckets[i].Load()
+		fmt.Fprintf(m, "go_proxy_cache_%s_bucket{le=\"%g\"} %d\n", name, bound, cumulative)
+	}
+	count := h.count.Load()
+	fmt.Fprintf(m, "go_proxy_cache_%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(m, "go_proxy_cache_%s_sum %g\n", name, time.Duration(h.sum.Load()).Seconds())
+	fmt.Fprintf(m, "go_proxy_cache_%s_count %d\n", name, count)
+}
+
+// The metricsHandler function exposes the cache and target server metrics in the Prometheus text
+// format, so operators can graph the hit ratio and alert on target server errors. Like /admin/stats,
+// entry counts and sizes only cover memory.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := authorize(w, r, roleViewer, true); !ok {
+		return
+	}
+
+	stats := proxyCache.Stats()
+	hits, misses := int64(0), int64(0)
+	outcomes, counts := requestOutcomes.snapshot()
+	for i, outcome := range outcomes {
+		switch outcome {
+		case "hit":
+			hits += counts[i]
+		case "miss", "revalidated":
+			misses += counts[i]
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m := metricsWriter{bufio.NewWriter(w)}
+	defer m.Flush()
+	m.metric("hits_total", "counter", "Cacheable requests served from the cache.", hits)
+	m.metric("misses_total", "counter", "Cacheable requests sent to the target server, including revalidations.", misses)
+	m.labeled("requests_total", "outcome", "Proxied requests by how they were served, as reported in X-Cache.", &requestOutcomes)
+	m.labeled("responses_total", "code", "Responses sent to clients by status code.", &responseCodes)
+	m.metric("entries", "gauge", "Entries in memory.", stats.Entries)
+	m.metric("bytes", "gauge", "Size of the entries in memory in bytes.", stats.Bytes)
+	m.metric("max_bytes", "gauge", "Memory budget of the entries in bytes, 0 for unlimited.", stats.MaxBytes)
+	m.metric("evictions_total", "counter", "Entries evicted to stay within the memory budget.", stats.Evictions)
+	m.metric("expired_total", "counter", "Expired entries removed.", stats.Expired)
+	m.metric("store_loads_total", "counter", "Entries read from the store.", stats.StoreLoads)
+	m.metric("store_errors_total", "counter", "Failed store operations.", stats.StoreErrors)
+	m.metric("checksum_failures_total", "counter", "Entries removed because they failed checksum verification.", stats.ChecksumFailures)
+	m.metric("upstream_inflight", "gauge", "Requests being forwarded to target servers.", upstreamInflight.Load())
+	m.labeled("upstream_responses_total", "code", "Target server responses by status code.", &upstreamCodes)
+	m.metric("upstream_errors_total", "counter", "Requests to target servers that failed without a response.", upstreamErrors.Load())
+	m.histogram("upstream_duration_seconds", "Time target servers took to send their responses, body included.", &upstreamDurations)
+	if len(sloTrackers) > 0 {
+		m.slos()
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+var tlsCert = flag.String("tls-cert", "", "PEM certificate chain to serve HTTPS with on every -listen address; requires -tls-key")
+
+var tlsKey = flag.String("tls-key", "", "PEM private key of -tls-cert")
+
+var tlsClientCA = flag.String("tls-client-ca", "", "PEM bundle of CAs that sign client certificates; enables mutual TLS")
+
+var tlsClientAuth = flag.String("tls-client-auth", "require", "with -tls-client-ca, whether clients must present a certificate (require) or only have it verified when they do (verify-if-given)")
+
+var clientCertAllow = newListFlag("client-cert-allow", "comma-separated client certificate names (subject common name or DNS, email or URI subject alternative name) allowed to use the server; others get 403 (default: any verified certificate)")
+
+// The tlsConfig function builds the listener's TLS configuration from the flags, or returns nil when
+// -tls-cert is not set.
+func tlsConfig() (*tls.Config, error) {
+	if *tlsCert == "" {
+		if *tlsClientCA != "" {
+			return nil, errors.New("-tls-client-ca requires -tls-cert")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if *tlsClientCA == "" {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(*tlsClientCA)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", *tlsClientCA)
+	}
+	switch *tlsClientAuth {
+	case "require":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case "verify-if-given":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("invalid -tls-client-auth %q, expected require or verify-if-given", *tlsClientAuth)
+	}
+	return config, nil
+}
+
+// The clientCertNames function returns the subject common name followed by the subject alternative
+// names of the verified client certificate of a request, or nil when the client presented none.
+func clientCertNames(r *http.Request) []string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// The clientCertName function returns the subject common name of the verified client certificate of
+// a request, or an empty string. It identifies the calling service in logs and analytics.
+func clientCertName(r *http.Request) string {
+	if names := clientCertNames(r); len(names) > 0 {
+		return names[0]
+	}
+	return ""
+}
+
+// The withClientCertACL function restricts a handler to clients whose certificate carries one of the
+// -client-cert-allow names. Health and probe endpoints stay reachable so orchestrators, which don't
+// present client certificates, can check the server.
+func withClientCertACL(next http.Handler) http.Handler {
+	if len(*clientCertAllow) == 0 {
+		return next
+	}
+	allowed := make(map[string]bool, len(*clientCertAllow))
+	for _, name := range *clientCertAllow {
+		allowed[name] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health", "/livez", "/readyz":
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, name := range clientCertNames(r) {
+			if allowed[name] {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		http.Error(w, "Forbidden: client certificate not allowed", http.StatusForbidden)
+	})
+}
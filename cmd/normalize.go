@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var normalizeRequestHeaders = flag.Bool("normalize-request-headers", false, "remove client-specific request headers (client hints, fetch metadata, DNT, ...) and canonicalize Accept-Encoding and Accept-Language before requests are keyed and forwarded, so the target server sees consistent requests")
+
+var dropRequestHeaders = newListFlag("drop-request-headers", "comma-separated request headers removed before requests are keyed and forwarded (a trailing * matches a prefix, e.g. X-Debug-*)")
+
+// noisyRequestHeaders are the headers browsers add that describe the client rather than the resource,
+// removed by -normalize-request-headers. A trailing * matches a prefix.
+var noisyRequestHeaders = []string{"Sec-Ch-*", "Sec-Fetch-*", "Sec-Gpc", "Dnt", "Upgrade-Insecure-Requests", "Priority"}
+
+// The dropHeaders function removes the headers matching any of the patterns.
+func dropHeaders(header http.Header, patterns []string) {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			prefix = http.CanonicalHeaderKey(prefix)
+			for name := range header {
+				if strings.HasPrefix(name, prefix) {
+					header.Del(name)
+				}
+			}
+			continue
+		}
+		header.Del(pattern)
+	}
+}
+
+// The normalizeRequestHeader function applies -drop-request-headers and -normalize-request-headers to
+// a client's request headers. Accept-Encoding becomes a sorted, lowercase list without refused codings,
+// whose order carries no meaning; Accept-Language keeps its order, which expresses preference, and is
+// only lowercased and respaced. Equivalent requests thus produce the same cache key and Vary variant.
+func normalizeRequestHeader(header http.Header) {
+	dropHeaders(header, *dropRequestHeaders)
+	if !*normalizeRequestHeaders {
+		return
+	}
+	dropHeaders(header, noisyRequestHeaders)
+
+	if values := header.Values("Accept-Encoding"); len(values) > 0 {
+		var codings []string
+		for _, part := range listTokens(values) {
+			coding, params, _ := strings.Cut(part, ";")
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok && strings.Trim(q, "0.") == "" {
+				continue
+			}
+			codings = append(codings, strings.TrimSpace(coding))
+		}
+		slices.Sort(codings)
+		header.Set("Accept-Encoding", strings.Join(slices.Compact(codings), ", "))
+	}
+	if values := header.Values("Accept-Language"); len(values) > 0 {
+		header.Set("Accept-Language", strings.Join(listTokens(values), ", "))
+	}
+}
+
+// The listTokens function splits comma-separated header values into lowercase elements with the
+// whitespace around them and their parameters removed.
+func listTokens(values []string) []string {
+	var tokens []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			fields := strings.Split(part, ";")
+			for i := range fields {
+				fields[i] = strings.TrimSpace(fields[i])
+			}
+			if token := strings.ToLower(strings.Join(fields, ";")); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var notifyWebhook = flag.String("notify-webhook", "", "URL that receives a POST for operational events (target server failures, load shedding, cache full); the payload's text field makes it usable as a Slack incoming webhook")
+
+var notifyInterval = flag.Duration("notify-interval", 5*time.Minute, "minimum time between two notifications of the same event; repeats in between are counted and reported with the next one")
+
+// notification tracks when an event was last sent to -notify-webhook and how many repeats were
+// suppressed since.
+type notification struct {
+	sent       time.Time
+	suppressed int
+}
+
+var (
+	notifications      = make(map[string]*notification)
+	notificationsMutex sync.Mutex
+)
+
+// The notifyEvent function reports an operational event about subject (e.g. a target server) to
+// -notify-webhook. Repeats of the same event and subject within -notify-interval are deduplicated.
+func notifyEvent(event, subject, detail string) {
+	if *notifyWebhook == "" {
+		return
+	}
+	notificationsMutex.Lock()
+	state, ok := notifications[event+" "+subject]
+	if !ok {
+		state = &notification{}
+		notifications[event+" "+subject] = state
+	}
+	if time.Since(state.sent) < *notifyInterval {
+		state.suppressed++
+		notificationsMutex.Unlock()
+		return
+	}
+	suppressed := state.suppressed
+	state.sent, state.suppressed = time.Now(), 0
+	notificationsMutex.Unlock()
+
+	text := fmt.Sprintf("go-proxy-cache %s: %s", event, detail)
+	if suppressed > 0 {
+		text += fmt.Sprintf(" (%d similar events suppressed)", suppressed)
+	}
+	go postWebhook(*notifyWebhook, event+" notification", map[string]interface{}{
+		"Event":      event,
+		"Subject":    subject,
+		"Detail":     detail,
+		"Suppressed": suppressed,
+		"Time":       time.Now(),
+		"text":       text,
+	})
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var oidcIssuer = flag.String("oidc-issuer", "", "OpenID Connect issuer URL whose RS256 tokens are accepted as admin API bearer tokens, in addition to -admin-tokens-file (e.g. https://login.example.com/realms/ops)")
+
+var oidcAudience = flag.String("oidc-audience", "", "client ID that OIDC tokens must be issued for (the aud claim); required with -oidc-issuer")
+
+var oidcGroupsClaim = flag.String("oidc-groups-claim", "groups", "OIDC token claim listing the groups of the user")
+
+// oidcGroupRoles maps OIDC groups to admin API roles, see -oidc-group-roles.
+var oidcGroupRoles = make(map[string]role)
+
+func init() {
+	flag.Func("oidc-group-roles", "comma-separated group=role mappings granting admin API roles to OIDC groups (e.g. sre=admin,support=viewer)", func(value string) error {
+		for _, mapping := range strings.Split(value, ",") {
+			group, name, ok := strings.Cut(strings.TrimSpace(mapping), "=")
+			if !ok || group == "" {
+				return fmt.Errorf("invalid mapping %q, expected group=role", mapping)
+			}
+			r, ok := roleNames[name]
+			if !ok {
+				return fmt.Errorf("unknown role %q", name)
+			}
+			oidcGroupRoles[group] = r
+		}
+		return nil
+	})
+}
+
+// jwksRefreshInterval limits how often the issuer's signing keys are fetched again when a token is
+// signed with an unknown key.
+const jwksRefreshInterval = time.Minute
+
+// clockSkew is the leeway allowed when checking the expiry and not-before times of a token.
+const clockSkew = time.Minute
+
+// oidcVerifier validates tokens issued by the -oidc-issuer. The issuer's signing keys are discovered on
+// first use and refreshed when it starts signing with a new key.
+type oidcVerifier struct {
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	mutex     sync.Mutex
+}
+
+var oidc = &oidcVerifier{}
+
+// The `key` method in the `oidcVerifier` struct returns the issuer's public key with the given key ID,
+// fetching the issuer's key set when the key is not known yet.
+func (v *oidcVerifier) key(kid string) (*rsa.PublicKey, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(v.fetchedAt) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	v.fetchedAt = time.Now()
+	keys, err := fetchSigningKeys(*oidcIssuer)
+	if err != nil {
+		return nil, err
+	}
+	v.keys = keys
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// The fetchSigningKeys function discovers the JWKS endpoint of an issuer and returns its RSA signing
+// keys by key ID.
+func fetchSigningKeys(issuer string) (map[string]*rsa.PublicKey, error) {
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := getJSON(strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+// The getJSON function fetches a URL and decodes its JSON response into v.
+func getJSON(url string, v interface{}) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// The `verify` method in the `oidcVerifier` struct checks the signature, issuer, audience and validity
+// period of a token and returns the principal granted by the highest role among its groups.
+func (v *oidcVerifier) verify(token string) (principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return principal{}, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return principal{}, err
+	}
+	if header.Alg != "RS256" {
+		return principal{}, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return principal{}, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return principal{}, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return principal{}, errors.New("invalid signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return principal{}, err
+	}
+	if claims["iss"] != *oidcIssuer {
+		return principal{}, fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+	if !claimContains(claims["aud"], *oidcAudience) {
+		return principal{}, fmt.Errorf("token not issued for %s", *oidcAudience)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return principal{}, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return principal{}, errors.New("token not valid yet")
+	}
+
+	var granted role
+	for group, r := range oidcGroupRoles {
+		if r > granted && claimContains(claims[*oidcGroupsClaim], group) {
+			granted = r
+		}
+	}
+	if granted == 0 {
+		return principal{}, fmt.Errorf("no admin role granted to %v", claims["sub"])
+	}
+	name, _ := claims["sub"].(string)
+	for _, claim := range []string{"preferred_username", "email"} {
+		if value, ok := claims[claim].(string); ok && value != "" {
+			name = value
+			break
+		}
+	}
+	return principal{role: granted, name: name}, nil
+}
+
+// The decodeSegment function decodes a base64url-encoded JSON segment of a token into v.
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// The claimContains function reports whether a claim, either a single string or a list of strings,
+// contains value.
+func claimContains(claim interface{}, value string) bool {
+	switch claim := claim.(type) {
+	case string:
+		return claim == value
+	case []interface{}:
+		for _, item := range claim {
+			if item == value {
+				return true
+			}
+		}
+	}
+	return false
+}
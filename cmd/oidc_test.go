@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testIssuer is an OpenID Connect issuer publishing one RSA signing key.
+type testIssuer struct {
+	url string
+	kid string
+	key *rsa.PrivateKey
+}
+
+// The startTestIssuer function starts a testIssuer and makes it the -oidc-issuer, with the audience
+// "proxy", the group "sre" granted the admin role and "support" the viewer role, for the rest of the
+// test.
+func startTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &testIssuer{kid: "key-1", key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"jwks_uri": issuer.url + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": issuer.kid,
+			"kty": "RSA",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	issuer.url = server.URL
+
+	setVar(t, oidcIssuer, issuer.url)
+	setVar(t, oidcAudience, "proxy")
+	setVar(t, &oidcGroupRoles, map[string]role{"sre": roleAdmin, "support": roleViewer})
+	setVar(t, &oidc, &oidcVerifier{})
+	return issuer
+}
+
+// The `claims` method in the `testIssuer` struct returns the claims of a valid token for alice, in the
+// sre group.
+func (i *testIssuer) claims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":                i.url,
+		"aud":                []string{"other", "proxy"},
+		"sub":                "user-1",
+		"preferred_username": "alice",
+		"groups":             []string{"sre"},
+		"exp":                time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+// The `sign` method in the `testIssuer` struct returns a token with the given header and claims, signed
+// with the issuer's key.
+func (i *testIssuer) sign(header, claims map[string]interface{}) string {
+	signed := encodeSegment(header) + "." + encodeSegment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// The encodeSegment function encodes v as a base64url-encoded JSON segment of a token.
+func encodeSegment(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	issuer := startTestIssuer(t)
+	header := map[string]interface{}{"alg": "RS256", "kid": issuer.kid}
+	with := func(claim string, value interface{}) map[string]interface{} {
+		claims := issuer.claims()
+		claims[claim] = value
+		return claims
+	}
+
+	p, err := oidc.verify(issuer.sign(header, issuer.claims()))
+	if err != nil || p.role != roleAdmin || p.name != "alice" {
+		t.Fatalf("verify of a valid token: got %+v, %v, want alice with the admin role", p, err)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := &testIssuer{url: issuer.url, kid: issuer.kid, key: other}
+	unsigned := encodeSegment(map[string]interface{}{"alg": "none"}) + "." + encodeSegment(issuer.claims()) + "."
+	hs256 := encodeSegment(map[string]interface{}{"alg": "HS256", "kid": issuer.kid}) + "." + encodeSegment(issuer.claims())
+	mac := hmac.New(sha256.New, issuer.key.N.Bytes())
+	mac.Write([]byte(hs256))
+	hs256 += "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	for _, test := range []struct {
+		name  string
+		token string
+	}{
+		{"bad signature", forged.sign(header, issuer.claims())},
+		{"wrong issuer", issuer.sign(header, with("iss", "https://evil.example.com"))},
+		{"wrong audience", issuer.sign(header, with("aud", "other"))},
+		{"no audience", issuer.sign(header, with("aud", nil))},
+		{"expired", issuer.sign(header, with("exp", time.Now().Add(-time.Hour).Unix()))},
+		{"not valid yet", issuer.sign(header, with("nbf", time.Now().Add(time.Hour).Unix()))},
+		{"no role", issuer.sign(header, with("groups", []string{"dev"}))},
+		{"alg none", unsigned},
+		{"HS256", hs256},
+		{"unknown kid", issuer.sign(map[string]interface{}{"alg": "RS256", "kid": "key-2"}, issuer.claims())},
+		{"malformed", "a.b"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if p, err := oidc.verify(test.token); err == nil {
+				t.Fatalf("verify: got %+v, want an error", p)
+			}
+		})
+	}
+}
+
+func TestOIDCAuthorize(t *testing.T) {
+	issuer := startTestIssuer(t)
+	claims := issuer.claims()
+	claims["groups"] = "support"
+	token := issuer.sign(map[string]interface{}{"alg": "RS256", "kid": issuer.kid}, claims)
+
+	for _, test := range []struct {
+		name  string
+		auth  string
+		need  role
+		code  int
+		allow bool
+	}{
+		{"viewer", "Bearer " + token, roleViewer, http.StatusOK, true},
+		{"purger", "Bearer " + token, rolePurger, http.StatusForbidden, false},
+		{"no token", "", roleViewer, http.StatusUnauthorized, false},
+		{"invalid token", "Bearer " + token + "x", roleViewer, http.StatusUnauthorized, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/admin/stats", nil)
+			if test.auth != "" {
+				r.Header.Set("Authorization", test.auth)
+			}
+			w := httptest.NewRecorder()
+			p, ok := authorize(w, r, test.need, false)
+			if ok != test.allow || w.Code != test.code {
+				t.Fatalf("authorize: got %v and %d, want %v and %d", ok, w.Code, test.allow, test.code)
+			}
+			if ok && (p.role != roleViewer || p.name != "alice") {
+				t.Fatalf("authorize: got %+v, want alice with the viewer role", p)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// overrideCIDRs holds the networks of internal clients allowed to send X-Upstream-Override.
+var overrideCIDRs []netip.Prefix
+
+func init() {
+	flag.Func("upstream-override-cidrs", "comma-separated CIDRs (or addresses) of internal clients allowed to route a request to another origin with X-Upstream-Override; may be repeated", func(value string) error {
+		prefixes, err := parsePrefixes(value)
+		overrideCIDRs = append(overrideCIDRs, prefixes...)
+		return err
+	})
+}
+
+var overrideClients = newListFlag("upstream-override-clients", "comma-separated client certificate names that X-Upstream-Override additionally requires (see -tls-client-ca)")
+
+var overrideOrigins = newListFlag("upstream-override-origins", "comma-separated origins (scheme://host[:port]) X-Upstream-Override may route to (default: any)")
+
+// errOverrideForbidden is returned for X-Upstream-Override headers sent by clients that aren't trusted.
+var errOverrideForbidden = errors.New("X-Upstream-Override is not allowed for this client")
+
+// The overrideUpstream function applies the X-Upstream-Override header of a trusted client to the
+// target: the target's scheme and host are replaced with those of the override origin, keeping the
+// path and query. The target URL is part of the cache key and selects the namespace, so responses of
+// the alternate origin never mix with those of the regular one. It returns the target unchanged
+// when the header is absent, and removes the header so it isn't forwarded.
+//
+// A client is trusted when its address (see -trusted-proxies) belongs to -upstream-override-cidrs and, when
+// -upstream-override-clients is set, it presented a certificate with one of those names.
+func overrideUpstream(r *http.Request, target *url.URL) (*url.URL, error) {
+	value := strings.TrimSpace(r.Header.Get("X-Upstream-Override"))
+	r.Header.Del("X-Upstream-Override")
+	if value == "" {
+		return target, nil
+	}
+
+	addr, err := parseIP(clientIP(r))
+	if err != nil || !containsAddr(overrideCIDRs, addr) {
+		return nil, errOverrideForbidden
+	}
+	if len(*overrideClients) > 0 && !slices.ContainsFunc(clientCertNames(r), func(name string) bool {
+		return slices.Contains(*overrideClients, name)
+	}) {
+		return nil, errOverrideForbidden
+	}
+
+	origin, err := parseTarget(value)
+	if err != nil || (origin.Scheme != "http" && origin.Scheme != "https") || origin.Host == "" {
+		return nil, fmt.Errorf("invalid X-Upstream-Override %q, expected scheme://host[:port]", value)
+	}
+	origin.Path, origin.RawPath, origin.RawQuery = "", "", ""
+	if len(*overrideOrigins) > 0 && !slices.ContainsFunc(*overrideOrigins, func(allowed string) bool {
+		u, err := parseTarget(allowed)
+		return err == nil && u.Scheme == origin.Scheme && u.Host == origin.Host
+	}) {
+		return nil, fmt.Errorf("origin %s is not in -upstream-override-origins", origin)
+	}
+	overridden := *target
+	overridden.Scheme, overridden.Host = origin.Scheme, origin.Host
+	return &overridden, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+var precompressHits = flag.Int64("precompress-hits", 0, "number of hits after which a text entry is compressed in the background, so clients accepting gzip are served a stored compressed body; 0 to disable")
+
+// precompressors encode a body with a content coding. The standard library provides gzip; further
+// codings only need an entry here.
+var precompressors = map[string]func(body []byte) ([]byte, error){
+	"gzip": gzipBody,
+}
+
+// precompressPreference is the order in which codings are chosen when a client accepts several.
+var precompressPreference = []string{"gzip"}
+
+// precompressing holds the keys of entries being compressed, so a hot entry is only compressed once.
+var precompressing sync.Map
+
+// The gzipBody function compresses a body with gzip at the best compression level; the cost is paid
+// once per entry, off the request path.
+func gzipBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// The compressible function reports whether an entry holds an unencoded text body worth compressing.
+func compressible(entry cache.Entry) bool {
+	if entry.Response.Header.Get("Content-Encoding") != "" || len(entry.Body) < 256 {
+		return false
+	}
+	contentType := entry.Response.Header.Get("Content-Type")
+	for _, prefix := range []string{"text/", "application/json", "application/javascript", "application/xml", "image/svg+xml"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// The maybePrecompress function starts compressing a hot entry in the background once it reaches
+// -precompress-hits. The variants are stored with the entry by the time later requests arrive.
+func maybePrecompress(namespace *cache.Namespace, key string, entry cache.Entry) {
+	if *precompressHits <= 0 || entry.Hits() < *precompressHits || len(entry.Variants) == len(precompressors) || !compressible(entry) {
+		return
+	}
+	if _, busy := precompressing.LoadOrStore(key, true); busy {
+		return
+	}
+	go func() {
+		defer precompressing.Delete(key)
+		variants := make(map[string][]byte, len(precompressors))
+		for coding, encode := range precompressors {
+			encoded, err := encode(entry.Body)
+			if err != nil {
+				slog.Error("Error encoding variant", "key", key, "coding", coding, "error", err)
+				continue
+			}
+			// Only keep variants that save space
+			if len(encoded) < len(entry.Body) {
+				variants[coding] = encoded
+			}
+		}
+		// The variants belong to the body they were encoded from, not to an entry that replaced it
+		namespace.Update(key, func(e *cache.Entry) {
+			if e.ETag == entry.ETag && e.StoredAt.Equal(entry.StoredAt) {
+				e.Variants = variants
+			}
+		})
+	}()
+}
+
+// The acceptedVariant function returns the stored variant of an entry preferred by the client's
+// Accept-Encoding header, if any.
+func acceptedVariant(r *http.Request, entry cache.Entry) (string, []byte, bool) {
+	if len(entry.Variants) == 0 {
+		return "", nil, false
+	}
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				continue
+			}
+		}
+		accepted[strings.ToLower(coding)] = true
+	}
+	for _, coding := range precompressPreference {
+		if body, ok := entry.Variants[coding]; ok && (accepted[coding] || accepted["*"]) {
+			return coding, body, true
+		}
+	}
+	return "", nil, false
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+// The adminPurgeHandler function removes entries on DELETE: with ?target=<URL>, every entry cached for
+// that URL (all methods, Vary variants and identities, in every namespace); with ?key=<cache key> and
+// an optional &namespace=, the single entry stored under that key; with ?prefix= or ?pattern=, every
+// entry whose URL starts with the prefix or matches the regular expression. Tenant-scoped callers
+// only remove entries of their hosts. With &soft=true the entries are marked stale instead (see
+// purgeMode). It reports how many entries were purged, so deploys can invalidate stale content without
+// waiting for it to expire. Signed requests are accepted too (see authorizePurge).
+func adminPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := authorizePurge(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	target, key, prefix, pattern := query.Get("target"), query.Get("key"), query.Get("prefix"), query.Get("pattern")
+	record := purgeRecord{Who: p.name, Client: p.client, Tenant: p.tenant}
+	purge, ok := purgeMode(w, r, &record)
+	if !ok {
+		return
+	}
+	switch {
+	case target != "":
+		u, err := parseTarget(target)
+		if err != nil {
+			http.Error(w, "Invalid 'target' URL", http.StatusBadRequest)
+			return
+		}
+		target = u.String()
+		if !p.allowsURL(target) {
+			http.Error(w, "Forbidden: URL outside of tenant "+p.tenant, http.StatusForbidden)
+			return
+		}
+		record.URLs = []string{target}
+		// Requests differing only in ignored query parameters share an entry fetched for any of them
+		route := routeFor(u)
+		keyed := route.keyURL(u).String()
+		// Stale entries go too, so they can't be served again when the target server fails
+		record.Entries = purge(func(namespace, key string, entry cache.Entry) bool {
+			if entry.Response.Request.URL == target {
+				return true
+			}
+			if len(route.IgnoreParams) == 0 || !strings.HasPrefix(entry.Response.Request.URL, route.Prefix) {
+				return false
+			}
+			fetched, err := url.Parse(entry.Response.Request.URL)
+			return err == nil && route.keyURL(fetched).String() == keyed
+		})
+
+	case key != "":
+		record.Key = key
+		namespace := proxyCache.Namespace(query.Get("namespace"))
+		entry, ok := namespace.Peek(key)
+		if !ok {
+			// Stale entries go too, so they can't be served again when the target server fails
+			entry, ok = namespace.GetStale(key)
+		}
+		if ok && !p.allowsURL(entry.Response.Request.URL) {
+			ok = false
+		}
+		if ok && record.Kind == "soft purge" {
+			ok = namespace.Expire(key)
+		} else if ok {
+			ok = namespace.Delete(key)
+		}
+		if ok {
+			record.URLs = []string{entry.Response.Request.URL}
+			record.Entries = 1
+		}
+
+	case prefix != "":
+		record.Prefix = prefix
+		record.Entries = purge(func(namespace, key string, entry cache.Entry) bool {
+			return strings.HasPrefix(entry.Response.Request.URL, prefix) && p.allowsURL(entry.Response.Request.URL)
+		})
+
+	case pattern != "":
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			http.Error(w, "Invalid 'pattern' parameter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		record.Pattern = pattern
+		record.Entries = purge(func(namespace, key string, entry cache.Entry) bool {
+			return re.MatchString(entry.Response.Request.URL) && p.allowsURL(entry.Response.Request.URL)
+		})
+
+	default:
+		http.Error(w, "Missing 'target', 'key', 'prefix' or 'pattern' parameter. Usage: ?target=<URL>, ?key=<cache key>[&namespace=<namespace>], ?prefix=<URL prefix> or ?pattern=<URL regular expression>", http.StatusBadRequest)
+		return
+	}
+
+	recordPurge(record)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"Purged": record.Entries})
+}
+
+// The purgeMode function returns how a purge request removes the entries it selects, based on its
+// ?soft= parameter, and sets the kind of the purge record accordingly. A hard purge deletes them. A
+// soft purge only marks them expired: the next request revalidates them with the target server, while
+// -stale-if-error can still serve them if the target server is down. It answers 400 Bad Request for
+// an invalid parameter and returns false.
+func purgeMode(w http.ResponseWriter, r *http.Request, record *purgeRecord) (func(match func(namespace, key string, entry cache.Entry) bool) int, bool) {
+	soft := false
+	if value := r.URL.Query().Get("soft"); value != "" {
+		var err error
+		if soft, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "Invalid 'soft' parameter: "+err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	if soft {
+		record.Kind = "soft purge"
+		return proxyCache.ExpireFunc, true
+	}
+	record.Kind = "purge"
+	return proxyCache.DeleteFunc, true
+}
+
+// The surrogateKeys function returns the tags of a target server response, listed space-separated in
+// its Surrogate-Key header, and removes the header: like a CDN, the cache consumes it rather than
+// passing it on to clients.
+func surrogateKeys(header http.Header) []string {
+	var tags []string
+	for _, value := range header.Values("Surrogate-Key") {
+		for _, tag := range strings.Fields(value) {
+			if !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	header.Del("Surrogate-Key")
+	return tags
+}
+
+// The adminPurgeTagHandler function removes every entry tagged with one of the ?tag= parameters (which
+// may be repeated) on POST, in every namespace and including expired entries. Tenant-scoped callers
+// only remove entries of their hosts. With &soft=true the entries are marked stale instead (see
+// purgeMode). It reports how many entries were purged. Signed requests are accepted too (see
+// authorizePurge).
+func adminPurgeTagHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := authorizePurge(w, r)
+	if !ok {
+		return
+	}
+	tags := slices.DeleteFunc(r.URL.Query()["tag"], func(tag string) bool { return tag == "" })
+	if len(tags) == 0 {
+		http.Error(w, "Missing 'tag' parameter. Usage: ?tag=<surrogate key>[&tag=...][&soft=true]", http.StatusBadRequest)
+		return
+	}
+
+	record := purgeRecord{Who: p.name, Client: p.client, Tenant: p.tenant, Tags: tags}
+	purge, ok := purgeMode(w, r, &record)
+	if !ok {
+		return
+	}
+	record.Entries = purge(func(namespace, key string, entry cache.Entry) bool {
+		return slices.ContainsFunc(entry.Tags, func(tag string) bool { return slices.Contains(tags, tag) }) && p.allowsURL(entry.Response.Request.URL)
+	})
+	recordPurge(record)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"Purged": record.Entries})
+}
+
+// The adminFlushHandler function removes every entry on POST, for emergency cache resets without
+// restarting the server, and reports how many entries were removed.
+func adminFlushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := authorize(w, r, roleAdmin, true)
+	if !ok {
+		return
+	}
+	flushed := proxyCache.Flush()
+	slog.Info("Flushed cache", "entries", flushed, "who", p.name)
+	recordPurge(purgeRecord{Who: p.name, Client: p.client, Kind: "flush", Entries: flushed})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"Purged": flushed})
+}
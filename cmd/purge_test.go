@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+func TestPurgeStaleKey(t *testing.T) {
+	useTestCache(t, cache.Options{StaleRetention: time.Hour})
+	setVar(t, staleIfError, time.Hour)
+	var failing atomic.Bool
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("cached"))
+	}))
+	defer target.Close()
+
+	if w := proxyGet(target.URL); w.Code != http.StatusOK || w.Body.String() != "cached" {
+		t.Fatalf("first request: got %d %q", w.Code, w.Body)
+	}
+	var key string
+	proxyCache.Range(func(namespace, k string, entry cache.Entry) bool {
+		key = k
+		return false
+	})
+	if expired := expireAll(); expired != 1 {
+		t.Fatalf("expireAll: got %d entries, want 1", expired)
+	}
+	failing.Store(true)
+	if w := proxyGet(target.URL); w.Body.String() != "cached" {
+		t.Fatalf("request to a failing target before the purge: got %d %q, want the stale response", w.Code, w.Body)
+	}
+
+	w := adminRequest(adminPurgeHandler, "DELETE", "/admin/purge?key="+url.QueryEscape(key))
+	if w.Code != http.StatusOK || w.Body.String() != "{\"Purged\":1}\n" {
+		t.Fatalf("purge of a stale key: got %d %q", w.Code, w.Body)
+	}
+	if w := proxyGet(target.URL); w.Code != http.StatusInternalServerError {
+		t.Fatalf("request to a failing target after the purge: got %d %q, want the target's 500", w.Code, w.Body)
+	}
+}
+
+// The setTestEntries function caches an entry for each URL in the default namespace, under the key
+// "GET <URL>".
+func setTestEntries(urls ...string) {
+	for _, u := range urls {
+		entry := cache.Entry{Response: cache.ResponseRecord{StatusCode: http.StatusOK, Request: cache.RequestRecord{Method: "GET", URL: u}}}
+		proxyCache.Set("GET "+u, entry, time.Hour)
+	}
+}
+
+// The purgeCount function sends a purge request with the given query and bearer token, and returns how
+// many entries it reports purged, or -1 with the status of a failed request.
+func purgeCount(t *testing.T, query, token string) (int, int) {
+	t.Helper()
+	r := httptest.NewRequest("DELETE", "/admin/purge?"+query, nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	adminPurgeHandler(w, r)
+	if w.Code != http.StatusOK {
+		return -1, w.Code
+	}
+	var result struct{ Purged int }
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("purge response: %v", err)
+	}
+	return result.Purged, w.Code
+}
+
+func TestPurgeMatching(t *testing.T) {
+	setVar(t, &routes, []route{{Prefix: "https://shop.example.com/", IgnoreParams: []string{"utm_source"}}})
+	urls := []string{
+		"https://shop.example.com/a",
+		"https://shop.example.com/a?utm_source=news",
+		"https://shop.example.com/a?page=2",
+		"https://shop.example.com/style.css",
+		"https://blog.example.com/a",
+		"https://blog.example.com/theme.css",
+	}
+	for _, test := range []struct {
+		query  string
+		purged []string
+	}{
+		{"target=" + url.QueryEscape("https://shop.example.com/a"), urls[:2]},
+		{"target=" + url.QueryEscape("https://blog.example.com/a"), urls[4:5]},
+		{"key=" + url.QueryEscape("GET https://shop.example.com/a?page=2"), urls[2:3]},
+		{"prefix=" + url.QueryEscape("https://shop.example.com/"), urls[:4]},
+		{"pattern=" + url.QueryEscape(`\.css$`), []string{urls[3], urls[5]}},
+		{"target=" + url.QueryEscape("https://other.example.com/"), nil},
+	} {
+		useTestCache(t, cache.Options{})
+		setTestEntries(urls...)
+		if purged, code := purgeCount(t, test.query, ""); purged != len(test.purged) {
+			t.Fatalf("purge ?%s: got %d entries (%d), want %d", test.query, purged, code, len(test.purged))
+		}
+		for _, u := range urls {
+			_, cached := proxyCache.Get("GET " + u)
+			if cached == slices.Contains(test.purged, u) {
+				t.Fatalf("purge ?%s: got %s cached %v", test.query, u, cached)
+			}
+		}
+	}
+
+	for _, test := range []struct {
+		method string
+		query  string
+		code   int
+	}{
+		{"GET", "prefix=https", http.StatusMethodNotAllowed},
+		{"DELETE", "", http.StatusBadRequest},
+		{"DELETE", "pattern=(", http.StatusBadRequest},
+		{"DELETE", "prefix=https&soft=maybe", http.StatusBadRequest},
+	} {
+		w := adminRequest(adminPurgeHandler, test.method, "/admin/purge?"+test.query)
+		if w.Code != test.code {
+			t.Errorf("%s ?%s: got %d, want %d", test.method, test.query, w.Code, test.code)
+		}
+	}
+}
+
+func TestSoftPurge(t *testing.T) {
+	useTestCache(t, cache.Options{StaleRetention: time.Hour})
+	setTestEntries("https://example.com/a", "https://example.com/b")
+	if purged, code := purgeCount(t, "soft=true&prefix=https", ""); purged != 2 {
+		t.Fatalf("soft purge: got %d entries (%d), want 2", purged, code)
+	}
+	// Entries already stale are left as they are
+	if purged, code := purgeCount(t, "soft=true&key="+url.QueryEscape("GET https://example.com/a"), ""); purged != 0 {
+		t.Fatalf("soft purge of a stale key: got %d entries (%d), want 0", purged, code)
+	}
+	for _, u := range []string{"https://example.com/a", "https://example.com/b"} {
+		if _, ok := proxyCache.Get("GET " + u); ok {
+			t.Fatalf("soft purge: got %s fresh", u)
+		}
+		if _, ok := proxyCache.Namespace(cache.DefaultNamespace).GetStale("GET " + u); !ok {
+			t.Fatalf("soft purge: got %s removed, want it kept stale", u)
+		}
+	}
+}
+
+func TestPurgeTenant(t *testing.T) {
+	useTestCache(t, cache.Options{})
+	useAdminTokens(t, "shop purger shop shop.example.com\nviewer viewer\n")
+	urls := []string{"https://shop.example.com/a", "https://blog.example.com/a"}
+	setTestEntries(urls...)
+
+	if _, code := purgeCount(t, "prefix=https", "viewer"); code != http.StatusForbidden {
+		t.Fatalf("purge by a viewer: got %d, want 403", code)
+	}
+	if _, code := purgeCount(t, "target="+url.QueryEscape(urls[1]), "shop"); code != http.StatusForbidden {
+		t.Fatalf("purge of another tenant's URL: got %d, want 403", code)
+	}
+	if purged, _ := purgeCount(t, "key="+url.QueryEscape("GET "+urls[1]), "shop"); purged != 0 {
+		t.Fatalf("purge of another tenant's key: got %d entries, want 0", purged)
+	}
+	if purged, _ := purgeCount(t, "prefix=https", "shop"); purged != 1 {
+		t.Fatalf("purge of every URL by a tenant: got %d entries, want 1", purged)
+	}
+	if _, ok := proxyCache.Get("GET " + urls[1]); !ok {
+		t.Fatal("purge by a tenant: removed another tenant's entry")
+	}
+}
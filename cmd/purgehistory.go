@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var purgeHistorySize = flag.Int("purge-history", 1000, "number of purges remembered for /admin/purges; the oldest are forgotten first")
+
+// purgeRecord describes a purge: who removed entries, what they selected and how many entries were
+// removed.
+type purgeRecord struct {
+	Time    time.Time
+	Who     string
+	Client  string `json:",omitempty"`
+	Tenant  string `json:",omitempty"`
+	Kind    string
+	URLs    []string `json:",omitempty"`
+	Prefix  string   `json:",omitempty"`
+	Pattern string   `json:",omitempty"`
+	Key     string   `json:",omitempty"`
+	Tags    []string `json:",omitempty"`
+	Entries int
+}
+
+// purgeHistory holds the most recent -purge-history purges, oldest first.
+var purgeHistory struct {
+	sync.Mutex
+	records []purgeRecord
+}
+
+// The recordPurge function adds a purge to the history, forgetting the oldest ones beyond
+// -purge-history.
+func recordPurge(record purgeRecord) {
+	if *purgeHistorySize <= 0 {
+		return
+	}
+	record.Time = time.Now()
+	purgeHistory.Lock()
+	defer purgeHistory.Unlock()
+	purgeHistory.records = append(purgeHistory.records, record)
+	if excess := len(purgeHistory.records) - *purgeHistorySize; excess > 0 {
+		purgeHistory.records = slices.Delete(purgeHistory.records, 0, excess)
+	}
+}
+
+// The `matches` method in the `purgeRecord` struct reports whether a purge selected a URL containing
+// the given text, either directly or through its prefix or pattern.
+func (r purgeRecord) matches(text string) bool {
+	if strings.Contains(r.Prefix, text) || strings.Contains(r.Pattern, text) {
+		return true
+	}
+	return slices.ContainsFunc(r.URLs, func(u string) bool { return strings.Contains(u, text) })
+}
+
+// The adminPurgesHandler function returns the purge history, newest first, optionally filtered by
+// ?who=, ?url= (a substring of the purged URLs, prefix or pattern), ?since= and ?until= (RFC 3339 times), and
+// limited to ?limit= records. Tenant-scoped callers only see their tenant's purges.
+func adminPurgesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := authorize(w, r, roleViewer, false)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	var since, until time.Time
+	for name, t := range map[string]*time.Time{"since": &since, "until": &until} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, "Invalid '"+name+"' parameter: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			*t = parsed
+		}
+	}
+	limit := *purgeHistorySize
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid 'limit' parameter", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	purgeHistory.Lock()
+	records := slices.Clone(purgeHistory.records)
+	purgeHistory.Unlock()
+
+	matched := []purgeRecord{}
+	for i := len(records) - 1; i >= 0 && len(matched) < limit; i-- {
+		record := records[i]
+		switch {
+		case p.scoped() && record.Tenant != p.tenant:
+		case query.Get("who") != "" && record.Who != query.Get("who"):
+		case query.Get("url") != "" && !record.matches(query.Get("url")):
+		case !since.IsZero() && record.Time.Before(since):
+		case !until.IsZero() && record.Time.After(until):
+		default:
+			matched = append(matched, record)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(matched)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+// The rangeable function reports whether a request for a cached entry may be answered with a range of
+// its body: GET requests for entries of complete (200 OK) responses.
+func rangeable(r *http.Request, entry cache.Entry) bool {
+	return r.Method == "GET" && entry.Response.StatusCode == http.StatusOK
+}
+
+// The requestedRange function returns the byte range of a body of size bytes that the Range header of
+// a request asks for, as its offset and length, and whether there is one to serve. Requests without a
+// Range header, with several ranges or other units, or whose If-Range no longer matches the entry get
+// the whole body. A range starting past the end of the body is unsatisfiable: satisfiable is false.
+func requestedRange(r *http.Request, entry cache.Entry, size int64) (offset, length int64, ranged, satisfiable bool) {
+	spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes=")
+	if !ok || strings.Contains(spec, ",") || !ifRangeMatches(r.Header.Get("If-Range"), entry) {
+		return 0, 0, false, true
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, false, true
+	}
+	if first == "" {
+		// A suffix range: the last bytes of the body
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false, true
+		}
+		if n == 0 {
+			return 0, 0, true, false
+		}
+		n = min(n, size)
+		return size - n, n, true, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false, true
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false, true
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, true, false
+	}
+	return start, end - start + 1, true, true
+}
+
+// The ifRangeMatches function reports whether an If-Range header allows a range of an entry to be
+// served: when it is absent, names the entry's ETag with a strong comparison, or is the exact
+// Last-Modified date of the entry (RFC 9110, section 13.1.5).
+func ifRangeMatches(ifRange string, entry cache.Entry) bool {
+	switch {
+	case ifRange == "":
+		return true
+	case strings.HasPrefix(ifRange, `"`):
+		return entry.ETag != "" && !strings.HasPrefix(entry.ETag, "W/") && ifRange == entry.ETag
+	case strings.HasPrefix(ifRange, "W/"):
+		return false
+	}
+	lastModified := entry.Response.Header.Get("Last-Modified")
+	return lastModified != "" && ifRange == lastModified
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+var adminTokensFile = flag.String("admin-tokens-file", "", "file of admin API tokens, one 'token role [tenant host,host...]' per line (roles: viewer, purger, admin); when neither this, -oidc-issuer nor -purge-keys-file is set the admin API only answers loopback clients, see -admin-insecure")
+
+var adminInsecure = flag.Bool("admin-insecure", false, "open the admin API to every client when neither -admin-tokens-file, -oidc-issuer nor -purge-keys-file is set, instead of only to loopback clients")
+
+// role is an admin API permission level. Each role includes the permissions of the roles below it.
+type role int
+
+const (
+	roleViewer role = iota + 1
+	rolePurger
+	roleAdmin
+)
+
+var roleNames = map[string]role{"viewer": roleViewer, "purger": rolePurger, "admin": roleAdmin}
+
+func (r role) String() string {
+	for name, value := range roleNames {
+		if value == r {
+			return name
+		}
+	}
+	return "none"
+}
+
+// principal is the caller of an admin API request. A principal with a tenant is scoped: it may only
+// see and act on entries and jobs of its tenant's hosts.
+type principal struct {
+	role   role
+	tenant string
+	hosts  map[string]bool
+	// name identifies the caller in the purge history: the OIDC username, email or subject, or a
+	// fingerprint of a static token. client is the address the request came from.
+	name   string
+	client string
+}
+
+// unrestricted is the principal of admin requests when no tokens are configured. Unless -admin-insecure
+// is set, only loopback clients get it.
+var unrestricted = principal{role: roleAdmin, name: "anonymous"}
+
+// adminToken is a configured admin API credential.
+type adminToken struct {
+	token string
+	principal
+}
+
+var adminTokens []adminToken
+
+// The loadAdminTokens function reads the -admin-tokens-file. Blank lines and lines starting with # are
+// ignored.
+func loadAdminTokens(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 && len(fields) != 4 {
+			return fmt.Errorf("%s:%d: expected 'token role [tenant host,host...]'", path, line)
+		}
+		r, ok := roleNames[fields[1]]
+		if !ok {
+			return fmt.Errorf("%s:%d: unknown role %q", path, line, fields[1])
+		}
+		t := adminToken{token: fields[0], principal: principal{role: r, name: tokenFingerprint(fields[0])}}
+		if len(fields) == 4 {
+			t.tenant = fields[2]
+			if t.hosts, err = tenantHosts(fields[3]); err != nil {
+				return fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+		}
+		adminTokens = append(adminTokens, t)
+	}
+	return scanner.Err()
+}
+
+// The tenantHosts function parses the comma-separated hosts a tenant owns.
+func tenantHosts(list string) (map[string]bool, error) {
+	hosts := make(map[string]bool)
+	for _, host := range strings.Split(list, ",") {
+		normalized, err := normalizeHost(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host %q: %w", host, err)
+		}
+		hosts[normalized] = true
+	}
+	return hosts, nil
+}
+
+// The tokenFingerprint function names a static token without revealing it.
+func tokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:4])
+}
+
+// The `scoped` method in the `principal` struct reports whether the principal is limited to a tenant.
+func (p principal) scoped() bool {
+	return p.tenant != ""
+}
+
+// The `allowsURL` method in the `principal` struct reports whether the principal may see or act on
+// entries for the given URL.
+func (p principal) allowsURL(rawURL string) bool {
+	if !p.scoped() {
+		return true
+	}
+	u, err := parseTarget(rawURL)
+	return err == nil && p.hosts[u.Hostname()]
+}
+
+// The `allowsJob` method in the `principal` struct reports whether the principal may see or cancel a
+// job.
+func (p principal) allowsJob(job Job) bool {
+	return !p.scoped() || job.Tenant == p.tenant
+}
+
+// The authorize function authenticates an admin API request by its bearer token, either a static token
+// or an OIDC token from the -oidc-issuer, and checks that the caller holds at least the needed role.
+// Without any credentials configured, loopback clients are admins (see -admin-insecure). Operations on
+// the whole cache pass global, which scoped principals are never allowed. On failure it writes the
+// error response and returns false.
+func authorize(w http.ResponseWriter, r *http.Request, need role, global bool) (principal, bool) {
+	if len(adminTokens) == 0 && *oidcIssuer == "" && len(purgeKeys) == 0 {
+		p := unrestricted
+		p.client = clientIP(r)
+		if addr, err := netip.ParseAddr(p.client); !*adminInsecure && (err != nil || !addr.IsLoopback()) {
+			http.Error(w, "Forbidden: without admin credentials configured, only loopback clients are allowed", http.StatusForbidden)
+			return principal{}, false
+		}
+		return p, true
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	p, found := principal{}, false
+	for _, t := range adminTokens {
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(t.token)) == 1 {
+			p, found = t.principal, true
+			break
+		}
+	}
+	if !found && ok && *oidcIssuer != "" && strings.Count(token, ".") == 2 {
+		var err error
+		if p, err = oidc.verify(token); err == nil {
+			found = true
+		} else {
+			slog.Warn("Rejected OIDC token", "client", clientIP(r), "error", err)
+		}
+	}
+	if !found {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return principal{}, false
+	}
+
+	p.client = clientIP(r)
+	if p.role < need {
+		http.Error(w, "Forbidden: requires the "+need.String()+" role", http.StatusForbidden)
+		return principal{}, false
+	}
+	if global && p.scoped() {
+		http.Error(w, "Forbidden: not available to tenant-scoped tokens", http.StatusForbidden)
+		return principal{}, false
+	}
+	return p, true
+}
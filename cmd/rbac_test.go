@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The useAdminTokens function loads an -admin-tokens-file with the given contents for the rest of the
+// test.
+func useAdminTokens(t *testing.T, contents string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setVar(t, &adminTokens, nil)
+	if err := loadAdminTokens(path); err != nil {
+		t.Fatalf("loadAdminTokens: %v", err)
+	}
+}
+
+func TestAuthorizeWithoutCredentials(t *testing.T) {
+	for _, test := range []struct {
+		remote   string
+		insecure bool
+		allow    bool
+	}{
+		{"127.0.0.1:1234", false, true},
+		{"[::1]:1234", false, true},
+		{"192.0.2.1:1234", false, false},
+		{"192.0.2.1:1234", true, true},
+	} {
+		setVar(t, adminInsecure, test.insecure)
+		r := httptest.NewRequest("GET", "/admin/stats", nil)
+		r.RemoteAddr = test.remote
+		w := httptest.NewRecorder()
+		p, ok := authorize(w, r, roleAdmin, true)
+		if ok != test.allow {
+			t.Fatalf("authorize from %s with -admin-insecure=%v: got %v (%d), want %v", test.remote, test.insecure, ok, w.Code, test.allow)
+		}
+		if !ok && w.Code != http.StatusForbidden {
+			t.Fatalf("authorize from %s: got status %d, want 403", test.remote, w.Code)
+		}
+		if ok && (p.role != roleAdmin || p.name != "anonymous") {
+			t.Fatalf("authorize from %s: got %+v, want an anonymous admin", test.remote, p)
+		}
+	}
+}
+
+func TestAuthorizeTokens(t *testing.T) {
+	useAdminTokens(t, `
+# token  role    tenant hosts
+ops      admin
+shop     purger  shop   shop.example.com,static.shop.example.com
+viewer   viewer
+`)
+	for _, test := range []struct {
+		name   string
+		token  string
+		need   role
+		global bool
+		code   int
+	}{
+		{"admin", "ops", roleAdmin, true, http.StatusOK},
+		{"purger", "shop", rolePurger, false, http.StatusOK},
+		{"purger for an admin operation", "shop", roleAdmin, false, http.StatusForbidden},
+		{"tenant for a global operation", "shop", rolePurger, true, http.StatusForbidden},
+		{"viewer", "viewer", roleViewer, true, http.StatusOK},
+		{"viewer for a purge", "viewer", rolePurger, false, http.StatusForbidden},
+		{"unknown token", "other", roleViewer, false, http.StatusUnauthorized},
+		{"no token", "", roleViewer, false, http.StatusUnauthorized},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/admin/stats", nil)
+			r.RemoteAddr = "127.0.0.1:1234"
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			w := httptest.NewRecorder()
+			_, ok := authorize(w, r, test.need, test.global)
+			if ok != (test.code == http.StatusOK) || w.Code != test.code {
+				t.Fatalf("authorize: got %v and %d, want %d", ok, w.Code, test.code)
+			}
+		})
+	}
+}
+
+func TestPrincipalAllowsURL(t *testing.T) {
+	useAdminTokens(t, "shop purger shop Shop.Example.com\n")
+	p := adminTokens[0].principal
+	for url, allowed := range map[string]bool{
+		"https://shop.example.com/cart":      true,
+		"http://shop.example.com:8080/":      true,
+		"https://static.shop.example.com/":   false,
+		"https://example.com/":               false,
+		"https://shop.example.com.evil.com/": false,
+	} {
+		if got := p.allowsURL(url); got != allowed {
+			t.Errorf("allowsURL(%q): got %v, want %v", url, got, allowed)
+		}
+	}
+	if !unrestricted.allowsURL("https://example.com/") {
+		t.Error("allowsURL of an unscoped principal: got false")
+	}
+	if !p.allowsJob(Job{Tenant: "shop"}) || p.allowsJob(Job{Tenant: "other"}) {
+		t.Error("allowsJob: a tenant's principal should only see the tenant's jobs")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var redirectListen = flag.String("redirect-listen", "", "address of a plain HTTP listener that only redirects to the HTTPS listener with 301 (e.g. :80); requires -tls-cert")
+
+var hstsMaxAge = flag.Duration("hsts-max-age", 0, "max-age of the Strict-Transport-Security header sent on HTTPS responses (e.g. 8760h), 0 to not send it")
+
+var hstsIncludeSubdomains = flag.Bool("hsts-include-subdomains", false, "add includeSubDomains to the Strict-Transport-Security header")
+
+var hstsPreload = flag.Bool("hsts-preload", false, "add preload to the Strict-Transport-Security header; browsers' preload lists also require includeSubDomains and a max-age of at least a year")
+
+// The hstsHeader function returns the Strict-Transport-Security header value configured by the flags,
+// or an empty string when HSTS is disabled.
+func hstsHeader() string {
+	if *hstsMaxAge <= 0 {
+		return ""
+	}
+	value := fmt.Sprintf("max-age=%d", int64(hstsMaxAge.Seconds()))
+	if *hstsIncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if *hstsPreload {
+		value += "; preload"
+	}
+	return value
+}
+
+// The withHSTS function adds the Strict-Transport-Security header to every response sent over TLS.
+func withHSTS(next http.Handler) http.Handler {
+	value := hstsHeader()
+	if value == "" {
+		return next
+	}
+	if *hstsPreload && (!*hstsIncludeSubdomains || *hstsMaxAge < 365*24*time.Hour) {
+		slog.Warn("HSTS preload lists require includeSubDomains and a max-age of at least a year")
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The redirectHandler function returns a handler that permanently redirects every request to the same
+// host and path on the HTTPS listener at httpsPort.
+func redirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		if httpsPort != "443" {
+			host += ":" + httpsPort
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// The httpsPort function returns the port of the first -listen address, which redirects point to.
+func httpsPort() string {
+	addr := strings.TrimSpace(strings.Split(*listenAddrs, ",")[0])
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		return port
+	}
+	return "443"
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+var revalidateConcurrency = newIntValue("revalidate-concurrency", 4, "maximum number of concurrent origin requests made by a revalidation or warm job")
+
+// The adminRevalidateHandler function starts a revalidation job for the entries selected by a JSON
+// body with 'urls' and/or 'pattern' on POST, and reports a job's status on GET ?id=<job ID>.
+func adminRevalidateHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		p, ok := authorize(w, r, roleViewer, false)
+		if !ok {
+			return
+		}
+		writeJobStatus(w, r.URL.Query().Get("id"), p)
+
+	case "POST":
+		p, ok := authorize(w, r, rolePurger, false)
+		if !ok {
+			return
+		}
+		var body jobRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		body.Kind = "revalidate"
+		job, err := startJob(body, p)
+		if err != nil {
+			http.Error(w, "Invalid job request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"ID": job.ID})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// errNotRevalidatable is returned for entries whose original request cannot be replayed.
+var errNotRevalidatable = errors.New("only GET entries not varying on credentials can be revalidated")
+
+// errNotStorable is returned when the target server's Cache-Control no longer allows a response to be
+// cached. The stale entry is removed.
+var errNotStorable = errors.New("response may not be cached")
+
+// The revalidateEntry function replays the request that filled an entry and replaces the entry with
+// the origin's current response. The request is replayed without its credentials, which aren't kept,
+// so entries varying on them are not revalidated.
+func revalidateEntry(namespace, key string, entry cache.Entry) error {
+	original := entry.Response.Request
+	if original.Method != "GET" || variesOnCredentials(entry.Vary) {
+		return errNotRevalidatable
+	}
+	req, err := http.NewRequest("GET", original.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = original.Header.Clone()
+	conditional := addValidators(req, entry)
+
+	fresh, err := fetchEntry(withChunking(req))
+	if err != nil {
+		return err
+	}
+	// An origin advertising a new version drops the namespace of the entries of the previous one
+	if *versionHeader != "" && originNamespace(req.URL).Name() != namespace {
+		proxyCache.RemoveBody(fresh)
+		return errNotStorable
+	}
+	if conditional && fresh.Response.StatusCode == http.StatusNotModified {
+		if _, storable := refreshStale(proxyCache.Namespace(namespace), key, entry, req, fresh.Response); !storable {
+			return errNotStorable
+		}
+		return nil
+	}
+	fresh.Identity = entry.Identity
+	ttl, storable := responseTTL(req, fresh.Response)
+	if !storable {
+		proxyCache.Namespace(namespace).Delete(key)
+		proxyCache.RemoveBody(fresh)
+		return errNotStorable
+	}
+	route := routeFor(req.URL)
+	route.keepRevisions(proxyCache.Namespace(namespace), key, &fresh)
+	compressStored(route, &fresh)
+	proxyCache.Namespace(namespace).Set(key, fresh, ttl)
+	return nil
+}
+
+// The addValidators function makes a request to the target server conditional on a stale entry still
+// being current, using the validators (ETag and Last-Modified) the target server sent with it. It
+// reports whether the entry had any validator.
+func addValidators(req *http.Request, stale cache.Entry) bool {
+	etag := stale.Response.Header.Get("ETag")
+	lastModified := stale.Response.Header.Get("Last-Modified")
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	return etag != "" || lastModified != ""
+}
+
+// The refreshStale function makes a stale entry fresh again after the target server answered a
+// conditional request for it with 304 Not Modified, updating its stored headers with those of the 304
+// response as RFC 9111 requires. The new lifetime follows the updated headers; when they no longer
+// allow the response to be cached the entry is removed and false is returned. Either way the returned
+// entry can be served for req.
+func refreshStale(namespace *cache.Namespace, key string, stale cache.Entry, req *http.Request, notModified cache.ResponseRecord) (cache.Entry, bool) {
+	response := stale.Response
+	response.Header = stale.Response.Header.Clone()
+	for name, values := range notModified.Header {
+		if name != "Content-Length" {
+			response.Header[name] = values
+		}
+	}
+	updated := stale
+	updated.Response = response
+
+	ttl, storable := responseTTL(req, response)
+	if !storable {
+		namespace.Delete(key)
+		return updated, false
+	}
+	if refreshed, ok := namespace.Refresh(key, ttl, func(entry *cache.Entry) { entry.Response = response }); ok {
+		return refreshed, true
+	}
+	return updated, true
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+func TestAddValidators(t *testing.T) {
+	lastModified := "Mon, 02 Jan 2006 15:04:05 GMT"
+	for _, test := range []struct {
+		name        string
+		header      http.Header
+		ifNoneMatch string
+		ifModified  string
+	}{
+		{"ETag", http.Header{"Etag": {`"v1"`}}, `"v1"`, ""},
+		{"Last-Modified", http.Header{"Last-Modified": {lastModified}}, "", lastModified},
+		{"both", http.Header{"Etag": {`W/"v1"`}, "Last-Modified": {lastModified}}, `W/"v1"`, lastModified},
+		{"none", http.Header{}, "", ""},
+	} {
+		req := httptest.NewRequest("GET", "https://example.com/", nil)
+		conditional := addValidators(req, cache.Entry{Response: cache.ResponseRecord{Header: test.header}})
+		if conditional != (test.ifNoneMatch != "" || test.ifModified != "") {
+			t.Errorf("addValidators with %s: got %v", test.name, conditional)
+		}
+		if got := req.Header.Get("If-None-Match"); got != test.ifNoneMatch {
+			t.Errorf("addValidators with %s: got If-None-Match %q, want %q", test.name, got, test.ifNoneMatch)
+		}
+		if got := req.Header.Get("If-Modified-Since"); got != test.ifModified {
+			t.Errorf("addValidators with %s: got If-Modified-Since %q, want %q", test.name, got, test.ifModified)
+		}
+	}
+}
+
+func TestProxyRevalidatesStaleEntry(t *testing.T) {
+	useTestCache(t, cache.Options{StaleRetention: time.Hour})
+	var fetched, revalidated atomic.Int64
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			revalidated.Add(1)
+			w.Header().Set("Cache-Control", "max-age=120")
+			w.Header().Set("X-Revision", "2")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fetched.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("X-Revision", "1")
+		w.Write([]byte("body"))
+	}))
+	defer target.Close()
+
+	proxyGet(target.URL)
+	expireAll()
+	w := proxyGet(target.URL)
+	if w.Code != http.StatusOK || w.Body.String() != "body" || w.Header().Get("X-Revision") != "2" {
+		t.Fatalf("request for a stale entry: got %d %q with X-Revision %q, want the body with the headers of the 304", w.Code, w.Body, w.Header().Get("X-Revision"))
+	}
+	if fetched.Load() != 1 || revalidated.Load() != 1 {
+		t.Fatalf("requests to the target: got %d full and %d conditional, want 1 and 1", fetched.Load(), revalidated.Load())
+	}
+	proxyGet(target.URL)
+	if fetched.Load() != 1 || revalidated.Load() != 1 {
+		t.Fatal("request after revalidation: got a request to the target, want the refreshed entry served")
+	}
+}
+
+func TestRevalidateEntryNotReplayable(t *testing.T) {
+	for name, entry := range map[string]cache.Entry{
+		"POST entry": {Response: cache.ResponseRecord{Request: cache.RequestRecord{Method: "POST", URL: "https://example.com/"}}},
+		"entry varying on Cookie": {
+			Response: cache.ResponseRecord{Request: cache.RequestRecord{Method: "GET", URL: "https://example.com/"}},
+			Vary:     []string{"Cookie"},
+		},
+	} {
+		if err := revalidateEntry(cache.DefaultNamespace, "key", entry); err != errNotRevalidatable {
+			t.Errorf("revalidateEntry of a %s: got error %v, want errNotRevalidatable", name, err)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+// route holds the annotations of a -route definition, applying to targets starting with Prefix.
+type route struct {
+	Prefix string
+	// TTL replaces -ttl for responses without an explicit lifetime; zero keeps -ttl.
+	TTL time.Duration
+	// SWR is how long after expiry a stale entry is still served while it is revalidated in the
+	// background (stale-while-revalidate).
+	SWR time.Duration
+	// Bypass forwards every request for the route without caching.
+	Bypass bool
+	// BypassParams are query parameters whose presence bypasses the cache (e.g. preview).
+	BypassParams []string
+	// IgnoreParams are query parameters left out of the cache key (e.g. utm_source), so requests that
+	// only differ in them share an entry.
+	IgnoreParams []string
+	// ConnectTimeout, TTFBTimeout and TransferTimeout replace the -upstream-*-timeout flags when set.
+	ConnectTimeout  time.Duration
+	TTFBTimeout     time.Duration
+	TransferTimeout time.Duration
+	// Revisions is the number of previous versions of each entry kept when it is replaced.
+	Revisions int
+	// Schema, if set, is the JSON Schema successful GET responses must match to be served and cached.
+	Schema     *jsonSchema
+	SchemaFile string
+	// Respond, if set, is the status requests for the route are answered with by the proxy itself,
+	// with RespondBody and RespondHeader, without contacting the target server.
+	Respond       int
+	RespondFile   string
+	RespondBody   []byte
+	RespondHeader http.Header
+	// Delay, DelayJitter and ErrorRate inject faults for clients under test when -fault-injection is
+	// set: requests are delayed by Delay plus up to DelayJitter, and ErrorRate of them are answered with
+	// ErrorStatus (503 when zero).
+	Delay       time.Duration
+	DelayJitter time.Duration
+	ErrorRate   float64
+	ErrorStatus int
+	// SLOLatency, if set, declares a latency SLO: SLOLatencyTarget of the requests to the target server
+	// must take at most SLOLatency. SLOAvailability, if set, declares an availability SLO: that share
+	// of them must get a response other than a 5xx.
+	SLOLatency       time.Duration
+	SLOLatencyTarget float64
+	SLOAvailability  float64
+}
+
+// routes holds the -route definitions.
+var routes []route
+
+func init() {
+	flag.Func("route", "target URL prefix followed by annotations, e.g. 'https://example.com/news/ ttl=5m, swr=1m, bypass_params=[preview]'; may be repeated, the longest matching prefix applies", func(value string) error {
+		r, err := parseRoute(value)
+		if err != nil {
+			return err
+		}
+		routes = append(routes, r)
+		return nil
+	})
+}
+
+// The parseRoute function parses a route definition: a target URL prefix, whitespace, and
+// comma-separated annotations. Supported annotations are ttl=<duration>, swr=<duration>, bypass,
+// bypass_params=[<name>,...], ignore_params=[<name>,...], connect_timeout=<duration>,
+// ttfb_timeout=<duration>, transfer_timeout=<duration>, revisions=<count>, schema=<file>,
+// respond=<status>, respond_body=<file>, respond_header=[<name>: <value>], which may be repeated,
+// delay=<duration>, delay_jitter=<duration>, error_rate=<fraction>, error_status=<status>,
+// slo_latency=<duration>, slo_latency_target=<fraction> and slo_availability=<fraction>.
+func parseRoute(value string) (route, error) {
+	prefix, annotations, _ := strings.Cut(strings.TrimSpace(value), " ")
+	r := route{Prefix: prefix}
+	if prefix == "" {
+		return r, errors.New("missing target URL prefix")
+	}
+	for _, annotation := range splitAnnotations(annotations) {
+		name, arg, _ := strings.Cut(annotation, "=")
+		name, arg = strings.TrimSpace(name), strings.TrimSpace(arg)
+		var err error
+		switch name {
+		case "ttl":
+			r.TTL, err = time.ParseDuration(arg)
+		case "swr":
+			r.SWR, err = time.ParseDuration(arg)
+		case "connect_timeout":
+			r.ConnectTimeout, err = time.ParseDuration(arg)
+		case "ttfb_timeout":
+			r.TTFBTimeout, err = time.ParseDuration(arg)
+		case "transfer_timeout":
+			r.TransferTimeout, err = time.ParseDuration(arg)
+		case "revisions":
+			r.Revisions, err = strconv.Atoi(arg)
+			if err == nil && r.Revisions < 0 {
+				err = errors.New("must not be negative")
+			}
+		case "schema":
+			r.SchemaFile = arg
+			r.Schema, err = loadJSONSchema(arg)
+		case "respond":
+			r.Respond, err = strconv.Atoi(arg)
+			if err == nil && (r.Respond < 100 || r.Respond > 599) {
+				err = errors.New("must be an HTTP status code")
+			}
+		case "respond_body":
+			r.RespondFile = arg
+			r.RespondBody, err = os.ReadFile(arg)
+		case "respond_header":
+			err = r.addRespondHeader(arg)
+		case "delay":
+			r.Delay, err = time.ParseDuration(arg)
+		case "delay_jitter":
+			r.DelayJitter, err = time.ParseDuration(arg)
+		case "error_rate":
+			r.ErrorRate, err = strconv.ParseFloat(arg, 64)
+			if err == nil && !(r.ErrorRate >= 0 && r.ErrorRate <= 1) {
+				err = errors.New("must be between 0 and 1")
+			}
+		case "error_status":
+			r.ErrorStatus, err = strconv.Atoi(arg)
+			if err == nil && (r.ErrorStatus < 400 || r.ErrorStatus > 599) {
+				err = errors.New("must be an HTTP error status code")
+			}
+		case "slo_latency":
+			r.SLOLatency, err = time.ParseDuration(arg)
+			if err == nil && r.SLOLatency <= 0 {
+				err = errors.New("must be positive")
+			}
+		case "slo_latency_target":
+			r.SLOLatencyTarget, err = parseObjective(arg)
+		case "slo_availability":
+			r.SLOAvailability, err = parseObjective(arg)
+		case "bypass":
+			r.Bypass = arg == "" || arg == "true"
+		case "bypass_params":
+			r.BypassParams, err = parseParamList(arg)
+		case "ignore_params":
+			r.IgnoreParams, err = parseParamList(arg)
+		default:
+			return r, fmt.Errorf("unknown route annotation %q", name)
+		}
+		if err != nil {
+			return r, fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	if r.Respond == 0 && (r.RespondFile != "" || r.RespondHeader != nil) {
+		return r, errors.New("respond_body and respond_header require respond")
+	}
+	if r.ErrorStatus != 0 && r.ErrorRate == 0 {
+		return r, errors.New("error_status requires error_rate")
+	}
+	if r.SLOLatencyTarget != 0 && r.SLOLatency == 0 {
+		return r, errors.New("slo_latency_target requires slo_latency")
+	}
+	if r.SLOLatency > 0 && r.SLOLatencyTarget == 0 {
+		r.SLOLatencyTarget = 0.99
+	}
+	if r.Respond != 0 && len(r.RespondBody) > 0 && r.RespondHeader.Get("Content-Type") == "" {
+		contentType := mime.TypeByExtension(filepath.Ext(r.RespondFile))
+		if contentType == "" {
+			contentType = http.DetectContentType(r.RespondBody)
+		}
+		r.addRespondHeader("[Content-Type: " + contentType + "]")
+	}
+	return r, nil
+}
+
+// The parseObjective function parses the share of requests an SLO requires to be good, which must be
+// between 0 and 1, exclusive, so that an error budget remains.
+func parseObjective(arg string) (float64, error) {
+	objective, err := strconv.ParseFloat(arg, 64)
+	if err == nil && !(objective > 0 && objective < 1) {
+		err = errors.New("must be between 0 and 1, exclusive")
+	}
+	return objective, err
+}
+
+// The `addRespondHeader` method in the `route` struct adds a [<name>: <value>] header to the
+// responses of a respond route. The brackets let values contain commas.
+func (r *route) addRespondHeader(arg string) error {
+	header, ok := strings.CutPrefix(arg, "[")
+	if header, ok = strings.CutSuffix(header, "]"); !ok {
+		return fmt.Errorf("must be [<name>: <value>], got %q", arg)
+	}
+	name, value, ok := strings.Cut(header, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsAny(name, " \t\"(),/:;<=>?@[\\]{}") || strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("must be [<name>: <value>], got %q", arg)
+	}
+	if r.RespondHeader == nil {
+		r.RespondHeader = make(http.Header)
+	}
+	r.RespondHeader.Add(name, strings.TrimSpace(value))
+	return nil
+}
+
+// The parseParamList function parses the [<name>, ...] argument of a list annotation.
+func parseParamList(arg string) ([]string, error) {
+	list, ok := strings.CutPrefix(arg, "[")
+	if list, ok = strings.CutSuffix(list, "]"); !ok {
+		return nil, fmt.Errorf("must be a [list], got %q", arg)
+	}
+	var params []string
+	for _, param := range strings.Split(list, ",") {
+		if param = strings.TrimSpace(param); param != "" {
+			params = append(params, param)
+		}
+	}
+	return params, nil
+}
+
+// The `String` method in the `route` struct formats the route as a -route definition.
+func (r route) String() string {
+	var annotations []string
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{{"ttl", r.TTL}, {"swr", r.SWR}, {"connect_timeout", r.ConnectTimeout}, {"ttfb_timeout", r.TTFBTimeout}, {"transfer_timeout", r.TransferTimeout}, {"delay", r.Delay}, {"delay_jitter", r.DelayJitter}, {"slo_latency", r.SLOLatency}} {
+		if d.value > 0 {
+			annotations = append(annotations, d.name+"="+formatDuration(d.value))
+		}
+	}
+	if r.Bypass {
+		annotations = append(annotations, "bypass")
+	}
+	if len(r.BypassParams) > 0 {
+		annotations = append(annotations, "bypass_params=["+strings.Join(r.BypassParams, ", ")+"]")
+	}
+	if len(r.IgnoreParams) > 0 {
+		annotations = append(annotations, "ignore_params=["+strings.Join(r.IgnoreParams, ", ")+"]")
+	}
+	if r.Revisions > 0 {
+		annotations = append(annotations, "revisions="+strconv.Itoa(r.Revisions))
+	}
+	if r.SchemaFile != "" {
+		annotations = append(annotations, "schema="+r.SchemaFile)
+	}
+	if r.Respond != 0 {
+		annotations = append(annotations, "respond="+strconv.Itoa(r.Respond))
+	}
+	if r.RespondFile != "" {
+		annotations = append(annotations, "respond_body="+r.RespondFile)
+	}
+	var names []string
+	for name := range r.RespondHeader {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		for _, value := range r.RespondHeader[name] {
+			annotations = append(annotations, "respond_header=["+name+": "+value+"]")
+		}
+	}
+	if r.ErrorRate > 0 {
+		annotations = append(annotations, "error_rate="+strconv.FormatFloat(r.ErrorRate, 'g', -1, 64))
+	}
+	if r.ErrorStatus != 0 {
+		annotations = append(annotations, "error_status="+strconv.Itoa(r.ErrorStatus))
+	}
+	if r.SLOLatencyTarget > 0 {
+		annotations = append(annotations, "slo_latency_target="+strconv.FormatFloat(r.SLOLatencyTarget, 'g', -1, 64))
+	}
+	if r.SLOAvailability > 0 {
+		annotations = append(annotations, "slo_availability="+strconv.FormatFloat(r.SLOAvailability, 'g', -1, 64))
+	}
+	return strings.TrimSpace(r.Prefix + " " + strings.Join(annotations, ", "))
+}
+
+// The formatDuration function formats a duration without the zero units time.Duration adds, e.g. 5m
+// rather than 5m0s.
+func formatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// The splitAnnotations function splits annotations at the commas that are not inside a [list].
+func splitAnnotations(s string) []string {
+	var annotations []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				annotations = append(annotations, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	annotations = append(annotations, s[start:])
+
+	trimmed := annotations[:0]
+	for _, annotation := range annotations {
+		if annotation = strings.TrimSpace(annotation); annotation != "" {
+			trimmed = append(trimmed, annotation)
+		}
+	}
+	return trimmed
+}
+
+// The routeFor function returns the route with the longest prefix matching the target, or an empty
+// route when none does.
+func routeFor(target *url.URL) route {
+	var best route
+	for _, r := range routes {
+		if strings.HasPrefix(target.String(), r.Prefix) && len(r.Prefix) > len(best.Prefix) {
+			best = r
+		}
+	}
+	return best
+}
+
+// The `bypassReason` method in the `route` struct reports why a request for the target bypasses the
+// cache, if it does.
+func (r route) bypassReason(target *url.URL) (string, bool) {
+	if r.Bypass {
+		return "route " + r.Prefix, true
+	}
+	query := target.Query()
+	for _, param := range r.BypassParams {
+		if query.Has(param) {
+			return "query parameter " + param, true
+		}
+	}
+	return "", false
+}
+
+// The `keyURL` method in the `route` struct returns the target without the query parameters the route
+// leaves out of the cache key.
+func (r route) keyURL(target *url.URL) *url.URL {
+	query := target.Query()
+	if !slices.ContainsFunc(r.IgnoreParams, query.Has) {
+		return target
+	}
+	for _, param := range r.IgnoreParams {
+		query.Del(param)
+	}
+	keyed := *target
+	keyed.RawQuery = query.Encode()
+	return &keyed
+}
+
+// The `serveSynthetic` method in the `route` struct answers a request for a respond route with the
+// route's status, headers and body, without contacting the target server.
+func (r route) serveSynthetic(w http.ResponseWriter, req *http.Request, target *url.URL, client string) {
+	event := newCacheEvent(req, target, "", client)
+	defer recordCacheEvent(event)
+	slog.Debug("Serving synthetic response", "target", target.String(), "client", client, "route", r.Prefix)
+	entry := cache.Entry{
+		// Recorded as a GET so that HEAD requests get the Content-Length of the body
+		Response: cache.ResponseRecord{StatusCode: r.Respond, Header: r.RespondHeader, Request: cache.RequestRecord{Method: "GET", URL: target.String()}},
+		Body:     r.RespondBody,
+	}
+	if len(r.RespondBody) > 0 {
+		entry.ETag = contentETag(r.RespondBody)
+	}
+	event.Outcome, event.Status, event.Size = "static", r.Respond, len(r.RespondBody)
+	setCacheStatus(w, req, event)
+	writeEntry(w, req, entry)
+}
+
+// The `serveStale` method in the `route` struct reports whether a stale entry is still within the
+// route's stale-while-revalidate window.
+func (r route) serveStale(entry cache.Entry, now time.Time) bool {
+	return r.SWR > 0 && !entry.ExpiresAt.IsZero() && now.Before(entry.ExpiresAt.Add(r.SWR))
+}
+
+// The `keepRevisions` method in the `route` struct lets an entry about to be stored under key keep the
+// revisions of the entry it replaces, fresh or stale, when the route keeps revisions.
+func (r route) keepRevisions(namespace *cache.Namespace, key string, entry *cache.Entry) {
+	if r.Revisions == 0 {
+		return
+	}
+	previous, ok := namespace.Peek(key)
+	if !ok {
+		previous, ok = namespace.GetStale(key)
+	}
+	if !ok {
+		return
+	}
+	if err := entry.KeepRevision(previous, r.Revisions); err != nil {
+		slog.Error("Error keeping previous revision", "target", previous.Response.Request.URL, "error", err)
+	}
+}
+
+// The `validate` method in the `route` struct checks a successful GET response against the route's JSON
+// Schema, returning an error wrapping errInvalidPayload when it doesn't match.
+func (r route) validate(method string, status int, body []byte) error {
+	if r.Schema == nil || method != "GET" || status < 200 || status > 299 {
+		return nil
+	}
+	if err := r.Schema.validateBody(body); err != nil {
+		return fmt.Errorf("%w against %s: %v", errInvalidPayload, r.SchemaFile, err)
+	}
+	return nil
+}
+
+// revalidating holds the keys of stale entries being revalidated in the background, so each is only
+// fetched once.
+var revalidating sync.Map
+
+// The revalidateInBackground function refreshes a stale entry served under stale-while-revalidate.
+func revalidateInBackground(namespace *cache.Namespace, key string, entry cache.Entry) {
+	if _, busy := revalidating.LoadOrStore(key, true); busy {
+		return
+	}
+	go func() {
+		defer revalidating.Delete(key)
+		if err := revalidateEntry(namespace.Name(), key, entry); err != nil {
+			slog.Warn("Error revalidating in the background", "target", entry.Response.Request.URL, "error", err)
+		}
+	}()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var maxUpstreamInflight = newIntValue("max-upstream-inflight", 0, "maximum number of concurrent requests to target servers before requests that can't be served from cache are shed with 503, 0 for unlimited")
+
+var shedLatency = newDurationValue("shed-latency", 0, "shed requests that can't be served from cache while the moving average of target server latency exceeds this, 0 to disable")
+
+var shedRetryAfter = flag.Duration("shed-retry-after", 5*time.Second, "Retry-After advertised on shed responses")
+
+var (
+	// upstreamInflight counts requests currently being forwarded to target servers.
+	upstreamInflight atomic.Int64
+	// upstreamLatency is an exponentially weighted moving average of target server latency in
+	// nanoseconds.
+	upstreamLatency atomic.Int64
+)
+
+// The admitUpstream function decides whether a request may be forwarded to a target server given the
+// current load. When admitted, the caller must call done once the target server's response has been
+// read. Under overload it returns false, and the caller should shed the request with shedRequest.
+//
+// Latency-based shedding always lets one request through so the moving average keeps being updated and
+// shedding stops once the target servers recover.
+func admitUpstream() (done func(), ok bool) {
+	inflight := upstreamInflight.Add(1)
+	limit, threshold := maxUpstreamInflight.Load(), shedLatency.Duration()
+	overloaded := limit > 0 && inflight > limit
+	if threshold > 0 && inflight > 1 && time.Duration(upstreamLatency.Load()) > threshold {
+		overloaded = true
+	}
+	if overloaded {
+		upstreamInflight.Add(-1)
+		return nil, false
+	}
+
+	start := time.Now()
+	return func() {
+		upstreamInflight.Add(-1)
+		recordUpstreamLatency(time.Since(start))
+	}, true
+}
+
+// The recordUpstreamLatency function folds a target server response time into the moving average.
+func recordUpstreamLatency(d time.Duration) {
+	for {
+		old := upstreamLatency.Load()
+		updated := int64(d)
+		if old != 0 {
+			updated = old + (int64(d)-old)/8
+		}
+		if upstreamLatency.CompareAndSwap(old, updated) {
+			return
+		}
+	}
+}
+
+// The shedRequest function rejects a request with 503 Service Unavailable and a Retry-After header.
+func shedRequest(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(shedRetryAfter.Seconds())))
+	http.Error(w, "Service overloaded, try again later", http.StatusServiceUnavailable)
+}
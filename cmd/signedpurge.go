@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var purgeKeysFile = flag.String("purge-keys-file", "", "file of keys for HMAC-signed purge requests, one 'key-id secret [tenant host,host...]' per line, so a CMS can purge without an admin token")
+
+var purgeSignatureWindow = flag.Duration("purge-signature-window", 5*time.Minute, "how far the timestamp of a signed purge request may be from the server's clock; nonces are remembered this long to reject replays")
+
+// purgeKey is a configured secret that signed purge requests are verified with.
+type purgeKey struct {
+	secret []byte
+	principal
+}
+
+// purgeKeys holds the -purge-keys-file keys by ID.
+var purgeKeys map[string]purgeKey
+
+// usedNonces holds the nonces of the signed purge requests accepted within the signature window, by
+// key ID and nonce, with when they can be forgotten.
+var usedNonces = struct {
+	seen  map[string]time.Time
+	mutex sync.Mutex
+}{seen: make(map[string]time.Time)}
+
+// The loadPurgeKeys function reads the -purge-keys-file. Blank lines and lines starting with # are
+// ignored.
+func loadPurgeKeys(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	purgeKeys = make(map[string]purgeKey)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 && len(fields) != 4 {
+			return fmt.Errorf("%s:%d: expected 'key-id secret [tenant host,host...]'", path, line)
+		}
+		if _, ok := purgeKeys[fields[0]]; ok {
+			return fmt.Errorf("%s:%d: duplicate key ID %q", path, line, fields[0])
+		}
+		k := purgeKey{secret: []byte(fields[1]), principal: principal{role: rolePurger, name: "signed:" + fields[0]}}
+		if len(fields) == 4 {
+			k.tenant = fields[2]
+			if k.hosts, err = tenantHosts(fields[3]); err != nil {
+				return fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+		}
+		purgeKeys[fields[0]] = k
+	}
+	return scanner.Err()
+}
+
+// The purgeSignature function returns the hex-encoded HMAC-SHA256 a signed purge request must carry:
+// of its method, path, raw query, timestamp and nonce, each followed by a newline.
+func purgeSignature(secret []byte, method, path, query, timestamp, nonce string) string {
+	mac := hmac.New(sha256.New, secret)
+	for _, part := range []string{method, path, query, timestamp, nonce} {
+		mac.Write([]byte(part + "\n"))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// The verifySignedPurge function checks the X-Purge-Key-Id, X-Purge-Timestamp, X-Purge-Nonce and
+// X-Purge-Signature headers of a request and returns the principal of its key. A request is only
+// accepted once: its nonce is remembered until its timestamp leaves the signature window.
+func verifySignedPurge(r *http.Request) (principal, error) {
+	id, timestamp, nonce := r.Header.Get("X-Purge-Key-Id"), r.Header.Get("X-Purge-Timestamp"), r.Header.Get("X-Purge-Nonce")
+	key, ok := purgeKeys[id]
+	if !ok {
+		return principal{}, fmt.Errorf("unknown key ID %q", id)
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return principal{}, errors.New("X-Purge-Timestamp must be a Unix time in seconds")
+	}
+	if nonce == "" || len(nonce) > 128 {
+		return principal{}, errors.New("X-Purge-Nonce must hold 1 to 128 characters")
+	}
+	signature := purgeSignature(key.secret, r.Method, r.URL.Path, r.URL.RawQuery, timestamp, nonce)
+	if !hmac.Equal([]byte(signature), []byte(strings.ToLower(r.Header.Get("X-Purge-Signature")))) {
+		return principal{}, errors.New("invalid signature")
+	}
+	signed := time.Unix(seconds, 0)
+	if skew := time.Since(signed).Abs(); skew > *purgeSignatureWindow {
+		return principal{}, fmt.Errorf("timestamp is %s away from the server's clock", skew.Round(time.Second))
+	}
+
+	usedNonces.mutex.Lock()
+	defer usedNonces.mutex.Unlock()
+	now := time.Now()
+	for seen, until := range usedNonces.seen {
+		if now.After(until) {
+			delete(usedNonces.seen, seen)
+		}
+	}
+	seen := id + " " + nonce
+	if _, replayed := usedNonces.seen[seen]; replayed {
+		return principal{}, errors.New("nonce already used")
+	}
+	usedNonces.seen[seen] = signed.Add(*purgeSignatureWindow)
+	return key.principal, nil
+}
+
+// The authorizePurge function authenticates a purge request. Requests signed with a -purge-keys-file
+// key get the purger role, scoped to the key's tenant if it has one; others are authorized like any
+// admin API request.
+func authorizePurge(w http.ResponseWriter, r *http.Request) (principal, bool) {
+	if len(purgeKeys) == 0 || r.Header.Get("X-Purge-Signature") == "" {
+		return authorize(w, r, rolePurger, false)
+	}
+	p, err := verifySignedPurge(r)
+	if err != nil {
+		slog.Warn("Rejected signed purge request", "client", clientIP(r), "error", err)
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return principal{}, false
+	}
+	p.client = clientIP(r)
+	return p, true
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+// The usePurgeKeys function loads a -purge-keys-file with the given contents for the rest of the test.
+func usePurgeKeys(t *testing.T, contents string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "purge-keys")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setVar(t, &purgeKeys, nil)
+	if err := loadPurgeKeys(path); err != nil {
+		t.Fatalf("loadPurgeKeys: %v", err)
+	}
+}
+
+// The signedPurge function returns a purge request for target signed with the key id and secret at
+// the given time, with a nonce unique to the test run.
+func signedPurge(target, id, secret string, at time.Time) *http.Request {
+	r := httptest.NewRequest("DELETE", target, nil)
+	timestamp, nonce := strconv.FormatInt(at.Unix(), 10), newJobID()
+	r.Header.Set("X-Purge-Key-Id", id)
+	r.Header.Set("X-Purge-Timestamp", timestamp)
+	r.Header.Set("X-Purge-Nonce", nonce)
+	r.Header.Set("X-Purge-Signature", purgeSignature([]byte(secret), r.Method, r.URL.Path, r.URL.RawQuery, timestamp, nonce))
+	return r
+}
+
+func TestVerifySignedPurge(t *testing.T) {
+	usePurgeKeys(t, "cms s3cr3t\nshop sh0p shop shop.example.com\n")
+	now := time.Now()
+	const target = "/admin/purge?prefix=https%3A%2F%2Fexample.com%2F"
+
+	p, err := verifySignedPurge(signedPurge(target, "cms", "s3cr3t", now))
+	if err != nil || p.role != rolePurger || p.name != "signed:cms" || p.scoped() {
+		t.Fatalf("verifySignedPurge: got %+v, %v, want an unscoped purger", p, err)
+	}
+	if p, err := verifySignedPurge(signedPurge(target, "shop", "sh0p", now)); err != nil || p.tenant != "shop" {
+		t.Fatalf("verifySignedPurge with a tenant's key: got %+v, %v", p, err)
+	}
+
+	replayed := signedPurge(target, "cms", "s3cr3t", now)
+	verifySignedPurge(replayed)
+	tampered := signedPurge(target, "cms", "s3cr3t", now)
+	tampered.URL.RawQuery = "prefix=https%3A%2F%2F"
+	noNonce := signedPurge(target, "cms", "s3cr3t", now)
+	noNonce.Header.Del("X-Purge-Nonce")
+	badTimestamp := signedPurge(target, "cms", "s3cr3t", now)
+	badTimestamp.Header.Set("X-Purge-Timestamp", now.Format(time.RFC3339))
+	for name, r := range map[string]*http.Request{
+		"wrong secret":     signedPurge(target, "cms", "guess", now),
+		"unknown key":      signedPurge(target, "other", "s3cr3t", now),
+		"tampered query":   tampered,
+		"old timestamp":    signedPurge(target, "cms", "s3cr3t", now.Add(-*purgeSignatureWindow-time.Minute)),
+		"future timestamp": signedPurge(target, "cms", "s3cr3t", now.Add(*purgeSignatureWindow+time.Minute)),
+		"replayed nonce":   replayed,
+		"missing nonce":    noNonce,
+		"bad timestamp":    badTimestamp,
+	} {
+		if p, err := verifySignedPurge(r); err == nil {
+			t.Errorf("verifySignedPurge of a request with %s: got %+v, want an error", name, p)
+		}
+	}
+}
+
+func TestAuthorizePurge(t *testing.T) {
+	usePurgeKeys(t, "shop sh0p shop shop.example.com\n")
+	const target = "/admin/purge?target=https%3A%2F%2Fshop.example.com%2F"
+
+	w := httptest.NewRecorder()
+	if p, ok := authorizePurge(w, signedPurge(target, "shop", "sh0p", time.Now())); !ok || p.tenant != "shop" {
+		t.Fatalf("authorizePurge of a signed request: got %+v, %v (%d)", p, ok, w.Code)
+	}
+	for name, r := range map[string]*http.Request{
+		"a bad signature": signedPurge(target, "shop", "guess", time.Now()),
+		"no signature":    httptest.NewRequest("DELETE", target, nil),
+	} {
+		r.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		if _, ok := authorizePurge(w, r); ok || w.Code != http.StatusUnauthorized {
+			t.Errorf("authorizePurge of a request with %s: got %v and %d, want 401", name, ok, w.Code)
+		}
+	}
+
+	// The key's tenant only purges its own hosts
+	useTestCache(t, cache.Options{})
+	for purged, code := range map[string]int{
+		"https://shop.example.com/": http.StatusOK,
+		"https://example.com/":      http.StatusForbidden,
+	} {
+		w := httptest.NewRecorder()
+		adminPurgeHandler(w, signedPurge("/admin/purge?target="+url.QueryEscape(purged), "shop", "sh0p", time.Now()))
+		if w.Code != code {
+			t.Errorf("signed purge of %s: got %d %q, want %d", purged, w.Code, w.Body, code)
+		}
+	}
+}
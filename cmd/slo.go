@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// sloWindows are the windows burn rates are computed over, in minutes: the long and short windows of
+// the fast (1h and 5m) and slow (6h and 30m) multiwindow burn-rate alerts.
+var sloWindows = []struct {
+	name    string
+	minutes int64
+}{{"5m", 5}, {"30m", 30}, {"1h", 60}, {"6h", 360}}
+
+// Burn rates over which an SLO is reported as burning its error budget: at 14.4 a 30-day budget lasts
+// about two days, at 6 five days.
+const (
+	fastBurnRate = 14.4
+	slowBurnRate = 6
+)
+
+// sloMinute counts the requests of one minute towards an SLO.
+type sloMinute struct {
+	minute int64
+	total  int64
+	bad    int64
+}
+
+// sloTracker counts the requests to the target server of a route towards one of its SLOs: a latency SLO,
+// under which requests slower than threshold are bad, or an availability SLO, under which failed
+// requests and 5xx responses are. Counts are kept per minute over the longest window.
+type sloTracker struct {
+	route     string
+	slo       string
+	objective float64
+	threshold time.Duration
+
+	mutex   sync.Mutex
+	total   int64
+	bad     int64
+	minutes [360]sloMinute
+}
+
+// sloTrackers holds the SLOs of the -route definitions.
+var sloTrackers []*sloTracker
+
+// The setupSLOs function starts tracking the SLOs declared by the routes.
+func setupSLOs() {
+	for _, r := range routes {
+		if r.SLOLatency > 0 {
+			sloTrackers = append(sloTrackers, &sloTracker{route: r.Prefix, slo: "latency", objective: r.SLOLatencyTarget, threshold: r.SLOLatency})
+		}
+		if r.SLOAvailability > 0 {
+			sloTrackers = append(sloTrackers, &sloTracker{route: r.Prefix, slo: "availability", objective: r.SLOAvailability})
+		}
+	}
+}
+
+// The observeSLOs function counts a request to the target server towards the SLOs of its route, given
+// its response status, 0 for a request that failed without a response, and how long it took.
+func observeSLOs(target *url.URL, status int, d time.Duration) {
+	if len(sloTrackers) == 0 {
+		return
+	}
+	prefix, now := routeFor(target).Prefix, time.Now()
+	for _, t := range sloTrackers {
+		if t.route != prefix {
+			continue
+		}
+		switch t.slo {
+		case "latency":
+			// Failed requests count towards availability only
+			if status != 0 {
+				t.observe(d > t.threshold, now)
+			}
+		case "availability":
+			t.observe(status == 0 || status >= 500, now)
+		}
+	}
+}
+
+// The `observe` method in the `sloTracker` struct counts a request, good or bad, in the current minute.
+func (t *sloTracker) observe(bad bool, now time.Time) {
+	minute := now.Unix() / 60
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	m := &t.minutes[minute%int64(len(t.minutes))]
+	if m.minute != minute {
+		*m = sloMinute{minute: minute}
+	}
+	m.total++
+	t.total++
+	if bad {
+		m.bad++
+		t.bad++
+	}
+}
+
+// The `burnRate` method in the `sloTracker` struct returns how fast the SLO's error budget was spent over
+// the last minutes, the current one included: the share of bad requests divided by the share the
+// objective allows. A burn rate of 1 spends the budget exactly over the SLO period; windows without
+// requests burn nothing.
+func (t *sloTracker) burnRate(minutes int64, now time.Time) float64 {
+	minute := now.Unix() / 60
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var total, bad int64
+	for _, m := range t.minutes {
+		if m.minute > minute-minutes && m.minute <= minute {
+			total += m.total
+			bad += m.bad
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(bad) / float64(total) / (1 - t.objective)
+}
+
+// sloSummary reports the state of an SLO.
+type sloSummary struct {
+	Route       string
+	SLO         string
+	Objective   float64
+	Threshold   string `json:",omitempty"`
+	Requests    int64
+	BadRequests int64
+	BurnRates   map[string]float64
+	// Status is fast-burn or slow-burn while both windows of the corresponding alert burn faster than
+	// its rate, and ok otherwise.
+	Status string
+}
+
+// The `summary` method in the `sloTracker` struct returns the state of the SLO.
+func (t *sloTracker) summary(now time.Time) sloSummary {
+	s := sloSummary{Route: t.route, SLO: t.slo, Objective: t.objective, BurnRates: make(map[string]float64), Status: "ok"}
+	if t.threshold > 0 {
+		s.Threshold = t.threshold.String()
+	}
+	for _, w := range sloWindows {
+		s.BurnRates[w.name] = t.burnRate(w.minutes, now)
+	}
+	switch {
+	case s.BurnRates["1h"] > fastBurnRate && s.BurnRates["5m"] > fastBurnRate:
+		s.Status = "fast-burn"
+	case s.BurnRates["6h"] > slowBurnRate && s.BurnRates["30m"] > slowBurnRate:
+		s.Status = "slow-burn"
+	}
+	t.mutex.Lock()
+	s.Requests, s.BadRequests = t.total, t.bad
+	t.mutex.Unlock()
+	return s
+}
+
+// The adminSLOHandler function reports the state of the SLOs declared by the routes: their request
+// counts, burn rates over each window and whether they are burning their error budget.
+func adminSLOHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := authorize(w, r, roleViewer, true); !ok {
+		return
+	}
+
+	now := time.Now()
+	summaries := make([]sloSummary, 0, len(sloTrackers))
+	for _, t := range sloTrackers {
+		summaries = append(summaries, t.summary(now))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
+
+// The `slos` method in the `metricsWriter` struct writes the request counts, objectives and burn rates
+// of the SLOs declared by the routes.
+func (m metricsWriter) slos() {
+	now := time.Now()
+	summaries := make([]sloSummary, len(sloTrackers))
+	for i, t := range sloTrackers {
+		summaries[i] = t.summary(now)
+	}
+	labels := func(s sloSummary) string {
+		return fmt.Sprintf("route=%q,slo=%q", s.Route, s.SLO)
+	}
+	m.metric("slo_requests_total", "counter", "Target server requests counted towards an SLO of their route.", nil)
+	for _, s := range summaries {
+		fmt.Fprintf(m, "go_proxy_cache_slo_requests_total{%s} %d\n", labels(s), s.Requests)
+	}
+	m.metric("slo_bad_requests_total", "counter", "Target server requests that missed an SLO of their route.", nil)
+	for _, s := range summaries {
+		fmt.Fprintf(m, "go_proxy_cache_slo_bad_requests_total{%s} %d\n", labels(s), s.BadRequests)
+	}
+	m.metric("slo_objective", "gauge", "Share of target server requests an SLO requires to be good.", nil)
+	for _, s := range summaries {
+		fmt.Fprintf(m, "go_proxy_cache_slo_objective{%s} %g\n", labels(s), s.Objective)
+	}
+	m.metric("slo_burn_rate", "gauge", "Rate an SLO's error budget is spent at over a window, 1 spending it exactly over the SLO period.", nil)
+	for _, s := range summaries {
+		for _, w := range sloWindows {
+			fmt.Fprintf(m, "go_proxy_cache_slo_burn_rate{%s,window=%q} %g\n", labels(s), w.name, s.BurnRates[w.name])
+		}
+	}
+}
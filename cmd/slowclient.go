@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"time"
+)
+
+var clientWriteTimeout = flag.Duration("client-write-timeout", 30*time.Second, "maximum time a client may take to accept each chunk of a response body before it is disconnected as stalled, 0 to disable")
+
+var clientWriteBuffer = flag.Int("client-write-buffer", 0, "socket send buffer size in bytes for client connections, capping how much of a response is queued for slow readers (0 keeps the OS default)")
+
+// writeChunkSize is how much of a body is written between write deadline extensions.
+const writeChunkSize = 32 << 10
+
+// The writeBody function writes a response body in chunks, giving the client -client-write-timeout to
+// accept each chunk. A stalled reader is disconnected instead of pinning the connection and the body
+// indefinitely, while slow but steady readers can still download large bodies.
+func writeBody(w http.ResponseWriter, body []byte) error {
+	if *clientWriteTimeout <= 0 {
+		_, err := w.Write(body)
+		return err
+	}
+
+	rc := http.NewResponseController(w)
+	for len(body) > 0 {
+		n := min(len(body), writeChunkSize)
+		if err := rc.SetWriteDeadline(time.Now().Add(*clientWriteTimeout)); err != nil {
+			if errors.Is(err, http.ErrNotSupported) {
+				_, err = w.Write(body)
+				return err
+			}
+			return err
+		}
+		if _, err := w.Write(body[:n]); err != nil {
+			return err
+		}
+		body = body[n:]
+	}
+	if err := rc.Flush(); err != nil {
+		return err
+	}
+	// Clear the deadline so it doesn't carry over to the next request on a keep-alive connection
+	return rc.SetWriteDeadline(time.Time{})
+}
+
+// writeBufferListener caps the socket send buffer of every accepted TCP connection.
+type writeBufferListener struct {
+	net.Listener
+	size int
+}
+
+func (l writeBufferListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetWriteBuffer(l.size)
+	}
+	return conn, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var snapshotFile = flag.String("snapshot-file", "", "file the cache is saved to on shutdown and restored from on startup, so a restart doesn't start cold")
+
+// The restoreSnapshot function restores the cache from -snapshot-file, if there is one. A missing file
+// is not an error; a damaged one is logged and the entries read until then are kept.
+func restoreSnapshot() {
+	if *snapshotFile == "" {
+		return
+	}
+	f, err := os.Open(*snapshotFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		slog.Error("Error opening snapshot", "error", err)
+		return
+	}
+	defer f.Close()
+	start := time.Now()
+	restored, err := proxyCache.LoadFrom(f)
+	if err != nil {
+		slog.Error("Error restoring snapshot", "file", *snapshotFile, "error", err)
+	}
+	slog.Info("Restored snapshot", "file", *snapshotFile, "entries", restored, "duration", time.Since(start).Round(time.Millisecond).String())
+	restoreVersions()
+}
+
+// The restoreVersions function makes the entries restored into the namespaces of origin versions (see
+// -version-header) reachable again: the current version of each origin becomes the one its restored
+// namespace names. Namespaces lookups can't reach, because -version-header is no longer set or several
+// versions of an origin were restored, are dropped rather than left to take up memory.
+func restoreVersions() {
+	origins := make(map[string][]string)
+	for name := range proxyCache.Stats().Namespaces {
+		if origin, _, ok := strings.Cut(name, "@"); ok && strings.Contains(origin, "://") {
+			origins[origin] = append(origins[origin], name)
+		}
+	}
+	for origin, names := range origins {
+		if *versionHeader != "" && len(names) == 1 {
+			versions.versions[origin] = strings.TrimPrefix(names[0], origin+"@")
+			continue
+		}
+		for _, name := range names {
+			dropped := proxyCache.DropNamespace(name)
+			slog.Info("Dropped unreachable restored entries", "namespace", name, "entries", dropped)
+		}
+	}
+}
+
+// The saveSnapshot function saves the cache to -snapshot-file. It writes a temporary file next to it
+// and renames it, so a crash while saving leaves the previous snapshot intact.
+func saveSnapshot() {
+	if *snapshotFile == "" {
+		return
+	}
+	start := time.Now()
+	f, err := os.CreateTemp(filepath.Dir(*snapshotFile), filepath.Base(*snapshotFile)+".*")
+	if err != nil {
+		slog.Error("Error saving snapshot", "error", err)
+		return
+	}
+	saved, err := proxyCache.SaveTo(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), *snapshotFile)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		slog.Error("Error saving snapshot", "file", *snapshotFile, "error", err)
+		return
+	}
+	slog.Info("Saved snapshot", "file", *snapshotFile, "entries", saved, "duration", time.Since(start).Round(time.Millisecond).String())
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+var redisURL = flag.String("redis-url", "", "Redis server the cache is written through to and read from, shared by every proxy instance using it, e.g. redis://:password@redis:6379/0")
+
+var redisPrefix = flag.String("redis-prefix", "go-proxy-cache:", "prefix of the Redis keys holding cache entries")
+
+var redisLocalTTL = flag.Duration("redis-local-ttl", time.Second, "how long an entry read from Redis is served from memory before being read again; purges and updates made by other instances take up to this long to show (0 keeps memory copies until they expire)")
+
+var diskDir = flag.String("disk-dir", "", "directory the cache is written through to, so entries survive restarts and memory only holds the most recently used ones (see -max-bytes)")
+
+var diskMaxBytes = flag.Int64("disk-max-bytes", 0, "budget for the files in -disk-dir in bytes; the oldest entries are dropped to stay within it, 0 for unlimited")
+
+var diskCompactInterval = flag.Duration("disk-compact-interval", time.Minute, "how often files in -disk-dir that mostly hold replaced, purged or expired entries are compacted")
+
+var memcachedServers = newListFlag("memcached-servers", "comma-separated memcached servers (host:port) the cache is written through to and read from, shared by every proxy instance using them; keys are spread over them by consistent hashing")
+
+var memcachedPrefix = flag.String("memcached-prefix", "go-proxy-cache:", "prefix of the memcached keys holding cache entries")
+
+var memcachedLocalTTL = flag.Duration("memcached-local-ttl", time.Second, "how long an entry read from memcached is served from memory before being read again; purges and updates made by other instances take up to this long to show (0 keeps memory copies until they expire)")
+
+var storeHotBytes = flag.Int64("store-hot-bytes", 0, "budget in bytes for serialized entries kept in memory above -disk-dir, -redis-url or -memcached-servers; the least recently used are spilled to the store, 0 to disable")
+
+var storeHotValueBytes = flag.Int("store-hot-value-bytes", 0, "size in bytes of the largest serialized entry kept in memory by -store-hot-bytes; larger entries go straight to the store (default: a sixty-fourth of -store-hot-bytes)")
+
+// storeKeyEnv is the environment variable that may hold the key entries are encrypted with in the store,
+// instead of -store-encryption-keys-file.
+const storeKeyEnv = "GO_PROXY_CACHE_STORE_KEY"
+
+var storeEncryptionKeysFile = flag.String("store-encryption-keys-file", "", "file of hex-encoded AES keys of 16, 24 or 32 bytes, one per line, entries written to -disk-dir, -redis-url or -memcached-servers are encrypted with; the first encrypts, the others only decrypt entries written before a key rotation ($"+storeKeyEnv+" may hold a single key instead)")
+
+// storeErrorLogged is when a store error was last logged, in Unix nanoseconds.
+var storeErrorLogged atomic.Int64
+
+// The cacheStore function returns the store configured with -redis-url, -memcached-servers or
+// -disk-dir, encrypting entries when keys are configured, below a tier of values kept in memory when
+// -store-hot-bytes is set, or nil when there is none, together with how long memory copies of its
+// entries are trusted.
+func cacheStore() (cache.Store, time.Duration, error) {
+	store, localTTL, err := backendStore()
+	if err != nil {
+		return nil, 0, err
+	}
+	keys, err := storeEncryptionKeys()
+	if err != nil {
+		return nil, 0, err
+	}
+	if store == nil {
+		if *storeEncryptionKeysFile != "" {
+			return nil, 0, errors.New("-store-encryption-keys-file requires -disk-dir, -redis-url or -memcached-servers")
+		}
+		return nil, 0, nil
+	}
+	if len(keys) > 0 {
+		encrypted, err := cache.NewEncryptedStore(store, keys...)
+		if err != nil {
+			return nil, 0, err
+		}
+		store = encrypted
+	}
+	if *storeHotBytes <= 0 {
+		return store, localTTL, nil
+	}
+	if *diskDir == "" {
+		slog.Warn("Entries kept in memory by -store-hot-bytes are only seen by this instance until they are spilled")
+	}
+	return cache.NewTieredStore(cache.TieredOptions{Cold: store, HotBytes: *storeHotBytes, MaxHotValueBytes: *storeHotValueBytes}), localTTL, nil
+}
+
+// The storeEncryptionKeys function returns the keys of -store-encryption-keys-file, or the key in the
+// environment variable named by storeKeyEnv. Blank lines and lines starting with # are ignored.
+func storeEncryptionKeys() ([][]byte, error) {
+	source, text := "$"+storeKeyEnv, os.Getenv(storeKeyEnv)
+	if *storeEncryptionKeysFile != "" {
+		data, err := os.ReadFile(*storeEncryptionKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		source, text = *storeEncryptionKeysFile, string(data)
+	}
+	var keys [][]byte
+	for i, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil || len(key) != 16 && len(key) != 24 && len(key) != 32 {
+			return nil, fmt.Errorf("%s:%d: expected a hex-encoded key of 16, 24 or 32 bytes", source, i+1)
+		}
+		keys = append(keys, key)
+	}
+	if *storeEncryptionKeysFile != "" && len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", source)
+	}
+	return keys, nil
+}
+
+// The backendStore function returns the store configured with -redis-url, -memcached-servers or
+// -disk-dir, or nil when there is none, together with how long memory copies of its entries are
+// trusted.
+func backendStore() (cache.Store, time.Duration, error) {
+	configured := 0
+	for _, set := range []bool{*redisURL != "", len(*memcachedServers) > 0, *diskDir != ""} {
+		if set {
+			configured++
+		}
+	}
+	switch {
+	case configured > 1:
+		return nil, 0, errors.New("only one of -redis-url, -memcached-servers and -disk-dir can be used")
+	case *redisURL != "":
+		store, err := redisStore()
+		return store, *redisLocalTTL, err
+	case len(*memcachedServers) > 0:
+		if strings.ContainsFunc(*memcachedPrefix, unicode.IsSpace) || strings.ContainsFunc(*memcachedPrefix, unicode.IsControl) {
+			return nil, 0, errors.New("invalid -memcached-prefix: must not contain spaces or control characters")
+		}
+		slog.Warn("Memcached can't list its keys: purges other than by key only reach entries in memory, and the rest expire with their TTL")
+		store := cache.NewMemcachedStore(cache.MemcachedOptions{Servers: *memcachedServers, Prefix: *memcachedPrefix})
+		return store, *memcachedLocalTTL, nil
+	case *diskDir != "":
+		store, err := cache.OpenDiskStore(cache.DiskOptions{Dir: *diskDir, MaxBytes: *diskMaxBytes, CompactInterval: *diskCompactInterval})
+		if err != nil {
+			return nil, 0, fmt.Errorf("opening -disk-dir: %w", err)
+		}
+		// The store is only written through this cache, so memory copies never go out of date
+		return store, 0, nil
+	}
+	return nil, 0, nil
+}
+
+// The redisStore function returns the Redis store configured with -redis-url.
+func redisStore() (cache.Store, error) {
+	u, err := url.Parse(*redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -redis-url: %w", err)
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, errors.New("invalid -redis-url: expected redis://[[user]:password@]host[:port][/db]")
+	}
+	opts := cache.RedisOptions{Addr: u.Host, Prefix: *redisPrefix}
+	if u.Port() == "" {
+		opts.Addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		opts.Username = u.User.Username()
+		opts.Password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if opts.DB, err = strconv.Atoi(db); err != nil || opts.DB < 0 {
+			return nil, fmt.Errorf("invalid -redis-url: bad database %q", db)
+		}
+	}
+	return cache.NewRedisStore(opts), nil
+}
+
+// The logStoreError function reports a failed store operation. Requests keep being served from
+// memory meanwhile, so at most one error is logged every 10 seconds.
+func logStoreError(err error) {
+	now := time.Now().UnixNano()
+	last := storeErrorLogged.Load()
+	if now-last < int64(10*time.Second) || !storeErrorLogged.CompareAndSwap(last, now) {
+		return
+	}
+	slog.Error("Cache store error", "errors", proxyCache.Stats().StoreErrors, "error", err)
+	notifyEvent("store-error", "store", err.Error())
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-proxy-cache/pkg/cache"
+)
+
+var suggestEndpoints = flag.Int("suggest-endpoints", 1000, "number of endpoints (target URLs without their query) whose traffic is recorded for /admin/suggestions; the least requested are forgotten first, 0 to disable")
+
+// suggestVariants is how many query strings are recorded per endpoint.
+const suggestVariants = 64
+
+// suggestTTLSteps are the lifetimes suggested for endpoints refetched while their bodies don't change,
+// rounded down to the nearest one.
+var suggestTTLSteps = []time.Duration{time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second, time.Minute, 5 * time.Minute, 10 * time.Minute, 30 * time.Minute, time.Hour}
+
+// trafficEndpoint is the recorded traffic of GET requests for one endpoint.
+type trafficEndpoint struct {
+	requests int64
+	// fetched counts the successful responses fetched from the target server for cacheable requests
+	fetched  int64
+	variants map[string]*trafficVariant
+	// lifetimeHeader is the Cache-Control or Expires header of the last fetched response, if it sets or
+	// forbids a lifetime
+	lifetimeHeader string
+}
+
+// trafficVariant is the recorded traffic of one query string of an endpoint.
+type trafficVariant struct {
+	query   url.Values
+	body    [sha256.Size]byte
+	fetches int
+	// repeats counts the fetches that returned the same body as the previous one
+	repeats int
+	// since and last are when the current body was first and last fetched
+	since, last time.Time
+	// shortest is the shortest time a body was served before the target server changed it, zero if it
+	// never did
+	shortest time.Duration
+}
+
+// trafficRecorder records the GET traffic of the most requested endpoints, from which
+// /admin/suggestions derives candidate -route rules.
+type trafficRecorder struct {
+	since     time.Time
+	capacity  int
+	endpoints map[string]*trafficEndpoint
+	mutex     sync.Mutex
+}
+
+var traffic *trafficRecorder
+
+// The startTraffic function starts recording traffic unless -suggest-endpoints is 0.
+func startTraffic() {
+	if *suggestEndpoints <= 0 {
+		return
+	}
+	traffic = &trafficRecorder{since: time.Now(), capacity: *suggestEndpoints, endpoints: make(map[string]*trafficEndpoint)}
+}
+
+// The endpointOf function returns the endpoint of a target URL: the URL without its query.
+func endpointOf(target *url.URL) string {
+	endpoint := *target
+	endpoint.RawQuery, endpoint.ForceQuery, endpoint.Fragment = "", false, ""
+	return endpoint.String()
+}
+
+// The `endpoint` method in the `trafficRecorder` struct returns the recorded traffic of an endpoint,
+// making room for it by forgetting the least requested endpoint when needed. The caller must hold the
+// lock.
+func (t *trafficRecorder) endpoint(name string) *trafficEndpoint {
+	if e, ok := t.endpoints[name]; ok {
+		return e
+	}
+	if len(t.endpoints) >= t.capacity {
+		var least string
+		for other, e := range t.endpoints {
+			if least == "" || e.requests < t.endpoints[least].requests {
+				least = other
+			}
+		}
+		delete(t.endpoints, least)
+	}
+	e := &trafficEndpoint{variants: make(map[string]*trafficVariant)}
+	t.endpoints[name] = e
+	return e
+}
+
+// The `observe` method in the `trafficRecorder` struct counts a finished GET request.
+func (t *trafficRecorder) observe(event *cacheEvent) {
+	if t == nil || event.Method != "GET" {
+		return
+	}
+	target, err := url.Parse(event.URL)
+	if err != nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.endpoint(endpointOf(target)).requests++
+}
+
+// The `fetched` method in the `trafficRecorder` struct records a successful response the target server
+// sent for a cacheable GET request, noting whether its body is the one the previous request for the
+// same URL got.
+func (t *trafficRecorder) fetched(target *url.URL, entry cache.Entry) {
+	if t == nil || entry.Response.StatusCode != http.StatusOK {
+		return
+	}
+	body := sha256.Sum256(entry.Body)
+	if entry.BodySize > 0 {
+		// Bodies kept in chunks are compared by their ETag, a hash of the body unless the origin set one
+		body = sha256.Sum256([]byte(entry.ETag))
+	}
+	now := time.Now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	e := t.endpoint(endpointOf(target))
+	e.fetched++
+	e.lifetimeHeader = ""
+	if cacheControl := entry.Response.Header.Get("Cache-Control"); cacheControl != "" {
+		directives := parseCacheControl(entry.Response.Header)
+		for _, name := range []string{"no-store", "no-cache", "private", "s-maxage", "max-age"} {
+			if _, ok := directives[name]; ok {
+				e.lifetimeHeader = "Cache-Control: " + cacheControl
+				break
+			}
+		}
+	} else if expires := entry.Response.Header.Get("Expires"); expires != "" {
+		e.lifetimeHeader = "Expires: " + expires
+	}
+
+	v, ok := e.variants[target.RawQuery]
+	if !ok {
+		if len(e.variants) >= suggestVariants {
+			return
+		}
+		v = &trafficVariant{query: target.Query(), body: body, since: now}
+		e.variants[target.RawQuery] = v
+	} else if v.body == body {
+		v.repeats++
+	} else {
+		if lasted := now.Sub(v.since); v.shortest == 0 || lasted < v.shortest {
+			v.shortest = lasted
+		}
+		v.body, v.since = body, now
+	}
+	v.fetches++
+	v.last = now
+}
+
+// ruleSuggestion is a candidate -route rule for an endpoint, with the traffic it is based on.
+type ruleSuggestion struct {
+	Prefix   string
+	Requests int64
+	Fetched  int64
+	Reasons  []string
+	// Route is the suggested -route definition, keeping the annotations of the route currently applying
+	Route string
+	Note  string `json:",omitempty"`
+}
+
+// The `suggest` method in the `trafficRecorder` struct derives rules from the traffic of the endpoints
+// with at least minRequests requests that the caller may see, those saving the most requests to the
+// target servers first.
+func (t *trafficRecorder) suggest(p principal, minRequests int64) []ruleSuggestion {
+	suggestions := []ruleSuggestion{}
+	if t == nil {
+		return suggestions
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for name, e := range t.endpoints {
+		if e.requests < minRequests || !p.allowsURL(name) {
+			continue
+		}
+		target, err := url.Parse(name)
+		if err != nil {
+			continue
+		}
+		current := routeFor(target)
+		if current.Bypass {
+			continue
+		}
+		suggested := current
+		suggested.Prefix, suggested.IgnoreParams = name, slices.Clone(current.IgnoreParams)
+		suggestion := ruleSuggestion{Prefix: name, Requests: e.requests, Fetched: e.fetched}
+
+		// Unchanged bodies are fetched again because the target server's headers don't let them be cached
+		// for long, or because the configured lifetime is shorter than they last
+		headers := e.lifetimeHeader != "" && !*ignoreCacheControl
+		configured := current.TTL
+		if configured == 0 {
+			configured = *ttl
+		}
+		if lifetime, reason, ok := e.suggestTTL(); ok && (headers || configured > 0 && configured < lifetime) {
+			suggested.TTL = lifetime
+			suggestion.Reasons = append(suggestion.Reasons, reason)
+			if headers {
+				suggestion.Note = "The target server sends " + e.lifetimeHeader + ", which takes precedence over ttl unless -ignore-cache-control is set"
+			}
+		}
+		for _, param := range e.ignorableParams(current) {
+			suggested.IgnoreParams = append(suggested.IgnoreParams, param.name)
+			suggestion.Reasons = append(suggestion.Reasons, param.reason)
+		}
+		if len(suggestion.Reasons) == 0 {
+			continue
+		}
+		suggestion.Route = suggested.String()
+		suggestions = append(suggestions, suggestion)
+	}
+	slices.SortFunc(suggestions, func(a, b ruleSuggestion) int {
+		if a.Fetched != b.Fetched {
+			return int(b.Fetched - a.Fetched)
+		}
+		return strings.Compare(a.Prefix, b.Prefix)
+	})
+	return suggestions
+}
+
+// The `suggestTTL` method in the `trafficEndpoint` struct suggests a lifetime when the target server
+// was asked again for most of its URLs while sending the same body: at most the shortest time a body was
+// seen to last, or, when none changed, the longest time one was seen unchanged.
+func (e *trafficEndpoint) suggestTTL() (time.Duration, string, bool) {
+	fetches, repeats := 0, 0
+	var shortest, unchanged time.Duration
+	for _, v := range e.variants {
+		fetches += v.fetches
+		repeats += v.repeats
+		if v.shortest > 0 && (shortest == 0 || v.shortest < shortest) {
+			shortest = v.shortest
+		}
+		unchanged = max(unchanged, v.last.Sub(v.since))
+	}
+	if repeats < 3 || repeats*2 < fetches {
+		return 0, "", false
+	}
+	lasted, how := shortest, "the quickest a body changed was after"
+	if shortest == 0 {
+		lasted, how = unchanged, "no body changed over"
+	}
+	i, found := slices.BinarySearch(suggestTTLSteps, lasted)
+	if !found {
+		i--
+	}
+	if i < 0 {
+		return 0, "", false
+	}
+	reason := fmt.Sprintf("%d of %d responses fetched from the target server repeated the previous body of their URL; %s %s", repeats, fetches, how, formatDuration(lasted.Round(time.Second)))
+	return suggestTTLSteps[i], reason, true
+}
+
+// ignorableParam is a query parameter that didn't change the responses of an endpoint.
+type ignorableParam struct {
+	name   string
+	reason string
+}
+
+// The `ignorableParams` method in the `trafficEndpoint` struct finds the query parameters the
+// endpoint's responses don't depend on: among URLs that only differ in a parameter, every value got the
+// same body, at least three times over, and never a different one. Parameters the route already
+// ignores or bypasses the cache for are left out.
+func (e *trafficEndpoint) ignorableParams(current route) []ignorableParam {
+	names := make(map[string]bool)
+	for _, v := range e.variants {
+		for name := range v.query {
+			names[name] = !slices.Contains(current.IgnoreParams, name) && !slices.Contains(current.BypassParams, name)
+		}
+	}
+	var params []ignorableParam
+	for name, candidate := range names {
+		if !candidate {
+			continue
+		}
+		// Group the URLs by their other parameters
+		groups := make(map[string][]*trafficVariant)
+		for _, v := range e.variants {
+			rest := url.Values{}
+			for other, values := range v.query {
+				if other != name {
+					rest[other] = values
+				}
+			}
+			groups[rest.Encode()] = append(groups[rest.Encode()], v)
+		}
+		same, values := 0, 0
+		for _, group := range groups {
+			if len(group) < 2 {
+				continue
+			}
+			if slices.ContainsFunc(group, func(v *trafficVariant) bool { return v.body != group[0].body }) {
+				same = -1
+				break
+			}
+			same += len(group) - 1
+			values += len(group)
+		}
+		if same >= 3 {
+			params = append(params, ignorableParam{name, fmt.Sprintf("%d URLs differing only in %s got the same body", values, name)})
+		}
+	}
+	slices.SortFunc(params, func(a, b ignorableParam) int { return strings.Compare(a.name, b.name) })
+	return params
+}
+
+// The adminSuggestionsHandler function suggests -route rules from the recorded traffic: lifetimes for
+// endpoints the target server is asked again for while it keeps sending the same bodies, and
+// ignore_params for query parameters the responses don't depend on. Only endpoints with at least
+// ?min_requests= (default 20) requests are considered. With ?format=text the rules are returned as
+// command-line flags, each preceded by the reasons as comments.
+func adminSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := authorize(w, r, roleViewer, false)
+	if !ok {
+		return
+	}
+	minRequests := int64(20)
+	if value := r.URL.Query().Get("min_requests"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid 'min_requests' parameter, expected a positive integer", http.StatusBadRequest)
+			return
+		}
+		minRequests = n
+	}
+	if traffic == nil {
+		http.Error(w, "Traffic recording is disabled (-suggest-endpoints 0)", http.StatusNotFound)
+		return
+	}
+
+	suggestions := traffic.suggest(p, minRequests)
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, s := range suggestions {
+			fmt.Fprintf(w, "# %s: %d requests, %d fetched from the target server\n", s.Prefix, s.Requests, s.Fetched)
+			for _, reason := range append(s.Reasons, s.Note) {
+				if reason != "" {
+					fmt.Fprintf(w, "# %s\n", reason)
+				}
+			}
+			fmt.Fprintf(w, "-route '%s'\n\n", s.Route)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"Since":       traffic.since,
+		"Suggestions": suggestions,
+	})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// The parseTarget function parses a target URL and normalizes it with normalizeURL, so equivalent
+// spellings of a URL share one cache key and are checked against host allowlists in one form.
+func parseTarget(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := normalizeURL(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// The normalizeURL function rewrites a URL into its normal form (RFC 3986 section 6.2.2 and 6.2.3):
+// the host is lower-cased with internationalized labels converted to punycode, the default port of
+// the scheme is removed, percent-encoded unreserved characters are decoded and other escapes use
+// upper-case hex digits, an empty path becomes "/" and the fragment, which is never sent to the
+// target server, is dropped.
+func normalizeURL(u *url.URL) error {
+	if u.Host != "" {
+		host, err := normalizeHost(u.Hostname())
+		if err != nil {
+			return fmt.Errorf("invalid host %q: %w", u.Hostname(), err)
+		}
+		port := u.Port()
+		if port == "" || (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+			if strings.Contains(host, ":") {
+				host = "[" + host + "]"
+			}
+			u.Host = host
+		} else {
+			u.Host = net.JoinHostPort(host, port)
+		}
+	}
+
+	escaped := normalizeEscapes(u.EscapedPath())
+	if escaped == "" && u.Host != "" {
+		escaped = "/"
+	}
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		return err
+	}
+	u.Path, u.RawPath = path, escaped
+	u.RawQuery = normalizeEscapes(u.RawQuery)
+	u.Fragment, u.RawFragment = "", ""
+	return nil
+}
+
+// The normalizeEscapes function decodes the percent-encoded unreserved characters of an escaped URL
+// component, which are equivalent to the characters themselves, and upper-cases the hex digits of the
+// remaining escapes.
+func normalizeEscapes(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		hi, lo := unhex(s[i+1]), unhex(s[i+2])
+		if hi < 0 || lo < 0 {
+			b.WriteByte(s[i])
+			continue
+		}
+		if c := byte(hi<<4 | lo); isUnreserved(c) {
+			b.WriteByte(c)
+		} else {
+			b.WriteString(strings.ToUpper(s[i : i+3]))
+		}
+		i += 2
+	}
+	return b.String()
+}
+
+// The unhex function returns the value of a hex digit, or -1 for other characters.
+func unhex(c byte) int {
+	switch {
+	case '0' <= c && c <= '9':
+		return int(c - '0')
+	case 'a' <= c && c <= 'f':
+		return int(c - 'a' + 10)
+	case 'A' <= c && c <= 'F':
+		return int(c - 'A' + 10)
+	}
+	return -1
+}
+
+// The isUnreserved function reports whether a character may appear in a URL without being escaped.
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// The normalizeHost function returns the ASCII form of a host name: lower-cased, without a trailing
+// dot, and with every label containing other characters encoded as punycode ("xn--..."). Full-width
+// letters and digits and the ideographic full stops that IDNA treats as dots are mapped first, so
+// look-alike spellings of an allowed host resolve to the same name. IP addresses are returned as is.
+func normalizeHost(host string) (string, error) {
+	if strings.Contains(host, ":") {
+		return strings.ToLower(host), nil
+	}
+	if !utf8.ValidString(host) {
+		return "", errors.New("host is not valid UTF-8")
+	}
+	host = strings.Map(func(r rune) rune {
+		switch {
+		case r == '。' || r == '．' || r == '｡':
+			return '.'
+		case '！' <= r && r <= '～':
+			return r - 0xfee0
+		}
+		return r
+	}, host)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		encoded, err := punycode(label)
+		if err != nil {
+			return "", err
+		}
+		labels[i] = "xn--" + encoded
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// The isASCII function reports whether a string only contains ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Parameters of the punycode bootstring encoding (RFC 3492 section 5).
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+	punyMaxLabel    = 63
+)
+
+// The punycode function encodes a host name label with punycode (RFC 3492), without the "xn--"
+// prefix.
+func punycode(label string) (string, error) {
+	runes := []rune(label)
+	var out []byte
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for handled := basic; handled < len(runes); {
+		next := int(utf8.MaxRune) + 1
+		for _, r := range runes {
+			if int(r) >= n && int(r) < next {
+				next = int(r)
+			}
+		}
+		delta += (next - n) * (handled + 1)
+		n = next
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := min(max(k-bias, punyTMin), punyTMax)
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	if len(out)+len("xn--") > punyMaxLabel {
+		return "", errors.New("host label too long")
+	}
+	return string(out), nil
+}
+
+// The punyDigit function returns the character encoding a punycode digit.
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+// The punyAdapt function returns the bias for the next punycode delta.
+func punyAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > (punyBase-punyTMin)*punyTMax/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
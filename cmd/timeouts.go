@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var upstreamConnectTimeout = flag.Duration("upstream-connect-timeout", 30*time.Second, "maximum time to establish a connection to a target server, 0 for no limit")
+
+var upstreamTTFBTimeout = flag.Duration("upstream-ttfb-timeout", 0, "maximum time from sending a request to a target server until its response headers arrive, 0 for no limit")
+
+var upstreamTransferTimeout = flag.Duration("upstream-transfer-timeout", 0, "maximum total time of a request to a target server including reading the response body, 0 for no limit")
+
+// errUpstreamTimeout is wrapped by the errors of requests to target servers that ran out of time.
+var errUpstreamTimeout = errors.New("target server timed out")
+
+// connectTimeoutKey is the context key holding the connect timeout of a request to a target server.
+type connectTimeoutKey struct{}
+
+// upstreamClient sends requests to target servers. Its dialer applies the connect timeout carried by
+// each request's context, so timeouts can differ per route while connections are still pooled, and
+// its connections and response bodies are counted (see upstreamConnStats).
+var upstreamClient = &http.Client{Transport: trackingTransport{next: newUpstreamTransport()}}
+
+// The newUpstreamTransport function returns the default transport with a dialer honouring the
+// per-request connect timeout.
+func newUpstreamTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{KeepAlive: 30 * time.Second}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if timeout, _ := ctx.Value(connectTimeoutKey{}).(time.Duration); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = fmt.Errorf("%w: connecting to %s: %w", errUpstreamTimeout, addr, err)
+			}
+			return nil, err
+		}
+		return countConn(conn, addr), nil
+	}
+	return transport
+}
+
+// upstreamTimeouts are the time budgets of a request to a target server; zero means no limit.
+type upstreamTimeouts struct {
+	Connect  time.Duration
+	TTFB     time.Duration
+	Transfer time.Duration
+}
+
+// The timeoutsFor function returns the time budgets for a request to the target: those of its -route,
+// falling back to the -upstream-*-timeout flags.
+func timeoutsFor(target *url.URL) upstreamTimeouts {
+	r := routeFor(target)
+	timeouts := upstreamTimeouts{Connect: *upstreamConnectTimeout, TTFB: *upstreamTTFBTimeout, Transfer: *upstreamTransferTimeout}
+	if r.ConnectTimeout > 0 {
+		timeouts.Connect = r.ConnectTimeout
+	}
+	if r.TTFBTimeout > 0 {
+		timeouts.TTFB = r.TTFBTimeout
+	}
+	if r.TransferTimeout > 0 {
+		timeouts.Transfer = r.TransferTimeout
+	}
+	return timeouts
+}
+
+// The `apply` method in the `upstreamTimeouts` struct returns a copy of req whose context enforces the
+// budgets, and a function to call once the response headers have arrived, which stops the
+// time-to-first-byte timer. The returned cancel function releases the timers and must be called once
+// the response body has been read.
+func (t upstreamTimeouts) apply(req *http.Request) (timed *http.Request, gotHeaders func(), cancel func()) {
+	ctx, cancelCause := context.WithCancelCause(context.WithValue(req.Context(), connectTimeoutKey{}, t.Connect))
+	var timers []*time.Timer
+	gotHeaders = func() {}
+	if t.TTFB > 0 {
+		ttfb := time.AfterFunc(t.TTFB, func() {
+			cancelCause(fmt.Errorf("%w: no response headers within %s", errUpstreamTimeout, t.TTFB))
+		})
+		timers = append(timers, ttfb)
+		gotHeaders = func() { ttfb.Stop() }
+	}
+	if t.Transfer > 0 {
+		timers = append(timers, time.AfterFunc(t.Transfer, func() {
+			cancelCause(fmt.Errorf("%w: response not complete within %s", errUpstreamTimeout, t.Transfer))
+		}))
+	}
+	return req.WithContext(ctx), gotHeaders, func() {
+		for _, timer := range timers {
+			timer.Stop()
+		}
+		cancelCause(nil)
+	}
+}
+
+// The timeoutCause function returns the reason a timed request's context was cancelled in place of
+// the less specific error the transport reported, if the request ran out of time.
+func timeoutCause(req *http.Request, err error) error {
+	if cause := context.Cause(req.Context()); cause != nil && errors.Is(cause, errUpstreamTimeout) {
+		return cause
+	}
+	return err
+}
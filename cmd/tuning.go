@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// tuningSettings are the knobs exposed by /admin/tuning. On POST, only the fields present in the body
+// are changed.
+type tuningSettings struct {
+	GOMAXPROCS            *int    `json:",omitempty"`
+	MaxUpstreamInflight   *int64  `json:",omitempty"`
+	ShedLatency           *string `json:",omitempty"`
+	RevalidateConcurrency *int64  `json:",omitempty"`
+}
+
+// The currentTuning function returns the current value of every tunable setting.
+func currentTuning() tuningSettings {
+	procs := runtime.GOMAXPROCS(0)
+	inflight := maxUpstreamInflight.Load()
+	latency := shedLatency.String()
+	concurrency := revalidateConcurrency.Load()
+	return tuningSettings{
+		GOMAXPROCS:            &procs,
+		MaxUpstreamInflight:   &inflight,
+		ShedLatency:           &latency,
+		RevalidateConcurrency: &concurrency,
+	}
+}
+
+// The adminTuningHandler function returns the runtime-tunable settings on GET and changes them on POST
+// with immediate effect. Every change is written to the log together with the client that made it.
+func adminTuningHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if _, ok := authorize(w, r, roleViewer, true); !ok {
+			return
+		}
+
+	case "POST":
+		if _, ok := authorize(w, r, roleAdmin, true); !ok {
+			return
+		}
+		var changes tuningSettings
+		if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+			http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := applyTuning(changes, clientIP(r)); err != nil {
+			http.Error(w, "Invalid setting: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentTuning())
+}
+
+// The applyTuning function validates every requested change before applying any of them, then applies
+// them and records who changed what in the audit log.
+func applyTuning(changes tuningSettings, client string) error {
+	if changes.GOMAXPROCS != nil && *changes.GOMAXPROCS < 1 {
+		return errors.New("GOMAXPROCS must be at least 1")
+	}
+	if changes.MaxUpstreamInflight != nil && *changes.MaxUpstreamInflight < 0 {
+		return errors.New("MaxUpstreamInflight must not be negative")
+	}
+	if changes.RevalidateConcurrency != nil && *changes.RevalidateConcurrency < 1 {
+		return errors.New("RevalidateConcurrency must be at least 1")
+	}
+	var latency time.Duration
+	if changes.ShedLatency != nil {
+		var err error
+		if latency, err = time.ParseDuration(*changes.ShedLatency); err != nil || latency < 0 {
+			return errors.New("ShedLatency must be a non-negative duration")
+		}
+	}
+
+	audit := func(name string, from, to interface{}) {
+		slog.Info("Tuning changed", "client", client, "setting", name, "from", from, "to", to)
+	}
+	if changes.GOMAXPROCS != nil {
+		audit("GOMAXPROCS", runtime.GOMAXPROCS(*changes.GOMAXPROCS), *changes.GOMAXPROCS)
+	}
+	if changes.MaxUpstreamInflight != nil {
+		audit("MaxUpstreamInflight", maxUpstreamInflight.Swap(*changes.MaxUpstreamInflight), *changes.MaxUpstreamInflight)
+	}
+	if changes.ShedLatency != nil {
+		audit("ShedLatency", time.Duration(shedLatency.Swap(int64(latency))), latency)
+	}
+	if changes.RevalidateConcurrency != nil {
+		audit("RevalidateConcurrency", revalidateConcurrency.Swap(*changes.RevalidateConcurrency), *changes.RevalidateConcurrency)
+	}
+	return nil
+}
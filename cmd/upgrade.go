@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var upgradeInsecureTargets = newListFlag("upgrade-insecure-targets", "comma-separated hosts (example.com, *.example.com or * for every host) whose http:// targets are fetched, cached and keyed as https://")
+
+var rejectInsecureTargets = flag.Bool("reject-insecure-targets", false, "refuse http:// targets that aren't upgraded to https:// with 400 Bad Request")
+
+var learnHSTS = flag.Bool("learn-hsts", false, "remember the Strict-Transport-Security headers of https:// target servers and upgrade later http:// targets of those hosts like a browser would")
+
+// errInsecureTarget is returned for plaintext targets when -reject-insecure-targets is set.
+var errInsecureTarget = errors.New("plaintext http:// targets are not allowed")
+
+// maxHSTSHosts bounds the number of hosts whose HSTS policy is remembered, so arbitrary targets can't
+// grow the table without limit.
+const maxHSTSHosts = 10000
+
+// hstsPolicy is a Strict-Transport-Security policy learned from a target server.
+type hstsPolicy struct {
+	expires           time.Time
+	includeSubdomains bool
+}
+
+// hstsHosts holds the HSTS policies learned with -learn-hsts, by host.
+var hstsHosts struct {
+	sync.Mutex
+	policies map[string]hstsPolicy
+}
+
+// The secureTarget function resolves a scheme-relative target ("//example.com/") to https:// and
+// upgrades http:// targets to https:// when their host is listed in -upgrade-insecure-targets or has
+// sent an HSTS policy (see -learn-hsts). Targets with an explicit port keep their scheme, as the port
+// would not serve TLS. It returns errInsecureTarget for remaining http:// targets when
+// -reject-insecure-targets is set.
+func secureTarget(target *url.URL) error {
+	if target.Scheme == "" && target.Host != "" {
+		target.Scheme = "https"
+	}
+	if target.Scheme != "http" {
+		return nil
+	}
+	if target.Port() == "" && (upgradeListed(target.Hostname()) || knownHSTSHost(target.Hostname())) {
+		target.Scheme = "https"
+		return nil
+	}
+	if *rejectInsecureTargets {
+		return errInsecureTarget
+	}
+	return nil
+}
+
+// The upgradeListed function reports whether a host matches -upgrade-insecure-targets. A pattern
+// starting with * matches the domain after it and its subdomains, so *.example.com doesn't match
+// evilexample.com.
+func upgradeListed(host string) bool {
+	for _, pattern := range *upgradeInsecureTargets {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*" || pattern == host {
+			return true
+		}
+		if domain, ok := strings.CutPrefix(pattern, "*"); ok {
+			domain = strings.TrimPrefix(domain, ".")
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The knownHSTSHost function reports whether an unexpired HSTS policy covers the host, either its own
+// or one of a parent domain with includeSubDomains.
+func knownHSTSHost(host string) bool {
+	if !*learnHSTS {
+		return false
+	}
+	now := time.Now()
+	hstsHosts.Lock()
+	defer hstsHosts.Unlock()
+	for domain, own := host, true; domain != ""; own = false {
+		if policy, ok := hstsHosts.policies[domain]; ok && now.Before(policy.expires) && (own || policy.includeSubdomains) {
+			return true
+		}
+		_, parent, found := strings.Cut(domain, ".")
+		if !found {
+			break
+		}
+		domain = parent
+	}
+	return false
+}
+
+// The rememberHSTS function records the Strict-Transport-Security policy of a response to an https://
+// target. As RFC 6797 requires, the header is ignored on plaintext responses and for IP addresses, and
+// max-age=0 forgets the host.
+func rememberHSTS(target *url.URL, header http.Header) {
+	value := header.Get("Strict-Transport-Security")
+	if !*learnHSTS || value == "" || target.Scheme != "https" {
+		return
+	}
+	host := target.Hostname()
+	if _, err := netip.ParseAddr(host); err == nil {
+		return
+	}
+	policy, maxAge := hstsPolicy{}, -1
+	for _, directive := range strings.Split(value, ";") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "max-age":
+			if seconds, err := strconv.Atoi(strings.Trim(arg, `"`)); err == nil && seconds >= 0 {
+				maxAge = min(seconds, math.MaxInt64/int(time.Second))
+			}
+		case "includesubdomains":
+			policy.includeSubdomains = true
+		}
+	}
+	if maxAge < 0 {
+		return
+	}
+
+	hstsHosts.Lock()
+	defer hstsHosts.Unlock()
+	if maxAge == 0 {
+		delete(hstsHosts.policies, host)
+		return
+	}
+	if hstsHosts.policies == nil {
+		hstsHosts.policies = make(map[string]hstsPolicy)
+	}
+	if _, known := hstsHosts.policies[host]; !known && len(hstsHosts.policies) >= maxHSTSHosts {
+		slog.Warn("Not remembering HSTS policy, too many hosts known", "host", host, "known", maxHSTSHosts)
+		return
+	}
+	policy.expires = time.Now().Add(time.Duration(maxAge) * time.Second)
+	hstsHosts.policies[host] = policy
+}
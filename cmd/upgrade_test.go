@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestUpgradeListed(t *testing.T) {
+	setVar(t, upgradeInsecureTargets, listFlag{"Example.com", "*.shop.example.com", "*cdn.example.net"})
+	for host, listed := range map[string]bool{
+		"example.com":          true,
+		"www.example.com":      false,
+		"shop.example.com":     true,
+		"eu.shop.example.com":  true,
+		"evilshop.example.com": false,
+		"cdn.example.net":      true,
+		"img.cdn.example.net":  true,
+		"evilcdn.example.net":  false,
+		"example.org":          false,
+	} {
+		if got := upgradeListed(host); got != listed {
+			t.Errorf("upgradeListed(%q): got %v, want %v", host, got, listed)
+		}
+	}
+
+	setVar(t, upgradeInsecureTargets, listFlag{"*"})
+	if !upgradeListed("anything.example") {
+		t.Error("upgradeListed with *: got false")
+	}
+}
+
+func TestSecureTarget(t *testing.T) {
+	setVar(t, upgradeInsecureTargets, listFlag{"*.example.com"})
+	setVar(t, rejectInsecureTargets, true)
+	for _, test := range []struct {
+		target string
+		want   string
+		err    bool
+	}{
+		{"http://www.example.com/a", "https://www.example.com/a", false},
+		{"//other.example/a", "https://other.example/a", false},
+		{"https://other.example/a", "https://other.example/a", false},
+		{"http://www.example.com:8080/a", "", true},
+		{"http://wwwexample.com/a", "", true},
+	} {
+		u, err := url.Parse(test.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = secureTarget(u)
+		if test.err {
+			if err == nil {
+				t.Errorf("secureTarget(%q): got %s, want an error", test.target, u)
+			}
+			continue
+		}
+		if err != nil || u.String() != test.want {
+			t.Errorf("secureTarget(%q): got %s, %v, want %s", test.target, u, err, test.want)
+		}
+	}
+}
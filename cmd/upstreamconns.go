@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var upstreamLeakTimeout = flag.Duration("upstream-leak-timeout", time.Minute, "how long a target server response body may stay open before it is logged as a likely connection leak, 0 to disable the check")
+
+// hostConns counts the connections to a target server address (host:port). Open connections are
+// counted from dial to close; active ones from sending a request until its response body is closed.
+// The others are idle in the keep-alive pool.
+type hostConns struct {
+	open   atomic.Int64
+	active atomic.Int64
+}
+
+// connStats is the JSON form of hostConns reported by /admin/stats.
+type connStats struct {
+	Open   int64
+	Active int64
+	Idle   int64
+}
+
+var (
+	// upstreamConns holds the connection counts per target server address.
+	upstreamConns sync.Map
+	// openBodies holds the response bodies that have not been closed yet.
+	openBodies sync.Map
+	// upstreamLeaks counts response bodies that stayed open longer than -upstream-leak-timeout.
+	upstreamLeaks atomic.Int64
+)
+
+// The connsFor function returns the connection counts of a target server address.
+func connsFor(addr string) *hostConns {
+	conns, _ := upstreamConns.LoadOrStore(addr, new(hostConns))
+	return conns.(*hostConns)
+}
+
+// The upstreamConnStats function returns the connection counts of every target server address
+// connected to so far.
+func upstreamConnStats() map[string]connStats {
+	stats := make(map[string]connStats)
+	upstreamConns.Range(func(addr, value any) bool {
+		conns := value.(*hostConns)
+		open, active := conns.open.Load(), conns.active.Load()
+		stats[addr.(string)] = connStats{Open: open, Active: active, Idle: max(open-active, 0)}
+		return true
+	})
+	return stats
+}
+
+// countedConn is a connection to a target server that is counted as open until it is closed.
+type countedConn struct {
+	net.Conn
+	conns *hostConns
+	once  sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.conns.open.Add(-1) })
+	return c.Conn.Close()
+}
+
+// The countConn function counts a newly dialed connection to a target server address.
+func countConn(conn net.Conn, addr string) net.Conn {
+	conns := connsFor(addr)
+	conns.open.Add(1)
+	return &countedConn{Conn: conn, conns: conns}
+}
+
+// trackedBody is a target server response body that is counted as active, and watched for leaks,
+// until it is closed. A body that is never closed keeps its connection out of the keep-alive pool.
+type trackedBody struct {
+	io.ReadCloser
+	conns    *hostConns
+	url      string
+	opened   time.Time
+	reported atomic.Bool
+	once     sync.Once
+}
+
+func (b *trackedBody) Close() error {
+	b.once.Do(func() {
+		b.conns.active.Add(-1)
+		openBodies.Delete(b)
+	})
+	return b.ReadCloser.Close()
+}
+
+// trackingTransport counts the requests in flight to each target server address and tracks their
+// response bodies.
+type trackingTransport struct {
+	next http.RoundTripper
+}
+
+func (t trackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	conns := connsFor(canonicalAddr(req.URL))
+	conns.active.Add(1)
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		conns.active.Add(-1)
+		return nil, err
+	}
+	body := &trackedBody{ReadCloser: resp.Body, conns: conns, url: req.URL.String(), opened: time.Now()}
+	openBodies.Store(body, struct{}{})
+	resp.Body = body
+	return resp, nil
+}
+
+// The canonicalAddr function returns the host:port a request URL connects to, as passed to the dialer.
+func canonicalAddr(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// The startLeakDetector function periodically logs target server response bodies that have been open
+// for longer than -upstream-leak-timeout, once each.
+func startLeakDetector() {
+	if *upstreamLeakTimeout <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(*upstreamLeakTimeout / 2) {
+			openBodies.Range(func(key, _ any) bool {
+				body := key.(*trackedBody)
+				if age := time.Since(body.opened); age > *upstreamLeakTimeout && !body.reported.Swap(true) {
+					upstreamLeaks.Add(1)
+					slog.Warn("Response body open for long, its connection may be leaking", "target", body.url, "age", age.Round(time.Second).String())
+				}
+				return true
+			})
+		}
+	}()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// varyIndex remembers, per cache key, the request headers named by the Vary header of the last response
+// stored for it, so lookups can select the variant matching the client's headers before the response
+// is fetched. It holds one short list per URL that varies.
+var varyIndex = struct {
+	sync.RWMutex
+	names map[string][]string
+}{names: make(map[string][]string)}
+
+// The varyNames function returns the canonical, sorted request header names listed by a response's
+// Vary header. It reports false for Vary: *, which makes the response unusable for any other request.
+func varyNames(header http.Header) ([]string, bool) {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names), true
+}
+
+// The variantKey function appends the values of the varying request headers to a cache key.
+func variantKey(key string, names []string, header http.Header) string {
+	for _, name := range names {
+		key += " " + name + "=" + strings.Join(header.Values(name), ",")
+	}
+	return key
+}
+
+// The lookupKey function returns the key of the variant of a cache entry selected by the request
+// headers, or the key itself when the stored response doesn't vary.
+func lookupKey(key string, header http.Header) string {
+	varyIndex.RLock()
+	names := varyIndex.names[key]
+	varyIndex.RUnlock()
+	return variantKey(key, names, header)
+}
+
+// The storeKey function returns the key under which a response to a request is stored, taking the
+// response's Vary header into account, and records the varying headers for later lookups. It reports
+// false when the response varies on every request header and can't be cached.
+func storeKey(key string, requestHeader, responseHeader http.Header) (string, []string, bool) {
+	names, ok := varyNames(responseHeader)
+	if !ok {
+		return "", nil, false
+	}
+	varyIndex.Lock()
+	if len(names) == 0 {
+		delete(varyIndex.names, key)
+	} else {
+		varyIndex.names[key] = names
+	}
+	varyIndex.Unlock()
+	return variantKey(key, names, requestHeader), names, true
+}
@@ -0,0 +1,843 @@
+// Package cache implements the in-memory HTTP response cache used by the proxy server. Entries are
+// grouped into namespaces that can be dropped as a whole, count their hits, and are optionally owned
+// by a client identity so that per-identity quotas can be enforced.
+package cache
+
+import (
+	"container/list"
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Entry is a cached response together with its body and bookkeeping.
+type Entry struct {
+	Response ResponseRecord
+	Body     []byte
+	ETag     string
+	StoredAt time.Time
+	// ExpiresAt is when the entry's time to live runs out; zero for entries that never expire.
+	ExpiresAt time.Time
+	// JSON is the decoded body of a JSON response when -json-fields is enabled, used to serve
+	// ?fields= selections without parsing the body again.
+	JSON interface{}
+	// Identity is the client identity the entry was cached for (see -identity-header); empty for
+	// shared entries.
+	Identity string
+	// Variants holds the body pre-encoded with content codings such as gzip, by coding name.
+	Variants map[string][]byte
+	// Vary lists the request headers named by the response's Vary header; the entry only answers
+	// requests carrying the same values for them.
+	Vary []string
+	// Tags are the origin's surrogate keys for the entry; entries sharing a tag are purged together
+	// with PurgeTag.
+	Tags []string
+	// Revisions are the entry's previous versions, newest first, when they are kept (see
+	// KeepRevision).
+	Revisions []Revision
+	// Checksum is the CRC-32C of the body and variants, computed when the entry is cached so that
+	// corruption can be detected with `Verify`; zero for entries without one.
+	Checksum uint32
+	// BodySize is the size of a body kept in the store's chunks (see Fill) rather than in Body; zero
+	// when Body holds the body.
+	BodySize int64
+
+	hits *atomic.Int64
+	// elem is the entry's position in the LRU list when the cache has a memory budget
+	elem *list.Element
+	// syncedAt is when the entry was last written to or read from the cache's store
+	syncedAt time.Time
+	// chunks locates the chunks of a body of BodySize bytes
+	chunks chunkRef
+}
+
+// The `Hits` method in the `Entry` struct returns how many times the entry has been served from
+// the cache.
+func (e Entry) Hits() int64 {
+	if e.hits == nil {
+		return 0
+	}
+	return e.hits.Load()
+}
+
+// The `Size` method in the `Entry` struct returns the number of body bytes the entry holds, including
+// its encoded variants and revisions but not a body kept in chunks. It is what counts towards the
+// cache's memory budget.
+func (e Entry) Size() int64 {
+	size := int64(len(e.Body))
+	for _, variant := range e.Variants {
+		size += int64(len(variant))
+	}
+	for _, revision := range e.Revisions {
+		size += int64(len(revision.Delta))
+	}
+	return size
+}
+
+// The `Expired` method in the `Entry` struct reports whether the entry's time to live has run out at
+// the given time.
+func (e Entry) Expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt)
+}
+
+// The `removable` method in the `Cache` struct reports whether an entry has been expired for longer
+// than the cache keeps stale entries.
+func (c *Cache) removable(entry Entry, now time.Time) bool {
+	return !entry.ExpiresAt.IsZero() && !now.Before(entry.ExpiresAt.Add(c.retention))
+}
+
+// DefaultNamespace is the namespace used by the `Set` and `Get` methods of the `Cache` struct.
+const DefaultNamespace = ""
+
+// Cache stores entries in namespaces. It is safe for concurrent use.
+type Cache struct {
+	namespaces map[string]map[string]Entry
+	identities map[string]int
+	defaultTTL time.Duration
+	retention  time.Duration
+	mutex      sync.RWMutex
+
+	// Memory budget, see the `evict` method. bytes is only changed under the write lock.
+	maxBytes  int64
+	bytes     atomic.Int64
+	lru       *list.List
+	lruMutex  sync.Mutex
+	evictions atomic.Int64
+	onEvict   func(namespace, key string, entry Entry)
+	policy    Policy
+	// sketch counts requests per key under PolicyTinyLFU
+	sketch     *frequencySketch
+	rejections atomic.Int64
+
+	// The janitor removes expired entries in the background, see the `Stop` method.
+	stop     chan struct{}
+	stopOnce sync.Once
+	expired  atomic.Int64
+
+	// Second tier, see store.go. Writes are queued to writes and applied by the `storeWriter` goroutine,
+	// which closes written once `Stop` closed writes and it applied the last one. writesMutex guards
+	// sending to writes against closing it.
+	store        Store
+	localTTL     time.Duration
+	onLoad       func(namespace, key string, entry *Entry)
+	onStoreError func(err error)
+	writes       chan func()
+	writesMutex  sync.RWMutex
+	writesClosed bool
+	written      chan struct{}
+	storeLoads   atomic.Int64
+	storeErrors  atomic.Int64
+	storeDropped atomic.Int64
+
+	// Checksum verification, see the `verified` method.
+	verifyChecksum   func(loaded bool) bool
+	onCorrupt        func(namespace, key string, entry Entry)
+	checksumFailures atomic.Int64
+
+	// Bodies kept in chunks, see chunks.go. broken holds the IDs of bodies with a missing or corrupt
+	// chunk, and fills whether the fills this cache started or resumed, by ID, are being written.
+	chunkBytes int
+	broken     sync.Map
+	fills      sync.Map
+
+	// Lock contention counters, see the `Stats` method.
+	lockAcquisitions atomic.Int64
+	lockWaitNanos    atomic.Int64
+	maxLockWaitNanos atomic.Int64
+}
+
+// Options configures a Cache created by New. The zero value is a cache without expiry or size limit.
+type Options struct {
+	// DefaultTTL is the time to live of entries set without one of their own; zero keeps them until
+	// they are removed.
+	DefaultTTL time.Duration
+	// StaleRetention is how long expired entries are kept so they can be revalidated with the origin
+	// (see `GetStale` and `Refresh`) instead of fetched again; zero removes them once they expire.
+	StaleRetention time.Duration
+	// SweepInterval is how often a janitor goroutine removes expired entries so their memory is
+	// reclaimed; zero leaves them until they are looked up.
+	SweepInterval time.Duration
+	// MaxBytes is the budget for the total size of cached bodies. The least recently used entries are
+	// evicted to stay within it; zero means unlimited.
+	MaxBytes int64
+	// Policy selects the entries evicted, and under PolicyTinyLFU the entries admitted, when MaxBytes
+	// is reached. The default is PolicyLRU.
+	Policy Policy
+	// OnEvict, if set, is called for every entry evicted to stay within MaxBytes. It runs while the
+	// cache is locked, so it must be quick and must not use the cache.
+	OnEvict func(namespace, key string, entry Entry)
+	// Store, if set, is a second tier every entry set, refreshed, updated, expired or deleted is written
+	// through to, and lookups missing in memory are read from. Memory then acts as a local copy of the
+	// store: evicting or sweeping an entry from memory leaves it in the store. Store writes are made in
+	// the background, in order; purges wait for them.
+	Store Store
+	// LocalTTL is how long memory copies are served before being read from the Store again, so that
+	// changes made by other caches sharing the store are picked up; zero trusts them until they are
+	// removed.
+	LocalTTL time.Duration
+	// OnLoad, if set, is called for every entry read from the Store, e.g. to restore its JSON field.
+	OnLoad func(namespace, key string, entry *Entry)
+	// OnStoreError, if set, is called for every failed Store operation. Lookups then fall back to
+	// memory.
+	OnStoreError func(err error)
+	// VerifyChecksum, if set, is called for every entry about to be returned by `Get` or `GetStale`,
+	// with whether it was just read from the Store, and reports whether its checksum is verified. An
+	// entry failing verification is removed, from memory and the store, and is a miss.
+	VerifyChecksum func(loaded bool) bool
+	// OnCorrupt, if set, is called for every entry failing checksum verification.
+	OnCorrupt func(namespace, key string, entry Entry)
+	// ChunkBytes, with a Store, is the size of the chunks that bodies written with `Fill` are saved in,
+	// each a separate value of the store, so that they are never held in memory as a whole and can be
+	// read a range at a time with `ReadBody`. Zero disables Fill.
+	ChunkBytes int
+}
+
+// The New function creates and returns a new Cache instance with an empty map of entries. When
+// opts.SweepInterval is set, the janitor goroutine runs until the `Stop` method is called.
+func New(opts Options) *Cache {
+	c := &Cache{
+		namespaces: make(map[string]map[string]Entry),
+		identities: make(map[string]int),
+		defaultTTL: opts.DefaultTTL,
+		retention:  opts.StaleRetention,
+		maxBytes:   opts.MaxBytes,
+		onEvict:    opts.OnEvict,
+		policy:     opts.Policy,
+		lru:        list.New(),
+		stop:       make(chan struct{}),
+
+		store:        opts.Store,
+		localTTL:     opts.LocalTTL,
+		onLoad:       opts.OnLoad,
+		onStoreError: opts.OnStoreError,
+
+		verifyChecksum: opts.VerifyChecksum,
+		onCorrupt:      opts.OnCorrupt,
+
+		chunkBytes: opts.ChunkBytes,
+	}
+	if opts.Store != nil {
+		c.writes, c.written = make(chan func(), storeQueue), make(chan struct{})
+		go c.storeWriter()
+	}
+	if opts.Policy == PolicyTinyLFU && opts.MaxBytes > 0 {
+		c.sketch = &frequencySketch{}
+	}
+	if opts.SweepInterval > 0 {
+		go c.janitor(opts.SweepInterval)
+	}
+	return c
+}
+
+// The `janitor` method in the `Cache` struct calls `Sweep` every interval until the cache is stopped.
+func (c *Cache) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Sweep()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// The `Stop` method in the `Cache` struct stops the janitor goroutine and, once the queued writes to the
+// store are done, the goroutine applying them. The cache remains usable, but expired entries are then
+// only removed when they are looked up, and writes to the store are made right away.
+func (c *Cache) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+		if c.store != nil {
+			c.writesMutex.Lock()
+			c.writesClosed = true
+			close(c.writes)
+			c.writesMutex.Unlock()
+			<-c.written
+		}
+	})
+}
+
+// The `Sweep` method in the `Cache` struct removes every entry expired for longer than the stale
+// retention and returns how many were removed. Namespaces are swept one at a time so that lookups in
+// other namespaces are not held up by the whole sweep.
+func (c *Cache) Sweep() int {
+	c.rlock()
+	names := make([]string, 0, len(c.namespaces))
+	for name := range c.namespaces {
+		names = append(names, name)
+	}
+	c.mutex.RUnlock()
+
+	removed := 0
+	for _, name := range names {
+		now := time.Now()
+		c.lock()
+		for key, entry := range c.namespaces[name] {
+			if c.removable(entry, now) {
+				c.remove(name, key, entry)
+				removed++
+			}
+		}
+		c.mutex.Unlock()
+	}
+	c.expired.Add(int64(removed))
+	return removed
+}
+
+// The `lock` method in the `Cache` struct acquires the write lock, recording how long it waited.
+func (c *Cache) lock() {
+	start := time.Now()
+	c.mutex.Lock()
+	c.recordLockWait(time.Since(start))
+}
+
+// The `rlock` method in the `Cache` struct acquires the read lock, recording how long it waited.
+func (c *Cache) rlock() {
+	start := time.Now()
+	c.mutex.RLock()
+	c.recordLockWait(time.Since(start))
+}
+
+// The `recordLockWait` method in the `Cache` struct adds a lock acquisition to the contention counters.
+func (c *Cache) recordLockWait(wait time.Duration) {
+	c.lockAcquisitions.Add(1)
+	c.lockWaitNanos.Add(int64(wait))
+	for {
+		longest := c.maxLockWaitNanos.Load()
+		if int64(wait) <= longest || c.maxLockWaitNanos.CompareAndSwap(longest, int64(wait)) {
+			return
+		}
+	}
+}
+
+// Stats describes the size and lock contention of a cache. Namespaces holds the number of entries of
+// each namespace. The cache isn't sharded: one lock guards every namespace, so there are no shard sizes
+// or per-shard load factors to report.
+type Stats struct {
+	Entries          int
+	Namespaces       map[string]int
+	Identities       int
+	Bytes            int64
+	MaxBytes         int64
+	Expired          int64
+	Evictions        int64
+	Rejections       int64
+	LockAcquisitions int64
+	LockWaitTotal    time.Duration
+	LockWaitMax      time.Duration
+	LockWaitAverage  time.Duration
+	// Store counters: entries read from the store, failed store operations and entries not written
+	// because the store fell behind.
+	StoreLoads   int64
+	StoreErrors  int64
+	StoreDropped int64
+	// ChecksumFailures counts the entries removed because they failed checksum verification.
+	ChecksumFailures int64
+}
+
+// The `Stats` method in the `Cache` struct returns entry counts per namespace, the size of the cached
+// bodies, the number of expired and evicted entries removed so far and the cumulative time callers
+// spent waiting for the cache lock. Entry counts and sizes only cover memory, not the store.
+func (c *Cache) Stats() Stats {
+	c.rlock()
+	stats := Stats{
+		Namespaces: make(map[string]int, len(c.namespaces)),
+		Identities: len(c.identities),
+	}
+	for name, entries := range c.namespaces {
+		stats.Namespaces[name] = len(entries)
+		stats.Entries += len(entries)
+	}
+	c.mutex.RUnlock()
+
+	stats.Bytes = c.bytes.Load()
+	stats.MaxBytes = c.maxBytes
+	stats.Expired = c.expired.Load()
+	stats.Evictions = c.evictions.Load()
+	stats.Rejections = c.rejections.Load()
+	stats.LockAcquisitions = c.lockAcquisitions.Load()
+	stats.LockWaitTotal = time.Duration(c.lockWaitNanos.Load())
+	stats.LockWaitMax = time.Duration(c.maxLockWaitNanos.Load())
+	if stats.LockAcquisitions > 0 {
+		stats.LockWaitAverage = stats.LockWaitTotal / time.Duration(stats.LockAcquisitions)
+	}
+	stats.StoreLoads = c.storeLoads.Load()
+	stats.StoreErrors = c.storeErrors.Load()
+	stats.StoreDropped = c.storeDropped.Load()
+	stats.ChecksumFailures = c.checksumFailures.Load()
+	return stats
+}
+
+// The `track` method in the `Cache` struct adjusts the per-identity entry count for an entry being
+// added (delta 1) or removed (delta -1). The caller must hold the write lock.
+func (c *Cache) track(entry Entry, delta int) {
+	if entry.Identity == "" {
+		return
+	}
+	c.identities[entry.Identity] += delta
+	if c.identities[entry.Identity] <= 0 {
+		delete(c.identities, entry.Identity)
+	}
+}
+
+// The `IdentityEntries` method in the `Cache` struct returns how many entries are currently cached for
+// the given client identity across all namespaces.
+func (c *Cache) IdentityEntries(identity string) int {
+	c.rlock()
+	defer c.mutex.RUnlock()
+	return c.identities[identity]
+}
+
+// The `Set` method in the `Cache` struct is used to set a cache entry in the default namespace that
+// expires after ttl (see the `Set` method of the `Namespace` struct).
+func (c *Cache) Set(key string, entry Entry, ttl time.Duration) {
+	c.Namespace(DefaultNamespace).Set(key, entry, ttl)
+}
+
+// The `Get` method in the `Cache` struct is used to retrieve a cache entry from the default namespace
+// based on a given key. Expired entries are misses.
+func (c *Cache) Get(key string) (Entry, bool) {
+	return c.Namespace(DefaultNamespace).Get(key)
+}
+
+// The `Delete` method in the `Cache` struct removes the entry stored under key in the default namespace
+// and reports whether it existed.
+func (c *Cache) Delete(key string) bool {
+	return c.Namespace(DefaultNamespace).Delete(key)
+}
+
+// Namespace groups cache entries (e.g. per service or per deployment build ID) so that they can be
+// dropped together with `DropNamespace`. Keys in different namespaces never collide.
+type Namespace struct {
+	cache *Cache
+	name  string
+}
+
+// The `Namespace` method in the `Cache` struct returns a handle for reading and writing entries in the
+// named namespace. The namespace is created on its first `Set`.
+func (c *Cache) Namespace(name string) *Namespace {
+	return &Namespace{cache: c, name: name}
+}
+
+// The `Name` method in the `Namespace` struct returns the name of the namespace.
+func (n *Namespace) Name() string {
+	return n.name
+}
+
+// The `Set` method in the `Namespace` struct is used to set a cache entry in the namespace that expires
+// after ttl. A ttl of zero uses the cache's default TTL. Least recently used entries are evicted when
+// the cache exceeds its memory budget; an entry whose body alone exceeds the budget, or that the
+// cache's Policy does not admit, is not kept in memory. It is still written to the cache's store.
+func (n *Namespace) Set(key string, entry Entry, ttl time.Duration) {
+	n.cache.lock()
+	defer n.cache.mutex.Unlock()
+	if old, ok := n.cache.namespaces[n.name][key]; ok {
+		n.cache.remove(n.name, key, old)
+	}
+	if entry.StoredAt.IsZero() {
+		entry.StoredAt = time.Now()
+	}
+	if ttl == 0 {
+		ttl = n.cache.defaultTTL
+	}
+	entry.ExpiresAt = time.Time{}
+	if ttl > 0 {
+		entry.ExpiresAt = entry.StoredAt.Add(ttl)
+	}
+	entry.Checksum = entry.checksum()
+	n.cache.persist(n.name, key, &entry)
+	if n.cache.maxBytes > 0 && entry.Size() > n.cache.maxBytes {
+		return
+	}
+	if !n.cache.admit(n.name, key, entry.Size()) {
+		n.cache.rejections.Add(1)
+		return
+	}
+	entry.hits = new(atomic.Int64)
+	n.cache.insert(n.name, key, entry)
+	n.cache.evict()
+}
+
+// The `Get` method in the `Namespace` struct is used to retrieve a cache entry from the namespace based
+// on a given key. Every successful lookup counts as a hit on the entry. Expired entries are misses, and
+// are removed once past the stale retention, as are entries failing checksum verification.
+func (n *Namespace) Get(key string) (Entry, bool) {
+	if n.cache.sketch != nil {
+		n.cache.sketch.increment(n.name, key)
+	}
+	entry, ok := n.verified(key)
+	if !ok {
+		return Entry{}, false
+	}
+	if now := time.Now(); entry.Expired(now) {
+		if n.cache.removable(entry, now) {
+			n.expire(key, entry)
+		}
+		return Entry{}, false
+	}
+	entry.hits.Add(1)
+	n.cache.touch(entry)
+	return entry, true
+}
+
+// The `expire` method in the `Namespace` struct removes an expired entry, unless it has been replaced
+// since it was read.
+func (n *Namespace) expire(key string, entry Entry) {
+	n.cache.lock()
+	defer n.cache.mutex.Unlock()
+	if current, ok := n.cache.namespaces[n.name][key]; ok && current.hits == entry.hits {
+		n.cache.remove(n.name, key, current)
+		n.cache.expired.Add(1)
+	}
+}
+
+// The `GetStale` method in the `Namespace` struct returns the entry stored under key if it has expired
+// but is still retained, so that it can be revalidated with the origin.
+func (n *Namespace) GetStale(key string) (Entry, bool) {
+	entry, ok := n.verified(key)
+	if !ok || !entry.Expired(time.Now()) {
+		return Entry{}, false
+	}
+	return entry, true
+}
+
+// The `Refresh` method in the `Namespace` struct makes the entry stored under key, fresh or stale,
+// fresh again for ttl (the default TTL when zero) after the origin confirmed it is still current. fn,
+// if not nil, may update the entry, e.g. with the headers of the origin's 304 response; the same rules
+// as for `Update` apply. It returns the refreshed entry and whether it exists.
+func (n *Namespace) Refresh(key string, ttl time.Duration, fn func(entry *Entry)) (Entry, bool) {
+	n.lookup(key)
+	n.cache.lock()
+	defer n.cache.mutex.Unlock()
+	old, ok := n.cache.namespaces[n.name][key]
+	if !ok {
+		return Entry{}, false
+	}
+	refreshed := old
+	if fn != nil {
+		fn(&refreshed)
+	}
+	if ttl == 0 {
+		ttl = n.cache.defaultTTL
+	}
+	refreshed.hits, refreshed.elem, refreshed.Identity = old.hits, old.elem, old.Identity
+	refreshed.StoredAt, refreshed.ExpiresAt = time.Now(), time.Time{}
+	if ttl > 0 {
+		refreshed.ExpiresAt = refreshed.StoredAt.Add(ttl)
+	}
+	refreshed.Checksum = refreshed.checksum()
+	n.cache.persist(n.name, key, &refreshed)
+	n.cache.namespaces[n.name][key] = refreshed
+	n.cache.bytes.Add(refreshed.Size() - old.Size())
+	return refreshed, true
+}
+
+// The `Update` method in the `Namespace` struct changes the entry stored under key in place, keeping its
+// hits, storage time and expiry, and reports whether the entry exists. fn must not modify the maps or
+// slices of the entry it receives, only replace them, since readers may still be using them.
+func (n *Namespace) Update(key string, fn func(entry *Entry)) bool {
+	n.lookup(key)
+	n.cache.lock()
+	defer n.cache.mutex.Unlock()
+	old, ok := n.cache.namespaces[n.name][key]
+	if !ok || old.Expired(time.Now()) {
+		return false
+	}
+	updated := old
+	fn(&updated)
+	updated.hits, updated.elem = old.hits, old.elem
+	updated.StoredAt, updated.ExpiresAt, updated.Identity = old.StoredAt, old.ExpiresAt, old.Identity
+	updated.Checksum = updated.checksum()
+	n.cache.persist(n.name, key, &updated)
+	n.cache.namespaces[n.name][key] = updated
+	n.cache.bytes.Add(updated.Size() - old.Size())
+	n.cache.evict()
+	return true
+}
+
+// The `Peek` method in the `Namespace` struct retrieves a cache entry like `Get` without counting it as
+// a hit, for inspection purposes.
+func (n *Namespace) Peek(key string) (Entry, bool) {
+	entry, ok, _ := n.lookup(key)
+	if !ok || entry.Expired(time.Now()) {
+		return Entry{}, false
+	}
+	return entry, true
+}
+
+// The `Delete` method in the `Namespace` struct removes the entry stored under key, from memory and the
+// store, and reports whether it existed.
+func (n *Namespace) Delete(key string) bool {
+	c := n.cache
+	c.lock()
+	old, ok := c.namespaces[n.name][key]
+	if ok {
+		c.remove(n.name, key, old)
+	}
+	c.mutex.Unlock()
+	if c.store != nil {
+		c.storeDo(func() {
+			removed, err := c.removeStored(n.name, key)
+			c.storeError(err)
+			ok = ok || removed
+		})
+	}
+	return ok
+}
+
+// The `Expire` method in the `Namespace` struct marks the entry stored under key as expired without
+// removing it, so that it is revalidated with the origin before being served again but can still be
+// served stale while the cache retains it. It reports whether an unexpired entry was found, in memory
+// or the store.
+func (n *Namespace) Expire(key string) bool {
+	c := n.cache
+	now := time.Now()
+	c.lock()
+	entry, expired := c.namespaces[n.name][key]
+	expired = expired && !entry.Expired(now)
+	if expired {
+		entry.ExpiresAt = now
+		c.namespaces[n.name][key] = entry
+	}
+	c.mutex.Unlock()
+	if c.store != nil {
+		c.storeDo(func() {
+			stored, err := c.load(n.name, key)
+			if err != nil || stored.Expired(now) {
+				if !errors.Is(err, ErrNotStored) {
+					c.storeError(err)
+				}
+				return
+			}
+			stored.ExpiresAt = now
+			c.save(n.name, key, stored)
+			expired = true
+		})
+	}
+	return expired
+}
+
+// The `ExpireFunc` method in the `Cache` struct marks every unexpired entry for which match returns true
+// as expired, like the `Expire` method of the `Namespace` struct, and returns how many were marked. match
+// runs while the cache is locked, so it must be quick and must not use the cache. With a store that can
+// list its keys, match is also called for every entry in the store, each of which is read for it.
+func (c *Cache) ExpireFunc(match func(namespace, key string, entry Entry) bool) int {
+	c.lock()
+	now := time.Now()
+	expired := make(map[string]bool)
+	for name, entries := range c.namespaces {
+		for key, entry := range entries {
+			if !entry.Expired(now) && match(name, key, entry) {
+				entry.ExpiresAt = now
+				entries[key] = entry
+				expired[storeKey(name, key)] = true
+			}
+		}
+	}
+	c.mutex.Unlock()
+	if c.store != nil {
+		c.storeDo(func() {
+			c.storeEach("", true, func(name, key string) {
+				entry, err := c.load(name, key)
+				if err == nil && !entry.Expired(now) && match(name, key, entry) {
+					entry.ExpiresAt = now
+					c.save(name, key, entry)
+					expired[storeKey(name, key)] = true
+				}
+			})
+		})
+	}
+	return len(expired)
+}
+
+// The `DeleteFunc` method in the `Cache` struct removes every entry, expired or not, for which match
+// returns true and returns how many were removed. match runs while the cache is locked, so it must be
+// quick and must not use the cache. With a store that can list its keys, match is also called for every
+// entry in the store that wasn't removed from memory, each of which is read for it.
+func (c *Cache) DeleteFunc(match func(namespace, key string, entry Entry) bool) int {
+	c.lock()
+	removed := make(map[string]bool)
+	for name, entries := range c.namespaces {
+		for key, entry := range entries {
+			if match(name, key, entry) {
+				c.remove(name, key, entry)
+				removed[storeKey(name, key)] = true
+			}
+		}
+	}
+	c.mutex.Unlock()
+	if c.store != nil {
+		c.storeDo(func() {
+			c.storeEach("", true, func(name, key string) {
+				if !removed[storeKey(name, key)] {
+					entry, err := c.load(name, key)
+					if err != nil || !match(name, key, entry) {
+						return
+					}
+				}
+				_, err := c.removeStored(name, key)
+				c.storeError(err)
+				removed[storeKey(name, key)] = true
+			})
+		})
+	}
+	return len(removed)
+}
+
+// The `Flush` method in the `Cache` struct atomically removes every entry, expired or not, in every
+// namespace, including the store, and returns how many were removed. Counters such as evictions are
+// kept.
+func (c *Cache) Flush() int {
+	c.lock()
+	flushed := make(map[string]bool)
+	for name, entries := range c.namespaces {
+		for key := range entries {
+			flushed[storeKey(name, key)] = true
+		}
+	}
+	c.namespaces = make(map[string]map[string]Entry)
+	c.identities = make(map[string]int)
+	c.bytes.Store(0)
+	// Elements of the old list are ignored by the new one, should a concurrent lookup touch them
+	c.lruMutex.Lock()
+	c.lru = list.New()
+	c.lruMutex.Unlock()
+	c.mutex.Unlock()
+	if c.store != nil {
+		c.storeDo(func() {
+			c.storeEach("", true, func(name, key string) {
+				_, err := c.store.Remove(storeKey(name, key))
+				c.storeError(err)
+				flushed[storeKey(name, key)] = true
+			})
+			// So do the chunks of bodies and interrupted fills
+			err := c.store.Keys(storeKey(chunkNamespace, ""), func(key string) bool {
+				_, err := c.store.Remove(key)
+				c.storeError(err)
+				return true
+			})
+			if !errors.Is(err, ErrKeysUnsupported) {
+				c.storeError(err)
+			}
+		})
+	}
+	return len(flushed)
+}
+
+// The `PurgePrefix` method in the `Cache` struct removes every entry, expired or not, whose request
+// URL starts with prefix and returns how many were removed.
+func (c *Cache) PurgePrefix(prefix string) int {
+	return c.DeleteFunc(func(namespace, key string, entry Entry) bool {
+		return strings.HasPrefix(entry.Response.Request.URL, prefix)
+	})
+}
+
+// The `PurgeRegex` method in the `Cache` struct removes every entry, expired or not, whose request URL
+// matches the regular expression expr and returns how many were removed.
+func (c *Cache) PurgeRegex(expr string) (int, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return 0, err
+	}
+	return c.DeleteFunc(func(namespace, key string, entry Entry) bool {
+		return re.MatchString(entry.Response.Request.URL)
+	}), nil
+}
+
+// The `PurgeTag` method in the `Cache` struct removes every entry, expired or not, carrying any of the
+// given tags and returns how many were removed.
+func (c *Cache) PurgeTag(tags ...string) int {
+	return c.DeleteFunc(func(namespace, key string, entry Entry) bool {
+		return slices.ContainsFunc(entry.Tags, func(tag string) bool { return slices.Contains(tags, tag) })
+	})
+}
+
+// The `DropNamespace` method in the `Cache` struct atomically removes every entry in the named namespace
+// and the store, and returns how many entries were dropped.
+func (c *Cache) DropNamespace(name string) int {
+	c.lock()
+	dropped := make(map[string]bool)
+	for key, entry := range c.namespaces[name] {
+		c.remove(name, key, entry)
+		dropped[key] = true
+	}
+	delete(c.namespaces, name)
+	c.mutex.Unlock()
+	if c.store != nil {
+		c.storeDo(func() {
+			c.storeEach(name, false, func(name, key string) {
+				_, err := c.removeStored(name, key)
+				c.storeError(err)
+				dropped[key] = true
+			})
+		})
+	}
+	return len(dropped)
+}
+
+// The `Range` method in the `Cache` struct calls fn for every unexpired entry in memory, in every
+// namespace, until fn returns false. It iterates over a snapshot, so fn may safely modify the cache.
+func (c *Cache) Range(fn func(namespace, key string, entry Entry) bool) {
+	type item struct {
+		namespace, key string
+		entry          Entry
+	}
+	now := time.Now()
+	c.rlock()
+	var items []item
+	for name, entries := range c.namespaces {
+		for key, entry := range entries {
+			if entry.Expired(now) {
+				continue
+			}
+			items = append(items, item{name, key, entry})
+		}
+	}
+	c.mutex.RUnlock()
+
+	for _, it := range items {
+		if !fn(it.namespace, it.key, it.entry) {
+			return
+		}
+	}
+}
+
+// The `Debug()` method in the `Cache` struct is used to retrieve debug information from the cache. It
+// iterates over all entries in the cache, extracts relevant information from each entry (such as URL,
+// HTTP method, response status, and the memory its body takes), and stores this information in a map
+// with string keys and interface{} values. Keys outside the default namespace are prefixed with their
+// namespace. This map is then returned as the debug information.
+func (c *Cache) Debug() map[string]interface{} {
+	c.rlock()
+	defer c.mutex.RUnlock()
+	debug := make(map[string]interface{})
+	for name, entries := range c.namespaces {
+		for key, entry := range entries {
+			if name != DefaultNamespace {
+				key = name + ": " + key
+			}
+			debug[key] = map[string]interface{}{
+				"Namespace": name,
+				"URL":       entry.Response.Request.URL,
+				"Method":    entry.Response.Request.Method,
+				"Status":    entry.Response.Status(),
+				"Size":      entry.Size(),
+				"ETag":      entry.ETag,
+				"StoredAt":  entry.StoredAt,
+				"ExpiresAt": entry.ExpiresAt,
+				"Hits":      entry.Hits(),
+				"Identity":  entry.Identity,
+				"Vary":      entry.Vary,
+				"Tags":      entry.Tags,
+				"Revisions": len(entry.Revisions),
+			}
+		}
+	}
+	return debug
+}
@@ -0,0 +1,36 @@
+package cache
+
+import (
+	"errors"
+	"hash/crc32"
+)
+
+// checksumTable is the CRC-32C table entry checksums are computed with; CRC-32C is hardware
+// accelerated on common CPUs.
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrChecksumMismatch is returned by the `Verify` method of the `Entry` struct for an entry whose body or
+// encoded variants no longer match its checksum.
+var ErrChecksumMismatch = errors.New("entry checksum mismatch")
+
+// The `checksum` method in the `Entry` struct returns the CRC-32C of the entry's body and encoded
+// variants, in order of coding name.
+func (e Entry) checksum() uint32 {
+	crc := crc32.Update(0, checksumTable, e.Body)
+	for _, name := range sortedKeys(e.Variants) {
+		crc = crc32.Update(crc, checksumTable, []byte(name))
+		crc = crc32.Update(crc, checksumTable, e.Variants[name])
+	}
+	return crc
+}
+
+// The `Verify` method in the `Entry` struct checks the entry's body and encoded variants against the
+// checksum computed when it was cached, and returns ErrChecksumMismatch when they differ, e.g. after a
+// bit flip on disk or a value cut short by a store. Entries without a checksum, such as those
+// serialized before checksums were kept, are not checked.
+func (e Entry) Verify() error {
+	if e.Checksum == 0 || e.checksum() == e.Checksum {
+		return nil
+	}
+	return ErrChecksumMismatch
+}
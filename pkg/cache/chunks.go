@@ -0,0 +1,363 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"time"
+)
+
+// chunkNamespace is the reserved namespace the chunks of bodies written with Fill, and the progress of
+// their fills, are saved under in a Store. Purges and listings skip it.
+const chunkNamespace = "\x01chunks"
+
+// ErrNoChunking is returned by the `Fill` method of the `Cache` struct for a cache without a Store or
+// ChunkBytes.
+var ErrNoChunking = errors.New("cache doesn't keep bodies in chunks")
+
+// ErrFillMismatch is returned by the `Fill` method of the `Cache` struct when asked to resume a fill
+// that was not interrupted at the given offset of a body with the given validator.
+var ErrFillMismatch = errors.New("no interrupted fill to resume")
+
+// chunkSlack is how much longer than their entry the chunks of a body are kept in the store, so that an
+// entry set once its fill finished, or saved again with a slightly later expiry, doesn't outlive them.
+const chunkSlack = 10 * time.Minute
+
+// chunkRef locates a body kept in chunks: the ID its chunks are saved under, their size, and when they
+// expire from the store; zero when they don't.
+type chunkRef struct {
+	id    string
+	size  int
+	until time.Time
+}
+
+// The bodyChunkKey function returns the key chunk i of a body is saved under in a Store.
+func bodyChunkKey(id string, i int64) string {
+	return storeKey(chunkNamespace, id+" "+strconv.FormatInt(i, 10))
+}
+
+// The fillKey function returns the key the progress of the fill under key is saved under in a Store.
+func fillKey(key string) string {
+	return storeKey(chunkNamespace, "fill "+key)
+}
+
+// Fill writes a body to a cache's store in chunks as it arrives, e.g. from the origin, so that it is
+// never held in memory as a whole. Fills of bodies with a validator record their progress under a key,
+// so that an interrupted fill, even one interrupted by a restart, can be resumed where it stopped. A
+// Fill is not safe for concurrent use.
+type Fill struct {
+	cache     *Cache
+	key       string
+	validator string
+	ttl       time.Duration
+	ref       chunkRef
+	written   int64
+	// buf is the chunk being written, after room for its checksum
+	buf []byte
+}
+
+// The outlasts function reports whether expiry a is later than expiry b, the zero time meaning never.
+func outlasts(a, b time.Time) bool {
+	return !b.IsZero() && (a.IsZero() || a.After(b))
+}
+
+// fillProgress is the saved progress of a fill: the chunks of written bytes have been saved.
+type fillProgress struct {
+	validator string
+	ref       chunkRef
+	written   int64
+}
+
+// The `fillProgress` method in the `Cache` struct reads the saved progress of the fill under key.
+func (c *Cache) fillProgress(key string) (fillProgress, error) {
+	data, err := c.store.Load(fillKey(key))
+	if err != nil {
+		return fillProgress{}, err
+	}
+	d := decoder{buf: data}
+	p := fillProgress{validator: d.string(), ref: chunkRef{id: d.string(), size: int(d.uint()), until: d.time()}, written: int64(d.uint())}
+	if d.err != nil || len(d.buf) > 0 || p.ref.size <= 0 {
+		return fillProgress{}, ErrInvalidEntry
+	}
+	return p, nil
+}
+
+// The `InterruptedFill` method in the `Cache` struct returns the validator of the body of an
+// interrupted fill under key and how many of its bytes were saved, if there is one that can be resumed.
+func (c *Cache) InterruptedFill(key string) (string, int64, bool) {
+	if c.store == nil || c.chunkBytes <= 0 {
+		return "", 0, false
+	}
+	p, err := c.fillProgress(key)
+	if err != nil || p.written == 0 {
+		return "", 0, false
+	}
+	return p.validator, p.written, true
+}
+
+// The `DiscardFill` method in the `Cache` struct removes an interrupted fill under key, with the chunks
+// it saved, if the fill was started or resumed by this cache. Fills of other caches sharing the store,
+// which may still be writing them, and those interrupted by a restart are left to expire.
+func (c *Cache) DiscardFill(key string) {
+	if c.store == nil {
+		return
+	}
+	p, err := c.fillProgress(key)
+	if err != nil {
+		return
+	}
+	if active, owned := c.fills.Load(p.ref.id); !owned || active.(bool) {
+		return
+	}
+	c.fills.Delete(p.ref.id)
+	c.removeChunks(p.ref.id)
+	_, err = c.store.Remove(fillKey(key))
+	c.storeError(err)
+}
+
+// The `Fill` method in the `Cache` struct starts a fill of a body, identified across restarts by key,
+// e.g. the cache key of its response, and by validator as the version of the body, e.g. its strong
+// ETag. With offset zero, any interrupted fill under key is discarded. Otherwise the interrupted fill is
+// resumed, writes continuing at offset, if it saved offset bytes of a body with the same validator and
+// is not being written by this cache, and ErrFillMismatch is returned if not. Only fills with a
+// validator can be resumed. Every new fill saves its chunks under an ID of its own. Chunks are kept in
+// the store for ttl, the default TTL when zero, and the stale retention, like the entries they belong
+// to; saving the entry again with a later expiry keeps them longer.
+func (c *Cache) Fill(key, validator string, offset int64, ttl time.Duration) (*Fill, error) {
+	if c.store == nil || c.chunkBytes <= 0 {
+		return nil, ErrNoChunking
+	}
+	if ttl == 0 {
+		ttl = c.defaultTTL
+	}
+	if ttl > 0 {
+		ttl += c.retention + chunkSlack
+	}
+	f := &Fill{cache: c, key: key, validator: validator, ttl: ttl}
+	if offset > 0 {
+		p, err := c.fillProgress(key)
+		if err != nil || validator == "" || p.validator != validator || p.written != offset {
+			return nil, ErrFillMismatch
+		}
+		if active, _ := c.fills.Load(p.ref.id); active == true {
+			return nil, ErrFillMismatch
+		}
+		f.ref, f.written = p.ref, p.written
+		c.fills.Store(f.ref.id, true)
+		return f, nil
+	}
+	c.DiscardFill(key)
+	id := make([]byte, 8)
+	rand.Read(id)
+	f.ref = chunkRef{id: hex.EncodeToString(id), size: c.chunkBytes}
+	if ttl > 0 {
+		f.ref.until = time.Now().Add(ttl)
+	}
+	c.fills.Store(f.ref.id, true)
+	return f, nil
+}
+
+// The `Written` method in the `Fill` struct returns how many bytes of the body have been written,
+// including those saved before the fill was resumed.
+func (f *Fill) Written() int64 {
+	return f.written + int64(max(len(f.buf)-crc32.Size, 0))
+}
+
+// The `Write` method in the `Fill` struct appends p to the body, saving every chunk it completes.
+func (f *Fill) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if f.buf == nil {
+			f.buf = make([]byte, crc32.Size, crc32.Size+f.ref.size)
+		}
+		part := p[:min(len(p), cap(f.buf)-len(f.buf))]
+		f.buf = append(f.buf, part...)
+		p = p[len(part):]
+		if len(f.buf) == cap(f.buf) {
+			if err := f.flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// The `flush` method in the `Fill` struct saves the chunk being written, prefixed with its CRC-32C,
+// and records the progress of the fill. A new buffer is used for the next chunk, as stores may keep
+// the values they save.
+func (f *Fill) flush() error {
+	c := f.cache
+	binary.BigEndian.PutUint32(f.buf, crc32.Checksum(f.buf[crc32.Size:], checksumTable))
+	if err := c.store.Save(bodyChunkKey(f.ref.id, f.written/int64(f.ref.size)), f.buf, f.ttl); err != nil {
+		c.storeError(err)
+		return err
+	}
+	f.written += int64(len(f.buf) - crc32.Size)
+	f.buf = nil
+	if f.validator == "" || f.written%int64(f.ref.size) != 0 {
+		return nil
+	}
+	e := encoder{}
+	e.string(f.validator)
+	e.string(f.ref.id)
+	e.uint(uint64(f.ref.size))
+	e.time(f.ref.until)
+	e.uint(uint64(f.written))
+	err := c.store.Save(fillKey(f.key), e.buf, f.ttl)
+	c.storeError(err)
+	return err
+}
+
+// The `Finish` method in the `Fill` struct saves the rest of the body and ends the fill. entry then
+// refers to the saved body, its Body cleared and BodySize set, and can be set in the cache.
+func (f *Fill) Finish(entry *Entry) error {
+	if len(f.buf) > crc32.Size {
+		if err := f.flush(); err != nil {
+			return err
+		}
+	}
+	// The progress record may already be another cache's, filling the same body
+	if p, err := f.cache.fillProgress(f.key); err == nil && p.ref.id == f.ref.id {
+		_, err := f.cache.store.Remove(fillKey(f.key))
+		f.cache.storeError(err)
+	}
+	f.cache.fills.Delete(f.ref.id)
+	entry.Body, entry.BodySize, entry.chunks = nil, f.written, chunkRef{}
+	if f.written > 0 {
+		entry.chunks = f.ref
+	}
+	return nil
+}
+
+// The `Abandon` method in the `Fill` struct ends a fill that can't be finished, e.g. because the origin
+// closed the connection. Its chunks are kept for the fill to be resumed, if it has a validator, and
+// removed if not.
+func (f *Fill) Abandon() {
+	if f.validator == "" {
+		f.cache.fills.Delete(f.ref.id)
+		f.cache.removeChunks(f.ref.id)
+		return
+	}
+	f.cache.fills.Store(f.ref.id, false)
+}
+
+// The `keepChunks` method in the `Cache` struct saves the chunks of an entry's body again with ttl when
+// they would expire before the entry, e.g. after the entry was refreshed, so that the entry never
+// outlives its body. The entry records their new expiry. It is called by the store writer.
+func (c *Cache) keepChunks(entry *Entry, ttl time.Duration) {
+	until := time.Time{}
+	if ttl > 0 {
+		until = time.Now().Add(ttl)
+		ttl += chunkSlack
+	}
+	if !outlasts(until, entry.chunks.until) {
+		return
+	}
+	size := int64(entry.chunks.size)
+	for i := int64(0); i*size < entry.BodySize; i++ {
+		data, err := c.store.Load(bodyChunkKey(entry.chunks.id, i))
+		if err == nil {
+			err = c.store.Save(bodyChunkKey(entry.chunks.id, i), data, ttl)
+		}
+		if err != nil {
+			// The entry is a miss once its body is found missing
+			c.storeError(err)
+			return
+		}
+	}
+	entry.chunks.until = until
+	if ttl > 0 {
+		entry.chunks.until = until.Add(chunkSlack)
+	}
+}
+
+// The `RemoveBody` method in the `Cache` struct removes the chunks of the body of an entry finished with
+// Fill that won't be cached after all. It does nothing for other entries.
+func (c *Cache) RemoveBody(entry Entry) {
+	if entry.BodySize > 0 && c.store != nil {
+		c.removeChunks(entry.chunks.id)
+	}
+}
+
+// The `removeChunks` method in the `Cache` struct removes the chunks saved under id, up to the first
+// missing one.
+func (c *Cache) removeChunks(id string) {
+	for i := int64(0); ; i++ {
+		removed, err := c.store.Remove(bodyChunkKey(id, i))
+		c.storeError(err)
+		if !removed || err != nil {
+			return
+		}
+	}
+}
+
+// The `removeStored` method in the `Cache` struct removes an entry from the store, together with the
+// chunks of its body when the cache keeps bodies in chunks.
+func (c *Cache) removeStored(name, key string) (bool, error) {
+	if c.chunkBytes > 0 {
+		if old, err := c.load(name, key); err == nil && old.BodySize > 0 {
+			c.removeChunks(old.chunks.id)
+		}
+	}
+	return c.store.Remove(storeKey(name, key))
+}
+
+// The `ReadBody` method in the `Cache` struct calls fn with length bytes of an entry's body starting at
+// offset. A body kept in chunks is read from the store a chunk at a time, each chunk checked against
+// its checksum, so only the chunks holding the range are read and memory stays bounded by the chunk
+// size. fn must not keep the slices it gets. Should a chunk be missing or corrupt, the error is
+// returned and the entry is a miss for later lookups.
+func (c *Cache) ReadBody(entry Entry, offset, length int64, fn func(p []byte) error) error {
+	if offset < 0 || length < 0 || offset+length > max(entry.BodySize, int64(len(entry.Body))) {
+		return fmt.Errorf("range %d-%d out of a body of %d bytes", offset, offset+length, max(entry.BodySize, int64(len(entry.Body))))
+	}
+	if entry.BodySize == 0 {
+		if length == 0 {
+			return nil
+		}
+		return fn(entry.Body[offset : offset+length])
+	}
+	size := int64(entry.chunks.size)
+	for length > 0 {
+		i := offset / size
+		chunk, err := c.readChunk(entry, i)
+		if err != nil {
+			c.broken.Store(entry.chunks.id, true)
+			return err
+		}
+		part := chunk[offset-i*size : min(int64(len(chunk)), offset-i*size+length)]
+		if err := fn(part); err != nil {
+			return err
+		}
+		offset += int64(len(part))
+		length -= int64(len(part))
+	}
+	return nil
+}
+
+// The `readChunk` method in the `Cache` struct reads chunk i of the body of an entry from the store,
+// checking its length and checksum.
+func (c *Cache) readChunk(entry Entry, i int64) ([]byte, error) {
+	if c.store == nil {
+		return nil, ErrNotStored
+	}
+	data, err := c.store.Load(bodyChunkKey(entry.chunks.id, i))
+	if err != nil {
+		c.storeError(err)
+		return nil, fmt.Errorf("reading chunk %d: %w", i, err)
+	}
+	size := int64(entry.chunks.size)
+	if len(data) < crc32.Size || int64(len(data)-crc32.Size) != min(size, entry.BodySize-i*size) {
+		c.storeError(ErrInvalidEntry)
+		return nil, fmt.Errorf("reading chunk %d: %w", i, ErrInvalidEntry)
+	}
+	if crc32.Checksum(data[crc32.Size:], checksumTable) != binary.BigEndian.Uint32(data) {
+		c.checksumFailures.Add(1)
+		return nil, fmt.Errorf("reading chunk %d: %w", i, ErrChecksumMismatch)
+	}
+	return data[crc32.Size:], nil
+}
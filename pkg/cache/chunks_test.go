@@ -0,0 +1,192 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// The openChunkStore function opens a DiskStore for chunks, closed at the end of the test once the
+// caches using it are stopped.
+func openChunkStore(t *testing.T) *DiskStore {
+	t.Helper()
+	store, err := OpenDiskStore(DiskOptions{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("OpenDiskStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// The newChunkedCache function returns a cache keeping bodies in chunks of 1 KiB in store, stopped at
+// the end of the test.
+func newChunkedCache(t *testing.T, store Store) *Cache {
+	t.Helper()
+	c := New(Options{Store: store, ChunkBytes: 1 << 10})
+	t.Cleanup(c.Stop)
+	return c
+}
+
+// The testBody function returns a body of n bytes that differ from one chunk to the next.
+func testBody(n int) []byte {
+	body := make([]byte, n)
+	for i := range body {
+		body[i] = byte(i * 7)
+	}
+	return body
+}
+
+// The fillBody function writes body with a new fill under key, in parts of a size other than the chunk
+// size, and returns the finished entry.
+func fillBody(t *testing.T, c *Cache, key, validator string, body []byte) Entry {
+	t.Helper()
+	f, err := c.Fill(key, validator, 0, time.Hour)
+	if err != nil {
+		t.Fatalf("Fill: %v", err)
+	}
+	for p := body; len(p) > 0; p = p[min(len(p), 700):] {
+		if _, err := f.Write(p[:min(len(p), 700)]); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if f.Written() != int64(len(body)) {
+		t.Fatalf("Written: got %d, want %d", f.Written(), len(body))
+	}
+	entry := Entry{ETag: validator}
+	if err := f.Finish(&entry); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	return entry
+}
+
+// The readBody function returns length bytes of the body of entry starting at offset.
+func readBody(c *Cache, entry Entry, offset, length int64) ([]byte, error) {
+	var body []byte
+	err := c.ReadBody(entry, offset, length, func(p []byte) error {
+		body = append(body, p...)
+		return nil
+	})
+	return body, err
+}
+
+func TestFillReadBody(t *testing.T) {
+	disk := openChunkStore(t)
+	c := newChunkedCache(t, disk)
+	body := testBody(5000)
+	entry := fillBody(t, c, "key", `"v1"`, body)
+	if entry.Body != nil || entry.BodySize != 5000 {
+		t.Fatalf("Finish: got %d bytes in Body and BodySize %d, want the body in chunks", len(entry.Body), entry.BodySize)
+	}
+	c.Set("key", entry, time.Hour)
+
+	if got, err := readBody(c, entry, 0, 5000); err != nil || !bytes.Equal(got, body) {
+		t.Fatalf("ReadBody of the whole body: got %d bytes, %v", len(got), err)
+	}
+	if got, err := readBody(c, entry, 1000, 2100); err != nil || !bytes.Equal(got, body[1000:3100]) {
+		t.Fatalf("ReadBody of a range: got %d bytes, %v", len(got), err)
+	}
+	if _, err := readBody(c, entry, 4000, 1001); err == nil {
+		t.Fatal("ReadBody past the end of the body: got no error")
+	}
+	if _, _, ok := c.InterruptedFill("key"); ok {
+		t.Fatal("InterruptedFill after Finish: got a fill to resume")
+	}
+
+	// Corrupt the third chunk
+	chunk, err := disk.Load(bodyChunkKey(entry.chunks.id, 2))
+	if err != nil {
+		t.Fatalf("Load of a chunk: %v", err)
+	}
+	corrupt := append([]byte(nil), chunk...)
+	corrupt[len(corrupt)-1] ^= 1
+	disk.Save(bodyChunkKey(entry.chunks.id, 2), corrupt, 0)
+
+	if got, err := readBody(c, entry, 0, 2048); err != nil || !bytes.Equal(got, body[:2048]) {
+		t.Fatalf("ReadBody of the chunks before the corrupt one: got %d bytes, %v", len(got), err)
+	}
+	if _, err := readBody(c, entry, 2000, 100); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("ReadBody of a corrupt chunk: got error %v, want ErrChecksumMismatch", err)
+	}
+	if failures := c.Stats().ChecksumFailures; failures != 1 {
+		t.Fatalf("ChecksumFailures: got %d, want 1", failures)
+	}
+	if _, ok := c.Get("key"); ok {
+		t.Fatal("Get of an entry with a corrupt chunk: got a hit")
+	}
+	c.Stop()
+	if _, err := disk.Load(storeKey(DefaultNamespace, "key")); !errors.Is(err, ErrNotStored) {
+		t.Fatalf("Load of an entry with a corrupt chunk from the store: got error %v, want ErrNotStored", err)
+	}
+	if _, err := disk.Load(bodyChunkKey(entry.chunks.id, 0)); !errors.Is(err, ErrNotStored) {
+		t.Fatalf("Load of a chunk of a removed entry: got error %v, want ErrNotStored", err)
+	}
+}
+
+func TestFillResume(t *testing.T) {
+	disk := openChunkStore(t)
+	c := newChunkedCache(t, disk)
+	body := testBody(5000)
+	f, err := c.Fill("key", `"v1"`, 0, time.Hour)
+	if err != nil {
+		t.Fatalf("Fill: %v", err)
+	}
+	f.Write(body[:2500])
+	f.Abandon()
+
+	validator, offset, ok := c.InterruptedFill("key")
+	if !ok || validator != `"v1"` || offset != 2048 {
+		t.Fatalf("InterruptedFill: got %q, %d, %v, want %q, 2048, true", validator, offset, ok, `"v1"`)
+	}
+	for _, resume := range []struct {
+		validator string
+		offset    int64
+	}{{`"v2"`, 2048}, {`"v1"`, 2500}} {
+		if _, err := c.Fill("key", resume.validator, resume.offset, time.Hour); !errors.Is(err, ErrFillMismatch) {
+			t.Fatalf("Fill resuming %q at %d: got error %v, want ErrFillMismatch", resume.validator, resume.offset, err)
+		}
+	}
+	f, err = c.Fill("key", `"v1"`, 2048, time.Hour)
+	if err != nil {
+		t.Fatalf("Fill resuming the interrupted fill: %v", err)
+	}
+	if _, err := c.Fill("key", `"v1"`, 2048, time.Hour); !errors.Is(err, ErrFillMismatch) {
+		t.Fatalf("Fill resuming a fill being written: got error %v, want ErrFillMismatch", err)
+	}
+	f.Write(body[2048:])
+	entry := Entry{}
+	if err := f.Finish(&entry); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	if got, err := readBody(c, entry, 0, 5000); err != nil || !bytes.Equal(got, body) {
+		t.Fatalf("ReadBody of a resumed fill: got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestDiscardFillOwnership(t *testing.T) {
+	disk := openChunkStore(t)
+	// Two caches sharing a store
+	c1, c2 := newChunkedCache(t, disk), newChunkedCache(t, disk)
+	f, err := c1.Fill("key", `"v1"`, 0, time.Hour)
+	if err != nil {
+		t.Fatalf("Fill: %v", err)
+	}
+	f.Write(testBody(2048))
+	f.Abandon()
+	first := bodyChunkKey(f.ref.id, 0)
+
+	if _, err := c2.Fill("key", `"v1"`, 0, time.Hour); err != nil {
+		t.Fatalf("Fill by another cache: %v", err)
+	}
+	if _, err := disk.Load(first); err != nil {
+		t.Fatalf("Load of a chunk after another cache started a fill: %v", err)
+	}
+	c1.DiscardFill("key")
+	if _, err := disk.Load(first); !errors.Is(err, ErrNotStored) {
+		t.Fatalf("Load of a chunk after DiscardFill: got error %v, want ErrNotStored", err)
+	}
+
+	if _, err := New(Options{ChunkBytes: 1 << 10}).Fill("key", "", 0, 0); !errors.Is(err, ErrNoChunking) {
+		t.Fatalf("Fill without a store: got error %v, want ErrNoChunking", err)
+	}
+}
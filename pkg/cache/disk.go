@@ -0,0 +1,515 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiskOptions configures a DiskStore opened by OpenDiskStore.
+type DiskOptions struct {
+	// Dir is the directory holding the store's files; it is created if needed. Only one store may use
+	// a directory at a time.
+	Dir string
+	// MaxBytes is the budget for the store's files. The oldest segment file is dropped, with the entries
+	// it still holds, to stay within it; zero means unlimited.
+	MaxBytes int64
+	// SegmentBytes is the size segment files are rotated at; the default is 64 MiB, or an eighth of
+	// MaxBytes when that is smaller, but at least 1 MiB.
+	SegmentBytes int64
+	// CompactInterval is how often segment files that are mostly removed, replaced or expired entries
+	// are compacted in the background; the default is a minute.
+	CompactInterval time.Duration
+}
+
+// DiskStore is a Store that keeps entries in append-only segment files in a directory, so that they
+// survive restarts and large bodies need not be kept in memory. An index of the keys and where their
+// values are is kept in memory and rebuilt from the files when the store is opened.
+type DiskStore struct {
+	opts     DiskOptions
+	mutex    sync.RWMutex
+	index    map[string]diskLocation
+	segments map[uint64]*diskSegment
+	// active is the segment written to; older segments are only read and compacted
+	active *diskSegment
+	bytes  int64
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// diskSegment is a segment file.
+type diskSegment struct {
+	id   uint64
+	file *os.File
+	size int64
+}
+
+// diskLocation locates the record holding a key's value.
+type diskLocation struct {
+	segment uint64
+	offset  int64
+	size    int64
+	expires int64
+}
+
+// Record kinds. A tombstone records that a key was removed, so that older records of it in other
+// segments aren't used when the index is rebuilt.
+const (
+	diskValue     byte = 1
+	diskTombstone byte = 2
+)
+
+// diskHeaderSize is the size of a record header: CRC-32 of the rest of the record, kind, expiry in Unix
+// nanoseconds (zero for none), key length and value length.
+const diskHeaderSize = 4 + 1 + 8 + 4 + 4
+
+// diskRecord is a decoded record.
+type diskRecord struct {
+	kind    byte
+	expires int64
+	key     string
+	value   []byte
+}
+
+// errCorruptRecord is returned for records failing their checksum, e.g. one cut short by a crash.
+var errCorruptRecord = errors.New("corrupt record")
+
+// The OpenDiskStore function opens the store in opts.Dir, reading its segment files to rebuild the
+// index. Writes go to a new segment file. The store compacts its files in the background until it is
+// closed.
+func OpenDiskStore(opts DiskOptions) (*DiskStore, error) {
+	if opts.SegmentBytes <= 0 {
+		opts.SegmentBytes = 64 << 20
+		if opts.MaxBytes > 0 {
+			opts.SegmentBytes = max(min(opts.SegmentBytes, opts.MaxBytes/8), 1<<20)
+		}
+	}
+	if opts.CompactInterval <= 0 {
+		opts.CompactInterval = time.Minute
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &DiskStore{
+		opts:     opts,
+		index:    make(map[string]diskLocation),
+		segments: make(map[uint64]*diskSegment),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	names, err := filepath.Glob(filepath.Join(opts.Dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, name := range names {
+		if id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".seg"), 16, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		if err := s.replay(id); err != nil {
+			s.closeFiles()
+			return nil, err
+		}
+	}
+	next := uint64(1)
+	if len(ids) > 0 {
+		next = ids[len(ids)-1] + 1
+	}
+	if err := s.rotate(next); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+	go s.compactor()
+	return s, nil
+}
+
+// The `replay` method in the `DiskStore` struct adds a segment file's records to the index, newer
+// records replacing older ones. Reading stops at the first corrupt record, which can only be the
+// unfinished last write of a crashed process.
+func (s *DiskStore) replay(id uint64) error {
+	file, err := os.OpenFile(s.segmentPath(id), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	segment := &diskSegment{id: id, file: file, size: info.Size()}
+	s.segments[id] = segment
+	s.bytes += segment.size
+
+	now := time.Now().UnixNano()
+	r := bufio.NewReader(io.NewSectionReader(file, 0, segment.size))
+	for offset := int64(0); ; {
+		record, size, err := readDiskRecord(r, segment.size-offset)
+		if err != nil {
+			return nil
+		}
+		if record.kind == diskValue && (record.expires == 0 || record.expires > now) {
+			s.index[record.key] = diskLocation{segment: id, offset: offset, size: size, expires: record.expires}
+		} else {
+			delete(s.index, record.key)
+		}
+		offset += size
+	}
+}
+
+// The `segmentPath` method in the `DiskStore` struct returns the name of a segment file.
+func (s *DiskStore) segmentPath(id uint64) string {
+	return filepath.Join(s.opts.Dir, fmt.Sprintf("%016x.seg", id))
+}
+
+// The `rotate` method in the `DiskStore` struct creates segment id and makes it the active one. The
+// caller must hold the write lock, except while opening the store.
+func (s *DiskStore) rotate(id uint64) error {
+	file, err := os.OpenFile(s.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if s.active != nil {
+		s.active.file.Sync()
+	}
+	s.active = &diskSegment{id: id, file: file}
+	s.segments[id] = s.active
+	return nil
+}
+
+// The `Load` method in the `DiskStore` struct reads the value stored under key from its segment file.
+func (s *DiskStore) Load(key string) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	location, ok := s.index[key]
+	if !ok || location.expires != 0 && location.expires <= time.Now().UnixNano() {
+		return nil, ErrNotStored
+	}
+	r := io.NewSectionReader(s.segments[location.segment].file, location.offset, location.size)
+	record, _, err := readDiskRecord(r, location.size)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s from %s: %w", key, s.segmentPath(location.segment), err)
+	}
+	return record.value, nil
+}
+
+// The `Save` method in the `DiskStore` struct appends value to the active segment file. A value that
+// alone exceeds MaxBytes is not stored.
+func (s *DiskStore) Save(key string, value []byte, ttl time.Duration) error {
+	var expires int64
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).UnixNano()
+	}
+	record := diskRecord{kind: diskValue, expires: expires, key: key, value: value}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.opts.MaxBytes > 0 && int64(diskHeaderSize+len(key)+len(value)) > s.opts.MaxBytes {
+		return s.remove(key)
+	}
+	location, err := s.append(record)
+	if err != nil {
+		return err
+	}
+	s.index[key] = location
+	s.enforceMaxBytes()
+	return nil
+}
+
+// The `Remove` method in the `DiskStore` struct drops key from the index and appends a tombstone, so
+// that the key stays removed when the store is opened again.
+func (s *DiskStore) Remove(key string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.index[key]
+	if !ok {
+		return false, nil
+	}
+	return true, s.remove(key)
+}
+
+// The `remove` method in the `DiskStore` struct removes key if it is stored. The caller must hold the
+// write lock.
+func (s *DiskStore) remove(key string) error {
+	if _, ok := s.index[key]; !ok {
+		return nil
+	}
+	delete(s.index, key)
+	_, err := s.append(diskRecord{kind: diskTombstone, key: key})
+	return err
+}
+
+// The `Keys` method in the `DiskStore` struct calls fn for every unexpired key starting with prefix. It
+// iterates over a snapshot, so fn may modify the store.
+func (s *DiskStore) Keys(prefix string, fn func(key string) bool) error {
+	now := time.Now().UnixNano()
+	s.mutex.RLock()
+	var keys []string
+	for key, location := range s.index {
+		if strings.HasPrefix(key, prefix) && (location.expires == 0 || location.expires > now) {
+			keys = append(keys, key)
+		}
+	}
+	s.mutex.RUnlock()
+	for _, key := range keys {
+		if !fn(key) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// The `Bytes` method in the `DiskStore` struct returns the total size of the store's segment files.
+func (s *DiskStore) Bytes() int64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.bytes
+}
+
+// The `Close` method in the `DiskStore` struct stops the compaction and syncs and closes the segment
+// files. The store must not be used afterwards.
+func (s *DiskStore) Close() error {
+	close(s.stop)
+	<-s.done
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := s.active.file.Sync()
+	s.closeFiles()
+	return err
+}
+
+// The `closeFiles` method in the `DiskStore` struct closes every segment file.
+func (s *DiskStore) closeFiles() {
+	for _, segment := range s.segments {
+		segment.file.Close()
+	}
+}
+
+// The `append` method in the `DiskStore` struct writes a record at the end of the active segment,
+// rotating it first when the record would take it past SegmentBytes. The caller must hold the write
+// lock.
+func (s *DiskStore) append(record diskRecord) (diskLocation, error) {
+	data := encodeDiskRecord(record)
+	if s.active.size > 0 && s.active.size+int64(len(data)) > s.opts.SegmentBytes {
+		if err := s.rotate(s.active.id + 1); err != nil {
+			return diskLocation{}, err
+		}
+	}
+	if _, err := s.active.file.WriteAt(data, s.active.size); err != nil {
+		return diskLocation{}, err
+	}
+	location := diskLocation{segment: s.active.id, offset: s.active.size, size: int64(len(data)), expires: record.expires}
+	s.active.size += int64(len(data))
+	s.bytes += int64(len(data))
+	return location, nil
+}
+
+// The `enforceMaxBytes` method in the `DiskStore` struct drops the oldest segments until the files fit
+// in MaxBytes. The active segment is never dropped. The caller must hold the write lock.
+func (s *DiskStore) enforceMaxBytes() {
+	for s.opts.MaxBytes > 0 && s.bytes > s.opts.MaxBytes && len(s.segments) > 1 {
+		oldest := s.active.id
+		for id := range s.segments {
+			oldest = min(oldest, id)
+		}
+		s.drop(oldest)
+	}
+}
+
+// The `drop` method in the `DiskStore` struct deletes a segment file and the index entries of the keys
+// whose value it holds. The caller must hold the write lock.
+func (s *DiskStore) drop(id uint64) {
+	segment := s.segments[id]
+	for key, location := range s.index {
+		if location.segment == id {
+			delete(s.index, key)
+		}
+	}
+	segment.file.Close()
+	os.Remove(s.segmentPath(id))
+	delete(s.segments, id)
+	s.bytes -= segment.size
+}
+
+// The `compactor` method in the `DiskStore` struct calls `Compact` every CompactInterval until the
+// store is closed.
+func (s *DiskStore) compactor() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.opts.CompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Compact()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// The `Compact` method in the `DiskStore` struct rewrites every segment file, other than the active
+// one, of which less than half is taken by unexpired values still in use: those values are copied to
+// the active segment and the file is deleted. It returns how many bytes were reclaimed.
+func (s *DiskStore) Compact() int64 {
+	now := time.Now().UnixNano()
+	s.mutex.RLock()
+	live := make(map[uint64]int64, len(s.segments))
+	for _, location := range s.index {
+		if location.expires == 0 || location.expires > now {
+			live[location.segment] += location.size
+		}
+	}
+	var candidates []uint64
+	for id, segment := range s.segments {
+		if segment != s.active && live[id]*2 < segment.size {
+			candidates = append(candidates, id)
+		}
+	}
+	s.mutex.RUnlock()
+
+	slices.Sort(candidates)
+	reclaimed := int64(0)
+	for _, id := range candidates {
+		select {
+		case <-s.stop:
+			return reclaimed
+		default:
+		}
+		reclaimed += s.compact(id)
+	}
+	return reclaimed
+}
+
+// The `compact` method in the `DiskStore` struct copies the values of a segment still in use, and the
+// tombstones still needed for older segments, to the active segment and deletes the segment. The lock
+// is only held for one record at a time, so lookups aren't held up by the whole compaction. It returns
+// how many bytes were reclaimed.
+func (s *DiskStore) compact(id uint64) int64 {
+	s.mutex.RLock()
+	segment := s.segments[id]
+	s.mutex.RUnlock()
+	if segment == nil {
+		return 0
+	}
+	r := bufio.NewReader(io.NewSectionReader(segment.file, 0, segment.size))
+	copied := int64(0)
+	for offset := int64(0); offset < segment.size; {
+		record, size, err := readDiskRecord(r, segment.size-offset)
+		if err != nil && !errors.Is(err, errCorruptRecord) {
+			// The segment was dropped meanwhile, or can't be read; it is left for a later compaction
+			return 0
+		}
+		if err != nil {
+			break
+		}
+		s.mutex.Lock()
+		if s.segments[id] == nil {
+			s.mutex.Unlock()
+			return 0
+		}
+		location, ok := s.index[record.key]
+		switch {
+		case record.kind == diskValue && ok && location.segment == id && location.offset == offset:
+			if location.expires != 0 && location.expires <= time.Now().UnixNano() {
+				// Older values of the key must not come back when the index is rebuilt
+				delete(s.index, record.key)
+				if s.hasOlder(id) {
+					if moved, err := s.append(diskRecord{kind: diskTombstone, key: record.key}); err == nil {
+						copied += moved.size
+					}
+				}
+				break
+			}
+			if moved, err := s.append(record); err == nil {
+				s.index[record.key] = moved
+				copied += moved.size
+			}
+		case record.kind == diskTombstone && !ok && s.hasOlder(id):
+			if moved, err := s.append(record); err == nil {
+				copied += moved.size
+			}
+		}
+		s.mutex.Unlock()
+		offset += size
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.segments[id] == nil {
+		return 0
+	}
+	s.drop(id)
+	return segment.size - copied
+}
+
+// The `hasOlder` method in the `DiskStore` struct reports whether a segment older than id exists. The
+// caller must hold the lock.
+func (s *DiskStore) hasOlder(id uint64) bool {
+	for other := range s.segments {
+		if other < id {
+			return true
+		}
+	}
+	return false
+}
+
+// The encodeDiskRecord function encodes a record with its header.
+func encodeDiskRecord(record diskRecord) []byte {
+	data := make([]byte, diskHeaderSize+len(record.key)+len(record.value))
+	data[4] = record.kind
+	binary.BigEndian.PutUint64(data[5:], uint64(record.expires))
+	binary.BigEndian.PutUint32(data[13:], uint32(len(record.key)))
+	binary.BigEndian.PutUint32(data[17:], uint32(len(record.value)))
+	copy(data[diskHeaderSize:], record.key)
+	copy(data[diskHeaderSize+len(record.key):], record.value)
+	binary.BigEndian.PutUint32(data, crc32.ChecksumIEEE(data[4:]))
+	return data
+}
+
+// The readDiskRecord function reads a record of at most limit bytes and returns it with its encoded
+// size. It returns io.EOF at the end of the segment and errCorruptRecord for a record failing its
+// checksum or cut short.
+func readDiskRecord(r io.Reader, limit int64) (diskRecord, int64, error) {
+	header := make([]byte, diskHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return diskRecord{}, 0, errCorruptRecord
+		}
+		return diskRecord{}, 0, err
+	}
+	keyLen, valueLen := binary.BigEndian.Uint32(header[13:]), binary.BigEndian.Uint32(header[17:])
+	if kind := header[4]; kind != diskValue && kind != diskTombstone || int64(diskHeaderSize)+int64(keyLen)+int64(valueLen) > limit {
+		return diskRecord{}, 0, errCorruptRecord
+	}
+	body := make([]byte, int(keyLen)+int(valueLen))
+	if _, err := io.ReadFull(r, body); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return diskRecord{}, 0, errCorruptRecord
+		}
+		return diskRecord{}, 0, err
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(body)
+	if crc.Sum32() != binary.BigEndian.Uint32(header) {
+		return diskRecord{}, 0, errCorruptRecord
+	}
+	record := diskRecord{
+		kind:    header[4],
+		expires: int64(binary.BigEndian.Uint64(header[5:])),
+		key:     string(body[:keyLen]),
+		value:   body[keyLen:],
+	}
+	return record, int64(diskHeaderSize) + int64(len(body)), nil
+}
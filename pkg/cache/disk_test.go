@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDiskStore(t *testing.T) {
+	store, err := OpenDiskStore(DiskOptions{Dir: t.TempDir(), SegmentBytes: 64 << 10})
+	if err != nil {
+		t.Fatalf("OpenDiskStore: %v", err)
+	}
+	defer store.Close()
+	testStore(t, store, 50*time.Millisecond)
+}
+
+func TestDiskStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenDiskStore(DiskOptions{Dir: dir, SegmentBytes: 1 << 10})
+	if err != nil {
+		t.Fatalf("OpenDiskStore: %v", err)
+	}
+	for i := range 20 {
+		if err := store.Save(fmt.Sprintf("key %d", i), bytes.Repeat([]byte{byte(i)}, 200), 0); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	store.Save("key 1", []byte("replaced"), 0)
+	store.Remove("key 2")
+	store.Save("expired", []byte("value"), time.Millisecond)
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	store, err = OpenDiskStore(DiskOptions{Dir: dir, SegmentBytes: 1 << 10})
+	if err != nil {
+		t.Fatalf("OpenDiskStore again: %v", err)
+	}
+	defer store.Close()
+	if got, err := store.Load("key 1"); err != nil || string(got) != "replaced" {
+		t.Fatalf("Load of a replaced value after reopening: got %q, %v", got, err)
+	}
+	for _, key := range []string{"key 2", "expired"} {
+		if _, err := store.Load(key); !errors.Is(err, ErrNotStored) {
+			t.Fatalf("Load %q after reopening: got error %v, want ErrNotStored", key, err)
+		}
+	}
+	if got, err := store.Load("key 19"); err != nil || !bytes.Equal(got, bytes.Repeat([]byte{19}, 200)) {
+		t.Fatalf("Load after reopening: got %q, %v", got, err)
+	}
+}
+
+func TestDiskStoreCompact(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenDiskStore(DiskOptions{Dir: dir, SegmentBytes: 1 << 10})
+	if err != nil {
+		t.Fatalf("OpenDiskStore: %v", err)
+	}
+	for round := range 10 {
+		for i := range 5 {
+			store.Save(fmt.Sprintf("key %d", i), []byte(fmt.Sprintf("value %d of round %d", i, round)), 0)
+		}
+	}
+	store.Remove("key 0")
+	before := store.Bytes()
+	if reclaimed := store.Compact(); reclaimed <= 0 || store.Bytes() >= before {
+		t.Fatalf("Compact: reclaimed %d bytes, %d of %d left", reclaimed, store.Bytes(), before)
+	}
+	check := func() {
+		t.Helper()
+		if _, err := store.Load("key 0"); !errors.Is(err, ErrNotStored) {
+			t.Fatalf("Load of a removed key: got error %v, want ErrNotStored", err)
+		}
+		for i := 1; i < 5; i++ {
+			want := fmt.Sprintf("value %d of round 9", i)
+			if got, err := store.Load(fmt.Sprintf("key %d", i)); err != nil || string(got) != want {
+				t.Fatalf("Load: got %q, %v, want %q", got, err, want)
+			}
+		}
+	}
+	check()
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	store, err = OpenDiskStore(DiskOptions{Dir: dir, SegmentBytes: 1 << 10})
+	if err != nil {
+		t.Fatalf("OpenDiskStore again: %v", err)
+	}
+	defer store.Close()
+	check()
+}
+
+func TestDiskStoreMaxBytes(t *testing.T) {
+	store, err := OpenDiskStore(DiskOptions{Dir: t.TempDir(), MaxBytes: 8 << 10, SegmentBytes: 1 << 10})
+	if err != nil {
+		t.Fatalf("OpenDiskStore: %v", err)
+	}
+	defer store.Close()
+	for i := range 100 {
+		if err := store.Save(fmt.Sprintf("key %d", i), bytes.Repeat([]byte("x"), 300), 0); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		if store.Bytes() > 8<<10 {
+			t.Fatalf("Bytes after %d saves: got %d, want at most %d", i+1, store.Bytes(), 8<<10)
+		}
+	}
+	if _, err := store.Load("key 0"); !errors.Is(err, ErrNotStored) {
+		t.Fatalf("Load of the oldest value: got error %v, want ErrNotStored", err)
+	}
+	if _, err := store.Load("key 99"); err != nil {
+		t.Fatalf("Load of the newest value: %v", err)
+	}
+	if err := store.Save("too large", make([]byte, 9<<10), 0); err != nil {
+		t.Fatalf("Save of a value over MaxBytes: %v", err)
+	}
+	if _, err := store.Load("too large"); !errors.Is(err, ErrNotStored) {
+		t.Fatalf("Load of a value over MaxBytes: got error %v, want ErrNotStored", err)
+	}
+}
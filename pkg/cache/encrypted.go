@@ -0,0 +1,216 @@
+package cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// encryptedFormat starts every value saved by an EncryptedStore; it is the format version.
+const encryptedFormat = 1
+
+// keyIDSize is the length of the key fingerprint saved with each encrypted value.
+const keyIDSize = 4
+
+// EncryptedStore is a Store encrypting the values it saves in another store with AES-GCM, so that the
+// bodies and headers of entries kept on disk or in a shared server can't be read, or altered unnoticed,
+// without the key. Each value is bound to its key, so a value moved to another key doesn't decrypt.
+//
+// Keys are encrypted too, as cache keys may hold credentials such as Authorization header values. The
+// part of a key after its namespace (see storeKey) is encrypted deterministically, with a nonce derived
+// from it, so that it is saved under the same name every time; namespace names are saved as they are,
+// so keys can still be listed by namespace.
+type EncryptedStore struct {
+	store Store
+	// aeads are the ciphers of the keys, by key fingerprint; values are encrypted with current
+	aeads   map[string]cipher.AEAD
+	current string
+	// keyCiphers encrypt the keys, with the current key first
+	keyCiphers []keyCipher
+}
+
+// keyCipher encrypts the keys of an EncryptedStore with one encryption key: nonces are the HMAC of the
+// key with nonceKey, so that equal keys are encrypted alike.
+type keyCipher struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+// The newKeyCipher function derives the cipher of the keys from an encryption key, so that keys and
+// values are not encrypted with the same key.
+func newKeyCipher(key []byte) (keyCipher, error) {
+	derive := func(purpose string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(purpose))
+		return mac.Sum(nil)
+	}
+	block, err := aes.NewCipher(derive("go-proxy-cache store key encryption"))
+	if err != nil {
+		return keyCipher{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return keyCipher{}, err
+	}
+	return keyCipher{aead: aead, nonceKey: derive("go-proxy-cache store key nonce")}, nil
+}
+
+// The `seal` method in the `keyCipher` struct returns the name key is saved under: its namespace, if it
+// has one, and the encrypted key.
+func (k keyCipher) seal(key string) string {
+	namespace, _, _ := strings.Cut(key, "\x00")
+	mac := hmac.New(sha256.New, k.nonceKey)
+	mac.Write([]byte(key))
+	nonce := mac.Sum(nil)[:k.aead.NonceSize()]
+	return namespace + "\x00" + base64.RawURLEncoding.EncodeToString(k.aead.Seal(nonce, nonce, []byte(key), []byte(namespace)))
+}
+
+// The `open` method in the `keyCipher` struct returns the key saved under name, if it was encrypted with
+// this cipher.
+func (k keyCipher) open(name string) (string, bool) {
+	namespace, sealed, ok := strings.Cut(name, "\x00")
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if !ok || err != nil || len(data) < k.aead.NonceSize() {
+		return "", false
+	}
+	key, err := k.aead.Open(nil, data[:k.aead.NonceSize()], data[k.aead.NonceSize():], []byte(namespace))
+	if err != nil {
+		return "", false
+	}
+	return string(key), true
+}
+
+// The NewEncryptedStore function returns a Store encrypting values saved in store with the first of
+// keys, which must be 16, 24 or 32 bytes long for AES-128, AES-192 or AES-256. Values encrypted with
+// any of the keys are decrypted, so keys can be rotated by putting the new key first and dropping the
+// old one once the values it encrypted have expired.
+func NewEncryptedStore(store Store, keys ...[]byte) (*EncryptedStore, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no encryption key")
+	}
+	s := &EncryptedStore{store: store, aeads: make(map[string]cipher.AEAD, len(keys))}
+	for i, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		id := string(sum[:keyIDSize])
+		if _, ok := s.aeads[id]; ok {
+			return nil, fmt.Errorf("encryption key %d is a duplicate", i+1)
+		}
+		s.aeads[id] = aead
+		if i == 0 {
+			s.current = id
+		}
+		keys, err := newKeyCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		s.keyCiphers = append(s.keyCiphers, keys)
+	}
+	return s, nil
+}
+
+// The `Load` method in the `EncryptedStore` struct returns the decrypted value stored under key, looking
+// for it under the name given by each encryption key in turn. Values that were not encrypted with one of
+// the store's keys, or that were altered, are an error; errors don't name the key, which may hold
+// credentials.
+func (s *EncryptedStore) Load(key string) ([]byte, error) {
+	var value []byte
+	err := ErrNotStored
+	for _, k := range s.keyCiphers {
+		if value, err = s.store.Load(k.seal(key)); !errors.Is(err, ErrNotStored) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(value) <= 1+keyIDSize || value[0] != encryptedFormat {
+		return nil, errors.New("stored value is not encrypted")
+	}
+	aead, ok := s.aeads[string(value[1:1+keyIDSize])]
+	if !ok {
+		return nil, errors.New("stored value is encrypted with an unknown key")
+	}
+	sealed := value[1+keyIDSize:]
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("stored value is truncated")
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting stored value: %w", err)
+	}
+	return plain, nil
+}
+
+// The `Save` method in the `EncryptedStore` struct encrypts value with the current key and a random
+// nonce, and saves it under key.
+func (s *EncryptedStore) Save(key string, value []byte, ttl time.Duration) error {
+	aead := s.aeads[s.current]
+	sealed := make([]byte, 1+keyIDSize+aead.NonceSize(), 1+keyIDSize+aead.NonceSize()+len(value)+aead.Overhead())
+	sealed[0] = encryptedFormat
+	copy(sealed[1:], s.current)
+	nonce := sealed[1+keyIDSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	return s.store.Save(s.keyCiphers[0].seal(key), aead.Seal(sealed, nonce, value, []byte(key)), ttl)
+}
+
+// The `Remove` method in the `EncryptedStore` struct removes the value stored under key, under the name
+// given by each encryption key.
+func (s *EncryptedStore) Remove(key string) (bool, error) {
+	removed := false
+	for _, k := range s.keyCiphers {
+		ok, err := s.store.Remove(k.seal(key))
+		if err != nil {
+			return removed, err
+		}
+		removed = removed || ok
+	}
+	return removed, nil
+}
+
+// The `Keys` method in the `EncryptedStore` struct calls fn for every stored key starting with prefix,
+// decrypting the names keys are saved under. Names the store's keys don't decrypt are skipped. Only
+// the namespace part of prefix narrows the listing of the underlying store.
+func (s *EncryptedStore) Keys(prefix string, fn func(key string) bool) error {
+	listed := ""
+	if namespace, _, ok := strings.Cut(prefix, "\x00"); ok {
+		listed = namespace + "\x00"
+	}
+	return s.store.Keys(listed, func(name string) bool {
+		for _, k := range s.keyCiphers {
+			if key, ok := k.open(name); ok {
+				if strings.HasPrefix(key, prefix) {
+					return fn(key)
+				}
+				return true
+			}
+		}
+		return true
+	})
+}
+
+// The `Close` method in the `EncryptedStore` struct closes the underlying store if it is an io.Closer.
+func (s *EncryptedStore) Close() error {
+	if closer, ok := s.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
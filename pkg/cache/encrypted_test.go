@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncryptedStore(t *testing.T) {
+	disk, err := OpenDiskStore(DiskOptions{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("OpenDiskStore: %v", err)
+	}
+	defer disk.Close()
+	store, err := NewEncryptedStore(disk, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatalf("NewEncryptedStore: %v", err)
+	}
+	testStore(t, store, 50*time.Millisecond)
+}
+
+func TestEncryptedStoreHidesKeysAndValues(t *testing.T) {
+	disk, err := OpenDiskStore(DiskOptions{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("OpenDiskStore: %v", err)
+	}
+	defer disk.Close()
+	store, err := NewEncryptedStore(disk, bytes.Repeat([]byte{1}, 16))
+	if err != nil {
+		t.Fatalf("NewEncryptedStore: %v", err)
+	}
+	key := storeKey("tenant", "GET https://example.com/ Authorization=Bearer secret-token")
+	if err := store.Save(key, []byte("secret value"), 0); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	var keys []string
+	disk.Keys("", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if len(keys) != 1 || strings.Contains(keys[0], "secret") || !strings.HasPrefix(keys[0], "tenant\x00") {
+		t.Fatalf("keys of the underlying store: got %q, want one encrypted key in the tenant namespace", keys)
+	}
+	value, err := disk.Load(keys[0])
+	if err != nil || bytes.Contains(value, []byte("secret")) {
+		t.Fatalf("value in the underlying store: got %q, %v, want it encrypted", value, err)
+	}
+
+	// A value moved to another key doesn't decrypt
+	other := storeKey("tenant", "other")
+	if err := store.Save(other, []byte("other value"), 0); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	disk.Keys("", func(name string) bool {
+		if name != keys[0] {
+			disk.Save(name, value, 0)
+		}
+		return true
+	})
+	if _, err := store.Load(other); err == nil || errors.Is(err, ErrNotStored) {
+		t.Fatalf("Load of a value moved to another key: got error %v, want a decryption error", err)
+	}
+	value[len(value)-1] ^= 1
+	disk.Save(keys[0], value, 0)
+	if _, err := store.Load(key); err == nil || errors.Is(err, ErrNotStored) {
+		t.Fatalf("Load of an altered value: got error %v, want a decryption error", err)
+	}
+}
+
+func TestEncryptedStoreKeyRotation(t *testing.T) {
+	disk, err := OpenDiskStore(DiskOptions{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("OpenDiskStore: %v", err)
+	}
+	defer disk.Close()
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	old, err := NewEncryptedStore(disk, oldKey)
+	if err != nil {
+		t.Fatalf("NewEncryptedStore: %v", err)
+	}
+	key := storeKey(DefaultNamespace, "key")
+	if err := old.Save(key, []byte("value"), 0); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	rotated, err := NewEncryptedStore(disk, newKey, oldKey)
+	if err != nil {
+		t.Fatalf("NewEncryptedStore with a new key: %v", err)
+	}
+	if got, err := rotated.Load(key); err != nil || string(got) != "value" {
+		t.Fatalf("Load of a value encrypted with the old key: got %q, %v", got, err)
+	}
+	var keys []string
+	rotated.Keys(storeKey(DefaultNamespace, ""), func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if len(keys) != 1 || keys[0] != key {
+		t.Fatalf("Keys: got %q, want %q", keys, []string{key})
+	}
+	if err := rotated.Save(key, []byte("new value"), 0); err != nil {
+		t.Fatalf("Save with the new key: %v", err)
+	}
+	if got, err := rotated.Load(key); err != nil || string(got) != "new value" {
+		t.Fatalf("Load of a value encrypted with the new key: got %q, %v", got, err)
+	}
+	if ok, err := rotated.Remove(key); err != nil || !ok {
+		t.Fatalf("Remove: got %v, %v, want true", ok, err)
+	}
+	if _, err := old.Load(key); !errors.Is(err, ErrNotStored) {
+		t.Fatalf("Load with the old key after Remove: got error %v, want ErrNotStored", err)
+	}
+
+	if _, err := NewEncryptedStore(disk, oldKey, oldKey); err == nil {
+		t.Fatal("NewEncryptedStore with a duplicate key: got no error")
+	}
+	if _, err := NewEncryptedStore(disk, []byte("short")); err == nil {
+		t.Fatal("NewEncryptedStore with an invalid key: got no error")
+	}
+}
@@ -0,0 +1,74 @@
+package cache
+
+// lruItem locates an entry from its element in the LRU list.
+type lruItem struct {
+	namespace, key string
+}
+
+// The `insert` method in the `Cache` struct stores an entry, accounting for its identity and body size.
+// The caller must hold the write lock and have removed any entry previously stored under the key.
+func (c *Cache) insert(name, key string, entry Entry) {
+	entries, ok := c.namespaces[name]
+	if !ok {
+		entries = make(map[string]Entry)
+		c.namespaces[name] = entries
+	}
+	if c.maxBytes > 0 {
+		c.lruMutex.Lock()
+		entry.elem = c.lru.PushFront(lruItem{name, key})
+		c.lruMutex.Unlock()
+	}
+	c.track(entry, 1)
+	c.bytes.Add(entry.Size())
+	entries[key] = entry
+}
+
+// The `remove` method in the `Cache` struct deletes a stored entry and undoes its accounting. The caller
+// must hold the write lock.
+func (c *Cache) remove(name, key string, entry Entry) {
+	if entry.elem != nil {
+		c.lruMutex.Lock()
+		c.lru.Remove(entry.elem)
+		c.lruMutex.Unlock()
+	}
+	c.track(entry, -1)
+	c.bytes.Add(-entry.Size())
+	delete(c.namespaces[name], key)
+}
+
+// The `touch` method in the `Cache` struct marks an entry as the most recently used. It only needs the
+// LRU list's own lock, so lookups can keep sharing the read lock; touching an entry that has been
+// removed meanwhile does nothing.
+func (c *Cache) touch(entry Entry) {
+	if entry.elem == nil {
+		return
+	}
+	c.lruMutex.Lock()
+	c.lru.MoveToFront(entry.elem)
+	c.lruMutex.Unlock()
+}
+
+// The `evict` method in the `Cache` struct removes entries chosen by the cache's Policy, across all
+// namespaces, until the cached bodies fit in the memory budget. The caller must hold the write lock.
+func (c *Cache) evict() {
+	for c.maxBytes > 0 && c.bytes.Load() > c.maxBytes {
+		victim := c.victim()
+		if victim == nil {
+			return
+		}
+		item := victim.Value.(lruItem)
+		entry, ok := c.namespaces[item.namespace][item.key]
+		if !ok || entry.elem != victim {
+			// A stale element frees nothing, so it isn't an eviction
+			c.lruMutex.Lock()
+			c.lru.Remove(victim)
+			c.lruMutex.Unlock()
+			continue
+		}
+		c.remove(item.namespace, item.key, entry)
+		c.evictions.Add(1)
+		if c.onEvict != nil {
+			c.onEvict(item.namespace, item.key, entry)
+		}
+	}
+}
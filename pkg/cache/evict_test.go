@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The sizedEntry function returns an entry with a body of n bytes.
+func sizedEntry(n int) Entry {
+	return Entry{Body: bytes.Repeat([]byte("x"), n)}
+}
+
+func TestEvictLRU(t *testing.T) {
+	var evicted []string
+	c := New(Options{MaxBytes: 300, OnEvict: func(namespace, key string, entry Entry) {
+		evicted = append(evicted, key)
+	}})
+	for _, key := range []string{"a", "b", "c"} {
+		c.Set(key, sizedEntry(100), 0)
+	}
+	c.Get("a")
+	c.Set("d", sizedEntry(100), 0)
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if _, ok := c.Get(key); ok != want {
+			t.Fatalf("Get %q after eviction: got %v, want %v", key, ok, want)
+		}
+	}
+	stats := c.Stats()
+	if stats.Evictions != 1 || stats.Bytes != 300 || len(evicted) != 1 || evicted[0] != "b" {
+		t.Fatalf("after eviction: got %d evictions of %q and %d bytes, want b evicted and 300 bytes", stats.Evictions, evicted, stats.Bytes)
+	}
+
+	// Replacing an entry frees its previous body
+	c.Set("a", sizedEntry(200), 0)
+	if stats := c.Stats(); stats.Bytes > 300 || stats.Evictions != 2 {
+		t.Fatalf("after replacing an entry: got %d bytes and %d evictions, want at most 300 bytes and 2 evictions", stats.Bytes, stats.Evictions)
+	}
+
+	c.Set("large", sizedEntry(301), 0)
+	if _, ok := c.Get("large"); ok {
+		t.Fatal("Get of an entry over the memory budget: got a hit")
+	}
+	if stats := c.Stats(); stats.Evictions != 2 {
+		t.Fatalf("Evictions after an entry over the memory budget: got %d, want 2", stats.Evictions)
+	}
+}
+
+func TestEvictAcrossNamespaces(t *testing.T) {
+	c := New(Options{MaxBytes: 200})
+	c.Namespace("one").Set("key", sizedEntry(100), 0)
+	c.Namespace("two").Set("key", sizedEntry(100), 0)
+	c.Namespace("three").Set("key", sizedEntry(100), 0)
+	if _, ok := c.Namespace("one").Get("key"); ok {
+		t.Fatal("Get of the least recently used entry of another namespace: got a hit")
+	}
+	if dropped := c.DropNamespace("two"); dropped != 1 {
+		t.Fatalf("DropNamespace: got %d entries dropped, want 1", dropped)
+	}
+	c.Namespace("four").Set("key", sizedEntry(100), 0)
+	if stats := c.Stats(); stats.Evictions != 1 || stats.Bytes != 200 {
+		t.Fatalf("after dropping a namespace: got %d evictions and %d bytes, want 1 and 200", stats.Evictions, stats.Bytes)
+	}
+}
@@ -0,0 +1,267 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// entryFormat starts every entry serialized by MarshalEntry; the last byte is the format version.
+var entryFormat = []byte("GPC\x01")
+
+// ErrInvalidEntry is returned by UnmarshalEntry for data that is not a serialized entry.
+var ErrInvalidEntry = errors.New("invalid serialized entry")
+
+// The MarshalEntry function serializes an entry for a Store: a compact binary format of
+// length-prefixed fields. The decoded JSON document, hit count and memory bookkeeping are not included.
+func MarshalEntry(entry Entry) []byte {
+	size := len(entryFormat) + 256 + len(entry.Body)
+	for _, variant := range entry.Variants {
+		size += len(variant)
+	}
+	for _, revision := range entry.Revisions {
+		size += len(revision.Delta)
+	}
+	e := encoder{buf: make([]byte, 0, size)}
+	e.buf = append(e.buf, entryFormat...)
+	e.response(entry.Response)
+	e.bytes(entry.Body)
+	e.string(entry.ETag)
+	e.time(entry.StoredAt)
+	e.time(entry.ExpiresAt)
+	e.string(entry.Identity)
+	e.uint(uint64(len(entry.Variants)))
+	for _, name := range sortedKeys(entry.Variants) {
+		e.string(name)
+		e.bytes(entry.Variants[name])
+	}
+	e.strings(entry.Vary)
+	e.strings(entry.Tags)
+	e.uint(uint64(len(entry.Revisions)))
+	for _, revision := range entry.Revisions {
+		e.response(revision.Response)
+		e.string(revision.ETag)
+		e.time(revision.StoredAt)
+		e.bytes(revision.Delta)
+	}
+	e.uint(uint64(entry.Checksum))
+	e.uint(uint64(entry.BodySize))
+	e.string(entry.chunks.id)
+	e.uint(uint64(entry.chunks.size))
+	e.time(entry.chunks.until)
+	return e.buf
+}
+
+// The UnmarshalEntry function decodes an entry serialized by MarshalEntry. The entry's byte slices
+// share memory with data, which must not be modified afterwards.
+func UnmarshalEntry(data []byte) (Entry, error) {
+	format, rest, ok := cutBytes(data, len(entryFormat))
+	if !ok || string(format) != string(entryFormat) {
+		return Entry{}, ErrInvalidEntry
+	}
+	d := decoder{buf: rest}
+	var entry Entry
+	entry.Response = d.response()
+	entry.Body = d.bytes()
+	entry.ETag = d.string()
+	entry.StoredAt = d.time()
+	entry.ExpiresAt = d.time()
+	entry.Identity = d.string()
+	if n := d.count(); n > 0 {
+		entry.Variants = make(map[string][]byte, n)
+		for range n {
+			name := d.string()
+			entry.Variants[name] = d.bytes()
+		}
+	}
+	entry.Vary = d.strings()
+	entry.Tags = d.strings()
+	if n := d.count(); n > 0 {
+		entry.Revisions = make([]Revision, n)
+		for i := range entry.Revisions {
+			entry.Revisions[i] = Revision{Response: d.response(), ETag: d.string(), StoredAt: d.time(), Delta: d.bytes()}
+		}
+	}
+	// Entries serialized before checksums, or bodies in chunks, were kept end here
+	if len(d.buf) > 0 {
+		entry.Checksum = uint32(d.uint())
+	}
+	if len(d.buf) > 0 {
+		entry.BodySize = int64(d.uint())
+		entry.chunks = chunkRef{id: d.string(), size: int(d.uint())}
+		if len(d.buf) > 0 {
+			entry.chunks.until = d.time()
+		}
+		if entry.BodySize > 0 && entry.chunks.size <= 0 {
+			return Entry{}, ErrInvalidEntry
+		}
+	}
+	if d.err != nil || len(d.buf) > 0 {
+		return Entry{}, ErrInvalidEntry
+	}
+	return entry, nil
+}
+
+// The sortedKeys function returns the keys of a map in order, so serializations are deterministic.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// encoder appends the fields of a serialized entry to buf.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) string(s string) {
+	e.uint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) strings(values []string) {
+	e.uint(uint64(len(values)))
+	for _, s := range values {
+		e.string(s)
+	}
+}
+
+// The `time` method in the `encoder` struct appends a time as Unix nanoseconds, 0 for the zero time.
+func (e *encoder) time(t time.Time) {
+	if t.IsZero() {
+		e.buf = binary.AppendVarint(e.buf, 0)
+		return
+	}
+	e.buf = binary.AppendVarint(e.buf, t.UnixNano())
+}
+
+func (e *encoder) header(h http.Header) {
+	e.uint(uint64(len(h)))
+	for _, name := range sortedKeys(h) {
+		e.string(name)
+		e.strings(h[name])
+	}
+}
+
+func (e *encoder) response(r ResponseRecord) {
+	e.uint(uint64(r.StatusCode))
+	e.header(r.Header)
+	e.string(r.Request.Method)
+	e.string(r.Request.URL)
+	e.header(r.Request.Header)
+}
+
+// decoder reads the fields of a serialized entry from buf. After the first error every field
+// decodes as its zero value and err is set.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) uint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = ErrInvalidEntry
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// The `count` method in the `decoder` struct reads the length of a list, which can't exceed the
+// remaining data since every element takes at least a byte.
+func (d *decoder) count() int {
+	n := d.uint()
+	if n > uint64(len(d.buf)) {
+		d.err = ErrInvalidEntry
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.count()
+	if d.err != nil || n == 0 {
+		return nil
+	}
+	b := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) strings() []string {
+	n := d.count()
+	if n == 0 {
+		return nil
+	}
+	values := make([]string, n)
+	for i := range values {
+		values[i] = d.string()
+	}
+	return values
+}
+
+func (d *decoder) time() time.Time {
+	if d.err != nil {
+		return time.Time{}
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = ErrInvalidEntry
+		return time.Time{}
+	}
+	d.buf = d.buf[n:]
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, v)
+}
+
+// The `header` method in the `decoder` struct reads a header, never nil so that it can be modified
+// like the header of a response.
+func (d *decoder) header() http.Header {
+	n := d.count()
+	h := make(http.Header, n)
+	for range n {
+		name := d.string()
+		h[name] = d.strings()
+	}
+	return h
+}
+
+func (d *decoder) response() ResponseRecord {
+	return ResponseRecord{
+		StatusCode: int(d.uint()),
+		Header:     d.header(),
+		Request:    RequestRecord{Method: d.string(), URL: d.string(), Header: d.header()},
+	}
+}
+
+// The cutBytes function splits the first n bytes off data.
+func cutBytes(data []byte, n int) ([]byte, []byte, bool) {
+	if len(data) < n {
+		return nil, nil, false
+	}
+	return data[:n], data[n:], true
+}
@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The testEntry function returns an entry with every serialized field set.
+func testEntry() Entry {
+	stored := time.Unix(1700000000, 123456789)
+	entry := Entry{
+		Response: ResponseRecord{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/plain"}, "Vary": {"Accept-Encoding"}},
+			Request: RequestRecord{
+				Method: "GET",
+				URL:    "https://example.com/path?q=1",
+				Header: http.Header{"Accept-Encoding": {"gzip"}},
+			},
+		},
+		Body:      []byte("hello, world"),
+		ETag:      `"v2"`,
+		StoredAt:  stored,
+		ExpiresAt: stored.Add(time.Hour),
+		Identity:  "user-1",
+		Variants:  map[string][]byte{"br": []byte("brotli"), "gzip": []byte("gzipped")},
+		Vary:      []string{"Accept-Encoding"},
+		Tags:      []string{"product-1", "products"},
+		Revisions: []Revision{{
+			Response: ResponseRecord{StatusCode: http.StatusOK, Header: http.Header{"Etag": {`"v1"`}}, Request: RequestRecord{Method: "GET", URL: "https://example.com/path?q=1", Header: http.Header{}}},
+			ETag:     `"v1"`,
+			StoredAt: stored.Add(-time.Hour),
+			Delta:    []byte("delta"),
+		}},
+		BodySize: 3 << 20,
+		chunks:   chunkRef{id: "0123456789abcdef", size: 1 << 20, until: stored.Add(2 * time.Hour)},
+	}
+	entry.Checksum = entry.checksum()
+	return entry
+}
+
+func TestMarshalEntryRoundTrip(t *testing.T) {
+	entry := testEntry()
+	got, err := UnmarshalEntry(MarshalEntry(entry))
+	if err != nil {
+		t.Fatalf("UnmarshalEntry: %v", err)
+	}
+	if !reflect.DeepEqual(got, entry) {
+		t.Fatalf("UnmarshalEntry: got %+v, want %+v", got, entry)
+	}
+
+	empty, err := UnmarshalEntry(MarshalEntry(Entry{}))
+	if err != nil {
+		t.Fatalf("UnmarshalEntry of an empty entry: %v", err)
+	}
+	if len(empty.Body) != 0 || !empty.StoredAt.IsZero() || !empty.ExpiresAt.IsZero() || empty.BodySize != 0 {
+		t.Fatalf("UnmarshalEntry of an empty entry: got %+v", empty)
+	}
+}
+
+func TestUnmarshalEntryTruncated(t *testing.T) {
+	entry := testEntry()
+	data := MarshalEntry(entry)
+	// Entries serialized before checksums and bodies in chunks end before these optional fields
+	e := encoder{}
+	e.uint(uint64(entry.Checksum))
+	e.uint(uint64(entry.BodySize))
+	e.string(entry.chunks.id)
+	e.uint(uint64(entry.chunks.size))
+	e.time(entry.chunks.until)
+	required := len(data) - len(e.buf)
+
+	for n := 0; n < len(data); n++ {
+		got, err := UnmarshalEntry(data[:n])
+		if n < required {
+			if !errors.Is(err, ErrInvalidEntry) {
+				t.Fatalf("UnmarshalEntry of the first %d of %d bytes: got error %v, want ErrInvalidEntry", n, len(data), err)
+			}
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrInvalidEntry) {
+			t.Fatalf("UnmarshalEntry of the first %d of %d bytes: got error %v, want ErrInvalidEntry", n, len(data), err)
+		}
+		if err == nil && (string(got.Body) != string(entry.Body) || !reflect.DeepEqual(got.Revisions, entry.Revisions)) {
+			t.Fatalf("UnmarshalEntry of the first %d of %d bytes: got %+v", n, len(data), got)
+		}
+	}
+
+	if _, err := UnmarshalEntry(append(data, 0)); !errors.Is(err, ErrInvalidEntry) {
+		t.Fatalf("UnmarshalEntry with a trailing byte: got error %v, want ErrInvalidEntry", err)
+	}
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(entryFormat)-1]++
+	if _, err := UnmarshalEntry(corrupt); !errors.Is(err, ErrInvalidEntry) {
+		t.Fatalf("UnmarshalEntry of another format version: got error %v, want ErrInvalidEntry", err)
+	}
+}
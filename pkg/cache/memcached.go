@@ -0,0 +1,413 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MemcachedOptions configures a MemcachedStore created by NewMemcachedStore.
+type MemcachedOptions struct {
+	// Servers are the host:port addresses of the memcached servers. Keys are spread over them by
+	// consistent hashing, so adding or removing a server only moves the keys of its share of the ring.
+	Servers []string
+	// Prefix is prepended to every key, so several caches can share the servers.
+	Prefix string
+	// ChunkBytes is the size values are split at, to stay below the server's item size limit (-I, 1 MiB
+	// by default); the default is 1 MiB minus room for the item's key and header.
+	ChunkBytes int
+	// PoolSize is the number of idle connections kept per server; the default is 10.
+	PoolSize int
+	// Timeout bounds dialing and every command; the default is 5 seconds.
+	Timeout time.Duration
+}
+
+// MemcachedStore is a Store that keeps entries on memcached servers, so that proxy instances share one
+// cache. Values larger than ChunkBytes are split into chunks stored as separate items, which may live
+// on different servers. memcached can't list its keys, so `Keys` returns ErrKeysUnsupported.
+type MemcachedStore struct {
+	opts    MemcachedOptions
+	ring    []ringPoint
+	servers map[string]*memcachedServer
+}
+
+// ringPoint is a point of a server on the consistent hashing ring.
+type ringPoint struct {
+	hash   uint32
+	server string
+}
+
+// memcachedServer holds the idle connections to a server.
+type memcachedServer struct {
+	addr string
+	idle chan *memcachedConn
+}
+
+// memcachedConn is a connection speaking memcached's text protocol.
+type memcachedConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// Item kinds, the first byte of every item written under an entry's key: the value itself, or a
+// manifest of the chunks holding it.
+const (
+	memcachedValue    byte = 'v'
+	memcachedManifest byte = 'm'
+)
+
+// memcachedPointsPerServer is the number of ring points of each server, as in libketama.
+const memcachedPointsPerServer = 160
+
+// memcachedMaxRelative is the longest expiry memcached takes as relative; longer ones must be given as
+// a Unix time.
+const memcachedMaxRelative = 30 * 24 * time.Hour
+
+// The NewMemcachedStore function returns a Store on the memcached servers described by opts. Connections
+// are made when they are needed.
+func NewMemcachedStore(opts MemcachedOptions) *MemcachedStore {
+	if opts.ChunkBytes <= 0 {
+		opts.ChunkBytes = 1<<20 - 1024
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 10
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	s := &MemcachedStore{opts: opts, servers: make(map[string]*memcachedServer, len(opts.Servers))}
+	for _, addr := range opts.Servers {
+		s.servers[addr] = &memcachedServer{addr: addr, idle: make(chan *memcachedConn, opts.PoolSize)}
+		// Each MD5 digest gives four points, the way libketama places servers
+		for i := 0; i < memcachedPointsPerServer/4; i++ {
+			digest := md5.Sum([]byte(addr + "-" + strconv.Itoa(i)))
+			for j := 0; j < 4; j++ {
+				s.ring = append(s.ring, ringPoint{hash: binary.LittleEndian.Uint32(digest[j*4:]), server: addr})
+			}
+		}
+	}
+	slices.SortFunc(s.ring, func(a, b ringPoint) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		}
+		return strings.Compare(a.server, b.server)
+	})
+	return s
+}
+
+// The `server` method in the `MemcachedStore` struct returns the server owning an item key: the first
+// ring point at or after the key's hash.
+func (s *MemcachedStore) server(key string) *memcachedServer {
+	digest := md5.Sum([]byte(key))
+	hash := binary.LittleEndian.Uint32(digest[:4])
+	i, _ := slices.BinarySearchFunc(s.ring, hash, func(p ringPoint, hash uint32) int {
+		switch {
+		case p.hash < hash:
+			return -1
+		case p.hash > hash:
+			return 1
+		}
+		return 0
+	})
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.servers[s.ring[i].server]
+}
+
+// The `itemKey` method in the `MemcachedStore` struct returns the memcached key of an entry. Cache keys
+// contain spaces and may exceed memcached's 250 byte limit, so they are hashed.
+func (s *MemcachedStore) itemKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return s.opts.Prefix + hex.EncodeToString(sum[:])
+}
+
+// The chunkKey function returns the memcached key of a value's chunk. The generation is random per
+// write, so chunks of concurrent writes of the same key never mix.
+func chunkKey(item, generation string, i int) string {
+	return item + ":" + generation + ":" + strconv.Itoa(i)
+}
+
+// The `Load` method in the `MemcachedStore` struct returns the value stored under key, reassembling
+// its chunks. A value missing any chunk, e.g. because memcached evicted it, is not stored.
+func (s *MemcachedStore) Load(key string) ([]byte, error) {
+	item := s.itemKey(key)
+	data, err := s.get(item)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, ErrNotStored
+	}
+	switch data[0] {
+	case memcachedValue:
+		return data[1:], nil
+	case memcachedManifest:
+		generation, chunks, size, err := parseManifest(data[1:])
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, 0, size)
+		for i := 0; i < chunks; i++ {
+			chunk, err := s.get(chunkKey(item, generation, i))
+			if err != nil {
+				return nil, err
+			}
+			value = append(value, chunk...)
+		}
+		if len(value) != size {
+			return nil, ErrNotStored
+		}
+		return value, nil
+	}
+	return nil, fmt.Errorf("memcached: unknown item kind %q", data[0])
+}
+
+// The `Save` method in the `MemcachedStore` struct stores value under key, in chunks if it is larger
+// than ChunkBytes. The chunks are written before the manifest referencing them, so readers never see
+// an incomplete value; the chunks of the value it replaces are deleted once it is written.
+func (s *MemcachedStore) Save(key string, value []byte, ttl time.Duration) error {
+	item := s.itemKey(key)
+	previous, _ := s.get(item)
+	if len(value) < s.opts.ChunkBytes {
+		if err := s.set(item, append([]byte{memcachedValue}, value...), ttl); err != nil {
+			return err
+		}
+		s.deleteChunks(item, previous)
+		return nil
+	}
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	generation := hex.EncodeToString(nonce)
+	chunks := 0
+	for offset := 0; offset < len(value); offset += s.opts.ChunkBytes {
+		chunk := value[offset:min(offset+s.opts.ChunkBytes, len(value))]
+		if err := s.set(chunkKey(item, generation, chunks), chunk, ttl); err != nil {
+			return err
+		}
+		chunks++
+	}
+	manifest := fmt.Sprintf("%c%s %d %d", memcachedManifest, generation, chunks, len(value))
+	if err := s.set(item, []byte(manifest), ttl); err != nil {
+		return err
+	}
+	s.deleteChunks(item, previous)
+	return nil
+}
+
+// The `Remove` method in the `MemcachedStore` struct deletes the item stored under key, and its chunks.
+func (s *MemcachedStore) Remove(key string) (bool, error) {
+	item := s.itemKey(key)
+	if data, err := s.get(item); err == nil {
+		s.deleteChunks(item, data)
+	}
+	return s.delete(item)
+}
+
+// The `deleteChunks` method in the `MemcachedStore` struct deletes the chunks of item if data, the
+// item's content, is a manifest. Failures are ignored: the chunks expire with the value anyway.
+func (s *MemcachedStore) deleteChunks(item string, data []byte) {
+	if len(data) == 0 || data[0] != memcachedManifest {
+		return
+	}
+	if generation, chunks, _, err := parseManifest(data[1:]); err == nil {
+		for i := 0; i < chunks; i++ {
+			s.delete(chunkKey(item, generation, i))
+		}
+	}
+}
+
+// The `Keys` method in the `MemcachedStore` struct returns ErrKeysUnsupported, as memcached can't list
+// its keys.
+func (s *MemcachedStore) Keys(prefix string, fn func(key string) bool) error {
+	return ErrKeysUnsupported
+}
+
+// The `Close` method in the `MemcachedStore` struct closes the idle connections.
+func (s *MemcachedStore) Close() error {
+	for _, server := range s.servers {
+		for len(server.idle) > 0 {
+			(<-server.idle).Close()
+		}
+	}
+	return nil
+}
+
+// The parseManifest function decodes a manifest: the chunks' generation, their number and the total
+// size of the value.
+func parseManifest(data []byte) (string, int, int, error) {
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		return "", 0, 0, errors.New("memcached: invalid chunk manifest")
+	}
+	chunks, err1 := strconv.Atoi(fields[1])
+	size, err2 := strconv.Atoi(fields[2])
+	if err1 != nil || err2 != nil {
+		return "", 0, 0, errors.New("memcached: invalid chunk manifest")
+	}
+	return fields[0], chunks, size, nil
+}
+
+// The `get` method in the `MemcachedStore` struct returns the data of an item, or ErrNotStored.
+func (s *MemcachedStore) get(item string) ([]byte, error) {
+	var data []byte
+	found := false
+	err := s.do(item, func(c *memcachedConn) error {
+		fmt.Fprintf(c.w, "get %s\r\n", item)
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+		for {
+			line, err := c.line()
+			if err != nil {
+				return err
+			}
+			if line == "END" {
+				return nil
+			}
+			// VALUE <key> <flags> <bytes>
+			fields := strings.Fields(line)
+			if len(fields) < 4 || fields[0] != "VALUE" {
+				return memcachedReplyError(line)
+			}
+			n, err := strconv.Atoi(fields[3])
+			if err != nil {
+				return fmt.Errorf("memcached: invalid reply %q", line)
+			}
+			buf := make([]byte, n+2)
+			if _, err := io.ReadFull(c.r, buf); err != nil {
+				return err
+			}
+			data, found = buf[:n], true
+		}
+	})
+	if err == nil && !found {
+		err = ErrNotStored
+	}
+	return data, err
+}
+
+// The `set` method in the `MemcachedStore` struct stores an item expiring after ttl, rounded up to the
+// second.
+func (s *MemcachedStore) set(item string, data []byte, ttl time.Duration) error {
+	exptime := int64(0)
+	if ttl > 0 {
+		exptime = int64((ttl + time.Second - 1) / time.Second)
+		if ttl > memcachedMaxRelative {
+			exptime += time.Now().Unix()
+		}
+	}
+	return s.do(item, func(c *memcachedConn) error {
+		fmt.Fprintf(c.w, "set %s 0 %d %d\r\n", item, exptime, len(data))
+		c.w.Write(data)
+		c.w.WriteString("\r\n")
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+		line, err := c.line()
+		if err != nil {
+			return err
+		}
+		if line != "STORED" {
+			return memcachedReplyError(line)
+		}
+		return nil
+	})
+}
+
+// The `delete` method in the `MemcachedStore` struct deletes an item and reports whether it existed.
+func (s *MemcachedStore) delete(item string) (bool, error) {
+	deleted := false
+	err := s.do(item, func(c *memcachedConn) error {
+		fmt.Fprintf(c.w, "delete %s\r\n", item)
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+		line, err := c.line()
+		if err != nil {
+			return err
+		}
+		switch line {
+		case "DELETED":
+			deleted = true
+		case "NOT_FOUND":
+		default:
+			return memcachedReplyError(line)
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// memcachedReplyError is an unexpected reply of a memcached server, such as "SERVER_ERROR object too
+// large for cache". The connection remains usable.
+type memcachedReplyError string
+
+func (e memcachedReplyError) Error() string {
+	return "memcached: " + string(e)
+}
+
+// The `do` method in the `MemcachedStore` struct runs a command on a pooled connection to the server
+// owning item. Connections failing other than with a reply error are closed, and a command failing on
+// a reused connection, which the server may have closed since, is retried once on a new one.
+func (s *MemcachedStore) do(item string, command func(c *memcachedConn) error) error {
+	if len(s.ring) == 0 {
+		return errors.New("memcached: no servers")
+	}
+	server := s.server(item)
+	for attempt := 0; ; attempt++ {
+		var conn *memcachedConn
+		reused := false
+		select {
+		case conn = <-server.idle:
+			reused = true
+		default:
+			nc, err := net.DialTimeout("tcp", server.addr, s.opts.Timeout)
+			if err != nil {
+				return err
+			}
+			conn = &memcachedConn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+		}
+		conn.SetDeadline(time.Now().Add(s.opts.Timeout))
+		err := command(conn)
+		var replyErr memcachedReplyError
+		if err != nil && !errors.As(err, &replyErr) {
+			conn.Close()
+			if reused && attempt == 0 {
+				continue
+			}
+			return err
+		}
+		select {
+		case server.idle <- conn:
+		default:
+			conn.Close()
+		}
+		return err
+	}
+}
+
+// The `line` method in the `memcachedConn` struct reads a reply line without its line ending.
+func (c *memcachedConn) line() (string, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimRight(line, "\r\n")), nil
+}
@@ -0,0 +1,191 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMemcached is a memcached server keeping items in memory, speaking enough of the text protocol
+// for a MemcachedStore: get, set and delete.
+type fakeMemcached struct {
+	addr    string
+	mutex   sync.Mutex
+	items   map[string][]byte
+	expires map[string]time.Time
+}
+
+// The startFakeMemcached function starts a fakeMemcached, which stops at the end of the test.
+func startFakeMemcached(t *testing.T) *fakeMemcached {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &fakeMemcached{addr: l.Addr().String(), items: make(map[string][]byte), expires: make(map[string]time.Time)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// The `len` method in the `fakeMemcached` struct returns the number of unexpired items.
+func (s *fakeMemcached) len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expire()
+	return len(s.items)
+}
+
+// The `expire` method in the `fakeMemcached` struct deletes the expired items. The caller must hold the
+// lock.
+func (s *fakeMemcached) expire() {
+	now := time.Now()
+	for item, expires := range s.expires {
+		if !now.Before(expires) {
+			delete(s.items, item)
+			delete(s.expires, item)
+		}
+	}
+}
+
+// The `serve` method in the `fakeMemcached` struct answers the commands of a connection.
+func (s *fakeMemcached) serve(conn net.Conn) {
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			w.WriteString("ERROR\r\n")
+			w.Flush()
+			continue
+		}
+		s.mutex.Lock()
+		s.expire()
+		switch fields[0] {
+		case "get":
+			if data, ok := s.items[fields[1]]; ok {
+				fmt.Fprintf(w, "VALUE %s 0 %d\r\n%s\r\n", fields[1], len(data), data)
+			}
+			w.WriteString("END\r\n")
+		case "set":
+			// set <key> <flags> <exptime> <bytes>
+			exptime, _ := strconv.ParseInt(fields[3], 10, 64)
+			n, _ := strconv.Atoi(fields[4])
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				s.mutex.Unlock()
+				return
+			}
+			s.items[fields[1]] = data[:n]
+			delete(s.expires, fields[1])
+			switch {
+			case exptime > int64(memcachedMaxRelative/time.Second):
+				s.expires[fields[1]] = time.Unix(exptime, 0)
+			case exptime > 0:
+				s.expires[fields[1]] = time.Now().Add(time.Duration(exptime) * time.Second)
+			}
+			w.WriteString("STORED\r\n")
+		case "delete":
+			if _, ok := s.items[fields[1]]; ok {
+				delete(s.items, fields[1])
+				delete(s.expires, fields[1])
+				w.WriteString("DELETED\r\n")
+			} else {
+				w.WriteString("NOT_FOUND\r\n")
+			}
+		default:
+			w.WriteString("ERROR\r\n")
+		}
+		s.mutex.Unlock()
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+func TestMemcachedStore(t *testing.T) {
+	a, b := startFakeMemcached(t), startFakeMemcached(t)
+	store := NewMemcachedStore(MemcachedOptions{Servers: []string{a.addr, b.addr}, Prefix: "test:", ChunkBytes: 4 << 10})
+	defer store.Close()
+	testStore(t, store, time.Second)
+	for i := range 32 {
+		store.Save(fmt.Sprintf("key %d", i), []byte("value"), 0)
+	}
+	if a.len() == 0 || b.len() == 0 {
+		t.Fatalf("items per server: got %d and %d, want both servers used", a.len(), b.len())
+	}
+}
+
+func TestMemcachedStoreChunks(t *testing.T) {
+	a, b := startFakeMemcached(t), startFakeMemcached(t)
+	store := NewMemcachedStore(MemcachedOptions{Servers: []string{a.addr, b.addr}, ChunkBytes: 1 << 10})
+	defer store.Close()
+	large := bytes.Repeat([]byte("0123456789"), 1000)
+	if err := store.Save("key", large, 0); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	// The manifest and 10 chunks
+	if items := a.len() + b.len(); items != 11 {
+		t.Fatalf("items after Save: got %d, want 11", items)
+	}
+	if err := store.Save("key", large[:5000], 0); err != nil {
+		t.Fatalf("Save again: %v", err)
+	}
+	if items := a.len() + b.len(); items != 6 {
+		t.Fatalf("items after replacing the value: got %d, want the chunks of the replaced value deleted", items)
+	}
+	if got, err := store.Load("key"); err != nil || !bytes.Equal(got, large[:5000]) {
+		t.Fatalf("Load: got %d bytes, %v, want %d", len(got), err, 5000)
+	}
+	if err := store.Save("key", []byte("small"), 0); err != nil {
+		t.Fatalf("Save of a small value: %v", err)
+	}
+	if items := a.len() + b.len(); items != 1 {
+		t.Fatalf("items after replacing the value with a small one: got %d, want 1", items)
+	}
+	store.Save("key", large, 0)
+	if ok, err := store.Remove("key"); err != nil || !ok {
+		t.Fatalf("Remove: got %v, %v, want true", ok, err)
+	}
+	if items := a.len() + b.len(); items != 0 {
+		t.Fatalf("items after Remove: got %d, want 0", items)
+	}
+}
+
+func TestMemcachedStoreMissingChunk(t *testing.T) {
+	s := startFakeMemcached(t)
+	store := NewMemcachedStore(MemcachedOptions{Servers: []string{s.addr}, ChunkBytes: 1 << 10})
+	defer store.Close()
+	if err := store.Save("key", make([]byte, 3000), 0); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	s.mutex.Lock()
+	for item := range s.items {
+		if strings.HasSuffix(item, ":1") {
+			delete(s.items, item)
+		}
+	}
+	s.mutex.Unlock()
+	if _, err := store.Load("key"); !errors.Is(err, ErrNotStored) {
+		t.Fatalf("Load of a value missing a chunk: got error %v, want ErrNotStored", err)
+	}
+}
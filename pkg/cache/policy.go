@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// Policy selects which entries are evicted, and which are admitted, when a cache with a memory budget
+// is full.
+type Policy int
+
+const (
+	// PolicyLRU evicts the least recently used entries.
+	PolicyLRU Policy = iota
+	// PolicyLFU evicts the least frequently used of the least recently used entries, so entries with
+	// many hits survive a burst of one-off requests.
+	PolicyLFU
+	// PolicyTinyLFU evicts like PolicyLRU, but only admits a new entry when it has been requested more
+	// often than the entries it would evict, estimated with a frequency sketch. One-hit wonders then
+	// never displace popular entries.
+	PolicyTinyLFU
+)
+
+var policyNames = map[Policy]string{PolicyLRU: "lru", PolicyLFU: "lfu", PolicyTinyLFU: "tinylfu"}
+
+// The `String` method in the `Policy` type returns the name of the policy as accepted by ParsePolicy.
+func (p Policy) String() string {
+	if name, ok := policyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// The ParsePolicy function returns the policy with the given name: lru, lfu or tinylfu.
+func ParsePolicy(name string) (Policy, error) {
+	for policy, policyName := range policyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown eviction policy %q", name)
+}
+
+// lfuSample is how many of the least recently used entries PolicyLFU compares to pick a victim.
+const lfuSample = 8
+
+// The `victim` method in the `Cache` struct returns the LRU list element of the next entry to evict, or
+// nil when the cache is empty. The caller must hold the write lock.
+func (c *Cache) victim() *list.Element {
+	c.lruMutex.Lock()
+	defer c.lruMutex.Unlock()
+	oldest := c.lru.Back()
+	if c.policy != PolicyLFU || oldest == nil {
+		return oldest
+	}
+	victim, fewest := oldest, int64(-1)
+	for e, i := oldest, 0; e != nil && i < lfuSample; e, i = e.Prev(), i+1 {
+		item := e.Value.(lruItem)
+		hits := c.namespaces[item.namespace][item.key].Hits()
+		if fewest < 0 || hits < fewest {
+			victim, fewest = e, hits
+		}
+	}
+	return victim
+}
+
+// The `admit` method in the `Cache` struct decides under PolicyTinyLFU whether storing size more bytes
+// for the given key is worth evicting the entries that would make room for it: the key must have been
+// requested more often than each of them. Caches without a memory budget admit everything. The caller
+// must hold the write lock.
+func (c *Cache) admit(name, key string, size int64) bool {
+	if c.policy != PolicyTinyLFU || c.maxBytes <= 0 || c.sketch == nil || c.bytes.Load()+size <= c.maxBytes {
+		return true
+	}
+	frequency := c.sketch.estimate(name, key)
+	c.lruMutex.Lock()
+	defer c.lruMutex.Unlock()
+	freed := int64(0)
+	for e := c.lru.Back(); e != nil && c.bytes.Load()+size-freed > c.maxBytes; e = e.Prev() {
+		item := e.Value.(lruItem)
+		if c.sketch.estimate(item.namespace, item.key) >= frequency {
+			return false
+		}
+		freed += c.namespaces[item.namespace][item.key].Size()
+	}
+	return true
+}
+
+// Frequency sketch dimensions. Counters saturate at sketchMaxCount and are all halved after
+// sketchResetAfter increments, so the sketch follows changes in popularity.
+const (
+	sketchDepth      = 4
+	sketchWidth      = 1 << 16
+	sketchMaxCount   = 15
+	sketchResetAfter = 10 * sketchWidth
+)
+
+// frequencySketch is a count-min sketch estimating how often each key has been requested in the recent
+// past, in constant memory regardless of the number of keys.
+type frequencySketch struct {
+	counters  [sketchDepth][sketchWidth]uint8
+	additions int
+	mutex     sync.Mutex
+}
+
+// The `indexes` method in the `frequencySketch` struct returns the counter of a key in each row.
+func (s *frequencySketch) indexes(name, key string) [sketchDepth]uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	low, high := uint32(sum), uint32(sum>>32)|1
+	var indexes [sketchDepth]uint32
+	for i := range indexes {
+		indexes[i] = (low + uint32(i)*high) % sketchWidth
+	}
+	return indexes
+}
+
+// The `increment` method in the `frequencySketch` struct records a request for a key.
+func (s *frequencySketch) increment(name, key string) {
+	indexes := s.indexes(name, key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for row, i := range indexes {
+		if s.counters[row][i] < sketchMaxCount {
+			s.counters[row][i]++
+		}
+	}
+	s.additions++
+	if s.additions >= sketchResetAfter {
+		for row := range s.counters {
+			for i := range s.counters[row] {
+				s.counters[row][i] /= 2
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+// The `estimate` method in the `frequencySketch` struct returns how often a key has been requested, an
+// estimate that may be too high but never too low.
+func (s *frequencySketch) estimate(name, key string) uint8 {
+	indexes := s.indexes(name, key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	estimate := uint8(sketchMaxCount)
+	for row, i := range indexes {
+		estimate = min(estimate, s.counters[row][i])
+	}
+	return estimate
+}
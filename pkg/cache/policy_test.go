@@ -0,0 +1,85 @@
+package cache
+
+import "testing"
+
+func TestPolicyLFU(t *testing.T) {
+	c := New(Options{MaxBytes: 300, Policy: PolicyLFU})
+	c.Set("a", sizedEntry(100), 0)
+	for range 5 {
+		c.Get("a")
+	}
+	c.Set("b", sizedEntry(100), 0)
+	c.Set("c", sizedEntry(100), 0)
+	c.Get("c")
+	// a is the least recently used entry, but b has fewer hits
+	c.Set("d", sizedEntry(100), 0)
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if _, ok := c.Get(key); ok != want {
+			t.Fatalf("Get %q after eviction: got %v, want %v", key, ok, want)
+		}
+	}
+	if evictions := c.Stats().Evictions; evictions != 1 {
+		t.Fatalf("Evictions: got %d, want 1", evictions)
+	}
+}
+
+func TestPolicyTinyLFU(t *testing.T) {
+	c := New(Options{MaxBytes: 300, Policy: PolicyTinyLFU})
+	for _, key := range []string{"a", "b", "c"} {
+		c.Set(key, sizedEntry(100), 0)
+		for range 3 {
+			c.Get(key)
+		}
+	}
+	// A one-hit wonder doesn't displace popular entries
+	c.Set("d", sizedEntry(100), 0)
+	if _, ok := c.Get("d"); ok {
+		t.Fatal("Get of an entry requested less than those it would evict: got a hit")
+	}
+	if stats := c.Stats(); stats.Rejections != 1 || stats.Evictions != 0 {
+		t.Fatalf("after a rejection: got %d rejections and %d evictions, want 1 and 0", stats.Rejections, stats.Evictions)
+	}
+
+	for range 5 {
+		c.Get("e")
+	}
+	c.Set("e", sizedEntry(100), 0)
+	if _, ok := c.Get("e"); !ok {
+		t.Fatal("Get of an entry requested more than the one it evicts: got a miss")
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("Get of the least recently used entry after an admission: got a hit")
+	}
+	if stats := c.Stats(); stats.Rejections != 1 || stats.Evictions != 1 {
+		t.Fatalf("after an admission: got %d rejections and %d evictions, want 1 and 1", stats.Rejections, stats.Evictions)
+	}
+
+	// Entries fitting the budget are always admitted
+	c.Delete("b")
+	c.Set("f", sizedEntry(100), 0)
+	if _, ok := c.Get("f"); !ok {
+		t.Fatal("Get of an entry fitting the memory budget: got a miss")
+	}
+}
+
+func TestPolicyTinyLFUWithoutBudget(t *testing.T) {
+	c := New(Options{Policy: PolicyTinyLFU})
+	c.Set("a", sizedEntry(100), 0)
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("Get from a cache without a memory budget: got a miss")
+	}
+	if rejections := c.Stats().Rejections; rejections != 0 {
+		t.Fatalf("Rejections: got %d, want 0", rejections)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, policy := range []Policy{PolicyLRU, PolicyLFU, PolicyTinyLFU} {
+		if parsed, err := ParsePolicy(policy.String()); err != nil || parsed != policy {
+			t.Fatalf("ParsePolicy(%q): got %v, %v, want %v", policy.String(), parsed, err, policy)
+		}
+	}
+	if _, err := ParsePolicy("fifo"); err == nil {
+		t.Fatal("ParsePolicy of an unknown policy: got no error")
+	}
+}
@@ -0,0 +1,40 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// ResponseRecord is the part of an HTTP response kept by an entry: its status, its headers and the
+// request it answers. Unlike *http.Response it holds no connection state or closed body, so entries
+// can be shared between goroutines and serialized. Headers must not be modified once an entry is
+// stored; copy them first.
+type ResponseRecord struct {
+	StatusCode int
+	Header     http.Header
+	Request    RequestRecord
+}
+
+// RequestRecord is the request a cached response answers, replayed to revalidate the entry. The body,
+// which has already been sent, is not kept.
+type RequestRecord struct {
+	Method string
+	URL    string
+	Header http.Header
+}
+
+// The NewResponseRecord function returns a record of a response and the request it answers, with
+// copies of their headers.
+func NewResponseRecord(resp *http.Response) ResponseRecord {
+	record := ResponseRecord{StatusCode: resp.StatusCode, Header: resp.Header.Clone()}
+	if req := resp.Request; req != nil {
+		record.Request = RequestRecord{Method: req.Method, URL: req.URL.String(), Header: req.Header.Clone()}
+	}
+	return record
+}
+
+// The `Status` method in the `ResponseRecord` struct returns the status code followed by its text,
+// e.g. "200 OK".
+func (r ResponseRecord) Status() string {
+	return strconv.Itoa(r.StatusCode) + " " + http.StatusText(r.StatusCode)
+}
@@ -0,0 +1,287 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedisOptions configures a RedisStore created by NewRedisStore.
+type RedisOptions struct {
+	// Addr is the host:port of the Redis server.
+	Addr string
+	// Username and Password, if set, authenticate every connection; Username requires Redis 6 or later.
+	Username string
+	Password string
+	// DB selects the logical database.
+	DB int
+	// Prefix is prepended to every key, so several caches can share a database.
+	Prefix string
+	// PoolSize is the number of idle connections kept for reuse; the default is 10.
+	PoolSize int
+	// Timeout bounds dialing and every command; the default is 5 seconds.
+	Timeout time.Duration
+}
+
+// RedisStore is a Store that keeps entries in Redis, so that proxy instances behind a load balancer
+// share one cache. Entry TTLs become Redis expirations, so Redis removes entries when the cache would.
+type RedisStore struct {
+	opts RedisOptions
+	idle chan *redisConn
+}
+
+// redisConn is a connection to the Redis server speaking RESP, the Redis protocol.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// redisError is an error reply of the Redis server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// The NewRedisStore function returns a Store on the Redis server described by opts. Connections are
+// made when they are needed, so an unreachable server shows as errors of the store's operations.
+func NewRedisStore(opts RedisOptions) *RedisStore {
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 10
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	return &RedisStore{opts: opts, idle: make(chan *redisConn, opts.PoolSize)}
+}
+
+// The `Load` method in the `RedisStore` struct returns the value stored under key with GET.
+func (s *RedisStore) Load(key string) ([]byte, error) {
+	reply, err := s.do("GET", s.opts.Prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrNotStored
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected reply %v to GET", reply)
+	}
+	return value, nil
+}
+
+// The `Save` method in the `RedisStore` struct stores value under key with SET, expiring after ttl
+// rounded up to the millisecond.
+func (s *RedisStore) Save(key string, value []byte, ttl time.Duration) error {
+	args := []interface{}{"SET", s.opts.Prefix + key, value}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(int64((ttl+time.Millisecond-1)/time.Millisecond), 10))
+	}
+	_, err := s.do(args...)
+	return err
+}
+
+// The `Remove` method in the `RedisStore` struct deletes the value stored under key with DEL.
+func (s *RedisStore) Remove(key string) (bool, error) {
+	reply, err := s.do("DEL", s.opts.Prefix+key)
+	if err != nil {
+		return false, err
+	}
+	return reply == int64(1), nil
+}
+
+// The `Keys` method in the `RedisStore` struct iterates over the keys starting with prefix with SCAN, so
+// that the server isn't blocked the way KEYS would block it. Keys are returned without the store's
+// prefix.
+func (s *RedisStore) Keys(prefix string, fn func(key string) bool) error {
+	pattern := redisGlobEscape(s.opts.Prefix+prefix) + "*"
+	cursor := "0"
+	for {
+		reply, err := s.do("SCAN", cursor, "MATCH", pattern, "COUNT", "1000")
+		if err != nil {
+			return err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return fmt.Errorf("redis: unexpected reply %v to SCAN", reply)
+		}
+		next, _ := page[0].([]byte)
+		keys, _ := page[1].([]interface{})
+		for _, key := range keys {
+			key, _ := key.([]byte)
+			if !fn(strings.TrimPrefix(string(key), s.opts.Prefix)) {
+				return nil
+			}
+		}
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+// The `Close` method in the `RedisStore` struct closes the idle connections. Connections in use are
+// closed when they are returned.
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case conn := <-s.idle:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// The `do` method in the `RedisStore` struct sends a command on a pooled connection and returns its
+// reply: nil, int64, string (status), []byte (bulk string) or []interface{} (array). Connections that
+// fail are closed rather than returned to the pool, and a command failing on a reused connection,
+// which the server may have closed since, is retried once on a new one.
+func (s *RedisStore) do(args ...interface{}) (interface{}, error) {
+	for attempt := 0; ; attempt++ {
+		conn, reused, err := s.conn()
+		if err != nil {
+			return nil, err
+		}
+		reply, err := conn.do(s.opts.Timeout, args...)
+		var replyErr redisError
+		if err != nil && !errors.As(err, &replyErr) {
+			conn.Close()
+			if reused && attempt == 0 {
+				continue
+			}
+			return nil, err
+		}
+		s.release(conn)
+		return reply, err
+	}
+}
+
+// The `conn` method in the `RedisStore` struct returns an idle connection, or dials a new one,
+// authenticating and selecting the database. It reports whether the connection was reused.
+func (s *RedisStore) conn() (*redisConn, bool, error) {
+	select {
+	case conn := <-s.idle:
+		return conn, true, nil
+	default:
+	}
+	nc, err := net.DialTimeout("tcp", s.opts.Addr, s.opts.Timeout)
+	if err != nil {
+		return nil, false, err
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	var setup [][]interface{}
+	switch {
+	case s.opts.Username != "":
+		setup = append(setup, []interface{}{"AUTH", s.opts.Username, s.opts.Password})
+	case s.opts.Password != "":
+		setup = append(setup, []interface{}{"AUTH", s.opts.Password})
+	}
+	if s.opts.DB != 0 {
+		setup = append(setup, []interface{}{"SELECT", strconv.Itoa(s.opts.DB)})
+	}
+	for _, args := range setup {
+		if _, err := conn.do(s.opts.Timeout, args...); err != nil {
+			conn.Close()
+			return nil, false, err
+		}
+	}
+	return conn, false, nil
+}
+
+// The `release` method in the `RedisStore` struct returns a connection to the pool, or closes it when
+// the pool is full.
+func (s *RedisStore) release(conn *redisConn) {
+	select {
+	case s.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// The `do` method in the `redisConn` struct sends a command as an array of bulk strings and reads the
+// reply, failing after timeout.
+func (c *redisConn) do(timeout time.Duration, args ...interface{}) (interface{}, error) {
+	c.SetDeadline(time.Now().Add(timeout))
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var b []byte
+		switch arg := arg.(type) {
+		case string:
+			b = []byte(arg)
+		case []byte:
+			b = arg
+		}
+		fmt.Fprintf(c.w, "$%d\r\n", len(b))
+		c.w.Write(b)
+		c.w.WriteString("\r\n")
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return c.reply()
+}
+
+// The `reply` method in the `redisConn` struct reads a RESP reply.
+func (c *redisConn) reply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = c.reply(); err != nil {
+				var replyErr redisError
+				if !errors.As(err, &replyErr) {
+					return nil, err
+				}
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// The redisGlobEscape function escapes the characters SCAN's MATCH pattern treats specially.
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(`*?[]\^`, s[i]) >= 0 {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a Redis server keeping values in memory, speaking enough RESP for a RedisStore: AUTH,
+// SELECT, GET, SET with PX, DEL and SCAN with MATCH, which returns every match in one page.
+type fakeRedis struct {
+	password string
+	mutex    sync.Mutex
+	values   map[string]string
+	expires  map[string]time.Time
+}
+
+// The startFakeRedis function starts a fakeRedis requiring password, if set, and returns its address.
+// It stops at the end of the test.
+func startFakeRedis(t *testing.T, password string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &fakeRedis{password: password, values: make(map[string]string), expires: make(map[string]time.Time)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// The `serve` method in the `fakeRedis` struct answers the commands of a connection.
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	authenticated := s.password == ""
+	for {
+		args, err := readRESPCommand(r)
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(args[0])
+		switch {
+		case command == "AUTH":
+			authenticated = args[len(args)-1] == s.password
+			if !authenticated {
+				w.WriteString("-WRONGPASS invalid password\r\n")
+				break
+			}
+			w.WriteString("+OK\r\n")
+		case !authenticated:
+			w.WriteString("-NOAUTH Authentication required.\r\n")
+		default:
+			s.do(w, command, args[1:])
+		}
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// The `do` method in the `fakeRedis` struct runs a command of an authenticated connection.
+func (s *fakeRedis) do(w *bufio.Writer, command string, args []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	for key, expires := range s.expires {
+		if !now.Before(expires) {
+			delete(s.values, key)
+			delete(s.expires, key)
+		}
+	}
+	switch command {
+	case "SELECT":
+		w.WriteString("+OK\r\n")
+	case "GET":
+		value, ok := s.values[args[0]]
+		if !ok {
+			w.WriteString("$-1\r\n")
+			return
+		}
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(value), value)
+	case "SET":
+		s.values[args[0]] = args[1]
+		delete(s.expires, args[0])
+		if len(args) == 4 && strings.ToUpper(args[2]) == "PX" {
+			ms, _ := strconv.Atoi(args[3])
+			s.expires[args[0]] = now.Add(time.Duration(ms) * time.Millisecond)
+		}
+		w.WriteString("+OK\r\n")
+	case "DEL":
+		_, ok := s.values[args[0]]
+		delete(s.values, args[0])
+		delete(s.expires, args[0])
+		if ok {
+			w.WriteString(":1\r\n")
+			return
+		}
+		w.WriteString(":0\r\n")
+	case "SCAN":
+		// MATCH patterns are an escaped prefix followed by *
+		prefix := strings.TrimSuffix(args[2], "*")
+		var escaped bool
+		prefix = strings.Map(func(r rune) rune {
+			if r == '\\' && !escaped {
+				escaped = true
+				return -1
+			}
+			escaped = false
+			return r
+		}, prefix)
+		var keys []string
+		for key := range s.values {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		fmt.Fprintf(w, "*2\r\n$1\r\n0\r\n*%d\r\n", len(keys))
+		for _, key := range keys {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(key), key)
+		}
+	default:
+		fmt.Fprintf(w, "-ERR unknown command '%s'\r\n", command)
+	}
+}
+
+// The readRESPCommand function reads a command sent as an array of bulk strings.
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSuffix(line, "\r\n"), "*"))
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid command %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSuffix(line, "\r\n"), "$"))
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid argument %q", line)
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:size])
+	}
+	return args, nil
+}
+
+func TestRedisStore(t *testing.T) {
+	store := NewRedisStore(RedisOptions{Addr: startFakeRedis(t, "secret"), Password: "secret", DB: 2, Prefix: "test:"})
+	defer store.Close()
+	testStore(t, store, 50*time.Millisecond)
+}
+
+func TestRedisStoreAuthFailure(t *testing.T) {
+	store := NewRedisStore(RedisOptions{Addr: startFakeRedis(t, "secret"), Password: "wrong"})
+	defer store.Close()
+	if _, err := store.Load("key"); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Fatalf("Load with a wrong password: got error %v, want WRONGPASS", err)
+	}
+}
+
+func TestRedisStoreUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	store := NewRedisStore(RedisOptions{Addr: addr, Timeout: time.Second})
+	if err := store.Save("key", []byte("value"), 0); err == nil {
+		t.Fatal("Save to an unreachable server: got no error")
+	}
+}
@@ -0,0 +1,134 @@
+package cache
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Revision is a previous version of an entry's response, kept by `KeepRevision`. Its body is stored as a
+// delta: DEFLATE-compressed with the next newer body as preset dictionary, so a revision that differs
+// little from its successor takes little memory. DEFLATE only looks back 32 KiB, so bodies larger than
+// that are mostly stored compressed rather than as a delta.
+type Revision struct {
+	Response ResponseRecord
+	ETag     string
+	StoredAt time.Time
+	// Delta is the encoded body; use the `RevisionBody` method of the `Entry` struct to decode it.
+	Delta []byte
+}
+
+// ErrNoRevision is returned for revision numbers an entry doesn't have.
+var ErrNoRevision = errors.New("no such revision")
+
+// ErrNoEntry is returned by `Rollback` when no entry is stored under the key.
+var ErrNoEntry = errors.New("no such entry")
+
+// The `KeepRevision` method in the `Entry` struct carries the revisions of previous, the entry it
+// replaces, over to e and adds previous itself as the newest revision, keeping at most limit revisions.
+// Nothing is added when previous has the same body. A limit of zero drops all revisions.
+func (e *Entry) KeepRevision(previous Entry, limit int) error {
+	if limit <= 0 {
+		e.Revisions = nil
+		return nil
+	}
+	if bytes.Equal(previous.Body, e.Body) {
+		e.Revisions = previous.Revisions[:min(len(previous.Revisions), limit)]
+		return nil
+	}
+	delta, err := encodeDelta(previous.Body, e.Body)
+	if err != nil {
+		return err
+	}
+	revisions := make([]Revision, 0, min(len(previous.Revisions)+1, limit))
+	revisions = append(revisions, Revision{Response: previous.Response, ETag: previous.ETag, StoredAt: previous.StoredAt, Delta: delta})
+	revisions = append(revisions, previous.Revisions[:min(len(previous.Revisions), limit-1)]...)
+	e.Revisions = revisions
+	return nil
+}
+
+// The `RevisionBody` method in the `Entry` struct decodes the body of revision i, 0 being the newest
+// previous revision. Each revision is decoded against the next newer body, so older revisions take
+// longer to decode.
+func (e Entry) RevisionBody(i int) ([]byte, error) {
+	if i < 0 || i >= len(e.Revisions) {
+		return nil, ErrNoRevision
+	}
+	body := e.Body
+	for j := 0; j <= i; j++ {
+		decoded, err := decodeDelta(e.Revisions[j].Delta, body)
+		if err != nil {
+			return nil, fmt.Errorf("decoding revision %d: %w", j, err)
+		}
+		body = decoded
+	}
+	return body, nil
+}
+
+// The `Rollback` method in the `Namespace` struct replaces the entry stored under key, fresh or stale,
+// with its revision i (see `RevisionBody`), e.g. after the origin briefly served a bad deploy that got
+// cached. The replaced version becomes the newest revision, so the number of revisions stays the same
+// and a rollback can itself be rolled back. The restored entry is fresh for ttl, or keeps the replaced
+// entry's expiry when ttl is zero. Encoded variants are dropped; fn, if not nil, may update fields
+// derived from the body, with the same rules as for `Update`.
+func (n *Namespace) Rollback(key string, i int, ttl time.Duration, fn func(entry *Entry)) (Entry, error) {
+	n.lookup(key)
+	n.cache.lock()
+	defer n.cache.mutex.Unlock()
+	current, ok := n.cache.namespaces[n.name][key]
+	if !ok {
+		return Entry{}, ErrNoEntry
+	}
+	body, err := current.RevisionBody(i)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	restored := current
+	revision := current.Revisions[i]
+	restored.Response, restored.ETag, restored.Body = revision.Response, revision.ETag, body
+	restored.Variants = nil
+	if err := restored.KeepRevision(current, len(current.Revisions)); err != nil {
+		return Entry{}, err
+	}
+	if fn != nil {
+		fn(&restored)
+	}
+	restored.hits, restored.elem, restored.Identity = current.hits, current.elem, current.Identity
+	restored.Checksum = restored.checksum()
+	restored.StoredAt = time.Now()
+	if ttl > 0 {
+		restored.ExpiresAt = restored.StoredAt.Add(ttl)
+	}
+	n.cache.persist(n.name, key, &restored)
+	n.cache.namespaces[n.name][key] = restored
+	n.cache.bytes.Add(restored.Size() - current.Size())
+	n.cache.evict()
+	return restored, nil
+}
+
+// The encodeDelta function encodes body against dict, a body it likely shares most of its content with.
+func encodeDelta(body, dict []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := flate.NewWriterDict(&buf, flate.BestCompression, dict)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// The decodeDelta function decodes a body encoded by encodeDelta with the same dict.
+func decodeDelta(delta, dict []byte) ([]byte, error) {
+	zr := flate.NewReaderDict(bytes.NewReader(delta), dict)
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// snapshotFormat starts every snapshot written by SaveTo; the last byte is the format version.
+var snapshotFormat = []byte("GPCS\x01")
+
+// maxSnapshotField bounds the length of a field read from a snapshot, so that a corrupted length can't
+// exhaust memory.
+const maxSnapshotField = 1 << 30
+
+// ErrInvalidSnapshot is returned by LoadFrom for data that is not a snapshot.
+var ErrInvalidSnapshot = errors.New("invalid cache snapshot")
+
+// The `SaveTo` method in the `Cache` struct writes every entry in memory that is still fresh or
+// retained as stale to w, least recently used first, and returns how many it wrote. Each entry is a
+// record of its namespace, key and the entry serialized with MarshalEntry, all length-prefixed, so
+// LoadFrom can restore the cache after a restart.
+func (c *Cache) SaveTo(w io.Writer) (int, error) {
+	type item struct {
+		namespace, key string
+		entry          Entry
+	}
+	now := time.Now()
+	c.rlock()
+	var items []item
+	if c.maxBytes > 0 {
+		c.lruMutex.Lock()
+		for elem := c.lru.Back(); elem != nil; elem = elem.Prev() {
+			it := elem.Value.(lruItem)
+			if entry, ok := c.namespaces[it.namespace][it.key]; ok && !c.removable(entry, now) {
+				items = append(items, item{it.namespace, it.key, entry})
+			}
+		}
+		c.lruMutex.Unlock()
+	} else {
+		for name, entries := range c.namespaces {
+			for key, entry := range entries {
+				if !c.removable(entry, now) {
+					items = append(items, item{name, key, entry})
+				}
+			}
+		}
+	}
+	c.mutex.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	bw.Write(snapshotFormat)
+	var length [binary.MaxVarintLen64]byte
+	for _, it := range items {
+		bw.WriteByte(1)
+		for _, field := range [][]byte{[]byte(it.namespace), []byte(it.key), MarshalEntry(it.entry)} {
+			bw.Write(length[:binary.PutUvarint(length[:], uint64(len(field)))])
+			bw.Write(field)
+		}
+	}
+	bw.WriteByte(0)
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	return len(items), nil
+}
+
+// The `LoadFrom` method in the `Cache` struct restores the entries of a snapshot written by SaveTo,
+// keeping when they were stored and expire, and returns how many it restored. Entries past their stale
+// retention are skipped, entries already cached under the same key are replaced, and the memory
+// budget and Policy apply as for Set. Restored entries are not written to the store, which is expected
+// to have them already, and OnLoad is called for each. Should the snapshot be truncated or corrupted,
+// the entries read until then stay restored.
+func (c *Cache) LoadFrom(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	format := make([]byte, len(snapshotFormat))
+	if _, err := io.ReadFull(br, format); err != nil || string(format) != string(snapshotFormat) {
+		return 0, ErrInvalidSnapshot
+	}
+	restored := 0
+	now := time.Now()
+	for {
+		marker, err := br.ReadByte()
+		if err != nil {
+			return restored, fmt.Errorf("%w: %w", ErrInvalidSnapshot, io.ErrUnexpectedEOF)
+		}
+		if marker == 0 {
+			return restored, nil
+		}
+		var fields [3][]byte
+		for i := range fields {
+			if fields[i], err = readSnapshotField(br); err != nil {
+				return restored, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+			}
+		}
+		entry, err := UnmarshalEntry(fields[2])
+		if err != nil {
+			return restored, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+		}
+		if c.removable(entry, now) {
+			continue
+		}
+		if c.onLoad != nil {
+			c.onLoad(string(fields[0]), string(fields[1]), &entry)
+		}
+		if c.restore(string(fields[0]), string(fields[1]), entry) {
+			restored++
+		}
+	}
+}
+
+// The readSnapshotField function reads a length-prefixed field of a snapshot.
+func readSnapshotField(br *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if n > maxSnapshotField {
+		return nil, fmt.Errorf("field of %d bytes", n)
+	}
+	field := make([]byte, n)
+	if _, err := io.ReadFull(br, field); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return field, nil
+}
+
+// The `restore` method in the `Cache` struct keeps an entry read from a snapshot in memory, if it fits
+// the memory budget and the cache's Policy admits it, and reports whether it was kept.
+func (c *Cache) restore(name, key string, entry Entry) bool {
+	c.lock()
+	defer c.mutex.Unlock()
+	if old, ok := c.namespaces[name][key]; ok {
+		c.remove(name, key, old)
+	}
+	if c.maxBytes > 0 && entry.Size() > c.maxBytes || !c.admit(name, key, entry.Size()) {
+		return false
+	}
+	entry.hits = new(atomic.Int64)
+	entry.syncedAt = time.Now()
+	c.insert(name, key, entry)
+	c.evict()
+	_, ok := c.namespaces[name][key]
+	return ok
+}
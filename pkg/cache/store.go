@@ -0,0 +1,273 @@
+package cache
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Store is a second tier that a cache writes its entries through to, e.g. a Redis server shared by
+// several proxy instances. Entries are serialized with MarshalEntry under a key combining namespace and
+// key. Implementations must be safe for concurrent use.
+type Store interface {
+	// Load returns the value stored under key, or ErrNotStored.
+	Load(key string) ([]byte, error)
+	// Save stores value under key, replacing any previous value. The store may drop it after ttl; zero
+	// means no expiry.
+	Save(key string, value []byte, ttl time.Duration) error
+	// Remove deletes the value stored under key and reports whether there was one.
+	Remove(key string) (bool, error)
+	// Keys calls fn for every stored key starting with prefix until fn returns false. fn may modify the
+	// store; keys changed meanwhile may or may not be visited. Stores that can't list their keys return
+	// ErrKeysUnsupported; purges other than by key then only reach the entries in memory.
+	Keys(prefix string, fn func(key string) bool) error
+}
+
+// ErrNotStored is returned by the `Load` method of a Store for keys without a value.
+var ErrNotStored = errors.New("not stored")
+
+// ErrKeysUnsupported is returned by the `Keys` method of stores that can't list their keys.
+var ErrKeysUnsupported = errors.New("store can't list its keys")
+
+// storeQueue is how many writes may wait for the store before further entries are not written to it.
+const storeQueue = 1024
+
+// The storeKey function returns the key an entry is kept under in a Store.
+func storeKey(name, key string) string {
+	return name + "\x00" + key
+}
+
+// The `storeWriter` method in the `Cache` struct applies the queued store writes one at a time, so they
+// reach the store in the order the cache made them, until the cache is stopped.
+func (c *Cache) storeWriter() {
+	defer close(c.written)
+	for write := range c.writes {
+		write()
+	}
+}
+
+// The `queue` method in the `Cache` struct queues a write for the `storeWriter` goroutine, waiting for
+// room in the queue when wait is true. Once the cache is stopped, the write is made right away. It
+// reports false when the queue is full and wait is false.
+func (c *Cache) queue(write func(), wait bool) bool {
+	c.writesMutex.RLock()
+	defer c.writesMutex.RUnlock()
+	if c.writesClosed {
+		write()
+		return true
+	}
+	if wait {
+		c.writes <- write
+		return true
+	}
+	select {
+	case c.writes <- write:
+		return true
+	default:
+		return false
+	}
+}
+
+// The `persist` method in the `Cache` struct queues an entry to be written to the store, without waiting
+// for it. Should the store fall too far behind, the entry is not written and counted as dropped. The
+// caller must hold the write lock.
+func (c *Cache) persist(name, key string, entry *Entry) {
+	if c.store == nil {
+		return
+	}
+	entry.syncedAt = time.Now()
+	saved := *entry
+	if !c.queue(func() { c.save(name, key, saved) }, false) {
+		c.storeDropped.Add(1)
+	}
+}
+
+// The `storeDo` method in the `Cache` struct runs fn after the writes queued so far and waits for it,
+// so that e.g. a purge isn't undone by an older write still waiting. fn must not use the cache.
+func (c *Cache) storeDo(fn func()) {
+	done := make(chan struct{})
+	c.queue(func() {
+		fn()
+		close(done)
+	}, true)
+	<-done
+}
+
+// The `save` method in the `Cache` struct writes an entry to the store for as long as the cache would
+// keep it: until its stale retention ends. An entry already past it is removed instead.
+func (c *Cache) save(name, key string, entry Entry) {
+	var ttl time.Duration
+	if !entry.ExpiresAt.IsZero() {
+		ttl = time.Until(entry.ExpiresAt.Add(c.retention))
+		if ttl <= 0 {
+			_, err := c.removeStored(name, key)
+			c.storeError(err)
+			return
+		}
+	}
+	// The chunks of a body replaced by another are removed once the entry no longer refers to them, and
+	// those of a body kept are saved again should the entry now outlive them
+	if c.chunkBytes > 0 {
+		old, err := c.load(name, key)
+		if err == nil && old.BodySize > 0 && old.chunks.id != entry.chunks.id {
+			defer c.removeChunks(old.chunks.id)
+		}
+		if err == nil && old.BodySize > 0 && old.chunks.id == entry.chunks.id && outlasts(old.chunks.until, entry.chunks.until) {
+			entry.chunks.until = old.chunks.until
+		}
+		if entry.BodySize > 0 {
+			c.keepChunks(&entry, ttl)
+		}
+	}
+	c.storeError(c.store.Save(storeKey(name, key), MarshalEntry(entry), ttl))
+}
+
+// The `load` method in the `Cache` struct reads an entry from the store.
+func (c *Cache) load(name, key string) (Entry, error) {
+	data, err := c.store.Load(storeKey(name, key))
+	if err != nil {
+		return Entry{}, err
+	}
+	return UnmarshalEntry(data)
+}
+
+// The `storeEach` method in the `Cache` struct calls fn with the namespace and key of every entry in the
+// store whose namespace is name, or of every entry when all is true, skipping the chunks of bodies. It
+// does nothing for stores that can't list their keys.
+func (c *Cache) storeEach(name string, all bool, fn func(name, key string)) {
+	prefix := ""
+	if !all {
+		prefix = storeKey(name, "")
+	}
+	err := c.store.Keys(prefix, func(stored string) bool {
+		if name, key, ok := strings.Cut(stored, "\x00"); ok && name != chunkNamespace {
+			fn(name, key)
+		}
+		return true
+	})
+	if !errors.Is(err, ErrKeysUnsupported) {
+		c.storeError(err)
+	}
+}
+
+// The `storeError` method in the `Cache` struct counts and reports a failed store operation. A nil
+// error is ignored.
+func (c *Cache) storeError(err error) {
+	if err == nil {
+		return
+	}
+	c.storeErrors.Add(1)
+	if c.onStoreError != nil {
+		c.onStoreError(err)
+	}
+}
+
+// The `lookup` method in the `Namespace` struct returns the entry stored under key, expired or not, and
+// whether it was just read from the store. With a store, entries missing from memory, and memory copies
+// older than the cache's local TTL, are read from the store and kept in memory; should the store fail,
+// the memory copy is used.
+func (n *Namespace) lookup(key string) (entry Entry, ok bool, loaded bool) {
+	c := n.cache
+	c.rlock()
+	local, ok := c.namespaces[n.name][key]
+	c.mutex.RUnlock()
+	if c.store == nil || ok && (c.localTTL == 0 || time.Since(local.syncedAt) < c.localTTL) {
+		return local, ok, false
+	}
+
+	stored, err := c.load(n.name, key)
+	if errors.Is(err, ErrNotStored) {
+		if ok {
+			// Purged or replaced by another instance
+			n.drop(key, local)
+		}
+		return Entry{}, false, false
+	}
+	if err != nil {
+		c.storeError(err)
+		return local, ok, false
+	}
+	c.storeLoads.Add(1)
+	if c.onLoad != nil {
+		c.onLoad(n.name, key, &stored)
+	}
+	return n.promote(key, local, ok, stored), true, true
+}
+
+// The `verified` method in the `Namespace` struct returns the entry stored under key like `lookup`,
+// verifying its checksum when the cache's VerifyChecksum asks for it. An entry failing verification, or
+// whose body has a chunk that `ReadBody` found missing or corrupt, is removed, from memory and the
+// store, and is a miss.
+func (n *Namespace) verified(key string) (Entry, bool) {
+	c := n.cache
+	entry, ok, loaded := n.lookup(key)
+	if !ok {
+		return entry, ok
+	}
+	chunkBroken := false
+	if entry.BodySize > 0 {
+		// A chunk of its body was found missing or corrupt by ReadBody
+		_, chunkBroken = c.broken.LoadAndDelete(entry.chunks.id)
+	}
+	switch {
+	case chunkBroken:
+	case c.verifyChecksum != nil && c.verifyChecksum(loaded) && entry.Verify() != nil:
+		c.checksumFailures.Add(1)
+	default:
+		return entry, ok
+	}
+	if c.onCorrupt != nil {
+		c.onCorrupt(n.name, key, entry)
+	}
+	n.drop(key, entry)
+	if c.store != nil {
+		c.storeDo(func() {
+			// The entry may have been replaced by one of the writes queued before
+			if stored, err := c.load(n.name, key); err == nil && (stored.Verify() != nil || chunkBroken && stored.chunks.id == entry.chunks.id) {
+				_, err := c.removeStored(n.name, key)
+				c.storeError(err)
+			}
+		})
+	}
+	return Entry{}, false
+}
+
+// The `drop` method in the `Namespace` struct removes a memory copy the store no longer has, or that is
+// corrupt, unless it has been replaced since it was read.
+func (n *Namespace) drop(key string, local Entry) {
+	n.cache.lock()
+	defer n.cache.mutex.Unlock()
+	if current, ok := n.cache.namespaces[n.name][key]; ok && current.hits == local.hits {
+		n.cache.remove(n.name, key, current)
+	}
+}
+
+// The `promote` method in the `Namespace` struct keeps an entry loaded from the store in memory in place
+// of local, the memory copy read before loading, if any. Should the entry have been set meanwhile, the
+// newer entry is returned instead. Loaded entries keep the hits of the copy they replace, and are only
+// kept if they fit the memory budget and the cache's Policy admits them.
+func (n *Namespace) promote(key string, local Entry, ok bool, loaded Entry) Entry {
+	c := n.cache
+	c.lock()
+	defer c.mutex.Unlock()
+	current, exists := c.namespaces[n.name][key]
+	if exists && (!ok || current.hits != local.hits) {
+		return current
+	}
+	loaded.syncedAt = time.Now()
+	loaded.hits = new(atomic.Int64)
+	if exists {
+		loaded.hits = current.hits
+		c.remove(n.name, key, current)
+	}
+	if c.maxBytes > 0 && loaded.Size() > c.maxBytes || !c.admit(n.name, key, loaded.Size()) {
+		return loaded
+	}
+	c.insert(n.name, key, loaded)
+	c.evict()
+	if kept, ok := c.namespaces[n.name][key]; ok {
+		return kept
+	}
+	return loaded
+}
@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// The testStore function checks that store keeps to the Store contract. ttl is the shortest expiry the
+// store honours; a value saved with it must be gone once it has passed.
+func testStore(t *testing.T, store Store, ttl time.Duration) {
+	t.Helper()
+	if _, err := store.Load(storeKey("a", "missing")); !errors.Is(err, ErrNotStored) {
+		t.Fatalf("Load of a missing key: got error %v, want ErrNotStored", err)
+	}
+
+	values := map[string][]byte{
+		storeKey("a", "GET https://example.com/one"): []byte("one"),
+		storeKey("a", "GET https://example.com/two"): bytes.Repeat([]byte("large value "), 20000),
+		storeKey("a*[b]", "glob"):                    []byte("glob characters"),
+		storeKey("b", "GET https://example.com/one"): []byte("other namespace"),
+		storeKey(DefaultNamespace, "key"):            []byte("default namespace"),
+	}
+	for key, value := range values {
+		if err := store.Save(key, value, 0); err != nil {
+			t.Fatalf("Save %q: %v", key, err)
+		}
+	}
+	for key, value := range values {
+		got, err := store.Load(key)
+		if err != nil {
+			t.Fatalf("Load %q: %v", key, err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Fatalf("Load %q: got %d bytes, want %d", key, len(got), len(value))
+		}
+	}
+
+	replaced := storeKey("a", "GET https://example.com/two")
+	if err := store.Save(replaced, []byte("replaced"), 0); err != nil {
+		t.Fatalf("Save %q again: %v", replaced, err)
+	}
+	if got, err := store.Load(replaced); err != nil || string(got) != "replaced" {
+		t.Fatalf("Load of a replaced value: got %q, %v, want %q", got, err, "replaced")
+	}
+
+	var keys []string
+	err := store.Keys(storeKey("a", ""), func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if !errors.Is(err, ErrKeysUnsupported) {
+		if err != nil {
+			t.Fatalf("Keys: %v", err)
+		}
+		slices.Sort(keys)
+		want := []string{storeKey("a", "GET https://example.com/one"), storeKey("a", "GET https://example.com/two")}
+		if !slices.Equal(keys, want) {
+			t.Fatalf("Keys: got %q, want %q", keys, want)
+		}
+		calls := 0
+		if err := store.Keys("", func(key string) bool { calls++; return false }); err != nil || calls != 1 {
+			t.Fatalf("Keys stopped by fn: got %d calls, %v, want 1 call", calls, err)
+		}
+	}
+
+	removed := storeKey("a", "GET https://example.com/one")
+	if ok, err := store.Remove(removed); err != nil || !ok {
+		t.Fatalf("Remove %q: got %v, %v, want true", removed, ok, err)
+	}
+	if _, err := store.Load(removed); !errors.Is(err, ErrNotStored) {
+		t.Fatalf("Load of a removed key: got error %v, want ErrNotStored", err)
+	}
+	if ok, err := store.Remove(removed); err != nil || ok {
+		t.Fatalf("Remove %q again: got %v, %v, want false", removed, ok, err)
+	}
+	if got, err := store.Load(storeKey("b", "GET https://example.com/one")); err != nil || string(got) != "other namespace" {
+		t.Fatalf("Load of the same key in another namespace after Remove: got %q, %v", got, err)
+	}
+
+	expiring := storeKey("a", "expiring")
+	if err := store.Save(expiring, []byte("soon gone"), ttl); err != nil {
+		t.Fatalf("Save with a TTL: %v", err)
+	}
+	if got, err := store.Load(expiring); err != nil || string(got) != "soon gone" {
+		t.Fatalf("Load before the TTL: got %q, %v", got, err)
+	}
+	time.Sleep(ttl + ttl/2)
+	if _, err := store.Load(expiring); !errors.Is(err, ErrNotStored) {
+		t.Fatalf("Load after the TTL: got error %v, want ErrNotStored", err)
+	}
+}
+
+func TestStopStoreWriter(t *testing.T) {
+	disk := openChunkStore(t)
+	c := New(Options{Store: disk})
+	c.Set("before", Entry{Body: []byte("value")}, time.Hour)
+	c.Stop()
+	select {
+	case <-c.written:
+	default:
+		t.Fatal("Stop: the store writer is still running")
+	}
+	if _, err := disk.Load(storeKey(DefaultNamespace, "before")); err != nil {
+		t.Fatalf("Load of an entry set before Stop: %v", err)
+	}
+
+	// The cache remains usable, writing to the store right away
+	c.Set("after", Entry{Body: []byte("value")}, time.Hour)
+	if _, err := disk.Load(storeKey(DefaultNamespace, "after")); err != nil {
+		t.Fatalf("Load of an entry set after Stop: %v", err)
+	}
+	if !c.Delete("before") {
+		t.Fatal("Delete after Stop: got false")
+	}
+	if _, err := disk.Load(storeKey(DefaultNamespace, "before")); !errors.Is(err, ErrNotStored) {
+		t.Fatalf("Load of an entry deleted after Stop: got error %v, want ErrNotStored", err)
+	}
+	c.Stop()
+}
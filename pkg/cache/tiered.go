@@ -0,0 +1,240 @@
+package cache
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TieredOptions configures a TieredStore created by NewTieredStore.
+type TieredOptions struct {
+	// Cold is the store large entries, and entries spilled from memory, are kept in, e.g. a DiskStore.
+	// It has its own size budget.
+	Cold Store
+	// HotBytes is the budget for the keys and values kept in memory. The least recently used values
+	// are spilled to Cold to stay within it.
+	HotBytes int64
+	// MaxHotValueBytes is the size of the largest value kept in memory; larger values go straight to
+	// Cold. The default is a sixty-fourth of HotBytes.
+	MaxHotValueBytes int
+}
+
+// TieredStore is a Store of two tiers: small values are kept in memory up to a budget, and the rest in
+// a cold store. Values spilled to the cold store, because they are large or haven't been used for long,
+// are promoted back to memory when they are loaded, if they are small enough; the cold store keeps its
+// copy until the value is replaced or removed. Values saved to memory are only seen by the process
+// holding them until they are spilled, so the cold store shouldn't be shared by several caches.
+type TieredStore struct {
+	opts  TieredOptions
+	mutex sync.Mutex
+	hot   map[string]*list.Element
+	lru   *list.List
+	bytes int64
+	// moves serializes changes of the tier values live in, including their cold store operations
+	moves sync.Mutex
+	// version counts the Save and Remove calls, so that a promotion can tell whether the value it
+	// loaded has been replaced meanwhile
+	version int64
+}
+
+// hotValue is a value kept in memory by a TieredStore.
+type hotValue struct {
+	key     string
+	value   []byte
+	expires time.Time
+	// promoted values still have a copy in the cold store, so they need not be saved when spilled
+	promoted bool
+}
+
+// The NewTieredStore function returns a Store keeping small values in memory over opts.Cold.
+func NewTieredStore(opts TieredOptions) *TieredStore {
+	if opts.MaxHotValueBytes <= 0 {
+		opts.MaxHotValueBytes = int(opts.HotBytes / 64)
+	}
+	return &TieredStore{opts: opts, hot: make(map[string]*list.Element), lru: list.New()}
+}
+
+// The `Load` method in the `TieredStore` struct returns the value stored under key from memory, or else
+// from the cold store, promoting it to memory when it is small enough.
+func (s *TieredStore) Load(key string) ([]byte, error) {
+	s.mutex.Lock()
+	if elem, ok := s.hot[key]; ok {
+		hot := elem.Value.(*hotValue)
+		if hot.expires.IsZero() || time.Now().Before(hot.expires) {
+			s.lru.MoveToFront(elem)
+			s.mutex.Unlock()
+			return hot.value, nil
+		}
+		s.unlink(elem)
+		s.mutex.Unlock()
+		return nil, ErrNotStored
+	}
+	s.mutex.Unlock()
+
+	s.moves.Lock()
+	version := s.version
+	s.moves.Unlock()
+	value, err := s.opts.Cold.Load(key)
+	if err != nil || len(value) > s.opts.MaxHotValueBytes {
+		return value, err
+	}
+	return value, s.promote(key, value, version)
+}
+
+// The `promote` method in the `TieredStore` struct keeps a value loaded from the cold store in memory,
+// unless the key has been saved or removed since version. The cold store doesn't say when the value
+// expires, so the copy in memory is kept until it is spilled or replaced; the cold store's copy
+// expires as saved.
+func (s *TieredStore) promote(key string, value []byte, version int64) error {
+	s.moves.Lock()
+	defer s.moves.Unlock()
+	if s.version != version {
+		return nil
+	}
+	return s.keep(&hotValue{key: key, value: value, promoted: true})
+}
+
+// The `Save` method in the `TieredStore` struct keeps value in memory when it is small enough, spilling
+// the least recently used values to the cold store to make room, or else saves it in the cold store.
+// Any copy in the other tier is removed.
+func (s *TieredStore) Save(key string, value []byte, ttl time.Duration) error {
+	s.moves.Lock()
+	defer s.moves.Unlock()
+	s.version++
+	if len(value) > s.opts.MaxHotValueBytes || int64(len(key)+len(value)) > s.opts.HotBytes {
+		s.mutex.Lock()
+		if elem, ok := s.hot[key]; ok {
+			s.unlink(elem)
+		}
+		s.mutex.Unlock()
+		return s.opts.Cold.Save(key, value, ttl)
+	}
+	if _, err := s.opts.Cold.Remove(key); err != nil {
+		return err
+	}
+	hot := &hotValue{key: key, value: value}
+	if ttl > 0 {
+		hot.expires = time.Now().Add(ttl)
+	}
+	return s.keep(hot)
+}
+
+// The `keep` method in the `TieredStore` struct puts a value in memory and spills values to the cold
+// store until the memory budget is met. The caller must hold the moves lock.
+func (s *TieredStore) keep(hot *hotValue) error {
+	s.mutex.Lock()
+	if elem, ok := s.hot[hot.key]; ok {
+		s.unlink(elem)
+	}
+	s.hot[hot.key] = s.lru.PushFront(hot)
+	s.bytes += int64(len(hot.key) + len(hot.value))
+	var spilled []*hotValue
+	for s.bytes > s.opts.HotBytes {
+		elem := s.lru.Back()
+		spilled = append(spilled, elem.Value.(*hotValue))
+		s.unlink(elem)
+	}
+	s.mutex.Unlock()
+
+	var errs []error
+	for _, hot := range spilled {
+		errs = append(errs, s.spill(hot))
+	}
+	return errors.Join(errs...)
+}
+
+// The `spill` method in the `TieredStore` struct saves a value removed from memory in the cold store,
+// for the rest of its lifetime, unless the cold store still has it.
+func (s *TieredStore) spill(hot *hotValue) error {
+	if hot.promoted {
+		return nil
+	}
+	var ttl time.Duration
+	if !hot.expires.IsZero() {
+		if ttl = time.Until(hot.expires); ttl <= 0 {
+			return nil
+		}
+	}
+	return s.opts.Cold.Save(hot.key, hot.value, ttl)
+}
+
+// The `unlink` method in the `TieredStore` struct removes a value from memory. The caller must hold the
+// lock.
+func (s *TieredStore) unlink(elem *list.Element) {
+	hot := s.lru.Remove(elem).(*hotValue)
+	delete(s.hot, hot.key)
+	s.bytes -= int64(len(hot.key) + len(hot.value))
+}
+
+// The `Remove` method in the `TieredStore` struct removes the value stored under key from both tiers.
+func (s *TieredStore) Remove(key string) (bool, error) {
+	s.moves.Lock()
+	defer s.moves.Unlock()
+	s.version++
+	s.mutex.Lock()
+	elem, hot := s.hot[key]
+	if hot {
+		s.unlink(elem)
+	}
+	s.mutex.Unlock()
+	cold, err := s.opts.Cold.Remove(key)
+	return hot || cold, err
+}
+
+// The `Keys` method in the `TieredStore` struct calls fn for every key starting with prefix in memory,
+// then for those in the cold store. When the cold store can't list its keys, only the keys in memory
+// are visited and ErrKeysUnsupported is returned.
+func (s *TieredStore) Keys(prefix string, fn func(key string) bool) error {
+	s.mutex.Lock()
+	hot := make(map[string]bool)
+	for key := range s.hot {
+		if strings.HasPrefix(key, prefix) {
+			hot[key] = true
+		}
+	}
+	s.mutex.Unlock()
+	for key := range hot {
+		if !fn(key) {
+			return nil
+		}
+	}
+	return s.opts.Cold.Keys(prefix, func(key string) bool {
+		return hot[key] || fn(key)
+	})
+}
+
+// The `HotBytes` method in the `TieredStore` struct returns the size of the keys and values kept in
+// memory.
+func (s *TieredStore) HotBytes() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.bytes
+}
+
+// The `Close` method in the `TieredStore` struct spills every value in memory to the cold store, so
+// that none is lost when the cold store persists them, and closes the cold store if it is an
+// io.Closer. The store must not be used afterwards.
+func (s *TieredStore) Close() error {
+	s.moves.Lock()
+	defer s.moves.Unlock()
+	s.mutex.Lock()
+	var spilled []*hotValue
+	for elem := s.lru.Back(); elem != nil; elem = elem.Prev() {
+		spilled = append(spilled, elem.Value.(*hotValue))
+	}
+	s.hot, s.bytes = make(map[string]*list.Element), 0
+	s.lru.Init()
+	s.mutex.Unlock()
+
+	var errs []error
+	for _, hot := range spilled {
+		errs = append(errs, s.spill(hot))
+	}
+	if closer, ok := s.opts.Cold.(io.Closer); ok {
+		errs = append(errs, closer.Close())
+	}
+	return errors.Join(errs...)
+}
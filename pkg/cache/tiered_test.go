@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTieredStore(t *testing.T) {
+	cold, err := OpenDiskStore(DiskOptions{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("OpenDiskStore: %v", err)
+	}
+	store := NewTieredStore(TieredOptions{Cold: cold, HotBytes: 64 << 10})
+	defer store.Close()
+	testStore(t, store, 50*time.Millisecond)
+}
+
+func TestTieredStoreSpill(t *testing.T) {
+	dir := t.TempDir()
+	cold, err := OpenDiskStore(DiskOptions{Dir: dir})
+	if err != nil {
+		t.Fatalf("OpenDiskStore: %v", err)
+	}
+	store := NewTieredStore(TieredOptions{Cold: cold, HotBytes: 1000, MaxHotValueBytes: 300})
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte{byte(i)}, 200)
+	}
+	for i := range 10 {
+		if err := store.Save(fmt.Sprintf("key %d", i), value(i), 0); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		if store.HotBytes() > 1000 {
+			t.Fatalf("HotBytes after %d saves: got %d, want at most 1000", i+1, store.HotBytes())
+		}
+	}
+	if err := store.Save("large", make([]byte, 400), 0); err != nil {
+		t.Fatalf("Save of a large value: %v", err)
+	}
+	if _, err := cold.Load("large"); err != nil {
+		t.Fatalf("Load of a large value from the cold store: %v", err)
+	}
+	if _, err := cold.Load("key 0"); err != nil {
+		t.Fatalf("Load of a spilled value from the cold store: %v", err)
+	}
+	if _, err := cold.Load("key 9"); !errors.Is(err, ErrNotStored) {
+		t.Fatalf("Load of a value in memory from the cold store: got error %v, want ErrNotStored", err)
+	}
+	for i := range 10 {
+		if got, err := store.Load(fmt.Sprintf("key %d", i)); err != nil || !bytes.Equal(got, value(i)) {
+			t.Fatalf("Load %d: got %d bytes, %v", i, len(got), err)
+		}
+	}
+
+	// Promoted values keep their copy in the cold store until they are replaced
+	if _, err := cold.Load("key 0"); err != nil {
+		t.Fatalf("Load of a promoted value from the cold store: %v", err)
+	}
+	if err := store.Save("key 0", []byte("replaced"), 0); err != nil {
+		t.Fatalf("Save of a promoted value: %v", err)
+	}
+	if _, err := cold.Load("key 0"); !errors.Is(err, ErrNotStored) {
+		t.Fatalf("Load of a replaced value from the cold store: got error %v, want ErrNotStored", err)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	cold, err = OpenDiskStore(DiskOptions{Dir: dir})
+	if err != nil {
+		t.Fatalf("OpenDiskStore again: %v", err)
+	}
+	defer cold.Close()
+	if got, err := cold.Load("key 0"); err != nil || string(got) != "replaced" {
+		t.Fatalf("Load after Close: got %q, %v, want %q", got, err, "replaced")
+	}
+	for i := 1; i < 10; i++ {
+		if got, err := cold.Load(fmt.Sprintf("key %d", i)); err != nil || !bytes.Equal(got, value(i)) {
+			t.Fatalf("Load %d after Close: got %d bytes, %v", i, len(got), err)
+		}
+	}
+}